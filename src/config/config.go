@@ -1,6 +1,7 @@
 package config
 
 import (
+	"os"
 	"strings"
 )
 
@@ -41,6 +42,37 @@ type PhotoConfig struct {
 	Converter       string `yaml:"converter"` // local | remote
 	Url             string `yaml:"url"`       // Url of remote server
 	UrlFaceDetector string `yaml:"url-face-detector"`
+	// Command to convert HEIC to JPEG, called with <from> <to> (heif-convert). Embedded thumbnail is used if empty
+	HeicConverter string `yaml:"heic-converter"`
+	// Reduced images created for each photo, override default profiles (middle and small) by name
+	Profiles []ResizeProfile `yaml:"profiles"`
+	OnDemand OnDemandConfig  `yaml:"on-demand"`
+	// Number of images resized in parallel, number of cpus by default
+	Workers int `yaml:"workers"`
+	// Maximum memory in Mo used by decoded images during resize, 1024 by default
+	MaxMemory int `yaml:"max-memory"`
+}
+
+// OnDemandConfig define images resized on demand, kept in a limited area of cache
+type OnDemandConfig struct {
+	// Maximum size of resized images in cache, in Mo, 500 by default
+	MaxSize int `yaml:"max-size"`
+	// Allowed sizes, a requested size is rounded to the next one
+	Sizes []uint `yaml:"sizes"`
+}
+
+// ResizeProfile define a reduced image created for each photo
+type ResizeProfile struct {
+	Name string `yaml:"name" json:"name"`
+	// Bounding box, 0 to only use the other dimension
+	Width  uint `yaml:"width" json:"width"`
+	Height uint `yaml:"height" json:"height"`
+	// Jpeg quality, 75 by default
+	Quality int `yaml:"quality" json:"quality"`
+	// fit (default) keep the whole image in bounding box, fill crop image to cover bounding box
+	Crop string `yaml:"crop" json:"crop"`
+	// jpg (default) or png
+	Format string `yaml:"format" json:"format"`
 }
 
 type VideoConfig struct {
@@ -55,6 +87,8 @@ type VideoConfig struct {
 type Source struct {
 	Name   string `yaml:"name"`
 	Folder string `yaml:"folder"`
+	// Override resize profiles of photo config by name for this source
+	Profiles []ResizeProfile `yaml:"profiles"`
 }
 
 type Config struct {
@@ -68,10 +102,15 @@ type Config struct {
 	UploadedFolder string   `yaml:"upload-folder"`
 	Sources        []Source `yaml:"sources"`
 	//OverrideUploadFolder string          `yaml:"override-upload"`
-	Security  SecurityConfig  `yaml:"security"`
-	Tasks     CronTasks       `yaml:"tasks"`
-	Mirroring MirroringConfig `yaml:"mirroring"`
-	Custom    CustomConfig    `yaml:"custom"`
+	Security    SecurityConfig    `yaml:"security"`
+	Tasks       CronTasks         `yaml:"tasks"`
+	Mirroring   MirroringConfig   `yaml:"mirroring"`
+	Custom      CustomConfig      `yaml:"custom"`
+	Database    DatabaseConfig    `yaml:"database"`
+	Persistence PersistenceConfig `yaml:"persistence"`
+	Watcher     WatcherConfig     `yaml:"watcher"`
+	Geocoding   GeocodingConfig   `yaml:"geocoding"`
+	Storage     StorageConfig     `yaml:"storage"`
 }
 
 type CustomConfig struct {
@@ -87,6 +126,70 @@ type MirroringConfig struct {
 	Consistency bool `yaml:"consistency"`
 }
 
+// DatabaseConfig define where the tree of photos is persisted
+type DatabaseConfig struct {
+	Type string `yaml:"type"` // json (default) | bolt
+	// Path of the bolt database, default is photos.db in working directory
+	Path string `yaml:"path"`
+}
+
+// PersistenceConfig define how state files (tags, shares...) are saved
+type PersistenceConfig struct {
+	// Folder of state files (tree, tags, albums, ratings, shares, videos, peoples), working directory by default
+	Folder string `yaml:"folder"`
+	// Number of snapshots kept by file, default 10
+	Snapshots int `yaml:"snapshots"`
+	// Minimum delay in minutes between two snapshots of a file, 0 to snapshot every save
+	SnapshotInterval int `yaml:"snapshot-interval"`
+}
+
+// WatcherConfig enable the detection of changes in sources folders
+type WatcherConfig struct {
+	Enable bool `yaml:"enable"`
+	// Delay in seconds without event before updating a folder, default 10
+	Debounce int `yaml:"debounce"`
+}
+
+// GeocodingConfig define files of GeoNames dump used to find place names of photos
+type GeocodingConfig struct {
+	// Cities file (cities15000.txt for example), mandatory to enable geocoding
+	Cities string `yaml:"cities"`
+	// Optional, admin1CodesASCII.txt to get region names
+	Regions string `yaml:"regions"`
+	// Optional, countryInfo.txt to get country names
+	Countries string `yaml:"countries"`
+}
+
+// StorageConfig define quotas of storage areas and how their usage is computed
+type StorageConfig struct {
+	// Delay in minutes between two computations of usage, default 60
+	Refresh int `yaml:"refresh"`
+	// Percent of quota from which a warning is logged, default 90
+	Warning int           `yaml:"warning"`
+	Quotas  StorageQuotas `yaml:"quotas"`
+}
+
+// StorageQuotas are maximum sizes in Mo of each area, 0 is unlimited
+type StorageQuotas struct {
+	Cache   int `yaml:"cache"`
+	Garbage int `yaml:"garbage"`
+	// Original videos
+	Videos int `yaml:"videos"`
+	// HLS segments of videos
+	HLS int `yaml:"hls"`
+	// By name of source
+	Sources map[string]int `yaml:"sources"`
+}
+
+// GetFolder return folder of state files, working directory by default
+func (pc PersistenceConfig) GetFolder() string {
+	if pc.Folder != "" {
+		return pc.Folder
+	}
+	wd, _ := os.Getwd()
+	return wd
+}
+
 // Check if the config is complete
 func (c Config) Check() bool {
 	return !strings.EqualFold("", c.CacheFolder) && !strings.EqualFold("", c.WebResources)
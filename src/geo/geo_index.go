@@ -0,0 +1,110 @@
+package geo
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	indexPrecision = 9
+	// Max number of cells used to cover a box during search
+	maxCoverCells = 64
+)
+
+// Point is a position with any value attached (an image for example)
+type Point struct {
+	Latitude  float64
+	Longitude float64
+	Value     interface{}
+	hash      string
+}
+
+// Cluster group points in a same geohash cell
+type Cluster struct {
+	Geohash   string
+	Count     int
+	Latitude  float64
+	Longitude float64
+	// Some values of the cluster
+	Values []interface{}
+}
+
+// Index store points sorted by geohash, points of a same area are contiguous
+type Index struct {
+	points []Point
+}
+
+func NewIndex(points []Point) *Index {
+	for i := range points {
+		points[i].hash = Encode(points[i].Latitude, points[i].Longitude, indexPrecision)
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	return &Index{points: points}
+}
+
+func (idx *Index) Size() int {
+	return len(idx.points)
+}
+
+// Search return all points inside the box. A box crossing the antimeridian is searched on each side
+func (idx *Index) Search(box Box) []Point {
+	results := make([]Point, 0)
+	for _, part := range box.split() {
+		for _, cell := range coverBox(part) {
+			from := sort.Search(len(idx.points), func(i int) bool { return idx.points[i].hash >= cell })
+			for i := from; i < len(idx.points) && strings.HasPrefix(idx.points[i].hash, cell); i++ {
+				if part.Contains(idx.points[i].Latitude, idx.points[i].Longitude) {
+					results = append(results, idx.points[i])
+				}
+			}
+		}
+	}
+	return results
+}
+
+// coverBox return geohash cells (without overlap) covering the box
+func coverBox(box Box) []string {
+	cells := []string{""}
+	for precision := 1; precision <= indexPrecision; precision++ {
+		next := make([]string, 0)
+		for _, cell := range cells {
+			for _, c := range base32 {
+				if cellBox, _ := Decode(cell + string(c)); cellBox.intersects(box) {
+					next = append(next, cell+string(c))
+				}
+			}
+		}
+		if len(next) > maxCoverCells {
+			break
+		}
+		cells = next
+	}
+	return cells
+}
+
+// ClusterPoints group points (returned by search) by geohash cell of precision. Keep maxValues values by cluster
+func ClusterPoints(points []Point, precision, maxValues int) []Cluster {
+	if precision > indexPrecision {
+		precision = indexPrecision
+	}
+	clusters := make([]Cluster, 0)
+	byHash := make(map[string]int)
+	for _, point := range points {
+		hash := point.hash[:precision]
+		pos, exist := byHash[hash]
+		if !exist {
+			pos = len(clusters)
+			byHash[hash] = pos
+			clusters = append(clusters, Cluster{Geohash: hash, Values: make([]interface{}, 0, maxValues)})
+		}
+		cluster := &clusters[pos]
+		cluster.Count++
+		// Center is the mean of positions
+		cluster.Latitude += (point.Latitude - cluster.Latitude) / float64(cluster.Count)
+		cluster.Longitude += (point.Longitude - cluster.Longitude) / float64(cluster.Count)
+		if len(cluster.Values) < maxValues {
+			cluster.Values = append(cluster.Values, point.Value)
+		}
+	}
+	return clusters
+}
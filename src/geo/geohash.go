@@ -0,0 +1,132 @@
+package geo
+
+import (
+	"errors"
+	"strings"
+)
+
+/* Geohash encode a position in a string. Two positions sharing a prefix are close */
+
+const base32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Box is a geographic rectangle. When MinLon is greater than MaxLon, box crosses the antimeridian
+type Box struct {
+	MinLat float64
+	MinLon float64
+	MaxLat float64
+	MaxLon float64
+}
+
+// split return a box crossing the antimeridian as two boxes, one on each side
+func (b Box) split() []Box {
+	if b.MinLon <= b.MaxLon {
+		return []Box{b}
+	}
+	return []Box{
+		{MinLat: b.MinLat, MinLon: b.MinLon, MaxLat: b.MaxLat, MaxLon: 180},
+		{MinLat: b.MinLat, MinLon: -180, MaxLat: b.MaxLat, MaxLon: b.MaxLon},
+	}
+}
+
+func (b Box) Contains(lat, lon float64) bool {
+	if b.MinLon > b.MaxLon {
+		return lat >= b.MinLat && lat <= b.MaxLat && (lon >= b.MinLon || lon <= b.MaxLon)
+	}
+	return lat >= b.MinLat && lat <= b.MaxLat && lon >= b.MinLon && lon <= b.MaxLon
+}
+
+func (b Box) intersects(other Box) bool {
+	return b.MinLat <= other.MaxLat && b.MaxLat >= other.MinLat && b.MinLon <= other.MaxLon && b.MaxLon >= other.MinLon
+}
+
+func (b Box) Center() (float64, float64) {
+	return (b.MinLat + b.MaxLat) / 2, (b.MinLon + b.MaxLon) / 2
+}
+
+// Encode return the geohash of a position with precision characters
+func Encode(lat, lon float64, precision int) string {
+	box := Box{MinLat: -90, MinLon: -180, MaxLat: 90, MaxLon: 180}
+	hash := strings.Builder{}
+	even := true
+	bit, value := 0, 0
+	for hash.Len() < precision {
+		if even {
+			mid := (box.MinLon + box.MaxLon) / 2
+			if lon >= mid {
+				value = value<<1 | 1
+				box.MinLon = mid
+			} else {
+				value <<= 1
+				box.MaxLon = mid
+			}
+		} else {
+			mid := (box.MinLat + box.MaxLat) / 2
+			if lat >= mid {
+				value = value<<1 | 1
+				box.MinLat = mid
+			} else {
+				value <<= 1
+				box.MaxLat = mid
+			}
+		}
+		even = !even
+		if bit++; bit == 5 {
+			hash.WriteByte(base32[value])
+			bit, value = 0, 0
+		}
+	}
+	return hash.String()
+}
+
+// Decode return the area represented by a geohash
+func Decode(hash string) (Box, error) {
+	box := Box{MinLat: -90, MinLon: -180, MaxLat: 90, MaxLon: 180}
+	even := true
+	for _, c := range hash {
+		value := strings.IndexRune(base32, c)
+		if value == -1 {
+			return box, errors.New("invalid geohash " + hash)
+		}
+		for i := 4; i >= 0; i-- {
+			bit := value >> i & 1
+			if even {
+				mid := (box.MinLon + box.MaxLon) / 2
+				if bit == 1 {
+					box.MinLon = mid
+				} else {
+					box.MaxLon = mid
+				}
+			} else {
+				mid := (box.MinLat + box.MaxLat) / 2
+				if bit == 1 {
+					box.MinLat = mid
+				} else {
+					box.MaxLat = mid
+				}
+			}
+			even = !even
+		}
+	}
+	return box, nil
+}
+
+// PrecisionForZoom return the geohash length used to group positions at a map zoom level (0 to 20)
+func PrecisionForZoom(zoom int) int {
+	switch {
+	case zoom <= 2:
+		return 1
+	case zoom <= 5:
+		return 2
+	case zoom <= 7:
+		return 3
+	case zoom <= 10:
+		return 4
+	case zoom <= 12:
+		return 5
+	case zoom <= 15:
+		return 6
+	case zoom <= 17:
+		return 7
+	}
+	return 8
+}
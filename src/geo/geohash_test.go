@@ -0,0 +1,51 @@
+package geo
+
+import "testing"
+
+func TestEncodeDecode(t *testing.T) {
+	if hash := Encode(57.64911, 10.40744, 11); hash != "u4pruydqqvj" {
+		t.Error("Bad geohash", hash)
+	}
+	box, err := Decode("u4pruydqqvj")
+	if err != nil || !box.Contains(57.64911, 10.40744) {
+		t.Error("Position must be in decoded box", box, err)
+	}
+}
+
+func TestSearchAndCluster(t *testing.T) {
+	index := NewIndex([]Point{
+		{Latitude: 48.8566, Longitude: 2.3522, Value: "paris1"},
+		{Latitude: 48.8606, Longitude: 2.3376, Value: "paris2"},
+		{Latitude: 45.7640, Longitude: 4.8357, Value: "lyon"},
+		{Latitude: 40.7128, Longitude: -74.0060, Value: "new york"},
+	})
+	france := Box{MinLat: 41, MinLon: -5, MaxLat: 51, MaxLon: 10}
+	points := index.Search(france)
+	if len(points) != 3 {
+		t.Fatal("Must find 3 points in France but found", len(points))
+	}
+	clusters := ClusterPoints(points, 3, 1)
+	if len(clusters) != 2 {
+		t.Fatal("Must find 2 clusters (Paris and Lyon)", clusters)
+	}
+	for _, cluster := range clusters {
+		if cluster.Count == 2 && (len(cluster.Values) != 1 || cluster.Geohash != "u09") {
+			t.Error("Bad Paris cluster", cluster)
+		}
+	}
+}
+
+func TestSearchAcrossAntimeridian(t *testing.T) {
+	index := NewIndex([]Point{
+		{Latitude: -17.7134, Longitude: 178.0650, Value: "fiji"},
+		{Latitude: -13.7590, Longitude: -172.1046, Value: "samoa"},
+		{Latitude: 48.8566, Longitude: 2.3522, Value: "paris"},
+	})
+	pacific := Box{MinLat: -30, MinLon: 170, MaxLat: 0, MaxLon: -170}
+	if points := index.Search(pacific); len(points) != 2 {
+		t.Error("Must find points on both sides of antimeridian", points)
+	}
+	if !pacific.Contains(-17.7134, 178.0650) || pacific.Contains(-17.7134, 0) {
+		t.Error("Bad contains on box crossing antimeridian")
+	}
+}
@@ -0,0 +1,139 @@
+package geo
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jotitan/photos_server/logger"
+)
+
+/* Find the name of the place of a position without external service, with a GeoNames dump (https://download.geonames.org/export/dump/) */
+
+const (
+	earthRadius = 6371.0
+	// A position farther than this distance (in km) of any city is not resolved
+	maxCityDistance = 50.0
+)
+
+// Place is the name of location of a position
+type Place struct {
+	City    string `json:"city,omitempty"`
+	Region  string `json:"region,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+// Keywords return all names of place
+func (p Place) Keywords() []string {
+	keywords := make([]string, 0, 3)
+	for _, value := range []string{p.City, p.Region, p.Country} {
+		if value != "" {
+			keywords = append(keywords, value)
+		}
+	}
+	return keywords
+}
+
+type ReverseGeocoder struct {
+	cities *Index
+}
+
+// NewReverseGeocoder load cities (citiesXXX.txt), region names (admin1CodesASCII.txt) and country names (countryInfo.txt).
+// Regions and countries are optional, codes are used instead
+func NewReverseGeocoder(citiesPath, regionsPath, countriesPath string) (*ReverseGeocoder, error) {
+	regions := make(map[string]string)
+	if regionsPath != "" {
+		// Format : FR.84 <tab> Auvergne-Rhone-Alpes <tab> ...
+		if err := readTabFile(regionsPath, 2, func(fields []string) {
+			regions[fields[0]] = fields[1]
+		}); err != nil {
+			return nil, err
+		}
+	}
+	countries := make(map[string]string)
+	if countriesPath != "" {
+		// Format : ISO <tab> ISO3 <tab> ISO-Numeric <tab> fips <tab> Country ...
+		if err := readTabFile(countriesPath, 5, func(fields []string) {
+			countries[fields[0]] = fields[4]
+		}); err != nil {
+			return nil, err
+		}
+	}
+	points := make([]Point, 0)
+	// Format : geonameid, name, asciiname, alternatenames, latitude, longitude, feature class, feature code, country code, cc2, admin1 code...
+	err := readTabFile(citiesPath, 11, func(fields []string) {
+		lat, errLat := strconv.ParseFloat(fields[4], 64)
+		lon, errLon := strconv.ParseFloat(fields[5], 64)
+		if errLat != nil || errLon != nil {
+			return
+		}
+		place := &Place{City: fields[1], Region: fields[10], Country: fields[8]}
+		if name, exist := regions[fields[8]+"."+fields[10]]; exist {
+			place.Region = name
+		}
+		if name, exist := countries[fields[8]]; exist {
+			place.Country = name
+		}
+		points = append(points, Point{Latitude: lat, Longitude: lon, Value: place})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(points) == 0 {
+		return nil, errors.New("no city found in " + citiesPath)
+	}
+	logger.GetLogger2().Info("Load", len(points), "cities for reverse geocoding")
+	return &ReverseGeocoder{cities: NewIndex(points)}, nil
+}
+
+func readTabFile(path string, minFields int, treat func(fields []string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fields := strings.Split(line, "\t"); len(fields) >= minFields {
+			treat(fields)
+		}
+	}
+	return scanner.Err()
+}
+
+// Resolve return the place of nearest city, nil if none is close enough
+func (rg *ReverseGeocoder) Resolve(lat, lon float64) *Place {
+	if rg == nil {
+		return nil
+	}
+	// One degree of latitude is about 111 km
+	delta := maxCityDistance / 111
+	deltaLon := delta / math.Max(math.Cos(lat*math.Pi/180), 0.01)
+	box := Box{MinLat: lat - delta, MinLon: lon - deltaLon, MaxLat: lat + delta, MaxLon: lon + deltaLon}
+	var nearest *Place
+	minDistance := maxCityDistance
+	for _, city := range rg.cities.Search(box) {
+		if distance := Distance(lat, lon, city.Latitude, city.Longitude); distance <= minDistance {
+			minDistance = distance
+			nearest = city.Value.(*Place)
+		}
+	}
+	return nearest
+}
+
+// Distance return the distance in km between two positions (haversine)
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLon := (lon2 - lon1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,35 @@
+package geo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReverseGeocoder(t *testing.T) {
+	folder, _ := os.MkdirTemp("", "geocoding")
+	defer os.RemoveAll(folder)
+	cities := filepath.Join(folder, "cities.txt")
+	regions := filepath.Join(folder, "regions.txt")
+	countries := filepath.Join(folder, "countries.txt")
+	os.WriteFile(cities, []byte("2996944\tLyon\tLyon\t\t45.74846\t4.84671\tP\tPPLA\tFR\t\t84\n"+
+		"2988507\tParis\tParis\t\t48.85341\t2.3488\tP\tPPLC\tFR\t\t11\n"+
+		"2987914\tPerrache\tPerrache\t\t45.74\t4.82\tP\tPPLX\tFR\t\t84\n"), os.ModePerm)
+	os.WriteFile(regions, []byte("FR.84\tAuvergne-Rhone-Alpes\tAuvergne-Rhone-Alpes\t11071625\n"), os.ModePerm)
+	os.WriteFile(countries, []byte("#ISO\tISO3\tISO-Numeric\tfips\tCountry\nFR\tFRA\t250\tFR\tFrance\n"), os.ModePerm)
+
+	geocoder, err := NewReverseGeocoder(cities, regions, countries)
+	if err != nil {
+		t.Fatal("Gazetteer must be loaded", err)
+	}
+	place := geocoder.Resolve(45.76, 4.85)
+	if place == nil || place.City != "Lyon" || place.Region != "Auvergne-Rhone-Alpes" || place.Country != "France" {
+		t.Error("Must find Lyon", place)
+	}
+	if place := geocoder.Resolve(48.86, 2.35); place == nil || place.City != "Paris" || place.Region != "11" {
+		t.Error("Must find Paris with region code", place)
+	}
+	if place := geocoder.Resolve(40.71, -74.0); place != nil {
+		t.Error("No city must be found far from cities", place)
+	}
+}
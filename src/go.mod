@@ -6,20 +6,23 @@ go 1.23.8
 
 require (
 	gioui.org v0.9.0
+	github.com/Kagami/go-face v0.0.0-20210630145111-0c14797b4d0e
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/disintegration/imaging v1.6.2
 	github.com/dsoprea/go-exif/v2 v2.0.0-20200321225314-640175a69fe4
 	github.com/dsoprea/go-jpeg-image-structure v0.0.0-20200419165912-75b7a4f392e6
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/go-errors/errors v1.0.1
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
 	github.com/robfig/cron v1.2.0
 	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/text v0.24.0
 	gopkg.in/yaml.v2 v2.2.7
 )
 
 require (
 	gioui.org/shader v1.0.8 // indirect
-	github.com/Kagami/go-face v0.0.0-20210630145111-0c14797b4d0e // indirect
 	github.com/dsoprea/go-logging v0.0.0-20190624164917-c4f10aab7696 // indirect
 	github.com/dsoprea/go-utility v0.0.0-20200322154813-27f0b0d142d7 // indirect
 	github.com/go-text/typesetting v0.3.0 // indirect
@@ -28,5 +31,4 @@ require (
 	golang.org/x/image v0.26.0 // indirect
 	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553 // indirect
 	golang.org/x/sys v0.33.0 // indirect
-	golang.org/x/text v0.24.0 // indirect
 )
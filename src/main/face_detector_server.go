@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"image"
 	_ "image/jpeg"
 	_ "image/png"
 	"log"
@@ -15,6 +16,7 @@ import (
 	"time"
 
 	"github.com/Kagami/go-face"
+	"github.com/jotitan/photos_server/resize"
 )
 
 const (
@@ -26,10 +28,38 @@ const (
 	imagePattern = "-1080"
 )
 
-// FaceResult represents an identified face.
+// FaceResult represents a face found in an image, ID is 0 for an unknown face.
 type FaceResult struct {
-	ID        int    `json:"id"`
-	ImageFile string `json:"image_file"`
+	ID        int             `json:"id"`
+	ImageFile string          `json:"image_file"`
+	Box       *resize.FaceBox `json:"box,omitempty"`
+}
+
+// newFaceBox converts a face rectangle to ratios of image size, nil if size is unknown.
+func newFaceBox(rect image.Rectangle, width, height int) *resize.FaceBox {
+	if width <= 0 || height <= 0 {
+		return nil
+	}
+	return &resize.FaceBox{
+		X:      float64(rect.Min.X) / float64(width),
+		Y:      float64(rect.Min.Y) / float64(height),
+		Width:  float64(rect.Dx()) / float64(width),
+		Height: float64(rect.Dy()) / float64(height),
+	}
+}
+
+// imageSize reads width and height from image header.
+func imageSize(path string) (int, int) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0
+	}
+	return config.Width, config.Height
 }
 
 type knownFace struct {
@@ -242,16 +272,16 @@ func (wp *WorkerPool) runWorker(id int) {
 			continue
 		}
 
+		// Remove imagePattern from filename before returning
+		cleanName := strings.Replace(job.fileName, imagePattern, "", 1)
+		width, height := imageSize(job.imgPath)
 		for _, f := range targetFaces {
-			classID := rec.ClassifyThreshold(f.Descriptor, matchThreshold)
-			if classID >= 0 {
-				// Remove imagePattern from filename before returning
-				cleanName := strings.Replace(job.fileName, imagePattern, "", 1)
-				job.resultCh <- FaceResult{
-					ID:        wp.svc.knownFaces[classID].id,
-					ImageFile: cleanName,
-				}
+			// Unknown faces are also returned, their location is used to crop thumbnails
+			result := FaceResult{ImageFile: cleanName, Box: newFaceBox(f.Rectangle, width, height)}
+			if classID := rec.ClassifyThreshold(f.Descriptor, matchThreshold); classID >= 0 {
+				result.ID = wp.svc.knownFaces[classID].id
 			}
+			job.resultCh <- result
 		}
 		job.done <- struct{}{}
 	}
@@ -13,7 +13,7 @@ var agor resize.GoResizerManager
 
 func main() {
 	// Get path of ffmpeg from parameter
-	agor = resize.NewAsyncGoResize()
+	agor = resize.NewAsyncGoResize(0, 0)
 	s := http.NewServeMux()
 	s.HandleFunc("/convert", convertPhoto)
 	s.HandleFunc("/status", statusPhoto)
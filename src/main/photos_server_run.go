@@ -1,18 +1,42 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/jotitan/photos_server/arguments"
 	"github.com/jotitan/photos_server/config"
 	"github.com/jotitan/photos_server/logger"
+	"github.com/jotitan/photos_server/persistence"
 	"github.com/jotitan/photos_server/photos_server"
 	"github.com/jotitan/photos_server/tasks"
 )
 
 func main() {
 	args := arguments.NewArguments()
+	// Manage snapshots of a state file, server must be stopped before a rollback
+	if args.Exist("snapshots") {
+		listSnapshots(args.GetString("snapshots"))
+		return
+	}
+	if args.Exist("rollback") {
+		snapshot := args.GetMandatoryString("snapshot", "Argument -snapshot is mandatory to rollback a file")
+		if err := persistence.Rollback(args.GetString("rollback"), snapshot); err != nil {
+			logger.GetLogger2().Error("Impossible to rollback", err)
+		}
+		return
+	}
 	pathConfig := args.GetMandatoryString("config", "Argument -config is mandatory to specify path of YAML config")
 
 	if conf, errConfig := config.ReadConfig(pathConfig); errConfig == nil {
+		// Verify and repair cache, server must be stopped
+		if args.Exist("check-cache") {
+			if report, err := photos_server.RunCacheCheck(conf, args.Exist("dry-run")); err == nil {
+				printCacheReport(report)
+			} else {
+				logger.GetLogger2().Error("Impossible to check cache", err)
+			}
+			return
+		}
 		tasks.LaunchTasks(conf.Tasks)
 		server := photos_server.NewPhotosServerFromConfig(conf)
 		server.Launch(conf)
@@ -20,3 +44,30 @@ func main() {
 		logger.GetLogger2().Error(errConfig.Error())
 	}
 }
+
+func printCacheReport(report *photos_server.CacheReport) {
+	for _, path := range report.Missing {
+		fmt.Println("missing", path)
+	}
+	for _, path := range report.Corrupt {
+		fmt.Println("corrupt", path)
+	}
+	for _, path := range report.Orphans {
+		fmt.Println("orphan", path)
+	}
+	fmt.Printf("%d images, %d missing, %d corrupt, %d orphans\n", report.Images, len(report.Missing), len(report.Corrupt), len(report.Orphans))
+	if !report.DryRun {
+		fmt.Printf("%d images resized again, %d orphans removed\n", report.Repaired, report.Removed)
+	}
+}
+
+func listSnapshots(path string) {
+	snapshots, err := persistence.ListSnapshots(path)
+	if err != nil {
+		logger.GetLogger2().Error("Impossible to list snapshots", err)
+		return
+	}
+	for _, snapshot := range snapshots {
+		fmt.Println(snapshot.Name, snapshot.Date.Format("2006-01-02 15:04:05"), snapshot.Size)
+	}
+}
@@ -7,15 +7,19 @@ import (
 	"io"
 	"log"
 	"net/http"
+
+	"github.com/jotitan/photos_server/resize"
 )
 
 type resultsFaceDetection struct {
 	Results []resultFace
 }
 
+// resultFace is a face found in an image, id is 0 when people is unknown
 type resultFace struct {
-	Id       int    `json:"id"`
-	Filename string `json:"image_file"`
+	Id       int             `json:"id"`
+	Filename string          `json:"image_file"`
+	Box      *resize.FaceBox `json:"box,omitempty"`
 }
 
 type FaceDetector struct {
@@ -33,25 +37,33 @@ func NewFaceDetector(url, folderTag string) *FaceDetector {
 	}
 }
 
-// Launch launch a request on a distance service
-func (fd FaceDetector) Launch(folderId int, pathFolder string) (int, int, error) {
+// Launch launch a request on a distance service. Return number of tags, of peoples and locations of faces by image name
+func (fd FaceDetector) Launch(folderId int, pathFolder string) (int, int, map[string][]resize.FaceBox, error) {
 	log.Println(fmt.Sprintf("%s?folder=%s", fd.faceDetectUrlService, pathFolder))
 	resp, err := http.Post(fmt.Sprintf("%s?folder=%s", fd.faceDetectUrlService, pathFolder), "application/json", nil)
 	if err != nil {
-		return 0, 0, errors.New("impossible to detect faces " + err.Error())
+		return 0, 0, nil, errors.New("impossible to detect faces " + err.Error())
 	}
 	data, _ := io.ReadAll(resp.Body)
 	var results resultsFaceDetection
 	if err = json.Unmarshal(data, &results); err != nil {
-		return 0, 0, err
+		return 0, 0, nil, err
 	}
-	// Group by people
+	// Group by people, unknown faces are only located
 	groups := make(map[int][]string)
+	faces := make(map[string][]resize.FaceBox)
+	nbTags := 0
 	for _, r := range results.Results {
-		groups[r.Id] = append(groups[r.Id], r.Filename)
+		if r.Box != nil {
+			faces[r.Filename] = append(faces[r.Filename], *r.Box)
+		}
+		if r.Id != 0 {
+			groups[r.Id] = append(groups[r.Id], r.Filename)
+			nbTags++
+		}
 	}
 	for idTag, paths := range groups {
 		fd.tagManager.Tag(folderId, idTag, paths, []string{})
 	}
-	return len(results.Results), len(groups), fd.tagManager.Flush()
+	return nbTags, len(groups), faces, fd.tagManager.Flush()
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/jotitan/photos_server/logger"
+	"github.com/jotitan/photos_server/persistence"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -375,7 +376,7 @@ func AddPeopleTag(folder, name string) (int, error) {
 
 	// Write file
 	data, _ := json.Marshal(list)
-	if err := ioutil.WriteFile(filename, data, os.ModePerm); err != nil {
+	if err := persistence.WriteFile(filename, data); err != nil {
 		return 0, err
 	}
 	return id, nil
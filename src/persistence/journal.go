@@ -0,0 +1,129 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/jotitan/photos_server/logger"
+)
+
+/* Append only journal of json entries, an entry is durable once synced on disk.
+Owner replays entries over its last saved state and truncates journal when state is saved again */
+
+type Journal struct {
+	path   string
+	locker sync.Mutex
+	// Only one sync at a time, entries written during a sync are synced by the next one
+	syncLocker sync.Mutex
+	// Number of entries written and number of entries already synced
+	written int64
+	synced  int64
+}
+
+func NewJournal(path string) *Journal {
+	return &Journal{path: path}
+}
+
+// Append write entry at the end of journal and sync it on disk
+func (j *Journal) Append(entry interface{}) error {
+	if err := j.Write(entry); err != nil {
+		return err
+	}
+	return j.Sync()
+}
+
+// Write add entry at the end of journal without waiting disk, Sync must be called after
+func (j *Journal) Write(entry interface{}) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	j.locker.Lock()
+	defer j.locker.Unlock()
+	file, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(data, '\n')); err == nil {
+		j.written++
+	}
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// Sync write on disk entries written before, entries of many writers are synced together
+func (j *Journal) Sync() error {
+	j.syncLocker.Lock()
+	defer j.syncLocker.Unlock()
+	j.locker.Lock()
+	written := j.written
+	j.locker.Unlock()
+	if written <= j.synced {
+		return nil
+	}
+	file, err := os.OpenFile(j.path, os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Journal truncated, entries are in saved state
+			j.synced = written
+			return nil
+		}
+		return err
+	}
+	err = file.Sync()
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		j.synced = written
+	}
+	return err
+}
+
+// Replay call apply on each entry, in order. A last entry partially written (crash) is removed. Return number of entries replayed
+func (j *Journal) Replay(apply func(data []byte) error) (int, error) {
+	j.locker.Lock()
+	defer j.locker.Unlock()
+	data, err := os.ReadFile(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	count := 0
+	for offset := 0; offset < len(data); {
+		end := bytes.IndexByte(data[offset:], '\n')
+		var line []byte
+		if end != -1 {
+			line = bytes.TrimSpace(data[offset : offset+end])
+		}
+		if end == -1 || (len(line) > 0 && !json.Valid(line)) {
+			logger.GetLogger2().Error("Remove corrupted end of journal", j.path)
+			return count, os.Truncate(j.path, int64(offset))
+		}
+		offset += end + 1
+		if len(line) == 0 {
+			continue
+		}
+		if err := apply(line); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Truncate remove all entries, to call when state including them is saved
+func (j *Journal) Truncate() error {
+	j.locker.Lock()
+	defer j.locker.Unlock()
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package persistence
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	folder, _ := os.MkdirTemp("", "journal")
+	defer os.RemoveAll(folder)
+	path := filepath.Join(folder, "state.journal")
+	journal := NewJournal(path)
+	for _, value := range []string{"v1", "v2"} {
+		if err := journal.Append(value); err != nil {
+			t.Fatal("Append must success", err)
+		}
+	}
+	// Simulate a crash during last write
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, os.ModePerm)
+	file.WriteString(`"v3`)
+	file.Close()
+
+	values := make([]string, 0)
+	count, err := NewJournal(path).Replay(func(data []byte) error {
+		var value string
+		err := json.Unmarshal(data, &value)
+		values = append(values, value)
+		return err
+	})
+	if err != nil || count != 2 || values[0] != "v1" || values[1] != "v2" {
+		t.Error("Complete entries must be replayed in order", count, values, err)
+	}
+	journal.Append("v4")
+	values = values[:0]
+	if count, _ := journal.Replay(func(data []byte) error {
+		var value string
+		json.Unmarshal(data, &value)
+		values = append(values, value)
+		return nil
+	}); count != 3 || values[2] != "v4" {
+		t.Error("Corrupted entry must be removed before appending", count, values)
+	}
+	journal.Write("v5")
+	journal.Truncate()
+	if count, _ := journal.Replay(func(data []byte) error { return nil }); count != 0 {
+		t.Error("Journal must be empty after truncate", count)
+	}
+	if err := journal.Sync(); err != nil {
+		t.Error("Sync of a truncated journal must success", err)
+	}
+}
@@ -0,0 +1,63 @@
+package persistence
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// StateFile is a file written with WriteFile which can be rolled back
+type StateFile struct {
+	Name string
+	Path string
+	// Called after a rollback to read again the file, can be nil
+	reload func() error
+}
+
+type StateFileDto struct {
+	Name      string
+	Path      string
+	Snapshots []Snapshot
+}
+
+var (
+	stateFiles     = make(map[string]StateFile)
+	lockStateFiles = sync.Mutex{}
+)
+
+// Register a state file to manage its snapshots
+func Register(name, path string, reload func() error) {
+	lockStateFiles.Lock()
+	defer lockStateFiles.Unlock()
+	stateFiles[name] = StateFile{Name: name, Path: path, reload: reload}
+}
+
+// GetStateFiles return all registered files with their snapshots
+func GetStateFiles() []StateFileDto {
+	lockStateFiles.Lock()
+	defer lockStateFiles.Unlock()
+	files := make([]StateFileDto, 0, len(stateFiles))
+	for _, file := range stateFiles {
+		snapshots, _ := ListSnapshots(file.Path)
+		files = append(files, StateFileDto{Name: file.Name, Path: file.Path, Snapshots: snapshots})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files
+}
+
+// RollbackStateFile restore a snapshot of a registered file and reload it
+func RollbackStateFile(name, snapshot string) error {
+	lockStateFiles.Lock()
+	file, exist := stateFiles[name]
+	lockStateFiles.Unlock()
+	if !exist {
+		return errors.New("unknown state file " + name)
+	}
+	if err := Rollback(file.Path, snapshot); err != nil {
+		return err
+	}
+	if file.reload != nil {
+		return file.reload()
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package persistence
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jotitan/photos_server/logger"
+)
+
+/* Write state files safely : write in a temporary file, sync and rename. Keep last versions as snapshots */
+
+const (
+	snapshotsFolder  = ".snapshots"
+	snapshotDateForm = "20060102-150405.000000000"
+)
+
+var (
+	maxSnapshots     = 10
+	snapshotInterval = time.Duration(0)
+	// Only one writer by file at the same time
+	lockers     = make(map[string]*sync.Mutex)
+	lockLockers = sync.Mutex{}
+)
+
+// Configure define how many snapshots are kept for each file and the minimum delay between two snapshots
+func Configure(snapshots int, interval time.Duration) {
+	if snapshots > 0 {
+		maxSnapshots = snapshots
+	}
+	snapshotInterval = interval
+}
+
+type Snapshot struct {
+	Name string
+	Date time.Time
+	Size int64
+}
+
+func getLocker(path string) *sync.Mutex {
+	lockLockers.Lock()
+	defer lockLockers.Unlock()
+	if locker, exist := lockers[path]; exist {
+		return locker
+	}
+	locker := &sync.Mutex{}
+	lockers[path] = locker
+	return locker
+}
+
+// WriteFile replace atomically the content of file. Previous version is kept as a snapshot
+func WriteFile(path string, data []byte) error {
+	locker := getLocker(path)
+	locker.Lock()
+	defer locker.Unlock()
+	return writeFile(path, data, false)
+}
+
+func writeFile(path string, data []byte, forceSnapshot bool) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+	if err = snapshot(path, forceSnapshot); err != nil {
+		logger.GetLogger2().Error("Impossible to create snapshot of", path, err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncFolder(filepath.Dir(path))
+}
+
+func syncFolder(folder string) error {
+	if dir, err := os.Open(folder); err == nil {
+		defer dir.Close()
+		// Some systems can't sync a folder, not an error
+		dir.Sync()
+		return nil
+	} else {
+		return err
+	}
+}
+
+func getSnapshotFolder(path string) string {
+	return filepath.Join(filepath.Dir(path), snapshotsFolder)
+}
+
+// snapshot keep current version of file before replacing it
+func snapshot(path string, force bool) error {
+	if _, err := os.Stat(path); err != nil {
+		// Nothing to keep
+		return nil
+	}
+	snapshots, _ := ListSnapshots(path)
+	if !force && len(snapshots) > 0 && time.Since(snapshots[0].Date) < snapshotInterval {
+		return nil
+	}
+	folder := getSnapshotFolder(path)
+	if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+		return err
+	}
+	target := filepath.Join(folder, filepath.Base(path)+"."+time.Now().Format(snapshotDateForm))
+	// Hard link avoid a copy, file is replaced (not modified) after
+	if err := os.Link(path, target); err != nil {
+		if err = copyFile(path, target); err != nil {
+			return err
+		}
+	}
+	return cleanSnapshots(path)
+}
+
+// cleanSnapshots remove oldest snapshots
+func cleanSnapshots(path string) error {
+	snapshots, err := ListSnapshots(path)
+	if err != nil {
+		return err
+	}
+	for i := maxSnapshots; i < len(snapshots); i++ {
+		if err := os.Remove(filepath.Join(getSnapshotFolder(path), snapshots[i].Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListSnapshots return snapshots of a file, newest first
+func ListSnapshots(path string) ([]Snapshot, error) {
+	entries, err := os.ReadDir(getSnapshotFolder(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Snapshot{}, nil
+		}
+		return nil, err
+	}
+	prefix := filepath.Base(path) + "."
+	snapshots := make([]Snapshot, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		date, err := time.ParseInLocation(snapshotDateForm, entry.Name()[len(prefix):], time.Local)
+		if err != nil {
+			continue
+		}
+		size := int64(0)
+		if info, err := entry.Info(); err == nil {
+			size = info.Size()
+		}
+		snapshots = append(snapshots, Snapshot{Name: entry.Name(), Date: date, Size: size})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Date.After(snapshots[j].Date) })
+	return snapshots, nil
+}
+
+// Rollback replace file by a snapshot. Current version is kept as a new snapshot
+func Rollback(path, name string) error {
+	if strings.Contains(name, "/") || strings.Contains(name, "\\") || !strings.HasPrefix(name, filepath.Base(path)+".") {
+		return errors.New("invalid snapshot " + name)
+	}
+	data, err := os.ReadFile(filepath.Join(getSnapshotFolder(path), name))
+	if err != nil {
+		return err
+	}
+	locker := getLocker(path)
+	locker.Lock()
+	defer locker.Unlock()
+	logger.GetLogger2().Info("Rollback", path, "to snapshot", name)
+	return writeFile(path, data, true)
+}
+
+func copyFile(from, to string) error {
+	input, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(output, input); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
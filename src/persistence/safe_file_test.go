@@ -0,0 +1,35 @@
+package persistence
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileSnapshotAndRollback(t *testing.T) {
+	folder := t.TempDir()
+	Configure(2, 0)
+	path := filepath.Join(folder, "state.json")
+	for _, value := range []string{"v1", "v2", "v3", "v4"} {
+		if err := WriteFile(path, []byte(value)); err != nil {
+			t.Fatal("Write must success", err)
+		}
+	}
+	if data, _ := os.ReadFile(path); string(data) != "v4" {
+		t.Fatal("File must contain last version but found", string(data))
+	}
+	snapshots, _ := ListSnapshots(path)
+	if len(snapshots) != 2 {
+		t.Fatal("Only 2 snapshots must be kept but found", len(snapshots))
+	}
+	// Oldest kept snapshot is v2
+	if err := Rollback(path, snapshots[1].Name); err != nil {
+		t.Fatal("Rollback must success", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "v2" {
+		t.Error("File must be rollback to v2 but found", string(data))
+	}
+	if err := Rollback(path, "../state.json"); err == nil {
+		t.Error("Snapshot outside folder must be rejected")
+	}
+}
@@ -0,0 +1,329 @@
+package photos_server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jotitan/photos_server/logger"
+	"github.com/jotitan/photos_server/persistence"
+	"github.com/jotitan/photos_server/query"
+)
+
+/* Virtual albums : named and ordered lists of photos and videos from any folder.
+Smart albums have no items but a query (same as /search), evaluated on each read */
+
+// AlbumItem reference a photo or a video by its relative path, or a photo by id of its folder and its name
+type AlbumItem struct {
+	Path  string
+	Video bool `json:",omitempty"`
+	// Id of folder of photo when referenced by node id, photo is found with it even if folder moves
+	FolderId int `json:",omitempty"`
+}
+
+type Album struct {
+	Id          int
+	Name        string
+	Title       string `json:",omitempty"`
+	Description string `json:",omitempty"`
+	// Path of photo used as cover, first photo if empty
+	Cover string `json:",omitempty"`
+	// Only for smart albums
+	Query   string `json:",omitempty"`
+	Items   []AlbumItem
+	Created time.Time
+	Updated time.Time
+}
+
+// AlbumDto is used to create an album or update its details
+type AlbumDto struct {
+	Id          int
+	Name        string
+	Title       string
+	Description string
+	// Only on update, must be a photo of album
+	Cover string
+	// Create a smart album, can't be set on a regular album
+	Query string
+}
+
+type AlbumManager struct {
+	Albums map[int]*Album
+	NextId int
+	path   string
+	locker sync.Mutex
+}
+
+func getAlbumsPath(folder string) string {
+	return filepath.Join(folder, "albums.json")
+}
+
+// NewAlbumManager load albums saved in folder
+func NewAlbumManager(folder string) *AlbumManager {
+	am := &AlbumManager{Albums: make(map[int]*Album), NextId: 1, path: getAlbumsPath(folder)}
+	am.load()
+	persistence.Register("albums", am.path, func() error {
+		am.locker.Lock()
+		defer am.locker.Unlock()
+		am.Albums = make(map[int]*Album)
+		am.load()
+		return nil
+	})
+	return am
+}
+
+func (am *AlbumManager) load() {
+	if data, err := os.ReadFile(am.path); err == nil {
+		temp := AlbumManager{}
+		if json.Unmarshal(data, &temp) == nil && temp.Albums != nil {
+			am.Albums = temp.Albums
+			am.NextId = temp.NextId
+			logger.GetLogger2().Info("Load", len(am.Albums), "albums")
+		}
+	}
+}
+
+// save write albums, lock must be held
+func (am *AlbumManager) save() error {
+	data, err := json.Marshal(am)
+	if err != nil {
+		return err
+	}
+	return persistence.WriteFile(am.path, data)
+}
+
+// List return albums sorted by name
+func (am *AlbumManager) List() []Album {
+	am.locker.Lock()
+	defer am.locker.Unlock()
+	albums := make([]Album, 0, len(am.Albums))
+	for _, album := range am.Albums {
+		albums = append(albums, *album)
+	}
+	sort.Slice(albums, func(i, j int) bool { return strings.ToLower(albums[i].Name) < strings.ToLower(albums[j].Name) })
+	return albums
+}
+
+func (am *AlbumManager) Get(id int) (Album, error) {
+	am.locker.Lock()
+	defer am.locker.Unlock()
+	if album, exist := am.Albums[id]; exist {
+		return *album, nil
+	}
+	return Album{}, errors.New("unknown album")
+}
+
+func (am *AlbumManager) Create(details AlbumDto) (Album, error) {
+	if strings.TrimSpace(details.Name) == "" {
+		return Album{}, errors.New("name of album is mandatory")
+	}
+	if err := checkAlbumQuery(details.Query); err != nil {
+		return Album{}, err
+	}
+	am.locker.Lock()
+	defer am.locker.Unlock()
+	album := &Album{Id: am.NextId, Name: details.Name, Title: details.Title, Description: details.Description,
+		Query: strings.TrimSpace(details.Query), Items: make([]AlbumItem, 0), Created: time.Now(), Updated: time.Now()}
+	am.Albums[album.Id] = album
+	am.NextId++
+	return *album, am.save()
+}
+
+// UpdateDetails change name, title, description and cover of album
+func (am *AlbumManager) UpdateDetails(details AlbumDto) error {
+	return am.update(details.Id, func(album *Album) error {
+		if strings.TrimSpace(details.Name) != "" {
+			album.Name = details.Name
+		}
+		album.Title = details.Title
+		album.Description = details.Description
+		if value := strings.TrimSpace(details.Query); value != "" {
+			if !album.IsSmart() {
+				return errors.New("query can only be set on a smart album")
+			}
+			if err := checkAlbumQuery(value); err != nil {
+				return err
+			}
+			album.Query = value
+		}
+		cover := cleanRelativePath(details.Cover)
+		if cover != "" && !album.IsSmart() && album.indexOf(cover) == -1 {
+			return errors.New("cover must be a photo of album")
+		}
+		album.Cover = cover
+		return nil
+	})
+}
+
+func checkAlbumQuery(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	_, err := query.Parse(value)
+	return err
+}
+
+// IsSmart return true if album content is defined by a query
+func (a Album) IsSmart() bool {
+	return a.Query != ""
+}
+
+func (am *AlbumManager) Delete(id int) error {
+	am.locker.Lock()
+	defer am.locker.Unlock()
+	if _, exist := am.Albums[id]; !exist {
+		return errors.New("unknown album")
+	}
+	delete(am.Albums, id)
+	return am.save()
+}
+
+// AddItems add photos or videos at the end of album, already present ones are ignored
+func (am *AlbumManager) AddItems(id int, items []AlbumItem) error {
+	return am.updateItems(id, func(album *Album) error {
+		for _, item := range items {
+			item.Path = cleanRelativePath(item.Path)
+			if item.Path != "" && album.indexOf(item.Path) == -1 {
+				album.Items = append(album.Items, item)
+			}
+		}
+		return nil
+	})
+}
+
+func (am *AlbumManager) RemoveItems(id int, paths []string) error {
+	return am.updateItems(id, func(album *Album) error {
+		album.removePaths(toPathsSet(paths))
+		return nil
+	})
+}
+
+// Reorder set order of items, paths must contain all items of album
+func (am *AlbumManager) Reorder(id int, paths []string) error {
+	return am.updateItems(id, func(album *Album) error {
+		if len(paths) != len(album.Items) {
+			return errors.New("all items of album must be ordered")
+		}
+		items := make([]AlbumItem, 0, len(paths))
+		for _, path := range paths {
+			pos := album.indexOf(cleanRelativePath(path))
+			if pos == -1 {
+				return errors.New("unknown item " + path)
+			}
+			items = append(items, album.Items[pos])
+		}
+		album.Items = items
+		return nil
+	})
+}
+
+// updateItems change items of a regular album, items of smart album come from its query
+func (am *AlbumManager) updateItems(id int, updater func(album *Album) error) error {
+	return am.update(id, func(album *Album) error {
+		if album.IsSmart() {
+			return errors.New("items of a smart album come from its query")
+		}
+		return updater(album)
+	})
+}
+
+func (am *AlbumManager) update(id int, updater func(album *Album) error) error {
+	am.locker.Lock()
+	defer am.locker.Unlock()
+	album, exist := am.Albums[id]
+	if !exist {
+		return errors.New("unknown album")
+	}
+	// Work on a copy to keep album unchanged if update fails
+	updated := *album
+	updated.Items = append([]AlbumItem{}, album.Items...)
+	if err := updater(&updated); err != nil {
+		return err
+	}
+	updated.Updated = time.Now()
+	*album = updated
+	return am.save()
+}
+
+// UpdateExistingPath change references of a moved folder
+func (am *AlbumManager) UpdateExistingPath(pathFrom, pathTo string) {
+	from, to := cleanRelativePath(pathFrom), cleanRelativePath(pathTo)
+	am.locker.Lock()
+	defer am.locker.Unlock()
+	changed := false
+	for _, album := range am.Albums {
+		for i, item := range album.Items {
+			if path, moved := movePath(item.Path, from, to); moved && !item.Video {
+				album.Items[i].Path = path
+				changed = true
+			}
+		}
+		if cover, moved := movePath(album.Cover, from, to); moved {
+			album.Cover = cover
+			changed = true
+		}
+	}
+	if changed {
+		if err := am.save(); err != nil {
+			logger.GetLogger2().Error("Impossible to save albums", err)
+		}
+	}
+}
+
+// RemovePaths remove references of deleted photos or videos
+func (am *AlbumManager) RemovePaths(paths []string) {
+	toRemove := toPathsSet(paths)
+	am.locker.Lock()
+	defer am.locker.Unlock()
+	changed := false
+	for _, album := range am.Albums {
+		changed = album.removePaths(toRemove) || changed
+	}
+	if changed {
+		if err := am.save(); err != nil {
+			logger.GetLogger2().Error("Impossible to save albums", err)
+		}
+	}
+}
+
+func (a *Album) removePaths(paths map[string]struct{}) bool {
+	items := make([]AlbumItem, 0, len(a.Items))
+	for _, item := range a.Items {
+		if _, exist := paths[item.Path]; !exist {
+			items = append(items, item)
+		}
+	}
+	if _, exist := paths[a.Cover]; exist {
+		a.Cover = ""
+	}
+	removed := len(items) != len(a.Items)
+	a.Items = items
+	return removed
+}
+
+func (a Album) indexOf(path string) int {
+	for i, item := range a.Items {
+		if item.Path == path {
+			return i
+		}
+	}
+	return -1
+}
+
+// GetCover return cover path, first photo if not defined
+func (a Album) GetCover() string {
+	if a.Cover != "" {
+		return a.Cover
+	}
+	for _, item := range a.Items {
+		if !item.Video {
+			return item.Path
+		}
+	}
+	return ""
+}
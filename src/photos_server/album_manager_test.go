@@ -0,0 +1,80 @@
+package photos_server
+
+import (
+	"testing"
+)
+
+func TestAlbumManager(t *testing.T) {
+	folder := t.TempDir()
+	am := NewAlbumManager(folder)
+	if _, err := am.Create(AlbumDto{}); err == nil {
+		t.Error("Album without name must be rejected")
+	}
+	album, _ := am.Create(AlbumDto{Name: "Best of", Title: "Best of 2020"})
+	am.AddItems(album.Id, []AlbumItem{{Path: "/root/folder1/first.txt"}, {Path: "root/folder2/fifth.txt"}, {Path: "films/clip.mp4", Video: true}, {Path: "root/folder1/first.txt"}})
+	if album, _ = am.Get(album.Id); len(album.Items) != 3 || album.GetCover() != "root/folder1/first.txt" {
+		t.Fatal("Album must have 3 items with first photo as cover", album)
+	}
+	if err := am.Reorder(album.Id, []string{"films/clip.mp4", "root/folder2/fifth.txt"}); err == nil {
+		t.Error("Reorder must contain all items")
+	}
+	am.Reorder(album.Id, []string{"films/clip.mp4", "root/folder2/fifth.txt", "root/folder1/first.txt"})
+	if err := am.UpdateDetails(AlbumDto{Id: album.Id, Title: "Best", Cover: "root/other.txt"}); err == nil {
+		t.Error("Cover must be in album")
+	}
+	am.UpdateDetails(AlbumDto{Id: album.Id, Title: "Best", Cover: "root/folder1/first.txt"})
+
+	am.UpdateExistingPath("root/folder1", "root/folder3")
+	am.RemovePaths([]string{"root/folder2/fifth.txt"})
+	album, _ = am.Get(album.Id)
+	if len(album.Items) != 2 || album.Items[0].Path != "films/clip.mp4" || album.Items[1].Path != "root/folder3/first.txt" {
+		t.Error("Bad items after move and deletion", album.Items)
+	}
+	if album.Cover != "root/folder3/first.txt" || album.Title != "Best" {
+		t.Error("Cover must follow moved photo", album)
+	}
+	// Reload from file
+	if reloaded, err := NewAlbumManager(folder).Get(album.Id); err != nil || len(reloaded.Items) != 2 {
+		t.Error("Albums must be saved", reloaded, err)
+	}
+}
+
+func TestSmartAlbum(t *testing.T) {
+	folder := t.TempDir()
+	am := NewAlbumManager(folder)
+	if _, err := am.Create(AlbumDto{Name: "Kids", Query: "rating:6"}); err == nil {
+		t.Error("Smart album with bad query must be rejected")
+	}
+	smart, _ := am.Create(AlbumDto{Name: "Kids", Query: "tag:vacances rating:5 person:12"})
+	if !smart.IsSmart() || am.AddItems(smart.Id, []AlbumItem{{Path: "root/folder1/first.txt"}}) == nil {
+		t.Error("Items can't be added in a smart album")
+	}
+	if err := am.UpdateDetails(AlbumDto{Id: smart.Id, Query: "tag:noel", Cover: "root/folder2/fifth.txt"}); err != nil {
+		t.Error("Query and cover of smart album must be updated", err)
+	}
+	regular, _ := am.Create(AlbumDto{Name: "Best of"})
+	if am.UpdateDetails(AlbumDto{Id: regular.Id, Query: "tag:noel"}) == nil {
+		t.Error("Regular album can't become a smart album")
+	}
+	if smart, _ = am.Get(smart.Id); smart.Query != "tag:noel" || smart.Cover != "root/folder2/fifth.txt" {
+		t.Error("Bad smart album", smart)
+	}
+	// Cover of smart album is not an item, it must be saved when it moves
+	am.UpdateExistingPath("root/folder2", "root/folder4")
+	if smart, _ = NewAlbumManager(folder).Get(smart.Id); smart.Cover != "root/folder4/fifth.txt" {
+		t.Error("Moved cover must be saved", smart)
+	}
+}
+
+func TestAlbumItemsByFolderId(t *testing.T) {
+	fm, _, _ := createFakeStructure(t)
+	fm.detectMissingFoldersId()
+	folder1, _, _ := fm.FindNode("root/folder1")
+	items := []AlbumItem{{FolderId: folder1.Id, Path: "second.txt"}}
+	if err := fm.resolveAlbumItems(items); err != nil || items[0].Path != "root/folder1/second.txt" {
+		t.Error("Photo must be found with id of folder", items, err)
+	}
+	if fm.resolveAlbumItems([]AlbumItem{{FolderId: folder1.Id, Path: "missing.txt"}}) == nil || fm.resolveAlbumItems([]AlbumItem{{FolderId: -1}}) == nil {
+		t.Error("Unknown photo or folder must be rejected")
+	}
+}
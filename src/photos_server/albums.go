@@ -0,0 +1,258 @@
+package photos_server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jotitan/photos_server/query"
+	"github.com/jotitan/photos_server/video"
+)
+
+// Smart albums can be browsed like a folder with /browserf/_smart/<id>
+const smartAlbumsFolder = "_smart"
+
+/* Endpoints to manage virtual albums */
+
+type albumRestFul struct {
+	Id            int
+	Name          string
+	Title         string
+	Description   string
+	Count         int
+	Link          string
+	ThumbnailLink string
+	Updated       time.Time
+	// Only for smart albums
+	Query      string `json:",omitempty"`
+	FolderPath string `json:",omitempty"`
+}
+
+type albumItemsRequest struct {
+	Items []AlbumItem
+}
+
+// newAlbumRestful return album description, count of smart album is the number of photos found by its query for user
+func (s Server) newAlbumRestful(album Album, r *http.Request) albumRestFul {
+	restful := albumRestFul{Id: album.Id, Name: album.Name, Title: album.Title, Description: album.Description,
+		Count: len(album.Items), Link: fmt.Sprintf("/album?id=%d", album.Id), Updated: album.Updated, Query: album.Query}
+	if album.IsSmart() {
+		restful.FolderPath = fmt.Sprintf("%s/%d", smartAlbumsFolder, album.Id)
+		restful.Count = s.smartAlbumCount(album, r)
+	}
+	if cover := album.GetCover(); cover != "" {
+		if node, _, err := s.foldersManager.FindNode(cover); err == nil {
+			restful.ThumbnailLink = filepath.ToSlash(filepath.Join("/image", s.foldersManager.GetSmallImageName(*node)))
+		}
+	}
+	return restful
+}
+
+// albums return all albums (GET) or photos and videos of an album, in order (GET with id)
+func (s Server) albums(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	if r.FormValue("id") == "" {
+		albums := s.foldersManager.albumManager.List()
+		results := make([]albumRestFul, len(albums))
+		for i, album := range albums {
+			results[i] = s.newAlbumRestful(album, r)
+		}
+		data, _ := json.Marshal(results)
+		write(data, w)
+		return
+	}
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	album, err := s.foldersManager.albumManager.Get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.writeAlbum(w, r, album)
+}
+
+func (s Server) writeAlbum(w http.ResponseWriter, r *http.Request, album Album) {
+	var files []interface{}
+	if album.IsSmart() {
+		files = s.smartAlbumFiles(album, r)
+	} else {
+		files = make([]interface{}, 0, len(album.Items))
+		for _, item := range album.Items {
+			files = append(files, s.convertAlbumItem(item)...)
+		}
+		files = s.setUserRatings(files, r)
+	}
+	response := imagesResponse{Files: files, Id: album.Id, Title: album.Title, Description: album.Description}
+	if album.IsSmart() {
+		response.FolderPath = fmt.Sprintf("%s/%d", smartAlbumsFolder, album.Id)
+	}
+	if data, err := json.Marshal(response); err == nil {
+		write(data, w)
+	}
+}
+
+// smartAlbumFiles evaluate query of album, so photos added since last read are returned
+func (s Server) smartAlbumFiles(album Album, r *http.Request) []interface{} {
+	expr, err := query.Parse(album.Query)
+	if err != nil {
+		return []interface{}{}
+	}
+	items := s.runQuery(expr, r)
+	files := make([]interface{}, len(items))
+	for i, item := range items {
+		files[i] = s.convertQueryItem(item, r).Item
+	}
+	return files
+}
+
+func (s Server) smartAlbumCount(album Album, r *http.Request) int {
+	expr, err := query.Parse(album.Query)
+	if err != nil {
+		return 0
+	}
+	return len(s.runQuery(expr, r))
+}
+
+// browseSmartAlbum return smart album as a folder, path is _smart/<id>.
+// Like albums, only users or guests with a share of the album can read it
+func (s Server) browseSmartAlbum(w http.ResponseWriter, r *http.Request, path string) {
+	if !s.securityServer.CanReadPath(path, r) {
+		error403(w, r)
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(path, smartAlbumsFolder+"/"))
+	if err != nil {
+		error404(w, r)
+		return
+	}
+	album, err := s.foldersManager.albumManager.Get(id)
+	if err != nil || !album.IsSmart() {
+		error404(w, r)
+		return
+	}
+	s.writeAlbum(w, r, album)
+}
+
+// convertAlbumItem return restful representation of item, nothing if not found
+func (s Server) convertAlbumItem(item AlbumItem) []interface{} {
+	if item.Video {
+		if s.videoManager == nil {
+			return nil
+		}
+		if node, _, err := s.videoManager.FindVideoNode(item.Path); err == nil {
+			return s.convertVideoPaths([]*video.VideoNode{node}, false)
+		}
+		return nil
+	}
+	if item.FolderId != 0 {
+		// Folder may have moved since photo was added
+		if folder := s.foldersManager.findFolderById(item.FolderId); folder != nil {
+			if node, exist := folder.Files[filepath.Base(item.Path)]; exist {
+				return s.convertPaths([]*Node{node}, false)
+			}
+		}
+	}
+	if node, _, err := s.foldersManager.FindNode(item.Path); err == nil {
+		return s.convertPaths([]*Node{node}, false)
+	}
+	return nil
+}
+
+// resolveAlbumItems set path of photos referenced by id of folder (path is then the name of photo)
+func (fm *FoldersManager) resolveAlbumItems(items []AlbumItem) error {
+	for i, item := range items {
+		if item.FolderId == 0 || item.Video {
+			continue
+		}
+		folder := fm.findFolderById(item.FolderId)
+		if folder == nil {
+			return fmt.Errorf("unknown folder %d", item.FolderId)
+		}
+		node, exist := folder.Files[filepath.Base(item.Path)]
+		if !exist || node.IsFolder {
+			return errors.New("unknown photo " + item.Path)
+		}
+		items[i].Path = cleanRelativePath(node.RelativePath)
+	}
+	return nil
+}
+
+// editAlbum create (POST without id), update details (POST with id) or delete (DELETE with id) an album
+func (s Server) editAlbum(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	albumManager := s.foldersManager.albumManager
+	switch r.Method {
+	case http.MethodPost:
+		data, _ := io.ReadAll(r.Body)
+		var details AlbumDto
+		if err := json.Unmarshal(data, &details); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if details.Id == 0 {
+			album, err := albumManager.Create(details)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data, _ := json.Marshal(s.newAlbumRestful(album, r))
+			write(data, w)
+			return
+		}
+		if err := albumManager.UpdateDetails(details); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		write([]byte("success"), w)
+	case http.MethodDelete:
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		if err := albumManager.Delete(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		write([]byte("success"), w)
+	default:
+		http.Error(w, "Bad method", http.StatusMethodNotAllowed)
+	}
+}
+
+// editAlbumItems add (POST), remove (DELETE) or reorder (PUT with all items) items of album with id
+func (s Server) editAlbumItems(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	data, _ := io.ReadAll(r.Body)
+	var request albumItemsRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	paths := make([]string, len(request.Items))
+	for i, item := range request.Items {
+		paths[i] = item.Path
+	}
+	var err error
+	albumManager := s.foldersManager.albumManager
+	switch r.Method {
+	case http.MethodPost:
+		if err = s.foldersManager.resolveAlbumItems(request.Items); err == nil {
+			err = albumManager.AddItems(id, request.Items)
+		}
+	case http.MethodDelete:
+		err = albumManager.RemoveItems(id, paths)
+	case http.MethodPut:
+		err = albumManager.Reorder(id, paths)
+	default:
+		http.Error(w, "Bad method", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	write([]byte("success"), w)
+}
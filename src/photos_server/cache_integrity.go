@@ -0,0 +1,271 @@
+package photos_server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jotitan/photos_server/config"
+	"github.com/jotitan/photos_server/logger"
+	"github.com/jotitan/photos_server/progress"
+	"github.com/jotitan/photos_server/resize"
+)
+
+/* Verification of cache : each image must have its reduced images (profiles and preview of RAW / HEIC) and they must be readable.
+Files in cache folder of a source without image are orphans.
+Repair creates again missing and corrupt reduced images and removes orphans, dry run only reports them */
+
+// Only one verification at a time
+var cacheCheckLocker = sync.Mutex{}
+
+var lastCacheReport = struct {
+	sync.Mutex
+	report *CacheReport
+}{}
+
+// CacheReport is the result of a verification of cache, paths are absolute
+type CacheReport struct {
+	Date    time.Time
+	DryRun  bool
+	Images  int
+	Missing []string
+	Corrupt []string
+	Orphans []string
+	// Number of images resized again and orphans removed, always 0 in dry run
+	Repaired int
+	Removed  int
+}
+
+// reducedImagesOf return expected files in cache of an image
+func (fm *FoldersManager) reducedImagesOf(node *Node) []string {
+	folder := filepath.Join(fm.reducer.GetCache(), filepath.Dir(node.RelativePath))
+	files := make([]string, 0)
+	if node.HasPreview() {
+		files = append(files, filepath.Join(fm.reducer.GetCache(), fm.GetPreviewImageName(*node)))
+	}
+	profiles := fm.reducer.GetProfiles(node.RelativePath)
+	for _, profile := range profiles {
+		files = append(files, createProfileFile(fm.reducer, folder, node.RelativePath, profile, profiles))
+	}
+	return files
+}
+
+// cachedImage is an image of tree with its expected files in cache
+type cachedImage struct {
+	node  *Node
+	files []string
+}
+
+// cachedImages return images of each source with their expected files in cache, update lock must be held
+func (fm *FoldersManager) cachedImages() map[string][]cachedImage {
+	images := make(map[string][]cachedImage, len(fm.Sources))
+	for name, source := range fm.Sources {
+		addImage := func(_, _ string, node *Node) {
+			images[name] = append(images[name], cachedImage{node: node, files: fm.reducedImagesOf(node)})
+		}
+		for _, node := range source.Files {
+			if node.IsFolder {
+				node.applyOnEach(fm.Sources, addImage)
+			} else {
+				addImage("", node.RelativePath, node)
+			}
+		}
+	}
+	return images
+}
+
+// verifyCache compare cache with images, progresser is notified after each image.
+// Images are listed under update lock, files are checked after
+func (fm *FoldersManager) verifyCache(progresser *progress.UploadProgress) (*CacheReport, []imageToRegenerate) {
+	report := &CacheReport{Date: time.Now(), Missing: make([]string, 0), Corrupt: make([]string, 0), Orphans: make([]string, 0)}
+	images := make([]imageToRegenerate, 0)
+	updateLocker.Lock()
+	sources := fm.cachedImages()
+	updateLocker.Unlock()
+	for name, cachedImages := range sources {
+		expected := make(map[string]struct{})
+		for _, cached := range cachedImages {
+			report.Images++
+			image := imageToRegenerate{node: cached.node, existings: make(map[string]struct{})}
+			for _, path := range cached.files {
+				expected[path] = struct{}{}
+				if _, err := os.Stat(path); err != nil {
+					report.Missing = append(report.Missing, path)
+				} else if width, _ := resize.GetSize(path); width == 0 {
+					report.Corrupt = append(report.Corrupt, path)
+				} else {
+					image.existings[path] = struct{}{}
+				}
+			}
+			if len(image.existings) < len(cached.files) {
+				images = append(images, image)
+			}
+			if progresser != nil {
+				progresser.Done()
+			}
+		}
+		if len(expected) == 0 {
+			// Source without image (not loaded ?), its cache is kept
+			continue
+		}
+		filepath.Walk(filepath.Join(fm.reducer.GetCache(), name), func(path string, info os.FileInfo, err error) error {
+			// Files starting with a dot are temporary files of a running resize
+			if _, exist := expected[path]; err == nil && !info.IsDir() && !exist && !strings.HasPrefix(info.Name(), ".") {
+				report.Orphans = append(report.Orphans, path)
+			}
+			return nil
+		})
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Corrupt)
+	sort.Strings(report.Orphans)
+	return report, images
+}
+
+// repairCache remove corrupt images and orphans and resize again images with missing reduced images, wait end of resize
+func (fm *FoldersManager) repairCache(report *CacheReport, images []imageToRegenerate, progresser *progress.UploadProgress) {
+	for _, path := range report.Corrupt {
+		if err := os.Remove(path); err != nil {
+			logger.GetLogger2().Error("Impossible to remove", path, err)
+		}
+	}
+	// Images added since verification may use an orphan, they are checked again under lock
+	updateLocker.Lock()
+	expected := make(map[string]struct{})
+	for _, cachedImages := range fm.cachedImages() {
+		for _, cached := range cachedImages {
+			for _, path := range cached.files {
+				expected[path] = struct{}{}
+			}
+		}
+	}
+	for _, path := range report.Orphans {
+		if _, exist := expected[path]; exist {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			logger.GetLogger2().Error("Impossible to remove", path, err)
+		} else {
+			report.Removed++
+		}
+	}
+	absolutePaths := make([]string, len(images))
+	for i, image := range images {
+		absolutePaths[i] = image.node.GetAbsolutePath(fm.Sources)
+	}
+	updateLocker.Unlock()
+	if progresser != nil {
+		// Repair is a step by image, complete images have nothing to do
+		for i := len(images); i < report.Images; i++ {
+			progresser.Done()
+		}
+	}
+	if len(images) == 0 {
+		return
+	}
+	progresser.EnableWaiter()
+	progresser.Add(len(images))
+	nodes := make([]*Node, 0, len(images))
+	for i, image := range images {
+		fm.reducer.AddImage(absolutePaths[i], image.node.RelativePath, image.node, progresser, image.existings, false)
+		nodes = append(nodes, image.node)
+	}
+	progresser.Wait()
+	updateLocker.Lock()
+	defer updateLocker.Unlock()
+	fm.saveNodes(nil, nodes, false)
+	report.Repaired = len(images)
+}
+
+// CheckCache verify cache and repair it if not dry run. Report is sent to progresser when done
+func (fm *FoldersManager) CheckCache(dryRun bool, progresser *progress.UploadProgress) *CacheReport {
+	report, images := fm.verifyCache(progresser)
+	report.DryRun = dryRun
+	logger.GetLogger2().Info("Cache verified :", report.Images, "images,", len(report.Missing), "missing,", len(report.Corrupt), "corrupt and", len(report.Orphans), "orphans")
+	if !dryRun {
+		fm.repairCache(report, images, progresser)
+		logger.GetLogger2().Info("Cache repaired :", report.Repaired, "images resized again and", report.Removed, "orphans removed")
+	}
+	lastCacheReport.Lock()
+	lastCacheReport.report = report
+	lastCacheReport.Unlock()
+	return report
+}
+
+// LaunchCacheCheck verify and repair cache in background, report is sent in SSE of progresser and kept for GetCacheReport
+func (fm *FoldersManager) LaunchCacheCheck(dryRun bool) (*progress.UploadProgress, error) {
+	if !cacheCheckLocker.TryLock() {
+		return nil, errors.New("verification of cache is already running")
+	}
+	updateLocker.Lock()
+	images := fm.countImages()
+	updateLocker.Unlock()
+	progresser := fm.uploadProgressManager.AddTask(cacheCheckSteps(images, dryRun))
+	go func() {
+		defer cacheCheckLocker.Unlock()
+		report := fm.CheckCache(dryRun, progresser)
+		progresser.Report(report)
+		progresser.End()
+	}()
+	return progresser, nil
+}
+
+// cacheCheckSteps return number of steps of progress : verification of each image and, if not dry run, its repair
+func cacheCheckSteps(images int, dryRun bool) int {
+	if dryRun {
+		return images
+	}
+	return images * 2
+}
+
+// RunCacheCheck verify and repair cache from command line, fail if server is running
+func RunCacheCheck(conf *config.Config, dryRun bool) (*CacheReport, error) {
+	fm, err := loadFoldersManager(*conf)
+	if err != nil {
+		return nil, err
+	}
+	return fm.CheckCache(dryRun, progress.NewUploadProgressManager().AddTask(cacheCheckSteps(fm.countImages(), dryRun))), nil
+}
+
+// loadFoldersManager only read tree of images, nothing is saved, resized or watched at load (unlike NewFoldersManager).
+// Server must be stopped : its port must be free and its database not locked
+func loadFoldersManager(conf config.Config) (*FoldersManager, error) {
+	if conn, err := net.DialTimeout("tcp", "localhost:"+conf.Port, time.Second); err == nil {
+		conn.Close()
+		return nil, errors.New("server is running on port " + conf.Port + ", it must be stopped")
+	}
+	stateFolder := conf.Persistence.GetFolder()
+	store, err := openNodesStore(conf.Database, stateFolder)
+	if err != nil {
+		return nil, err
+	}
+	fm := &FoldersManager{reducer: NewReducer(conf), store: store, stateFolder: stateFolder}
+	fm.load(conf.Sources)
+	return fm, nil
+}
+
+// GetCacheReport return report of last verification, nil if never launched
+func GetCacheReport() *CacheReport {
+	lastCacheReport.Lock()
+	defer lastCacheReport.Unlock()
+	return lastCacheReport.report
+}
+
+func (fm *FoldersManager) countImages() int {
+	count := 0
+	for _, source := range fm.Sources {
+		for _, node := range source.Files {
+			if node.IsFolder {
+				node.applyOnEach(fm.Sources, func(_, _ string, _ *Node) { count++ })
+			} else {
+				count++
+			}
+		}
+	}
+	return count
+}
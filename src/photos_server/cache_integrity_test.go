@@ -0,0 +1,58 @@
+package photos_server
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jotitan/photos_server/config"
+)
+
+func TestCheckCache(t *testing.T) {
+	cache := t.TempDir()
+	first := &Node{Name: "a.jpg", RelativePath: "/src/folder/a.jpg"}
+	second := &Node{Name: "b.jpg", RelativePath: "/src/folder/b.jpg"}
+	sources := SourceNodes{"src": &SourceNode{Name: "src", Folder: "/photos/src", Files: Files{
+		"folder": &Node{Name: "folder", RelativePath: "/src/folder", IsFolder: true, Files: Files{"a.jpg": first, "b.jpg": second}}}}}
+	fm := &FoldersManager{Sources: sources, reducer: ImageReducer{cache: cache, profiles: newResizeProfiles(config.Config{CacheFolder: cache})}}
+
+	valid := bytes.Buffer{}
+	jpeg.Encode(&valid, image.NewGray(image.Rect(0, 0, 20, 10)), nil)
+	folder := filepath.Join(cache, "src", "folder")
+	os.MkdirAll(folder, os.ModePerm)
+	files := map[string][]byte{"a-1080.jpg": valid.Bytes(), "a-250.jpg": []byte("truncated"), "b-1080.jpg": valid.Bytes(), "c-1080.jpg": valid.Bytes(),
+		"a-square.jpg": valid.Bytes(), "b-square.jpg": valid.Bytes(), "d-1080.jpg": valid.Bytes(), ".b-250-123.jpg": []byte("writing")}
+	for name, data := range files {
+		os.WriteFile(filepath.Join(folder, name), data, os.ModePerm)
+	}
+
+	report, images := fm.verifyCache(nil)
+	if report.Images != 2 || len(images) != 2 {
+		t.Fatal("both images must be resized again", report.Images, len(images))
+	}
+	if len(report.Missing) != 1 || report.Missing[0] != filepath.Join(folder, "b-250.jpg") {
+		t.Error("small image of b must be missing", report.Missing)
+	}
+	if len(report.Corrupt) != 1 || report.Corrupt[0] != filepath.Join(folder, "a-250.jpg") {
+		t.Error("small image of a must be corrupt", report.Corrupt)
+	}
+	if len(report.Orphans) != 2 || report.Orphans[0] != filepath.Join(folder, "c-1080.jpg") || report.Orphans[1] != filepath.Join(folder, "d-1080.jpg") {
+		t.Error("images without original must be orphans, not temporary files", report.Orphans)
+	}
+
+	// Corrupt and orphan images are removed, valid ones and images of a photo added since verification are kept
+	sources["src"].Files["folder"].Files["d.jpg"] = &Node{Name: "d.jpg", RelativePath: "/src/folder/d.jpg"}
+	fm.repairCache(report, nil, nil)
+	for name := range files {
+		_, err := os.Stat(filepath.Join(folder, name))
+		if removed := name == "a-250.jpg" || name == "c-1080.jpg"; removed != (err != nil) {
+			t.Error("bad state after repair of", name, err)
+		}
+	}
+	if report.Removed != 1 {
+		t.Error("one orphan must be removed but found", report.Removed)
+	}
+}
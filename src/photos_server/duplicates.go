@@ -0,0 +1,144 @@
+package photos_server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jotitan/photos_server/logger"
+	"github.com/jotitan/photos_server/resize"
+)
+
+/* Detect same images stored in many places with a hash of original file content */
+
+type DuplicateImage struct {
+	Path   string
+	Date   time.Time
+	Width  int
+	Height int
+}
+
+type DuplicateGroup struct {
+	Hash   string
+	Images []DuplicateImage
+}
+
+func computeHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (fm *FoldersManager) setHash(absolutePath string, node *Node) {
+	if hash, err := computeHash(absolutePath); err == nil {
+		node.Hash = hash
+	} else {
+		logger.GetLogger2().Error("Impossible to compute hash of", absolutePath, err)
+	}
+}
+
+func (fm *FoldersManager) getHashIndex() map[string][]*Node {
+	if fm.hashIndex == nil {
+		index := make(map[string][]*Node)
+		for _, src := range fm.Sources {
+			for _, folder := range src.Files {
+				addToHashIndex(folder, index)
+			}
+		}
+		fm.hashIndex = index
+	}
+	return fm.hashIndex
+}
+
+func addToHashIndex(node *Node, index map[string][]*Node) {
+	if !node.IsFolder {
+		if node.Hash != "" {
+			index[node.Hash] = append(index[node.Hash], node)
+		}
+		return
+	}
+	for _, file := range node.Files {
+		addToHashIndex(file, index)
+	}
+}
+
+// GetDuplicates return groups of images with same content
+func (fm *FoldersManager) GetDuplicates() []DuplicateGroup {
+	groups := make([]DuplicateGroup, 0)
+	for hash, nodes := range fm.getHashIndex() {
+		if len(nodes) < 2 {
+			continue
+		}
+		images := make([]DuplicateImage, len(nodes))
+		for i, node := range nodes {
+			images[i] = DuplicateImage{Path: node.RelativePath, Date: node.Date, Width: node.Width, Height: node.Height}
+		}
+		sort.Slice(images, func(i, j int) bool { return images[i].Path < images[j].Path })
+		groups = append(groups, DuplicateGroup{Hash: hash, Images: images})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Images[0].Path < groups[j].Images[0].Path })
+	return groups
+}
+
+// RemoveDuplicates move selected copies to garbage. At least one copy of each image must be kept
+func (fm *FoldersManager) RemoveDuplicates(paths []string) (int, error) {
+	if fm.garbageManager == nil {
+		return 0, errors.New("garbage is not available")
+	}
+	index := fm.getHashIndex()
+	removedByHash := make(map[string]int)
+	for _, path := range paths {
+		node, _, err := fm.FindNode(path)
+		if err != nil {
+			return 0, err
+		}
+		if node.Hash == "" || len(index[node.Hash]) < 2 {
+			return 0, errors.New("image " + path + " is not a duplicate")
+		}
+		removedByHash[node.Hash]++
+		if removedByHash[node.Hash] >= len(index[node.Hash]) {
+			return 0, errors.New("impossible to remove all copies of " + path)
+		}
+	}
+	return fm.garbageManager.Remove(paths), nil
+}
+
+// ComputeMissingHashes compute hash and perceptual hash of images indexed before hashes exist, tree is locked during computation
+func (fm *FoldersManager) ComputeMissingHashes() int {
+	updateLocker.Lock()
+	defer updateLocker.Unlock()
+	updated := make([]*Node, 0)
+	for _, src := range fm.Sources {
+		for _, folder := range src.Files {
+			folder.applyOnEach(fm.Sources, func(absolutePath, _ string, node *Node) {
+				changed := false
+				if node.Hash == "" {
+					fm.setHash(absolutePath, node)
+					changed = node.Hash != ""
+				}
+				if node.PHash == "" {
+					node.PHash, _ = resize.DHash(filepath.Join(fm.reducer.GetCache(), fm.GetSmallImageName(*node)))
+					changed = changed || node.PHash != ""
+				}
+				if changed {
+					updated = append(updated, node)
+				}
+			})
+		}
+	}
+	fm.saveNodes(nil, updated, false)
+	logger.GetLogger2().Info("Compute hash of", len(updated), "images")
+	return len(updated)
+}
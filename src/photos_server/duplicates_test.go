@@ -0,0 +1,53 @@
+package photos_server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetDuplicates(t *testing.T) {
+	fm, folder, _ := createFakeStructure(t)
+	// Same content for two images in different folders
+	os.WriteFile(filepath.Join(folder, "root", "folder2", "fifth.txt"), []byte("same"), os.ModePerm)
+	os.WriteFile(filepath.Join(folder, "root", "folder1", "first.txt"), []byte("same"), os.ModePerm)
+
+	if nb := fm.ComputeMissingHashes(); nb != 5 {
+		t.Error("Must compute 5 hashes but found", nb)
+	}
+	duplicates := fm.GetDuplicates()
+	if len(duplicates) != 1 || len(duplicates[0].Images) != 2 {
+		t.Fatal("Must find one group of two images", duplicates)
+	}
+	if filepath.Base(duplicates[0].Images[0].Path) != "first.txt" {
+		t.Error("Bad duplicate", duplicates[0].Images[0].Path)
+	}
+	if fm.ComputeMissingHashes() != 0 {
+		t.Error("Hashes must not be computed twice")
+	}
+}
+
+func TestGetSimilarImages(t *testing.T) {
+	fm, _, _ := createFakeStructure(t)
+	folder1 := fm.Sources["root"].Files["folder1"].Files
+	folder2 := fm.Sources["root"].Files["folder2"].Files
+	// first and second differ by one bit, third is far
+	folder1["first.txt"].PHash = "f0f0f0f0f0f0f0f0"
+	folder1["second.txt"].PHash = "f0f0f0f0f0f0f0f1"
+	folder1["third.txt"].PHash = "0f0f0f0f0f0f0f0f"
+	folder2["fifth.txt"].PHash = "f0f0f0f0f0f0f0f3"
+	folder2["quater.txt"].Width, folder2["quater.txt"].Height = 0, 0
+	folder2["fifth.txt"].Width, folder2["fifth.txt"].Height = 100, 100
+
+	groups, _ := fm.GetSimilarImages("", 2, 0)
+	if len(groups) != 1 || len(groups[0].Images) != 3 {
+		t.Fatal("Must find one group of 3 images", groups)
+	}
+	if filepath.Base(groups[0].Best) != "fifth.txt" {
+		t.Error("Best image must be the biggest", groups[0].Best)
+	}
+	groups, _ = fm.GetSimilarImages("/root/folder1", 2, 0)
+	if len(groups) != 1 || len(groups[0].Images) != 2 {
+		t.Error("Must find one group of 2 images in folder", groups)
+	}
+}
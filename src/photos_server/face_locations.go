@@ -0,0 +1,127 @@
+package photos_server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jotitan/photos_server/logger"
+	"github.com/jotitan/photos_server/persistence"
+	"github.com/jotitan/photos_server/progress"
+	"github.com/jotitan/photos_server/resize"
+)
+
+/* Locations of faces found by face detector, used to crop square thumbnails around faces.
+Faces are found on reduced images, they are saved in cache (faces.json) by path of photo without extension */
+
+const facesFile = "faces.json"
+
+type faceLocations struct {
+	path   string
+	locker sync.Mutex
+	faces  map[string][]resize.FaceBox
+}
+
+func newFaceLocations(cache string) *faceLocations {
+	fl := &faceLocations{faces: make(map[string][]resize.FaceBox)}
+	if cache == "" {
+		return fl
+	}
+	fl.path = filepath.Join(cache, facesFile)
+	if data, err := os.ReadFile(fl.path); err == nil {
+		if err := json.Unmarshal(data, &fl.faces); err != nil {
+			logger.GetLogger2().Error("Impossible to read faces locations", err)
+		}
+	}
+	return fl
+}
+
+// faceKey return path of photo without extension, same for a RAW and its reduced images
+func faceKey(relativePath string) string {
+	relativePath = filepath.ToSlash(relativePath)
+	return strings.TrimSuffix(relativePath, filepath.Ext(relativePath))
+}
+
+// setFolder replace faces of photos of folder, faces are by name of image
+func (fl *faceLocations) setFolder(folder string, faces map[string][]resize.FaceBox) error {
+	fl.locker.Lock()
+	defer fl.locker.Unlock()
+	prefix := faceKey(folder) + "/"
+	for key := range fl.faces {
+		if strings.HasPrefix(key, prefix) && !strings.Contains(key[len(prefix):], "/") {
+			delete(fl.faces, key)
+		}
+	}
+	for name, boxes := range faces {
+		fl.faces[faceKey(filepath.Join(folder, name))] = boxes
+	}
+	if fl.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(fl.faces)
+	if err != nil {
+		return err
+	}
+	return persistence.WriteFile(fl.path, data)
+}
+
+// get return faces of a photo, nil if none
+func (fl *faceLocations) get(relativePath string) []resize.FaceBox {
+	if fl == nil {
+		return nil
+	}
+	fl.locker.Lock()
+	defer fl.locker.Unlock()
+	return fl.faces[faceKey(relativePath)]
+}
+
+// UpdateFaces save faces found in photos of folder and crop again smart thumbnails of these photos in background
+func (fm *FoldersManager) UpdateFaces(folder *Node, faces map[string][]resize.FaceBox) *progress.UploadProgress {
+	fm.reducer.SetFaces(folder.RelativePath, faces)
+	// Names are names of reduced images, extension can differ from original
+	names := make(map[string]struct{}, len(faces))
+	for name := range faces {
+		names[faceKey(name)] = struct{}{}
+	}
+	nodes := make([]*Node, 0, len(faces))
+	for _, node := range folder.Files {
+		if _, exist := names[faceKey(node.Name)]; exist && !node.IsFolder {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 || fm.reducer.GetCache() == "" {
+		return nil
+	}
+	progresser := fm.uploadProgressManager.AddTask(len(nodes))
+	progresser.EnableWaiter()
+	progresser.Add(len(nodes))
+	go func() {
+		folder := filepath.Join(fm.reducer.GetCache(), filepath.Dir(nodes[0].RelativePath))
+		// Tree is read under lock, resize is not waited with it
+		updateLocker.Lock()
+		absolutePaths := make([]string, len(nodes))
+		for i, node := range nodes {
+			absolutePaths[i] = node.GetAbsolutePath(fm.Sources)
+		}
+		updateLocker.Unlock()
+		for i, node := range nodes {
+			existings := fm.existingReducedImages(node)
+			profiles := fm.reducer.GetProfiles(node.RelativePath)
+			for _, profile := range profiles {
+				if isSmartCrop(profile) {
+					delete(existings, createProfileFile(fm.reducer, folder, node.RelativePath, profile, profiles))
+				}
+			}
+			fm.reducer.AddImage(absolutePaths[i], node.RelativePath, node, progresser, existings, false)
+		}
+		progresser.Wait()
+		progresser.End()
+		updateLocker.Lock()
+		defer updateLocker.Unlock()
+		fm.saveNodes(nil, nodes, false)
+		logger.GetLogger2().Info("End of crop on faces of", len(nodes), "images")
+	}()
+	return progresser
+}
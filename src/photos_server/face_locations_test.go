@@ -0,0 +1,35 @@
+package photos_server
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jotitan/photos_server/resize"
+)
+
+func TestFaceLocations(t *testing.T) {
+	cache := t.TempDir()
+	fl := newFaceLocations(cache)
+	box := resize.FaceBox{X: 0.2, Y: 0.1, Width: 0.3, Height: 0.2}
+	fl.setFolder("/src/folder", map[string][]resize.FaceBox{"a.jpg": {box}, "b.jpg": {box, box}})
+	fl.setFolder("/src/folder/sub", map[string][]resize.FaceBox{"c.jpg": {box}})
+	if faces := fl.get("/src/folder/a.CR2"); len(faces) != 1 || faces[0].X != 0.2 || faces[0].Height != 0.2 {
+		t.Error("faces found on reduced image must be used for original", faces)
+	}
+
+	// Detection of folder again replaces its faces only
+	fl.setFolder("/src/folder", map[string][]resize.FaceBox{"b.jpg": {box}})
+	fl = newFaceLocations(cache)
+	if len(fl.get("/src/folder/a.jpg")) != 0 || len(fl.get("/src/folder/b.jpg")) != 1 || len(fl.get("/src/folder/sub/c.jpg")) != 1 {
+		t.Error("faces must be replaced in folder and saved", fl.faces)
+	}
+
+	conversion := toConversion(ImageReducer{}, "folder", "/src/a.jpg", defaultProfiles[indexOfProfile(defaultProfiles, squareProfile)], defaultProfiles)
+	if !conversion.Crop || !conversion.Smart || conversion.To != filepath.Join("folder", "a-square.jpg") {
+		t.Error("square profile must be a smart crop", conversion)
+	}
+	var nilLocations *faceLocations
+	if nilLocations.get("/src/a.jpg") != nil {
+		t.Error("no faces without locations")
+	}
+}
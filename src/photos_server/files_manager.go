@@ -1,13 +1,15 @@
 package photos_server
 
 import (
-	"encoding/json"
 	"errors"
 	"github.com/jotitan/photos_server/common"
 	"github.com/jotitan/photos_server/config"
+	"github.com/jotitan/photos_server/geo"
 	"github.com/jotitan/photos_server/logger"
+	"github.com/jotitan/photos_server/persistence"
 	"github.com/jotitan/photos_server/progress"
 	"github.com/jotitan/photos_server/resize"
+	"github.com/jotitan/photos_server/storage"
 	"io"
 	"log"
 	"math"
@@ -40,23 +42,68 @@ type FoldersManager struct {
 	// When upload file, override first folder in tree (to force to be in a specific one)
 	//overrideUploadFolder  string
 	tagManger             *TagManager
+	albumManager          *AlbumManager
+	ratingsManager        *RatingsManager
 	uploadProgressManager *progress.UploadProgressManager
 	nextFolderId          int
 	Mirroring             Mirroring
+	store                 NodesStore
+	// Images by content hash, lazy loaded
+	hashIndex map[string][]*Node
+	// Images by perceptual hash, lazy loaded
+	similarIndex *bkTree
+	// Images with gps position, lazy loaded
+	geoIndex *geo.Index
+	// Photos by place name, lazy loaded
+	placeIndex map[string]map[string]*Node
+	geocoder   *geo.ReverseGeocoder
+	// Words of titles, names, tags and peoples, lazy loaded
+	searchIndex *searchIndex
+	// Refuse uploads when quota is exceeded, nil if not defined
+	storage *storage.StorageManager
+	// Folder of state files (tree, tags, albums, ratings)
+	stateFolder string
 }
 
 func NewFoldersManager(conf config.Config, uploadProgressManager *progress.UploadProgressManager) *FoldersManager {
-	fm := &FoldersManager{reducer: NewReducer(conf, []uint{1080, 250}),
+	stateFolder := conf.Persistence.GetFolder()
+	fm := &FoldersManager{reducer: NewReducer(conf),
 		UploadedFolder:        conf.UploadedFolder,
-		uploadProgressManager: uploadProgressManager}
-	fm.load(conf.Sources)
+		uploadProgressManager: uploadProgressManager,
+		store:                 newNodesStore(conf.Database, stateFolder),
+		geocoder:              newReverseGeocoder(conf.Geocoding),
+		stateFolder:           stateFolder}
+	sourcesAdded := fm.load(conf.Sources)
+	if store, isJson := fm.store.(jsonNodesStore); isJson {
+		persistence.Register("photos", store.path, func() error {
+			updateLocker.Lock()
+			defer updateLocker.Unlock()
+			fm.load(conf.Sources)
+			fm.resetIndexes()
+			return nil
+		})
+	}
 	fm.updateNextFolderId()
 	logger.GetLogger2().Info("Next folder id", fm.nextFolderId)
 	fm.detectMissingFoldersId()
+	fm.ResolveMissingPlaces()
 	fm.garbageManager = NewGarbageManager(conf.Garbage, conf.Security.MaskForAdmin, fm)
 	fm.tagManger = NewTagManager(fm)
+	fm.albumManager = NewAlbumManager(stateFolder)
+	fm.ratingsManager = NewRatingsManager(stateFolder)
 	fm.Mirroring = newMirroring(conf.Mirroring)
-	fm.save()
+	if sourcesAdded {
+		// Tree is saved incrementally, only new sources need to be written
+		fm.save()
+	}
+	changed, removed := fm.updateProfilesState()
+	fm.removeProfilesFiles(removed)
+	if changed {
+		logger.GetLogger2().Info("Resize profiles changed, regenerate reduced images")
+		if _, err := fm.RegenerateProfiles(); err != nil {
+			logger.GetLogger2().Error(err.Error())
+		}
+	}
 	return fm
 }
 
@@ -84,13 +131,15 @@ func (fm *FoldersManager) MoveFolder(pathFrom, pathTo string) error {
 	moveEachPaths(node, formatPathFrom, formatPathTo)
 
 	// Change tree
-	fm.moveNode(pathTo, node)
+	attachedNode := fm.moveNode(pathTo, node)
 	delete(siblings, filepath.Base(pathFrom))
 
 	fm.tagManger.UpdateExistingPath(pathFrom, pathTo)
 	fm.tagManger.flush()
+	fm.albumManager.UpdateExistingPath(pathFrom, pathTo)
+	fm.ratingsManager.UpdateExistingPath(pathFrom, pathTo)
 
-	fm.save()
+	fm.saveNodes([]string{pathFrom}, []*Node{attachedNode}, true)
 
 	// Move folder really (original and cache)
 	err = moveSourceFolder(previousFolder, nextPath)
@@ -120,6 +169,7 @@ func moveEachPaths(node *Node, pathFrom, pathTo string) {
 	}
 }
 
+// moveNode attach node in tree, create missing parents and return the highest node attached
 func (fm *FoldersManager) moveNode(path string, node *Node) *Node {
 	parent := filepath.Dir(path)
 	parentNode, _, err := fm.FindNode(strings.ReplaceAll(parent, "\\", "/"))
@@ -127,6 +177,11 @@ func (fm *FoldersManager) moveNode(path string, node *Node) *Node {
 		parentNode.Files[filepath.Base(path)] = node
 		return node
 	}
+	// Parent is the source itself
+	if source, subPath, err := fm.Sources.getSourceFromPath(parent); err == nil && strings.EqualFold("", subPath) {
+		source.Files[filepath.Base(path)] = node
+		return node
+	}
 	// Launch on parent and create missing folder
 	folder := NewFolderWithRel(filepath.Dir(node.GetAbsolutePath(fm.Sources)), "/"+parent, filepath.Base(parent), map[string]*Node{filepath.Base(path): node}, false)
 	return fm.moveNode(parent, folder)
@@ -164,8 +219,14 @@ func (fm *FoldersManager) GetAllDates() []common.NodeByDate {
 	return dates
 }
 
-func (fm *FoldersManager) resetPhotosByDate() {
+// resetIndexes clean indexes computed from tree, rebuilt at next use
+func (fm *FoldersManager) resetIndexes() {
 	fm.PhotosByDate = nil
+	fm.hashIndex = nil
+	fm.similarIndex = nil
+	fm.geoIndex = nil
+	fm.placeIndex = nil
+	fm.searchIndex = nil
 }
 
 // Update exif of all photos of a specific date
@@ -179,18 +240,22 @@ func (fm *FoldersManager) updateExifOfDate(date string) (int, error) {
 		if !exist {
 			return 0, errors.New("impossible to find images for this date")
 		}
+		updatedNodes := make([]*Node, 0, len(nodes))
 		for _, node := range nodes {
 			n := node.(*Node)
+			updatedNodes = append(updatedNodes, n)
 			// extract again exif date and update node
 			path := n.GetAbsolutePath(fm.Sources)
-			n.Date, _ = GetExif(path)
+			n.Date, _, n.Metadata = ReadExif(path)
+			n.Place = nil
+			fm.resolvePlace(n)
 			if n.Width == 0 {
 				path := filepath.Join(fm.reducer.GetCache(), fm.GetSmallImageName(*n))
 				n.Width, n.Height = resize.GetSizeAsInt(path)
 			}
 			logger.GetLogger2().Info("Found date", n.Date, "for path", path)
 		}
-		fm.save()
+		fm.saveNodes(nil, updatedNodes, false)
 		return len(nodes), nil
 	}
 }
@@ -213,11 +278,16 @@ func (fm *FoldersManager) GetPhotosByDate() map[time.Time][]common.INode {
 }
 
 func (fm FoldersManager) GetSmallImageName(node Node) string {
-	return fm.reducer.CreateJpegFile(filepath.Dir(node.RelativePath), node.RelativePath, fm.reducer.GetSizes()[1])
+	return fm.getProfileImageName(node, smallProfile)
 }
 
 func (fm FoldersManager) GetMiddleImageName(node Node) string {
-	return fm.reducer.CreateJpegFile(filepath.Dir(node.RelativePath), node.RelativePath, fm.reducer.GetSizes()[0])
+	return fm.getProfileImageName(node, middleProfile)
+}
+
+// GetPreviewImageName return JPEG created from a RAW file without paired image or from a HEIC file
+func (fm FoldersManager) GetPreviewImageName(node Node) string {
+	return createPreviewFile(filepath.Dir(node.RelativePath), node.RelativePath)
 }
 
 var extensions = []string{"jpg", "jpeg", "png"}
@@ -244,6 +314,10 @@ func (files Files) Compare(previousFiles Files) ([]*Node, map[string]*Node, []*N
 				file.Width = oldValue.Width
 				file.Date = oldValue.Date
 				file.ImagesResized = oldValue.ImagesResized
+				file.Hash = oldValue.Hash
+				file.PHash = oldValue.PHash
+				file.Metadata = oldValue.Metadata
+				file.Place = oldValue.Place
 				noChangesNodes = append(noChangesNodes, oldValue)
 			} else {
 				// Relaunch on folder
@@ -286,6 +360,40 @@ func (files Files) Compare(previousFiles Files) ([]*Node, map[string]*Node, []*N
 // Add a locker to check if an update is running
 var updateLocker = sync.Mutex{}
 
+// Folders written by running uploads (absolute path with number of uploads), ignored by folder watcher
+var uploadingFolders = struct {
+	sync.Mutex
+	folders map[string]int
+}{folders: make(map[string]int)}
+
+func startUploading(folder string) {
+	uploadingFolders.Lock()
+	defer uploadingFolders.Unlock()
+	uploadingFolders.folders[filepath.Clean(folder)]++
+}
+
+func endUploading(folder string) {
+	uploadingFolders.Lock()
+	defer uploadingFolders.Unlock()
+	folder = filepath.Clean(folder)
+	if uploadingFolders.folders[folder]--; uploadingFolders.folders[folder] <= 0 {
+		delete(uploadingFolders.folders, folder)
+	}
+}
+
+// isUploading return true if path is a folder written by an upload or is inside
+func isUploading(path string) bool {
+	uploadingFolders.Lock()
+	defer uploadingFolders.Unlock()
+	path = filepath.Clean(path)
+	for folder := range uploadingFolders.folders {
+		if path == folder || strings.HasPrefix(path, folder+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
 // UpdateFolder : only update one folder
 func (fm *FoldersManager) UpdateFolder(path string, progresser *progress.UploadProgress) error {
 	if node, _, err := fm.FindNode(path); err != nil {
@@ -297,9 +405,11 @@ func (fm *FoldersManager) UpdateFolder(path string, progresser *progress.UploadP
 		if t, exists := files[filepath.Base(path)]; exists {
 			files = t.Files
 		}
+		// RAW uploaded or detected by watcher next to an existing image is merged with it
+		pairRawFiles(files)
 		fm.compareAndCleanFolder(files, path, make(map[string]*Node), progresser)
 		node.Files = files
-		fm.save()
+		fm.saveNodes([]string{path}, []*Node{node}, true)
 		return nil
 	}
 }
@@ -324,15 +434,16 @@ func (fm *FoldersManager) UpdateExif(path string, forceSize bool) error {
 		if folderNode := getOnlyElementFromMap(files); folderNode != nil && folderNode.IsFolder {
 			_, _, noChanges := folderNode.Files.Compare(node.Files)
 			for _, file := range noChanges {
-				datePhoto, _ := GetExif(file.GetAbsolutePath(fm.Sources))
-				file.Date = datePhoto
+				file.Date, _, file.Metadata = ReadExif(file.GetAbsolutePath(fm.Sources))
+				file.Place = nil
+				fm.resolvePlace(file)
 				if forceSize || file.Width == 0 {
 					path := filepath.Join(fm.reducer.GetCache(), fm.GetSmallImageName(*file))
 					file.Width, file.Height = resize.GetSizeAsInt(path)
 					logger.GetLogger2().Info("Update exif size", path, file.Width, file.Height)
 				}
 			}
-			fm.save()
+			fm.saveNodes(nil, noChanges, false)
 			return nil
 		} else {
 			return errors.New("impossible to update exif")
@@ -360,10 +471,14 @@ func (fm *FoldersManager) compareAndCleanFolder(files Files, folderPath string,
 		for _, node := range delta {
 			absolutePath := node.GetAbsolutePath(fm.Sources)
 			logger.GetLogger2().Info("Launch update image resize", absolutePath)
+			fm.setHash(absolutePath, node)
 			fm.reducer.AddImage(absolutePath, node.RelativePath, node, progresser, existings, false)
 		}
 		progresser.Wait()
 		logger.GetLogger2().Info("All pictures have been resized")
+		for _, node := range delta {
+			fm.resolvePlace(node)
+		}
 	}
 
 	// remove deletions in cache
@@ -428,7 +543,46 @@ func (fm *FoldersManager) RemoveNode(path string) error {
 			return errors.New("impossible to remove not empty folder")
 		}
 		delete(parent, node.Name)
-		fm.save()
+		fm.saveNodes([]string{path}, nil, false)
+	}
+	return nil
+}
+
+// removeDeletedFolder remove from tree a folder which doesn't exist anymore on disk, with its resized images
+func (fm *FoldersManager) removeDeletedFolder(path string) error {
+	node, parent, err := fm.FindNode(path)
+	if err != nil {
+		return err
+	}
+	node.applyOnEach(fm.Sources, func(_, _ string, image *Node) {
+		fm.removeFilesNode(image)
+	})
+	delete(parent, node.Name)
+	fm.saveNodes([]string{path}, nil, false)
+	return nil
+}
+
+// findFolderById return folder with id, nil if not found
+func (fm *FoldersManager) findFolderById(id int) *Node {
+	for _, src := range fm.Sources {
+		if folder := findFolderByIdIn(src.Files, id); folder != nil {
+			return folder
+		}
+	}
+	return nil
+}
+
+func findFolderByIdIn(files Files, id int) *Node {
+	for _, node := range files {
+		if !node.IsFolder {
+			continue
+		}
+		if node.Id == id {
+			return node
+		}
+		if folder := findFolderByIdIn(node.Files, id); folder != nil {
+			return folder
+		}
 	}
 	return nil
 }
@@ -475,7 +629,7 @@ func createRelativePath(source, path string) string {
 	return strings.ReplaceAll(source+"/"+path, "\\", "/")
 }
 
-func (fm FoldersManager) FindNode(path string) (*Node, map[string]*Node, error) {
+func (fm *FoldersManager) FindNode(path string) (*Node, map[string]*Node, error) {
 	source, subPath, err := fm.Sources.getSourceFromPath(path)
 	// Source not found
 	if err != nil {
@@ -483,7 +637,7 @@ func (fm FoldersManager) FindNode(path string) (*Node, map[string]*Node, error)
 	}
 	return findNodeFromList(source.Files, subPath)
 }
-func (fm FoldersManager) FindNodeAndSub(path string) (*Node, string, error) {
+func (fm *FoldersManager) FindNodeAndSub(path string) (*Node, string, error) {
 	source, subPath, err := fm.Sources.getSourceFromPath(path)
 	// Source not found
 	if err != nil {
@@ -537,6 +691,9 @@ func (fm FoldersManager) removeFiles(files map[string]*Node) {
 }
 
 func (fm FoldersManager) removeFilesNode(node *Node) error {
+	if node.HasPreview() {
+		fm.removeFile(filepath.Join(fm.reducer.GetCache(), fm.GetPreviewImageName(*node)))
+	}
 	if err := fm.removeFile(filepath.Join(fm.reducer.GetCache(), fm.GetSmallImageName(*node))); err == nil {
 		return fm.removeFile(filepath.Join(fm.reducer.GetCache(), fm.GetMiddleImageName(*node)))
 	} else {
@@ -565,6 +722,7 @@ func (fm *FoldersManager) AddFolderToNode(absolutePath, relativePath string, for
 	}
 	// Update metadata
 	node.Files = nodeWithFiles.Files
+	pairRawFiles(node.Files)
 	node.IsFolder = true
 	node.Title = detail.title
 	node.Description = detail.description
@@ -580,7 +738,7 @@ func (fm *FoldersManager) AddFolderToNode(absolutePath, relativePath string, for
 
 	fm.launchImageResize(node, detail.source, p, existings, forceRotate)
 
-	fm.save()
+	fm.saveNodes([]string{node.RelativePath}, []*Node{node}, true)
 	return nil
 }
 
@@ -662,38 +820,27 @@ func (fm *FoldersManager) detectMissingFoldersId() {
 	}
 }
 
-func (fm *FoldersManager) load(sources []config.Source) {
-	folders := make(map[string]*SourceNode, 0)
-	if f, err := os.Open(getSavePath()); err == nil {
-		defer f.Close()
-		data, _ := io.ReadAll(f)
-		json.Unmarshal(data, &folders)
-		fm.Sources = folders
-		// Check if new sources are available
-		for _, source := range sources {
-			if src, exists := fm.Sources[source.Name]; !exists {
-				fm.Sources[source.Name] = &SourceNode{Name: source.Name, Folder: source.Folder, Files: make(map[string]*Node)}
-			} else {
-				if src.Files == nil {
-					src.Files = make(map[string]*Node)
-				}
-			}
-		}
-	} else {
-		logger.GetLogger2().Error("Impossible to read saved config", getSavePath(), err)
-		// Initialize folders with sources if exists
-		if len(sources) > 0 {
-			for _, source := range sources {
-				folders[source.Name] = &SourceNode{Name: source.Name, Folder: source.Folder, Files: make(map[string]*Node)}
+// load read saved tree and add new sources of configuration, return true if a source has been added
+func (fm *FoldersManager) load(sources []config.Source) bool {
+	folders, err := fm.store.Load()
+	if err != nil {
+		logger.GetLogger2().Error("Impossible to read saved tree", err)
+		folders = make(SourceNodes)
+	}
+	fm.Sources = folders
+	added := false
+	// Check if new sources are available
+	for _, source := range sources {
+		if src, exists := fm.Sources[source.Name]; !exists {
+			fm.Sources[source.Name] = &SourceNode{Name: source.Name, Folder: source.Folder, Files: make(map[string]*Node)}
+			added = true
+		} else {
+			if src.Files == nil {
+				src.Files = make(map[string]*Node)
 			}
-			fm.Sources = folders
 		}
 	}
-}
-
-func getSavePath() string {
-	wd, _ := os.Getwd()
-	return filepath.Join(wd, "save-images.json")
+	return added
 }
 
 type detailUploadFolder struct {
@@ -718,25 +865,51 @@ func (fm *FoldersManager) UploadFolder(detail detailUploadFolder, files []multip
 		return nil, errors.New("too dangerous relative path folder with .. inside")
 	}
 
+	// Cache is only checked (nothing reserved), reduced images are created later
+	if _, err := fm.storage.Reserve(0, storage.KindCache); err != nil {
+		return nil, err
+	}
+	reservation, err := fm.storage.Reserve(filesSize(files), storage.SourceKey(detail.source))
+	if err != nil {
+		return nil, err
+	}
 	outputFolder := filepath.Join(src.Folder, detail.path)
 	if addToFolder {
 		// if already exists, source if already in the path
 		if node, _, err := fm.FindNode(detail.path); err != nil {
+			reservation.Release()
 			return nil, err
 		} else {
 			outputFolder = node.GetAbsolutePath(fm.Sources)
 		}
-	} else {
+	}
+	// Upload index files itself, watcher must not index them again
+	startUploading(outputFolder)
+	if !addToFolder {
 		if err := createFolderIfExistOrFail(outputFolder); err != nil {
+			endUploading(outputFolder)
+			reservation.Release()
 			return nil, err
 		}
 	}
 	// Create work in go routine and return a progresser status
 	progresser := fm.uploadProgressManager.AddUploader(len(files))
-	go fm.doUploadFolder(detail, outputFolder, names, files, addToFolder, progresser)
+	go fm.doUploadFolder(detail, outputFolder, names, files, addToFolder, progresser, reservation)
 	return progresser, nil
 }
 
+// filesSize return total size of uploaded files
+func filesSize(files []multipart.File) int64 {
+	size := int64(0)
+	for _, file := range files {
+		if end, err := file.Seek(0, io.SeekEnd); err == nil {
+			size += end
+			file.Seek(0, io.SeekStart)
+		}
+	}
+	return size
+}
+
 func (fm *FoldersManager) copyImagesInFolder(names []string, files []multipart.File, folder string, detail detailUploadFolder, p *progress.UploadProgress) error {
 	for i, file := range files {
 		imagePath := filepath.Join(folder, names[i])
@@ -757,15 +930,22 @@ func (fm *FoldersManager) copyImagesInFolder(names []string, files []multipart.F
 	return nil
 }
 
-func (fm *FoldersManager) doUploadFolder(detail detailUploadFolder, outputFolder string, names []string, files []multipart.File, addToFolder bool, p *progress.UploadProgress) {
+func (fm *FoldersManager) doUploadFolder(detail detailUploadFolder, outputFolder string, names []string, files []multipart.File, addToFolder bool, p *progress.UploadProgress, reservation *storage.Reservation) {
+	defer endUploading(outputFolder)
 	// Copy files on filer
 	if err := fm.copyImagesInFolder(names, files, outputFolder, detail, p); err != nil {
+		// Files already copied are counted at next computation of usage
+		reservation.Release()
 		p.Error(err)
 		return
 	}
+	reservation.Written()
 
 	// Use default source to add folder in a specific folder by default, not in root. Resize will be in default-source and path also
 	logger.GetLogger2().Info("Folder", detail.path, "well uploaded with", len(files), "files")
+	// Tree is modified under lock, like the watcher does
+	updateLocker.Lock()
+	defer updateLocker.Unlock()
 	// If photos added in existing folder, update folder, otherwise, index
 	if addToFolder {
 		if err := fm.UpdateFolder(detail.path, p); err != nil {
@@ -787,21 +967,26 @@ func createFolderIfExistOrFail(path string) error {
 	return os.MkdirAll(path, os.ModePerm)
 }
 
+// save the whole tree
 func (fm *FoldersManager) save() {
-	fm.resetPhotosByDate()
-	data, _ := json.Marshal(fm.Sources)
-	if f, err := os.OpenFile(getSavePath(), os.O_TRUNC|os.O_CREATE|os.O_RDWR, os.ModePerm); err == nil {
-		defer f.Close()
-		f.Write(data)
-		logger.GetLogger2().Info("Save tree in file", getSavePath())
-	} else {
-		logger.GetLogger2().Error("Impossible to save tree in file", getSavePath())
+	fm.resetIndexes()
+	if err := fm.store.SaveAll(fm.Sources); err != nil {
+		logger.GetLogger2().Error("Impossible to save tree", err)
+	}
+}
+
+// saveNodes only save modified nodes, delete paths first. If deep, children of nodes are also saved
+func (fm *FoldersManager) saveNodes(deletions []string, nodes []*Node, deep bool) {
+	fm.resetIndexes()
+	if err := fm.store.Update(fm.Sources, deletions, nodes, deep); err != nil {
+		logger.GetLogger2().Error("Impossible to save nodes", err)
 	}
 }
 
 func (fm *FoldersManager) launchImageResize(folder *Node, source string, p *progress.UploadProgress, existings map[string]struct{}, forceRotate bool) {
 	folder.applyOnEach(fm.Sources, func(absolutePath, relativePath string, node *Node) {
 		p.Add(1)
+		fm.setHash(absolutePath, node)
 		// Override relative path to include source
 		fm.reducer.AddImage(absolutePath, node.RelativePath, node, p, existings, forceRotate)
 	})
@@ -809,7 +994,14 @@ func (fm *FoldersManager) launchImageResize(folder *Node, source string, p *prog
 		p.Wait()
 		p.End()
 		logger.GetLogger2().Info("End of resize folder", folder.Name)
+		updateLocker.Lock()
+		defer updateLocker.Unlock()
 		node.ImagesResized = true
+		node.applyOnEach(fm.Sources, func(_, _ string, image *Node) {
+			fm.resolvePlace(image)
+		})
+		// Keep sizes and dates computed during resize
+		fm.saveNodes(nil, []*Node{node}, true)
 	}(folder)
 }
 
@@ -855,6 +1047,7 @@ func (fm FoldersManager) treatFolder(rootFolder, path, name string, file *os.Fil
 			nodes[name] = node
 		}
 	}
+	pairRawFiles(nodes)
 	if len(nodes) > 0 {
 		// If folder already exists, get informations from existing node (title, description...)
 		//folder := NewFolder(rootFolder, path, name, nodes, false)
@@ -934,7 +1127,7 @@ func (fm *FoldersManager) UpdateDetails(details FolderDto) error {
 	if node, _, err := fm.FindNode(details.Path); err == nil {
 		node.Title = details.Title
 		node.Description = details.Description
-		fm.save()
+		fm.saveNodes(nil, []*Node{node}, false)
 		return nil
 	} else {
 		return err
@@ -947,5 +1140,42 @@ func isImage(name string) bool {
 			return true
 		}
 	}
-	return false
+	return resize.IsRaw(name) || resize.IsHeic(name)
+}
+
+// pairRawFiles merge RAW and HEIC files with the image of same base name (IMG_01.CR2, IMG_01.HEIC and IMG_01.JPG), image is kept as main node.
+// They would share reduced images in cache otherwise. Main node is an image displayable by browsers if any (HEIC otherwise), first by name if several
+func pairRawFiles(nodes map[string]*Node) {
+	rank := func(name string) int {
+		if resize.IsHeic(name) {
+			return 1
+		}
+		return 0
+	}
+	baseName := func(name string) string {
+		return strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+	}
+	images := make(map[string]*Node)
+	for name, node := range nodes {
+		if node.IsFolder || resize.IsRaw(name) {
+			continue
+		}
+		if image, exist := images[baseName(name)]; !exist || rank(name) < rank(image.Name) || (rank(name) == rank(image.Name) && name < image.Name) {
+			images[baseName(name)] = node
+		}
+	}
+	for name, node := range nodes {
+		image, exist := images[baseName(name)]
+		if node.IsFolder || !exist || image == node {
+			continue
+		}
+		switch {
+		case resize.IsRaw(name):
+			image.Raw = name
+			delete(nodes, name)
+		case resize.IsHeic(name) && !resize.IsHeic(image.Name):
+			image.Heic = name
+			delete(nodes, name)
+		}
+	}
 }
@@ -5,6 +5,7 @@ import (
 	"github.com/jotitan/photos_server/common"
 	"github.com/jotitan/photos_server/config"
 	"github.com/jotitan/photos_server/progress"
+	"github.com/jotitan/photos_server/resize"
 	"io"
 	"log"
 	"math/rand"
@@ -32,8 +33,26 @@ func (e EmptyReducer) CreateJpegFile(folder, basePath string, size uint) string
 	return ""
 }
 
-func (e EmptyReducer) GetSizes() []uint {
-	return []uint{200, 600}
+func (e EmptyReducer) ResizeQueueStatus() ResizeQueueStatus {
+	return ResizeQueueStatus{}
+}
+
+func (e EmptyReducer) ResizesToResume() []string {
+	return nil
+}
+
+func (e EmptyReducer) FailedResizes() []string {
+	return nil
+}
+
+func (e EmptyReducer) SetFaces(_ string, _ map[string][]resize.FaceBox) {}
+
+func (e EmptyReducer) ResizeOnDemand(path, relativePath string, conversion resize.ImageToResize) error {
+	return nil
+}
+
+func (e EmptyReducer) GetProfiles(relativePath string) []config.ResizeProfile {
+	return defaultProfiles
 }
 
 func (e EmptyReducer) AddImage(path, relativePath string, node *Node, progresser *progress.UploadProgress, existings map[string]struct{}, forceRotate bool) {
@@ -129,7 +148,7 @@ func TestCompare(t *testing.T) {
 }
 
 func TestManager(t *testing.T) {
-	fm := createStructure()
+	fm := createStructure(t)
 	if node, _, err := fm.FindNode("root/folder1/folder2/leaf2.jpg"); err != nil || node == nil {
 		t.Error("Impossible to find node")
 	}
@@ -148,7 +167,7 @@ func TestFilePath(t *testing.T) {
 
 func TestUploadFolder(t *testing.T) {
 	// GIVEN
-	fm, _, cache := createFakeStructure()
+	fm, _, cache := createFakeStructure(t)
 	upload, _ := os.MkdirTemp("", "upload-images")
 	fm.reducer = EmptyReducer{cache: cache}
 	createOriginalFile(upload, "", "file1.jpg", Files{})
@@ -174,7 +193,7 @@ func TestUploadFolder(t *testing.T) {
 }
 
 func TestMoveFolder(t *testing.T) {
-	fm, folder, cache := createFakeStructure()
+	fm, folder, cache := createFakeStructure(t)
 	err := fm.MoveFolder("root/folder1", "root/move/folder1")
 	if err != nil {
 		t.Error("Error during copy", err)
@@ -204,9 +223,8 @@ func TestMoveFolder(t *testing.T) {
 	}
 }
 
-func createFakeStructure() (*FoldersManager, string, string) {
-	folder, _ := os.MkdirTemp("", "test")
-	cache, _ := os.MkdirTemp("", "cache")
+func createFakeStructure(t *testing.T) (*FoldersManager, string, string) {
+	folder, cache := t.TempDir(), t.TempDir()
 
 	folder1 := Files{}
 	folder2 := Files{}
@@ -236,7 +254,7 @@ func createFakeStructure() (*FoldersManager, string, string) {
 
 	//r := NewFolder(folder, folder, filepath.Dir(folder), root, false)
 
-	fm := NewFoldersManager(config.Config{Security: config.SecurityConfig{}, CacheFolder: cache}, progress.NewUploadProgressManager())
+	fm := NewFoldersManager(config.Config{Security: config.SecurityConfig{}, CacheFolder: cache, Persistence: config.PersistenceConfig{Folder: t.TempDir()}}, progress.NewUploadProgressManager())
 	fm.tagManger = NewTagManager(fm)
 	//fm.Folders["root"] = r
 	fm.Sources["root"] = &SourceNode{Folder: filepath.Join(folder, "root"), Files: root}
@@ -264,8 +282,8 @@ func createFile(folder, sub, name string, files Files, addTree bool) string {
 	return path
 }
 
-func createStructure() *FoldersManager {
-	fm := NewFoldersManager(config.Config{Security: config.SecurityConfig{}}, nil)
+func createStructure(t *testing.T) *FoldersManager {
+	fm := NewFoldersManager(config.Config{Security: config.SecurityConfig{}, Persistence: config.PersistenceConfig{Folder: t.TempDir()}}, nil)
 	filesSub2 := Files{}
 	filesSub2["leaf1.jpg"] = newImage("/home", "/home/folder1/folder2/leaf1.jpg", "leaf1.jpg", "20200502")
 	filesSub2["leaf2.jpg"] = newImage("/home", "/home/folder1/folder2/leaf2.jpg", "leaf2.jpg", "20200502")
@@ -344,7 +362,7 @@ func Test(t *testing.T) {
 	}
 }
 func TestGroupByDate(t *testing.T) {
-	fm := NewFoldersManager(config.Config{Security: config.SecurityConfig{}}, nil)
+	fm := NewFoldersManager(config.Config{Security: config.SecurityConfig{}, Persistence: config.PersistenceConfig{Folder: t.TempDir()}}, nil)
 	filesRoot := Files{}
 	filesRoot["f1"] = &Node{Name: "f1", IsFolder: false, Date: time.Date(2020, 3, 10, 12, 0, 12, 0, time.Local)}
 	filesRoot["f2"] = &Node{Name: "f2", IsFolder: false, Date: time.Date(2020, 3, 10, 12, 15, 36, 0, time.Local)}
@@ -368,7 +386,7 @@ func TestGroupByDate(t *testing.T) {
 }
 
 func TestFindNode(t *testing.T) {
-	fm := createStructure()
+	fm := createStructure(t)
 	if node, _, err := fm.FindNode("root/folder1/folder2"); node == nil || err != nil {
 		t.Error("Must find the node")
 	} else {
@@ -380,7 +398,7 @@ func TestFindNode(t *testing.T) {
 
 func TestTagManager(t *testing.T) {
 	testDate := "20200502"
-	fm := createStructure()
+	fm := createStructure(t)
 	tagManager := NewTagManager(fm)
 
 	if tagManager.AddTagByFolder("root/ploup", "vacances", "green") == nil {
@@ -421,7 +439,7 @@ func TestTagManager(t *testing.T) {
 }
 
 func TestRemoveNode(t *testing.T) {
-	fm := createStructure()
+	fm := createStructure(t)
 	if node, _, err := fm.FindNode("root/folder1/folder2/leaf1.jpg"); node == nil || err != nil {
 		t.Error("Must find the node")
 	}
@@ -444,3 +462,48 @@ func createImageNode(rootFolder, path string) *Node {
 	dir := filepath.Dir(path)
 	return &Node{RelativePath: strings.ReplaceAll(dir, rootFolder, ""), IsFolder: false, Name: name, Width: int(rand.Int31() % 400), Height: int(rand.Int31() % 200), ImagesResized: true}
 }
+
+func TestPairRawFiles(t *testing.T) {
+	folder := filepath.Join(t.TempDir(), "raws")
+	os.MkdirAll(folder, os.ModePerm)
+	for _, name := range []string{"IMG_01.JPG", "img_01.CR2", "IMG_01.HEIC", "IMG_02.nef", "IMG_03.HEIC", "IMG_03.DNG", "notes.txt"} {
+		os.WriteFile(filepath.Join(folder, name), []byte{}, os.ModePerm)
+	}
+	files := FoldersManager{}.Analyse(filepath.Dir(folder), folder)["raws"].Files
+	if len(files) != 3 {
+		t.Fatal("RAW and HEIC with same base name must be paired with image", len(files))
+	}
+	if image := files["IMG_01.JPG"]; image == nil || image.Raw != "img_01.CR2" || image.GetRawPath() != "/raws/img_01.CR2" || image.GetHeicPath() != "/raws/IMG_01.HEIC" {
+		t.Error("JPEG must be main node with RAW and HEIC siblings", image)
+	}
+	if raw := files["IMG_02.nef"]; raw == nil || !raw.IsRawOnly() || raw.GetRawPath() != raw.RelativePath {
+		t.Error("RAW without image must be indexed alone", raw)
+	}
+	if heic := files["IMG_03.HEIC"]; heic == nil || heic.Raw != "IMG_03.DNG" || !heic.HasPreview() {
+		t.Error("HEIC without JPEG must be main node of RAW", heic)
+	}
+}
+
+func TestUploadRawInExistingFolder(t *testing.T) {
+	fm, folder, cache := createFakeStructure(t)
+	fm.reducer = EmptyReducer{cache: cache}
+	createOriginalFile(folder, "root/folder1", "IMG_01.jpg", fm.Sources["root"].Files["folder1"].Files)
+	upload := createSmallFile(t.TempDir(), "", "IMG_01.CR2")
+	f, _ := os.Open(upload)
+	defer f.Close()
+
+	if _, err := fm.UploadFolder(detailUploadFolder{source: "root", path: "root/folder1"}, []multipart.File{f}, []string{"IMG_01.CR2"}, true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		updateLocker.Lock()
+		node, _, _ := fm.FindNode("root/folder1/IMG_01.jpg")
+		_, _, errRaw := fm.FindNode("root/folder1/IMG_01.CR2")
+		updateLocker.Unlock()
+		if node != nil && node.Raw == "IMG_01.CR2" && errRaw != nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("RAW uploaded next to an image must be paired with it")
+}
@@ -0,0 +1,269 @@
+package photos_server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jotitan/photos_server/config"
+	"github.com/jotitan/photos_server/logger"
+)
+
+/* Watch folders of sources and update the tree when files are created, renamed or deleted.
+Folders written by an upload are ignored, upload indexes them itself */
+
+const defaultWatcherDebounce = 10
+
+// FolderWatcher group events by folder and update a folder only when no event occurs during debounce
+type FolderWatcher struct {
+	watcher  *fsnotify.Watcher
+	manager  *FoldersManager
+	debounce time.Duration
+	// Relative path of folders to update with date of last event
+	pending    map[string]time.Time
+	done       chan struct{}
+	locker     sync.Mutex
+	watched    int
+	processed  int
+	errors     int
+	lastUpdate time.Time
+	lastError  string
+}
+
+type pendingEventDto struct {
+	Path      string
+	LastEvent time.Time
+}
+
+type WatcherStatusDto struct {
+	Enabled        bool
+	WatchedFolders int
+	Pending        []pendingEventDto
+	Processed      int
+	Errors         int
+	LastUpdate     time.Time
+	LastError      string
+}
+
+func NewFolderWatcher(conf config.WatcherConfig, manager *FoldersManager) *FolderWatcher {
+	if !conf.Enable {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.GetLogger2().Error("Impossible to create watcher", err)
+		return nil
+	}
+	debounce := conf.Debounce
+	if debounce <= 0 {
+		debounce = defaultWatcherDebounce
+	}
+	fw := &FolderWatcher{
+		watcher:  watcher,
+		manager:  manager,
+		debounce: time.Duration(debounce) * time.Second,
+		pending:  make(map[string]time.Time),
+		done:     make(chan struct{}),
+	}
+	for _, source := range manager.Sources {
+		fw.watchRecursive(source.Folder)
+	}
+	logger.GetLogger2().Info("Watch", fw.watched, "folder(s) of sources")
+	go fw.listen()
+	go fw.run()
+	return fw
+}
+
+// watchRecursive add a watch on folder and all sub folders (except hidden ones)
+func (fw *FolderWatcher) watchRecursive(folder string) {
+	filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if path != folder && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if err := fw.watcher.Add(path); err != nil {
+			logger.GetLogger2().Error("Impossible to watch", path, err)
+		} else {
+			fw.locker.Lock()
+			fw.watched++
+			fw.locker.Unlock()
+		}
+		return nil
+	})
+}
+
+func (fw *FolderWatcher) listen() {
+	for {
+		select {
+		case event, ok := <-fw.watcher.Events:
+			if !ok {
+				return
+			}
+			fw.treatEvent(event)
+		case err, ok := <-fw.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.GetLogger2().Error("Watcher error", err)
+			fw.setError(err)
+		}
+	}
+}
+
+func (fw *FolderWatcher) treatEvent(event fsnotify.Event) {
+	if event.Has(fsnotify.Chmod) || strings.HasPrefix(filepath.Base(event.Name), ".") {
+		return
+	}
+	isFolder := false
+	if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+		isFolder = true
+		if event.Has(fsnotify.Create) {
+			fw.watchRecursive(event.Name)
+		}
+	}
+	if isUploading(event.Name) {
+		return
+	}
+	// A file change update its folder. A removed folder is checked itself (no way to know if it was a file)
+	folder := filepath.Dir(event.Name)
+	if isFolder || event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		folder = event.Name
+	}
+	if relativePath := fw.getRelativePath(folder); relativePath != "" {
+		fw.locker.Lock()
+		fw.pending[relativePath] = time.Now()
+		fw.locker.Unlock()
+	}
+}
+
+// getRelativePath return the path of folder in tree (source name + path in source)
+func (fw *FolderWatcher) getRelativePath(folder string) string {
+	for name, source := range fw.manager.Sources {
+		if rel, err := filepath.Rel(source.Folder, folder); err == nil && !strings.HasPrefix(rel, "..") {
+			if rel == "." {
+				return name
+			}
+			return name + "/" + filepath.ToSlash(rel)
+		}
+	}
+	return ""
+}
+
+// run update regularly folders without event during debounce
+func (fw *FolderWatcher) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fw.done:
+			return
+		case <-ticker.C:
+		}
+		for _, path := range fw.getReadyPaths() {
+			updateLocker.Lock()
+			err := fw.updatePath(path)
+			updateLocker.Unlock()
+			if err != nil {
+				logger.GetLogger2().Error("Impossible to update watched folder", path, err)
+				fw.setError(err)
+			} else {
+				fw.locker.Lock()
+				fw.processed++
+				fw.lastUpdate = time.Now()
+				fw.locker.Unlock()
+			}
+		}
+	}
+}
+
+func (fw *FolderWatcher) getReadyPaths() []string {
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	paths := make([]string, 0)
+	for path, last := range fw.pending {
+		if time.Since(last) > fw.debounce {
+			paths = append(paths, path)
+			delete(fw.pending, path)
+		}
+	}
+	// Parents first, children updates are often useless after
+	sort.Strings(paths)
+	return paths
+}
+
+// updatePath update the nearest existing folder of path in tree
+func (fw *FolderWatcher) updatePath(path string) error {
+	source, subPath, err := fw.manager.Sources.getSourceFromPath(path)
+	if err != nil {
+		return err
+	}
+	if subPath == "" {
+		// Only folders are managed at the root of a source
+		return nil
+	}
+	absolutePath := filepath.Join(source.Folder, subPath)
+	_, errDisk := os.Stat(absolutePath)
+	node, _, errTree := fw.manager.FindNode(path)
+	isFirstLevel := !strings.Contains(subPath, "/")
+	switch {
+	case errTree == nil && errDisk == nil:
+		logger.GetLogger2().Info("Watcher update folder", path)
+		return fw.manager.UpdateFolder(path, fw.manager.uploadProgressManager.AddUploader(0))
+	case errTree != nil && errDisk == nil && isFirstLevel:
+		logger.GetLogger2().Info("Watcher add folder", path)
+		return fw.manager.AddFolderToNode(absolutePath, path, false, detailUploadFolder{source: getSourceKey(path)}, fw.manager.uploadProgressManager.AddUploader(0))
+	case errTree == nil && errDisk != nil && isFirstLevel && node.IsFolder:
+		logger.GetLogger2().Info("Watcher remove folder", path)
+		return fw.manager.removeDeletedFolder(path)
+	case isFirstLevel:
+		// Not in tree and not on disk, nothing to do
+		return nil
+	}
+	return fw.updatePath(path[:strings.LastIndex(path, "/")])
+}
+
+func (fw *FolderWatcher) setError(err error) {
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	fw.errors++
+	fw.lastError = err.Error()
+}
+
+// Status return informations about watched folders and events not treated yet
+func (fw *FolderWatcher) Status() WatcherStatusDto {
+	if fw == nil {
+		return WatcherStatusDto{Pending: []pendingEventDto{}}
+	}
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	pending := make([]pendingEventDto, 0, len(fw.pending))
+	for path, last := range fw.pending {
+		pending = append(pending, pendingEventDto{Path: path, LastEvent: last})
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Path < pending[j].Path })
+	return WatcherStatusDto{
+		Enabled:        true,
+		WatchedFolders: fw.watched,
+		Pending:        pending,
+		Processed:      fw.processed,
+		Errors:         fw.errors,
+		LastUpdate:     fw.lastUpdate,
+		LastError:      fw.lastError,
+	}
+}
+
+// Close stop watching folders
+func (fw *FolderWatcher) Close() error {
+	if fw == nil {
+		return errors.New("watcher not enabled")
+	}
+	close(fw.done)
+	return fw.watcher.Close()
+}
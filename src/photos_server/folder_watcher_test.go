@@ -0,0 +1,58 @@
+package photos_server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jotitan/photos_server/config"
+)
+
+func waitNode(fm *FoldersManager, path string, exist bool) bool {
+	for i := 0; i < 50; i++ {
+		updateLocker.Lock()
+		_, _, err := fm.FindNode(path)
+		updateLocker.Unlock()
+		if (err == nil) == exist {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+func TestFolderWatcher(t *testing.T) {
+	fm, folder, cache := createFakeStructure(t)
+	fm.reducer = EmptyReducer{cache: cache}
+	fw := NewFolderWatcher(config.WatcherConfig{Enable: true, Debounce: 1}, fm)
+	if fw == nil {
+		t.Fatal("Watcher must be created")
+	}
+	defer fw.Close()
+
+	// New folder in source
+	createSmallFile(folder, "root/folder3", "new.jpg")
+	if !waitNode(fm, "root/folder3/new.jpg", true) {
+		t.Error("New image must be added in tree", fw.Status())
+	}
+	// New image in existing folder
+	createSmallFile(folder, "root/folder1", "other.jpg")
+	if !waitNode(fm, "root/folder1/other.jpg", true) {
+		t.Error("New image must be added in existing folder", fw.Status())
+	}
+	// Deleted folder
+	os.RemoveAll(filepath.Join(folder, "root", "folder3"))
+	if !waitNode(fm, "root/folder3", false) {
+		t.Error("Deleted folder must be removed from tree", fw.Status())
+	}
+	// Folder written by an upload
+	uploaded := filepath.Join(folder, "root", "folder4")
+	startUploading(uploaded)
+	createSmallFile(folder, "root/folder4", "uploaded.jpg")
+	time.Sleep(time.Second)
+	if status := fw.Status(); len(status.Pending) != 0 {
+		t.Error("Folder written by upload must be ignored", status)
+	}
+	endUploading(uploaded)
+}
@@ -37,6 +37,7 @@ func NewGarbageManager(folder, maskAdmin string, manager *FoldersManager) *Garba
 func (g GarbageManager) Remove(files []string) int {
 	// For each image to delete, find the good node
 	success := 0
+	deletions := make([]string, 0, len(files))
 	for _, file := range files {
 		if node, parent, err := g.manager.FindNode(file); err == nil {
 			// Remove copy only if move works
@@ -44,6 +45,7 @@ func (g GarbageManager) Remove(files []string) int {
 				if err := g.manager.removeFilesNode(node); err == nil {
 					// Remove node from structure
 					delete(parent, node.Name)
+					deletions = append(deletions, file)
 					success++
 					logger.GetLogger2().Info("Remove image", node.GetAbsolutePath(g.manager.Sources))
 				} else {
@@ -55,7 +57,10 @@ func (g GarbageManager) Remove(files []string) int {
 		}
 	}
 	// Save structure
-	g.manager.save()
+	g.manager.saveNodes(deletions, nil, false)
+	g.manager.albumManager.RemovePaths(deletions)
+	g.manager.ratingsManager.RemovePaths(deletions)
+	g.manager.tagManger.RemoveImages(deletions)
 	return success
 }
 
@@ -73,6 +78,12 @@ func (g GarbageManager) alreadyMoved(originalPath, movePath string) bool {
 }
 
 func (g GarbageManager) moveOriginalFile(node *Node) bool {
+	if node.Raw != "" && !g.MoveOriginalFileFromPath(node.GetRawAbsolutePath(g.manager.Sources), node.GetRawPath()) {
+		return false
+	}
+	if heicPath := node.GetHeicPath(); heicPath != "" && !g.MoveOriginalFileFromPath(Node{RelativePath: heicPath}.GetAbsolutePath(g.manager.Sources), heicPath) {
+		return false
+	}
 	return g.MoveOriginalFileFromPath(node.GetAbsolutePath(g.manager.Sources), node.RelativePath)
 }
 
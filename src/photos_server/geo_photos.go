@@ -0,0 +1,183 @@
+package photos_server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jotitan/photos_server/geo"
+)
+
+/* Locate photos on a map with gps position found in exif */
+
+const maxPhotosByCluster = 4
+
+type mapClusterDto struct {
+	Geohash   string
+	Count     int
+	Latitude  float64
+	Longitude float64
+	Photos    []imageRestFul
+}
+
+type geoJsonCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJsonFeature `json:"features"`
+}
+
+type geoJsonFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJsonGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJsonGeometry struct {
+	Type string `json:"type"`
+	// Longitude, latitude (and altitude)
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// GetPosition return gps position of image, nil if unknown
+func (n Node) GetPosition() *GpsPosition {
+	if n.Metadata == nil {
+		return nil
+	}
+	return n.Metadata.Gps
+}
+
+func (fm *FoldersManager) getGeoIndex() *geo.Index {
+	if fm.geoIndex == nil {
+		points := make([]geo.Point, 0)
+		for _, src := range fm.Sources {
+			for _, folder := range src.Files {
+				points = appendGeoPoints(folder, points)
+			}
+		}
+		fm.geoIndex = geo.NewIndex(points)
+	}
+	return fm.geoIndex
+}
+
+func appendGeoPoints(node *Node, points []geo.Point) []geo.Point {
+	if !node.IsFolder {
+		if position := node.GetPosition(); position != nil {
+			points = append(points, geo.Point{Latitude: position.Latitude, Longitude: position.Longitude, Value: node})
+		}
+		return points
+	}
+	for _, file := range node.Files {
+		points = appendGeoPoints(file, points)
+	}
+	return points
+}
+
+// SearchInBox return photos located in the box, only if canRead accept the folder of photo
+func (fm *FoldersManager) SearchInBox(box geo.Box, canRead func(folder string) bool) []geo.Point {
+	points := fm.getGeoIndex().Search(box)
+	filtered := make([]geo.Point, 0, len(points))
+	canReadImage := newImageReadChecker(canRead)
+	for _, point := range points {
+		if canReadImage(point.Value.(*Node)) {
+			filtered = append(filtered, point)
+		}
+	}
+	return filtered
+}
+
+// newImageReadChecker check if the folder of an image can be read, result is kept for each folder
+func newImageReadChecker(canRead func(folder string) bool) func(node *Node) bool {
+	readableFolders := make(map[string]bool)
+	return func(node *Node) bool {
+		folder := strings.TrimPrefix(filepath.ToSlash(filepath.Dir(node.RelativePath)), "/")
+		readable, exist := readableFolders[folder]
+		if !exist {
+			readable = canRead(folder)
+			readableFolders[folder] = readable
+		}
+		return readable
+	}
+}
+
+// parseBox read a box from minLat,minLon,maxLat,maxLon
+func parseBox(value string) (geo.Box, error) {
+	values := strings.Split(value, ",")
+	if len(values) != 4 {
+		return geo.Box{}, errors.New("bbox must be minLat,minLon,maxLat,maxLon")
+	}
+	coordinates := make([]float64, 4)
+	for i, v := range values {
+		coordinate, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return geo.Box{}, err
+		}
+		coordinates[i] = coordinate
+	}
+	return geo.Box{MinLat: coordinates[0], MinLon: coordinates[1], MaxLat: coordinates[2], MaxLon: coordinates[3]}, nil
+}
+
+func (s Server) canReadFolder(r *http.Request) func(folder string) bool {
+	return func(folder string) bool {
+		return s.securityServer.CanReadPath(folder, r)
+	}
+}
+
+// getPhotosOnMap return photos of a box grouped by area depending on zoom
+func (s Server) getPhotosOnMap(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	box, err := parseBox(r.FormValue("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	zoom, _ := strconv.Atoi(r.FormValue("zoom"))
+	points := s.foldersManager.SearchInBox(box, s.canReadFolder(r))
+	clusters := geo.ClusterPoints(points, geo.PrecisionForZoom(zoom), maxPhotosByCluster)
+	results := make([]mapClusterDto, len(clusters))
+	for i, cluster := range clusters {
+		results[i] = mapClusterDto{Geohash: cluster.Geohash, Count: cluster.Count, Latitude: cluster.Latitude, Longitude: cluster.Longitude,
+			Photos: make([]imageRestFul, len(cluster.Values))}
+		for j, value := range cluster.Values {
+			results[i].Photos[j] = s.newImageRestful(value.(*Node))
+		}
+	}
+	data, _ := json.Marshal(results)
+	write(data, w)
+}
+
+// exportGeoJson return located photos of a folder (and sub folders) in GeoJSON
+func (s Server) exportGeoJson(w http.ResponseWriter, r *http.Request) {
+	folder := strings.TrimPrefix(r.FormValue("folder"), "/")
+	if !s.securityServer.CanReadPath(folder, r) {
+		error403(w, r)
+		return
+	}
+	node, _, err := s.foldersManager.FindNode(folder)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	collection := geoJsonCollection{Type: "FeatureCollection", Features: make([]geoJsonFeature, 0)}
+	for _, point := range appendGeoPoints(node, nil) {
+		image := point.Value.(*Node)
+		coordinates := []float64{point.Longitude, point.Latitude}
+		if altitude := image.GetPosition().Altitude; altitude != 0 {
+			coordinates = append(coordinates, altitude)
+		}
+		restful := s.newImageRestful(image)
+		collection.Features = append(collection.Features, geoJsonFeature{
+			Type:     "Feature",
+			Geometry: geoJsonGeometry{Type: "Point", Coordinates: coordinates},
+			Properties: map[string]interface{}{
+				"name": image.Name, "path": image.RelativePath, "date": image.Date,
+				"thumbnail": restful.ThumbnailLink, "image": restful.ImageLink,
+			},
+		})
+	}
+	header(w)
+	w.Header().Set("Content-type", "application/geo+json")
+	data, _ := json.Marshal(collection)
+	write(data, w)
+}
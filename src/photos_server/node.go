@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"github.com/jotitan/photos_server/common"
+	"github.com/jotitan/photos_server/geo"
+	"github.com/jotitan/photos_server/resize"
 	"path/filepath"
 	"strings"
 	"time"
@@ -87,6 +89,18 @@ type Node struct {
 	// Only if node is a folder
 	Title       string `json:"title,omitempty"`
 	Description string `json:"description,omitempty"`
+	// Sha256 of original image content
+	Hash string `json:"hash,omitempty"`
+	// Perceptual hash of the reduced image, to find images visually identical
+	PHash string `json:"phash,omitempty"`
+	// Exif informations (camera, lens, gps...)
+	Metadata *PhotoMetadata `json:"metadata,omitempty"`
+	// Place found from gps position
+	Place *geo.Place `json:"place,omitempty"`
+	// Name of RAW file with same base name, paired with this image
+	Raw string `json:"raw,omitempty"`
+	// Name of HEIC file with same base name, paired with this image (export of iPhone)
+	Heic string `json:"heic,omitempty"`
 }
 
 func (n Node) GetAbsolutePath(sn SourceNodes) string {
@@ -97,6 +111,43 @@ func (n Node) GetAbsolutePath(sn SourceNodes) string {
 	return ""
 }
 
+// GetRawPath return relative path of RAW original, empty if none
+func (n Node) GetRawPath() string {
+	switch {
+	case n.Raw != "":
+		return filepath.ToSlash(filepath.Join(filepath.Dir(n.RelativePath), n.Raw))
+	case n.IsRawOnly():
+		return n.RelativePath
+	}
+	return ""
+}
+
+// GetRawAbsolutePath return absolute path of RAW original, empty if none
+func (n Node) GetRawAbsolutePath(sn SourceNodes) string {
+	if rawPath := n.GetRawPath(); rawPath != "" {
+		return Node{RelativePath: rawPath}.GetAbsolutePath(sn)
+	}
+	return ""
+}
+
+// GetHeicPath return relative path of paired HEIC original, empty if none
+func (n Node) GetHeicPath() string {
+	if n.Heic == "" {
+		return ""
+	}
+	return filepath.ToSlash(filepath.Join(filepath.Dir(n.RelativePath), n.Heic))
+}
+
+// HasPreview return true if photo can't be displayed by browsers (RAW, HEIC) and is shown with a JPEG preview
+func (n Node) HasPreview() bool {
+	return n.IsRawOnly() || (!n.IsFolder && resize.IsHeic(n.Name))
+}
+
+// IsRawOnly return true if node is a RAW file without paired image
+func (n Node) IsRawOnly() bool {
+	return !n.IsFolder && resize.IsRaw(n.Name)
+}
+
 func (n Node) GetDate() time.Time {
 	return n.Date
 }
@@ -0,0 +1,90 @@
+package photos_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jotitan/photos_server/config"
+	"github.com/jotitan/photos_server/logger"
+	"github.com/jotitan/photos_server/persistence"
+)
+
+// NodesStore persist the tree of folders and images
+type NodesStore interface {
+	// Load return all saved sources with their tree
+	Load() (SourceNodes, error)
+	// SaveAll replace everything saved by the sources
+	SaveAll(sources SourceNodes) error
+	// Update delete paths (with children) and save nodes in one transaction. If deep, children of nodes are saved too
+	Update(sources SourceNodes, deletions []string, nodes []*Node, deep bool) error
+}
+
+// newNodesStore create store of tree, files are in state folder unless a database path is defined.
+// If database can't be opened, json file is used instead
+func newNodesStore(conf config.DatabaseConfig, folder string) NodesStore {
+	store, err := openNodesStore(conf, folder)
+	if err != nil {
+		logger.GetLogger2().Error(err.Error(), ", use json file instead")
+		return jsonNodesStore{path: getSavePath(folder)}
+	}
+	return store
+}
+
+// openNodesStore create store of tree, fail if database can't be opened (locked by another process for instance)
+func openNodesStore(conf config.DatabaseConfig, folder string) (NodesStore, error) {
+	switch strings.ToLower(conf.Type) {
+	case "bolt":
+		path := conf.Path
+		if strings.EqualFold("", path) {
+			path = getDatabasePath(folder)
+		}
+		store, err := newBoltNodesStore(path, jsonNodesStore{path: getSavePath(folder)})
+		if err != nil {
+			return nil, fmt.Errorf("impossible to open database %s : %v", path, err)
+		}
+		return store, nil
+	}
+	return jsonNodesStore{path: getSavePath(folder)}, nil
+}
+
+func getSavePath(folder string) string {
+	return filepath.Join(folder, "save-images.json")
+}
+
+func getDatabasePath(folder string) string {
+	return filepath.Join(folder, "photos.db")
+}
+
+// jsonNodesStore save the whole tree in a json file at each modification
+type jsonNodesStore struct {
+	path string
+}
+
+func (js jsonNodesStore) Load() (SourceNodes, error) {
+	data, err := os.ReadFile(js.path)
+	if err != nil {
+		return nil, err
+	}
+	folders := make(SourceNodes)
+	json.Unmarshal(data, &folders)
+	return folders, nil
+}
+
+func (js jsonNodesStore) SaveAll(sources SourceNodes) error {
+	data, err := json.Marshal(sources)
+	if err != nil {
+		return err
+	}
+	if err = persistence.WriteFile(js.path, data); err == nil {
+		logger.GetLogger2().Info("Save tree in file", js.path)
+	}
+	return err
+}
+
+// Update rewrite the full file, no way to write only a part
+func (js jsonNodesStore) Update(sources SourceNodes, _ []string, _ []*Node, _ bool) error {
+	return js.SaveAll(sources)
+}
@@ -0,0 +1,264 @@
+package photos_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jotitan/photos_server/logger"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketSources = []byte("sources")
+	bucketNodes   = []byte("nodes")
+	bucketMeta    = []byte("meta")
+	keyMigrated   = []byte("migrated")
+)
+
+// boltNodesStore save each node in an embedded key / value database.
+// Each source has a bucket in nodes bucket, the key of a node is its path in the source (folder/sub/image.jpg)
+type boltNodesStore struct {
+	db *bolt.DB
+}
+
+func newBoltNodesStore(path string, legacy jsonNodesStore) (*boltNodesStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	store := &boltNodesStore{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketSources, bucketNodes, bucketMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err = store.migrate(legacy); err != nil {
+		db.Close()
+		return nil, err
+	}
+	logger.GetLogger2().Info("Use database", path, "to store tree")
+	return store, nil
+}
+
+// migrate import only once the legacy json file. The json file is kept as a backup
+func (bs *boltNodesStore) migrate(legacy jsonNodesStore) error {
+	migrated := false
+	bs.db.View(func(tx *bolt.Tx) error {
+		migrated = tx.Bucket(bucketMeta).Get(keyMigrated) != nil
+		return nil
+	})
+	if migrated {
+		return nil
+	}
+	if sources, err := legacy.Load(); err == nil {
+		logger.GetLogger2().Info("Migrate tree from", legacy.path, "with", len(sources), "source(s)")
+		if err := bs.SaveAll(sources); err != nil {
+			return err
+		}
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMeta).Put(keyMigrated, []byte(time.Now().Format(time.RFC3339)))
+	})
+}
+
+func (bs *boltNodesStore) Load() (SourceNodes, error) {
+	sources := make(SourceNodes)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		nodesBucket := tx.Bucket(bucketNodes)
+		return tx.Bucket(bucketSources).ForEach(func(name, value []byte) error {
+			source := &SourceNode{}
+			if err := json.Unmarshal(value, source); err != nil {
+				return err
+			}
+			source.Files = make(Files)
+			sources[string(name)] = source
+			if bucket := nodesBucket.Bucket(name); bucket != nil {
+				return loadSourceNodes(bucket, source)
+			}
+			return nil
+		})
+	})
+	return sources, err
+}
+
+// Keys are sorted, a parent is always read before its children
+func loadSourceNodes(bucket *bolt.Bucket, source *SourceNode) error {
+	folders := make(map[string]*Node)
+	return bucket.ForEach(func(key, value []byte) error {
+		node := &Node{}
+		if err := json.Unmarshal(value, node); err != nil {
+			return err
+		}
+		if node.IsFolder {
+			node.Files = make(Files)
+			folders[string(key)] = node
+		}
+		path := string(key)
+		idx := strings.LastIndex(path, "/")
+		if idx == -1 {
+			source.Files[path] = node
+			return nil
+		}
+		if parent, exist := folders[path[:idx]]; exist {
+			parent.Files[path[idx+1:]] = node
+		} else {
+			logger.GetLogger2().Error("Missing parent for node", source.Name, path)
+		}
+		return nil
+	})
+}
+
+func (bs *boltNodesStore) SaveAll(sources SourceNodes) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(bucketNodes); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		if err := tx.DeleteBucket(bucketSources); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		nodesBucket, err := tx.CreateBucket(bucketNodes)
+		if err != nil {
+			return err
+		}
+		sourcesBucket, err := tx.CreateBucket(bucketSources)
+		if err != nil {
+			return err
+		}
+		for name, source := range sources {
+			if err := putSource(sourcesBucket, name, source); err != nil {
+				return err
+			}
+			bucket, err := nodesBucket.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for key, node := range source.Files {
+				if err := putNode(bucket, key, node, true); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *boltNodesStore) Update(sources SourceNodes, deletions []string, nodes []*Node, deep bool) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		for _, path := range deletions {
+			_, subPath, err := sources.getSourceFromPath(path)
+			if err != nil || strings.EqualFold("", subPath) {
+				continue
+			}
+			if bucket := tx.Bucket(bucketNodes).Bucket([]byte(getSourceKey(path))); bucket != nil {
+				if err := deleteNodes(bucket, subPath); err != nil {
+					return err
+				}
+			}
+		}
+		for _, node := range nodes {
+			source, subPath, err := sources.getSourceFromPath(node.RelativePath)
+			if err != nil || strings.EqualFold("", subPath) {
+				logger.GetLogger2().Error("Impossible to save node", node.RelativePath, err)
+				continue
+			}
+			bucket, err := bs.getSourceBucket(tx, getSourceKey(node.RelativePath), source)
+			if err != nil {
+				return err
+			}
+			if err := putParents(bucket, source, subPath); err != nil {
+				return err
+			}
+			if err := putNode(bucket, subPath, node, deep); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *boltNodesStore) getSourceBucket(tx *bolt.Tx, name string, source *SourceNode) (*bolt.Bucket, error) {
+	if err := putSource(tx.Bucket(bucketSources), name, source); err != nil {
+		return nil, err
+	}
+	return tx.Bucket(bucketNodes).CreateBucketIfNotExists([]byte(name))
+}
+
+// getSourceKey return the name of source, first element of path
+func getSourceKey(path string) string {
+	path = strings.TrimPrefix(strings.ReplaceAll(path, "\\", "/"), "/")
+	if idx := strings.Index(path, "/"); idx != -1 {
+		return path[:idx]
+	}
+	return path
+}
+
+func putSource(bucket *bolt.Bucket, name string, source *SourceNode) error {
+	data, err := json.Marshal(SourceNode{Name: source.Name, Folder: source.Folder})
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(name), data)
+}
+
+// putParents save all folders between source and the path, without their children
+func putParents(bucket *bolt.Bucket, source *SourceNode, path string) error {
+	subs := strings.Split(path, "/")
+	current := source.Files
+	for i := 0; i < len(subs)-1; i++ {
+		parent, exist := current[subs[i]]
+		if !exist {
+			return errors.New("impossible to find parent of " + path)
+		}
+		if err := putNode(bucket, strings.Join(subs[:i+1], "/"), parent, false); err != nil {
+			return err
+		}
+		current = parent.Files
+	}
+	return nil
+}
+
+func putNode(bucket *bolt.Bucket, key string, node *Node, deep bool) error {
+	// Children are stored in their own keys
+	copyNode := *node
+	copyNode.Files = nil
+	data, err := json.Marshal(copyNode)
+	if err != nil {
+		return err
+	}
+	if err = bucket.Put([]byte(key), data); err != nil {
+		return err
+	}
+	if deep {
+		for name, child := range node.Files {
+			if err := putNode(bucket, key+"/"+name, child, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteNodes delete the node and all its children
+func deleteNodes(bucket *bolt.Bucket, path string) error {
+	if err := bucket.Delete([]byte(path)); err != nil {
+		return err
+	}
+	prefix := []byte(path + "/")
+	cursor := bucket.Cursor()
+	for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Seek(prefix) {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package photos_server
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func createStoreStructure() SourceNodes {
+	images := Files{}
+	images["leaf1.jpg"] = newImage("/home", "/home/root/folder1/leaf1.jpg", "leaf1.jpg", "20200502")
+	images["leaf2.jpg"] = newImage("/home", "/home/root/folder1/leaf2.jpg", "leaf2.jpg", "20200503")
+	folder := NewFolder("/home", "/home/root/folder1", "folder1", images, true)
+	folder.Id = 3
+	return SourceNodes{"root": &SourceNode{Name: "root", Folder: "/home/root", Files: Files{"folder1": folder}}}
+}
+
+func TestBoltStoreMigrateAndUpdate(t *testing.T) {
+	folder := t.TempDir()
+	legacy := jsonNodesStore{path: filepath.Join(folder, "save-images.json")}
+	if err := legacy.SaveAll(createStoreStructure()); err != nil {
+		t.Fatal("Impossible to save json", err)
+	}
+	store, err := newBoltNodesStore(filepath.Join(folder, "photos.db"), legacy)
+	if err != nil {
+		t.Fatal("Impossible to open database", err)
+	}
+	sources, _ := store.Load()
+	fm := FoldersManager{Sources: sources}
+	node, _, err := fm.FindNode("root/folder1/leaf2.jpg")
+	if err != nil || node.Date.Format("20060102") != "20200503" {
+		t.Fatal("Migrated node must be found", err)
+	}
+
+	// Add a folder with a missing parent and remove an image
+	newFolder, _ := fm.FindOrCreateNode("root/folder2/sub")
+	newFolder.IsFolder = true
+	newFolder.Files["leaf3.jpg"] = newImage("/home", "/home/root/folder2/sub/leaf3.jpg", "leaf3.jpg", "20200504")
+	delete(sources["root"].Files["folder1"].Files, "leaf1.jpg")
+	if err := store.Update(sources, []string{"root/folder1/leaf1.jpg"}, []*Node{newFolder}, true); err != nil {
+		t.Fatal("Update must success", err)
+	}
+	store.db.Close()
+
+	// Json file must not be imported again
+	store, _ = newBoltNodesStore(filepath.Join(folder, "photos.db"), legacy)
+	defer store.db.Close()
+	sources, _ = store.Load()
+	fm = FoldersManager{Sources: sources}
+	if _, _, err := fm.FindNode("root/folder1/leaf1.jpg"); err == nil {
+		t.Error("Deleted node must not be found")
+	}
+	if _, _, err := fm.FindNode("root/folder2/sub/leaf3.jpg"); err != nil {
+		t.Error("New node must be found", err)
+	}
+	if node, _, _ := fm.FindNode("root/folder1"); node == nil || node.Id != 3 || len(node.Files) != 1 {
+		t.Error("Folder must keep its id and one image")
+	}
+}
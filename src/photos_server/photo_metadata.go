@@ -0,0 +1,177 @@
+package photos_server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jotitan/photos_server/resize"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// PhotoMetadata store exif informations of an image
+type PhotoMetadata struct {
+	Make         string       `json:"make,omitempty"`
+	Model        string       `json:"model,omitempty"`
+	Lens         string       `json:"lens,omitempty"`
+	FocalLength  float64      `json:"focal_length,omitempty"`
+	Iso          int          `json:"iso,omitempty"`
+	Aperture     float64      `json:"aperture,omitempty"`
+	ExposureTime string       `json:"exposure_time,omitempty"`
+	Software     string       `json:"software,omitempty"`
+	Gps          *GpsPosition `json:"gps,omitempty"`
+}
+
+type GpsPosition struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude,omitempty"`
+}
+
+// ReadExif return date, orientation and metadata of an image. Metadata is nil if image has no exif
+func ReadExif(path string) (time.Time, int, *PhotoMetadata) {
+	if infos, err := decodeExif(path); err == nil || !exif.IsCriticalError(err) {
+		return getExifDate(infos, path), getExifOrientation(infos), extractMetadata(infos)
+	}
+	return getModificationDate(path), 0, nil
+}
+
+// decodeExif read exif of image. Exif of HEIC is stored in an item of the container
+func decodeExif(path string) (*exif.Exif, error) {
+	if resize.IsHeic(path) {
+		tiff, err := resize.ReadHeicExif(path)
+		if err != nil {
+			return nil, err
+		}
+		return exif.Decode(bytes.NewReader(tiff))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return exif.Decode(f)
+}
+
+func extractMetadata(infos *exif.Exif) *PhotoMetadata {
+	metadata := &PhotoMetadata{
+		Make:         getExifString(infos, exif.Make),
+		Model:        getExifString(infos, exif.Model),
+		Lens:         getExifString(infos, exif.LensModel),
+		FocalLength:  getExifFloat(infos, exif.FocalLength),
+		Aperture:     getExifFloat(infos, exif.FNumber),
+		ExposureTime: getExifExposure(infos),
+		Software:     getExifString(infos, exif.Software),
+	}
+	if tag, err := infos.Get(exif.ISOSpeedRatings); err == nil {
+		metadata.Iso, _ = tag.Int(0)
+	}
+	if lat, long, err := infos.LatLong(); err == nil {
+		metadata.Gps = &GpsPosition{Latitude: lat, Longitude: long, Altitude: getExifFloat(infos, exif.GPSAltitude)}
+		if tag, err := infos.Get(exif.GPSAltitudeRef); err == nil {
+			if ref, _ := tag.Int(0); ref == 1 {
+				metadata.Gps.Altitude = -metadata.Gps.Altitude
+			}
+		}
+	}
+	return metadata
+}
+
+func getExifString(infos *exif.Exif, field exif.FieldName) string {
+	if tag, err := infos.Get(field); err == nil {
+		if value, err := tag.StringVal(); err == nil {
+			return strings.TrimSpace(strings.Trim(value, "\x00"))
+		}
+	}
+	return ""
+}
+
+func getExifFloat(infos *exif.Exif, field exif.FieldName) float64 {
+	if tag, err := infos.Get(field); err == nil {
+		if value, err := tag.Rat(0); err == nil {
+			f, _ := value.Float64()
+			return f
+		}
+	}
+	return 0
+}
+
+// Exposure is shown as a fraction (1/250) when less than one second
+func getExifExposure(infos *exif.Exif) string {
+	if tag, err := infos.Get(exif.ExposureTime); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && num > 0 && den > 0 {
+			if num >= den {
+				return strconv.FormatFloat(float64(num)/float64(den), 'f', -1, 64)
+			}
+			return fmt.Sprintf("1/%d", (den+num/2)/num)
+		}
+	}
+	return ""
+}
+
+// metadataFilter keep only images matching exif criterias. Folders are always kept
+type metadataFilter struct {
+	camera   string
+	lens     string
+	minIso   int
+	maxIso   int
+	minFocal float64
+	maxFocal float64
+	gps      bool
+}
+
+func newMetadataFilter(r *http.Request) *metadataFilter {
+	filter := metadataFilter{
+		camera: strings.ToLower(r.FormValue("camera")),
+		lens:   strings.ToLower(r.FormValue("lens")),
+		gps:    r.FormValue("gps") == "true",
+	}
+	filter.minIso, _ = strconv.Atoi(r.FormValue("iso_min"))
+	filter.maxIso, _ = strconv.Atoi(r.FormValue("iso_max"))
+	filter.minFocal, _ = strconv.ParseFloat(r.FormValue("focal_min"), 64)
+	filter.maxFocal, _ = strconv.ParseFloat(r.FormValue("focal_max"), 64)
+	if filter == (metadataFilter{}) {
+		return nil
+	}
+	return &filter
+}
+
+func (mf *metadataFilter) match(node *Node) bool {
+	if mf == nil || node.IsFolder {
+		return true
+	}
+	m := node.Metadata
+	if m == nil {
+		return false
+	}
+	switch {
+	case mf.camera != "" && !strings.Contains(strings.ToLower(m.Make+" "+m.Model), mf.camera):
+		return false
+	case mf.lens != "" && !strings.Contains(strings.ToLower(m.Lens), mf.lens):
+		return false
+	case mf.minIso > 0 && m.Iso < mf.minIso, mf.maxIso > 0 && m.Iso > mf.maxIso:
+		return false
+	case mf.minFocal > 0 && m.FocalLength < mf.minFocal, mf.maxFocal > 0 && m.FocalLength > mf.maxFocal:
+		return false
+	case mf.gps && m.Gps == nil:
+		return false
+	}
+	return true
+}
+
+func (mf *metadataFilter) filter(nodes []*Node) []*Node {
+	if mf == nil {
+		return nodes
+	}
+	filtered := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		if mf.match(node) {
+			filtered = append(filtered, node)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,26 @@
+package photos_server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetadataFilter(t *testing.T) {
+	nodes := []*Node{
+		{Name: "folder", IsFolder: true},
+		{Name: "a.jpg", Metadata: &PhotoMetadata{Make: "Canon", Model: "EOS 80D", Iso: 100, FocalLength: 50}},
+		{Name: "b.jpg", Metadata: &PhotoMetadata{Make: "Apple", Model: "iPhone 12", Iso: 800, Gps: &GpsPosition{Latitude: 45, Longitude: 3}}},
+		{Name: "c.jpg"},
+	}
+	if filter := newMetadataFilter(httptest.NewRequest("GET", "/browserf/root", nil)); len(filter.filter(nodes)) != 4 {
+		t.Error("Without criteria, all nodes must be kept")
+	}
+	filter := newMetadataFilter(httptest.NewRequest("GET", "/browserf/root?camera=canon", nil))
+	if filtered := filter.filter(nodes); len(filtered) != 2 || filtered[1].Name != "a.jpg" {
+		t.Error("Only folder and canon image must be kept", filtered)
+	}
+	filter = newMetadataFilter(httptest.NewRequest("GET", "/browserf/root?iso_min=400&gps=true", nil))
+	if filtered := filter.filter(nodes); len(filtered) != 2 || filtered[1].Name != "b.jpg" {
+		t.Error("Only folder and iphone image must be kept", filtered)
+	}
+}
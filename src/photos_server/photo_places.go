@@ -0,0 +1,149 @@
+package photos_server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/jotitan/photos_server/config"
+	"github.com/jotitan/photos_server/geo"
+	"github.com/jotitan/photos_server/logger"
+)
+
+/* Search photos by place name (city, region, country), found from gps position */
+
+func newReverseGeocoder(conf config.GeocodingConfig) *geo.ReverseGeocoder {
+	if conf.Cities == "" {
+		return nil
+	}
+	geocoder, err := geo.NewReverseGeocoder(conf.Cities, conf.Regions, conf.Countries)
+	if err != nil {
+		logger.GetLogger2().Error("Impossible to load gazetteer, no reverse geocoding", err)
+		return nil
+	}
+	return geocoder
+}
+
+// resolvePlace set place of image from its gps position if not already known
+func (fm *FoldersManager) resolvePlace(node *Node) {
+	if position := node.GetPosition(); position != nil && node.Place == nil {
+		node.Place = fm.geocoder.Resolve(position.Latitude, position.Longitude)
+	}
+}
+
+// ResolveMissingPlaces set place of located images indexed before a gazetteer is configured
+func (fm *FoldersManager) ResolveMissingPlaces() int {
+	if fm.geocoder == nil {
+		return 0
+	}
+	updated := make([]*Node, 0)
+	for _, src := range fm.Sources {
+		for _, folder := range src.Files {
+			folder.applyOnEach(fm.Sources, func(_, _ string, node *Node) {
+				if node.Place == nil {
+					if fm.resolvePlace(node); node.Place != nil {
+						updated = append(updated, node)
+					}
+				}
+			})
+		}
+	}
+	if len(updated) > 0 {
+		fm.saveNodes(nil, updated, false)
+		logger.GetLogger2().Info("Resolve place of", len(updated), "images")
+	}
+	return len(updated)
+}
+
+// getPlaceIndex index images by names of their place and by words of these names
+func (fm *FoldersManager) getPlaceIndex() map[string]map[string]*Node {
+	if fm.placeIndex == nil {
+		index := make(map[string]map[string]*Node)
+		for _, src := range fm.Sources {
+			for _, folder := range src.Files {
+				folder.applyOnEach(fm.Sources, func(_, _ string, node *Node) {
+					if node.Place != nil {
+						addToPlaceIndex(index, node)
+					}
+				})
+			}
+		}
+		fm.placeIndex = index
+	}
+	return fm.placeIndex
+}
+
+func addToPlaceIndex(index map[string]map[string]*Node, node *Node) {
+	for _, name := range node.Place.Keywords() {
+		keywords := append(strings.FieldsFunc(name, isPlaceSeparator), name)
+		for _, keyword := range keywords {
+			normKeyword := strings.ToLower(keyword)
+			if nodes, exist := index[normKeyword]; !exist {
+				index[normKeyword] = map[string]*Node{node.RelativePath: node}
+			} else {
+				nodes[node.RelativePath] = node
+			}
+		}
+	}
+}
+
+func isPlaceSeparator(r rune) bool {
+	return r == ' ' || r == '-' || r == '\''
+}
+
+// SearchByPlace return images matching all names, sorted by date
+func (fm *FoldersManager) SearchByPlace(names []string) []*Node {
+	index := fm.getPlaceIndex()
+	var results map[string]*Node
+	for _, name := range names {
+		nodes := index[strings.ToLower(strings.TrimSpace(name))]
+		if results == nil {
+			results = make(map[string]*Node, len(nodes))
+			for key, node := range nodes {
+				results[key] = node
+			}
+			continue
+		}
+		// compute intersection
+		for key := range results {
+			if _, exist := nodes[key]; !exist {
+				delete(results, key)
+			}
+		}
+	}
+	list := make([]*Node, 0, len(results))
+	for _, node := range results {
+		list = append(list, node)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Date.Before(list[j].Date) })
+	return list
+}
+
+// resolvePlaces set in background place of located images indexed without
+func (s Server) resolvePlaces(w http.ResponseWriter, r *http.Request) {
+	go func() {
+		updateLocker.Lock()
+		defer updateLocker.Unlock()
+		s.foldersManager.ResolveMissingPlaces()
+	}()
+	write([]byte("Places resolution launched"), w)
+}
+
+// searchByPlace search images with names of place separated by comma (query=lyon,france)
+func (s Server) searchByPlace(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	query := strings.TrimSpace(r.FormValue("query"))
+	nodes := make([]*Node, 0)
+	if query != "" {
+		canReadImage := newImageReadChecker(s.canReadFolder(r))
+		for _, node := range s.newRatingsFilter(r).filter(s.foldersManager.SearchByPlace(strings.Split(query, ","))) {
+			if canReadImage(node) {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+	if data, err := json.Marshal(imagesResponse{Files: s.setUserRatings(s.convertPaths(nodes, false), r)}); err == nil {
+		write(data, w)
+	}
+}
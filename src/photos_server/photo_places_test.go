@@ -0,0 +1,35 @@
+package photos_server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jotitan/photos_server/geo"
+)
+
+func TestResolveMissingPlaces(t *testing.T) {
+	fm, _, _ := createFakeStructure(t)
+	if fm.ResolveMissingPlaces() != 0 {
+		t.Error("No place must be resolved without gazetteer")
+	}
+	folder := t.TempDir()
+	cities := filepath.Join(folder, "cities.txt")
+	os.WriteFile(cities, []byte("2996944\tLyon\tLyon\t\t45.74846\t4.84671\tP\tPPLA\tFR\t\t84\n"), os.ModePerm)
+	geocoder, err := geo.NewReverseGeocoder(cities, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm.geocoder = geocoder
+	located, _, err := fm.FindNode("root/folder1/first.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	located.Metadata = &PhotoMetadata{Gps: &GpsPosition{Latitude: 45.76, Longitude: 4.85}}
+	if count := fm.ResolveMissingPlaces(); count != 1 || located.Place == nil || located.Place.City != "Lyon" {
+		t.Error("Place of located image must be resolved", count, located.Place)
+	}
+	if len(fm.SearchByPlace([]string{"lyon"})) != 1 || fm.ResolveMissingPlaces() != 0 {
+		t.Error("Resolved place must be indexed and not resolved again")
+	}
+}
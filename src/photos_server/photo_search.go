@@ -0,0 +1,241 @@
+package photos_server
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/jotitan/photos_server/logger"
+	"github.com/jotitan/photos_server/people_tag"
+	"github.com/jotitan/photos_server/query"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+/* Full text search on folders and photos (title, description, names, tags and peoples) */
+
+const (
+	titleWeight       = 5.0
+	folderNameWeight  = 4.0
+	tagWeight         = 3.0
+	peopleWeight      = 3.0
+	descriptionWeight = 2.0
+	fileNameWeight    = 1.0
+	// A word only starting with searched one counts less than exact word
+	prefixFactor       = 0.5
+	defaultSearchLimit = 100
+)
+
+type searchIndex struct {
+	// For each word, score of nodes (key is relative path)
+	postings map[string]map[string]float64
+	// Words sorted, to find words by prefix
+	words []string
+	nodes map[string]*Node
+	// Folders and photos (with their folder) returned by structured queries
+	items []queryItem
+	// Version of tags when index was built
+	tagsVersion int64
+}
+
+type searchResult struct {
+	node  *Node
+	score float64
+}
+
+// normalizeText lower text and remove accents (éèà => eea)
+func normalizeText(text string) string {
+	normalizer := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	if result, _, err := transform.String(normalizer, text); err == nil {
+		text = result
+	}
+	return strings.ToLower(text)
+}
+
+// tokenize split a text in normalized words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(normalizeText(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{postings: make(map[string]map[string]float64), nodes: make(map[string]*Node)}
+}
+
+func (si *searchIndex) add(node *Node, text string, weight float64) {
+	si.nodes[node.RelativePath] = node
+	for _, word := range tokenize(text) {
+		if scores, exist := si.postings[word]; !exist {
+			si.postings[word] = map[string]float64{node.RelativePath: weight}
+		} else {
+			scores[node.RelativePath] += weight
+		}
+	}
+}
+
+func (si *searchIndex) sortWords() {
+	si.words = make([]string, 0, len(si.postings))
+	for word := range si.postings {
+		si.words = append(si.words, word)
+	}
+	sort.Strings(si.words)
+}
+
+// findWord return score of nodes having a word equal or starting with searched word
+func (si *searchIndex) findWord(searchWord string) map[string]float64 {
+	scores := make(map[string]float64)
+	for pos := sort.SearchStrings(si.words, searchWord); pos < len(si.words) && strings.HasPrefix(si.words[pos], searchWord); pos++ {
+		factor := prefixFactor
+		if si.words[pos] == searchWord {
+			factor = 1
+		}
+		for path, score := range si.postings[si.words[pos]] {
+			scores[path] += score * factor
+		}
+	}
+	return scores
+}
+
+// Search return nodes matching all words of query, best score first
+func (si *searchIndex) Search(query string) []searchResult {
+	var scores map[string]float64
+	for _, word := range tokenize(query) {
+		found := si.findWord(word)
+		if scores == nil {
+			scores = found
+			continue
+		}
+		// compute intersection
+		for path, score := range scores {
+			if wordScore, exist := found[path]; exist {
+				scores[path] = score + wordScore
+			} else {
+				delete(scores, path)
+			}
+		}
+	}
+	results := make([]searchResult, 0, len(scores))
+	for path, score := range scores {
+		results = append(results, searchResult{node: si.nodes[path], score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].node.RelativePath < results[j].node.RelativePath
+	})
+	return results
+}
+
+// InvalidateSearchIndex force to build again search index, when tags or peoples are changed
+func (fm *FoldersManager) InvalidateSearchIndex() {
+	fm.searchIndex = nil
+}
+
+func (fm *FoldersManager) getSearchIndex() *searchIndex {
+	if fm.searchIndex == nil || fm.searchIndex.tagsVersion != fm.tagManger.Version() {
+		index := newSearchIndex()
+		index.tagsVersion = fm.tagManger.Version()
+		foldersById := make(map[int]*Node)
+		for _, src := range fm.Sources {
+			for _, folder := range src.Files {
+				fm.indexForSearch(index, folder, nil, foldersById)
+			}
+		}
+		indexPeoples(index, foldersById, fm.getTagPath())
+		index.sortWords()
+		logger.GetLogger2().Info("Load search index with", len(index.words), "words")
+		fm.searchIndex = index
+	}
+	return fm.searchIndex
+}
+
+func (fm *FoldersManager) indexForSearch(index *searchIndex, node, parent *Node, foldersById map[int]*Node) {
+	if !node.IsFolder {
+		if parent != nil {
+			index.items = append(index.items, queryItem{kind: query.TypePhoto, photo: node, folder: parent})
+		}
+		index.add(node, strings.TrimSuffix(node.Name, filepath.Ext(node.Name)), fileNameWeight)
+		if fm.tagManger != nil {
+			for _, tag := range fm.tagManger.GetTagsByImage(node.RelativePath) {
+				index.add(node, tag.Value, tagWeight)
+			}
+		}
+		return
+	}
+	foldersById[node.Id] = node
+	index.items = append(index.items, queryItem{kind: query.TypeFolder, photo: node, folder: node})
+	index.add(node, node.Name, folderNameWeight)
+	index.add(node, node.Title, titleWeight)
+	index.add(node, node.Description, descriptionWeight)
+	if fm.tagManger != nil {
+		for _, tag := range fm.tagManger.GetTagsByFolder(strings.TrimPrefix(node.RelativePath, "/")) {
+			index.add(node, tag.Value, tagWeight)
+		}
+	}
+	for _, file := range node.Files {
+		fm.indexForSearch(index, file, node, foldersById)
+	}
+}
+
+// indexPeoples add names of peoples on tagged photos and on their folders
+func indexPeoples(index *searchIndex, foldersById map[int]*Node, tagPath string) {
+	peoples, err := people_tag.GetPeoples(tagPath)
+	if err != nil {
+		return
+	}
+	ptm := people_tag.NewPeopleTagManager(tagPath)
+	for _, people := range peoples {
+		for _, idFolder := range ptm.SearchAllFolder(people.Id) {
+			folder, exist := foldersById[idFolder]
+			if !exist {
+				continue
+			}
+			index.add(folder, people.Name, peopleWeight)
+			for _, path := range ptm.Search(idFolder, people.Id) {
+				if image, exist := folder.Files[filepath.Base(path)]; exist {
+					index.add(image, people.Name, peopleWeight)
+				}
+			}
+		}
+	}
+}
+
+// Search return folders and photos matching query, best first
+func (fm *FoldersManager) Search(query string) []*Node {
+	results := fm.getSearchIndex().Search(query)
+	nodes := make([]*Node, len(results))
+	for i, result := range results {
+		nodes[i] = result.node
+	}
+	return nodes
+}
+
+// searchPhotos search folders and photos with words (prefix accepted), only in readable folders
+func (s Server) searchPhotos(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	canRead := s.canReadFolder(r)
+	canReadImage := newImageReadChecker(canRead)
+	nodes := make([]*Node, 0)
+	for _, node := range s.newRatingsFilter(r).filter(s.foldersManager.Search(r.FormValue("query"))) {
+		if len(nodes) >= limit {
+			break
+		}
+		if (node.IsFolder && canRead(strings.TrimPrefix(node.RelativePath, "/"))) || (!node.IsFolder && canReadImage(node)) {
+			nodes = append(nodes, node)
+		}
+	}
+	if data, err := json.Marshal(imagesResponse{Files: s.setUserRatings(s.convertPaths(nodes, false), r)}); err == nil {
+		write(data, w)
+	}
+}
@@ -0,0 +1,31 @@
+package photos_server
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	fm, _, _ := createFakeStructure(t)
+	folder1 := fm.Sources["root"].Files["folder1"]
+	folder1.Title = "Vacances à la mer"
+	folder1.Description = "Été avec les cousins"
+	fm.tagManger.addTagInMap(tagsOfFolders, "root/folder2", Tag{Value: "Montagne", Color: "blue"})
+
+	if results := fm.Search("ETE vac"); len(results) != 1 || results[0] != folder1 {
+		t.Error("Must find folder1 without accent and with prefix", results)
+	}
+	if results := fm.Search("mont"); len(results) != 1 || results[0].Name != "folder2" {
+		t.Error("Must find folder2 by tag", results)
+	}
+	results := fm.Search("fi")
+	if len(results) != 2 || filepath.Base(results[0].RelativePath) != "first.txt" || filepath.Base(results[1].RelativePath) != "fifth.txt" {
+		t.Error("Must find first and fifth images", results)
+	}
+	if results := fm.Search("folder1"); len(results) != 1 || !results[0].IsFolder {
+		t.Error("Exact folder name must be found", results)
+	}
+	if results := fm.Search("mer montagne"); len(results) != 0 {
+		t.Error("All words must match", results)
+	}
+}
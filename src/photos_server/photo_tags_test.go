@@ -0,0 +1,60 @@
+package photos_server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTagImages(t *testing.T) {
+	fm, _, _ := createFakeStructure(t)
+	tm := fm.tagManger
+	exists := func(path string) bool {
+		node, _, err := fm.FindNode(path)
+		return err == nil && !node.IsFolder
+	}
+	if tm.AddTagByImages([]string{"root/folder1/unknown.txt"}, "Plage", "blue", exists) == nil {
+		t.Error("Unknown photo must be rejected")
+	}
+	if err := tm.AddTagByImages([]string{"/root/folder1/first.txt", "root/folder2/fifth.txt"}, "Plage", "blue", exists); err != nil {
+		t.Fatal("Photos must be tagged", err)
+	}
+	if tags := tm.GetTagsByImage("/root/folder1/first.txt"); len(tags) != 1 || tags[0].Value != "Plage" {
+		t.Error("Photo must be tagged", tags)
+	}
+	if len(tm.GetTagsByDate("20200502")) != 1 {
+		t.Error("Day of photos must be tagged")
+	}
+	if len(tm.FilterFolder("Plage")) != 0 {
+		t.Error("Folder must not be tagged while some photos are not")
+	}
+	tm.AddTagByImages([]string{"root/folder2/quater.txt"}, "Plage", "blue", exists)
+	if folders := tm.FilterFolder("Plage"); !reflect.DeepEqual(folders, []string{"root/folder2"}) {
+		t.Error("Folder must be tagged when all photos are", folders)
+	}
+	expected := []string{"root/folder1/first.txt", "root/folder2/fifth.txt", "root/folder2/quater.txt"}
+	if paths := tm.FilterImages("Plage"); !reflect.DeepEqual(paths, expected) {
+		t.Error("Bad tagged photos", paths)
+	}
+
+	tm.RemoveByImages([]string{"root/folder2/fifth.txt"}, "Plage", "blue")
+	if len(tm.FilterFolder("Plage")) != 1 || len(tm.GetTagsByImage("root/folder2/fifth.txt")) != 0 {
+		t.Error("Only tag of photo must be removed, not tag of folder")
+	}
+	tm.AddTagByImages([]string{"root/folder2/fifth.txt"}, "Plage", "blue", exists)
+	if len(tm.GetTagsByImage("root/folder2/fifth.txt")) != 0 {
+		t.Error("Photo of a tagged folder must not be tagged again")
+	}
+	tm.RemoveByImages([]string{"root/folder1/first.txt"}, "Plage", "blue")
+	if len(tm.GetTagsByDate("20200502")) != 1 {
+		t.Error("Day must stay tagged while a folder of its photos has the tag")
+	}
+	expected = []string{"root/folder2/fifth.txt", "root/folder2/quater.txt"}
+	if paths := tm.FilterImages("Plage"); !reflect.DeepEqual(paths, expected) {
+		t.Error("Photos of tagged folder must stay tagged", paths)
+	}
+	tm.RemoveByFolder("root/folder2", "Plage", "blue")
+	tm.RemoveByImages([]string{"root/folder2/quater.txt"}, "Plage", "blue")
+	if len(tm.GetTagsByDate("20200502")) != 0 || len(tm.FilterImages("Plage")) != 0 {
+		t.Error("Tag must be removed of day and photos")
+	}
+}
@@ -7,9 +7,12 @@ import (
 	"github.com/jotitan/photos_server/config"
 	"github.com/jotitan/photos_server/logger"
 	"github.com/jotitan/photos_server/people_tag"
+	"github.com/jotitan/photos_server/persistence"
 	"github.com/jotitan/photos_server/progress"
 	"github.com/jotitan/photos_server/remote_control"
+	"github.com/jotitan/photos_server/resize"
 	"github.com/jotitan/photos_server/security"
+	"github.com/jotitan/photos_server/storage"
 	"github.com/jotitan/photos_server/video"
 	"io"
 	"io/ioutil"
@@ -35,12 +38,15 @@ type Server struct {
 	remoteManager  remote_control.RemoteManager
 	custom         config.CustomConfig
 	faceDetector   *people_tag.FaceDetector
+	folderWatcher  *FolderWatcher
+	resizeCache    *resizeCache
+	storage        *storage.StorageManager
 }
 
 // Create security access from good provider
 func (s *Server) setSecurityAccess(conf *config.Config) {
 	if s.foldersManager.garbageManager != nil {
-		s.securityAccess = security.NewSecurityAccess(conf.Security, conf.Security.MaskForAdmin, []byte(conf.Security.HS256SecretKey))
+		s.securityAccess = security.NewSecurityAccess(conf.Security, conf.Security.MaskForAdmin, []byte(conf.Security.HS256SecretKey), conf.Persistence.GetFolder())
 		s.securityServer = security.NewSecurityServer(s.securityAccess)
 		// Check if basic or provider is enabled
 		s.securityAccess.SetAccessProvider(security.NewAccessProvider(conf.Security))
@@ -48,6 +54,8 @@ func (s *Server) setSecurityAccess(conf *config.Config) {
 }
 
 func NewPhotosServerFromConfig(conf *config.Config) Server {
+	persistence.Configure(conf.Persistence.Snapshots, time.Duration(conf.Persistence.SnapshotInterval)*time.Minute)
+	persistence.Register("peoples", filepath.Join(conf.Persistence.GetFolder(), "peoples_tag.list"), nil)
 	uploadProgressManager := progress.NewUploadProgressManager()
 	s := Server{
 		foldersManager:        NewFoldersManager(*conf, uploadProgressManager),
@@ -56,8 +64,13 @@ func NewPhotosServerFromConfig(conf *config.Config) Server {
 		uploadProgressManager: uploadProgressManager,
 		remoteManager:         remote_control.NewRemoteManager(),
 		custom:                conf.Custom,
-		faceDetector:          people_tag.NewFaceDetector(conf.PhotoConfig.UrlFaceDetector, getTagPath()),
+		faceDetector:          people_tag.NewFaceDetector(conf.PhotoConfig.UrlFaceDetector, conf.Persistence.GetFolder()),
 	}
+	s.folderWatcher = NewFolderWatcher(conf.Watcher, s.foldersManager)
+	s.resizeCache = newResizeCache(conf.CacheFolder, conf.PhotoConfig.OnDemand)
+	s.storage = storage.NewStorageManager(*conf)
+	s.foldersManager.storage = s.storage
+	s.videoManager.SetStorage(s.storage)
 	if err := s.videoManager.Load(); err != nil {
 		logger.GetLogger2().Error("Impossible to launch video manager", err)
 	}
@@ -124,7 +137,11 @@ func (s Server) filterByFct(w http.ResponseWriter, r *http.Request, filter func(
 func (s Server) getPhotosByDate(w http.ResponseWriter, r *http.Request) {
 	if date, err := time.Parse("20060102", r.FormValue("date")); err == nil {
 		if photos, exist := s.foldersManager.GetPhotosByDate()[date]; exist {
-			converts := s.convertPathsFromInterface(photos, false)
+			nodes := make([]*Node, len(photos))
+			for i, photo := range photos {
+				nodes[i] = photo.(*Node)
+			}
+			converts := s.setUserRatings(s.convertPaths(s.newRatingsFilter(r).filter(newMetadataFilter(r).filter(nodes)), false), r)
 			response := imagesResponse{Files: converts, Tags: s.foldersManager.tagManger.GetTagsByDate(r.FormValue("date"))}
 			header(w)
 			if data, err := json.Marshal(response); err == nil {
@@ -135,8 +152,8 @@ func (s Server) getPhotosByDate(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s Server) searchVideos(w http.ResponseWriter, r *http.Request) {
-	results := s.videoManager.Search(r.FormValue("query"))
-	convertResults := s.convertVideoPaths(results, false)
+	results := s.newRatingsFilter(r).filterVideos(s.videoManager.Search(r.FormValue("query")))
+	convertResults := s.setUserRatings(s.convertVideoPaths(results, false), r)
 	if data, err := json.Marshal(imagesResponse{Files: convertResults}); err == nil {
 		w.Write(data)
 	}
@@ -145,7 +162,11 @@ func (s Server) searchVideos(w http.ResponseWriter, r *http.Request) {
 func (s Server) getVideosByDate(w http.ResponseWriter, r *http.Request) {
 	if date, err := time.Parse("20060102", r.FormValue("date")); err == nil {
 		if videos, exist := s.videoManager.GetVideosByDate()[date]; exist {
-			converts := s.convertVideosPathsFromInterface(videos, false)
+			nodes := make([]*video.VideoNode, len(videos))
+			for i, node := range videos {
+				nodes[i] = node.(*video.VideoNode)
+			}
+			converts := s.setUserRatings(s.convertVideoPaths(s.newRatingsFilter(r).filterVideos(nodes), false), r)
 			response := imagesResponse{Files: converts, Tags: s.foldersManager.tagManger.GetTagsByDate(r.FormValue("date"))}
 			header(w)
 			if data, err := json.Marshal(response); err == nil {
@@ -177,6 +198,79 @@ func (s Server) updateTagsByDate(w http.ResponseWriter, r *http.Request) {
 	s.updateTag(w, r, r.URL.Path[12:], s.foldersManager.tagManger.AddTagByDate, s.foldersManager.tagManger.RemoveByDate)
 }
 
+type imagesTagDto struct {
+	// Paths of photos or videos
+	Paths    []string
+	Value    string
+	Color    string
+	ToRemove bool
+}
+
+// updateTagsByImages add or remove a tag on a selection of photos or videos
+func (s Server) updateTagsByImages(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only post is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, _ := io.ReadAll(r.Body)
+	var tag imagesTagDto
+	if err := json.Unmarshal(data, &tag); err != nil || tag.Value == "" {
+		http.Error(w, "bad tag", http.StatusBadRequest)
+		return
+	}
+	tagManager := s.foldersManager.tagManger
+	if tag.ToRemove {
+		tagManager.RemoveByImages(tag.Paths, tag.Value, tag.Color)
+	} else if err := tagManager.AddTagByImages(tag.Paths, tag.Value, tag.Color, s.itemExists); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	write([]byte("success"), w)
+}
+
+// itemExists check if path is a photo or a video
+func (s Server) itemExists(path string) bool {
+	if node, _, err := s.foldersManager.FindNode(path); err == nil {
+		return !node.IsFolder
+	}
+	if s.videoManager != nil {
+		if node, _, err := s.videoManager.FindVideoNode(path); err == nil {
+			return !node.IsFolder
+		}
+	}
+	return false
+}
+
+// getTagsOfImage return tags of a photo or a video
+func (s Server) getTagsOfImage(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	if !s.canReadItem(r.FormValue("path"), false, r) {
+		error403(w, r)
+		return
+	}
+	data, _ := json.Marshal(s.foldersManager.tagManger.GetTagsByImage(r.FormValue("path")))
+	write(data, w)
+}
+
+// filterTagsImages return photos and videos with tag (value), tagged directly or by their folder
+func (s Server) filterTagsImages(w http.ResponseWriter, r *http.Request) {
+	s.writeItemsOfPaths(w, r, s.foldersManager.tagManger.FilterImages(r.FormValue("value")))
+}
+
+// filterTagsDateImages return photos of days with tag (value)
+func (s Server) filterTagsDateImages(w http.ResponseWriter, r *http.Request) {
+	s.writeItemsOfPaths(w, r, s.foldersManager.tagManger.FilterDateImages(r.FormValue("value")))
+}
+
+func (s Server) writeItemsOfPaths(w http.ResponseWriter, r *http.Request, paths []string) {
+	header(w)
+	files := s.setUserRatings(s.convertItemPaths(paths, r), r)
+	if data, err := json.Marshal(imagesResponse{Files: files}); err == nil {
+		write(data, w)
+	}
+}
+
 func (s Server) updateTag(w http.ResponseWriter, r *http.Request, key string, updateTag func(string, string, string) error, removeTag func(string, string, string)) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	if r.Method != "POST" {
@@ -224,9 +318,9 @@ type tagRequest struct {
 	Deleted []string `json:"deleted"`
 }
 
-func getTagPath() string {
-	wd, _ := os.Getwd()
-	return wd
+// getTagPath return folder of peoples tags, the state folder
+func (fm *FoldersManager) getTagPath() string {
+	return fm.stateFolder
 }
 
 func (s Server) tagFolder(w http.ResponseWriter, r *http.Request) {
@@ -240,11 +334,12 @@ func (s Server) tagFolder(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	ptm := people_tag.NewPeopleTagManager(getTagPath())
+	ptm := people_tag.NewPeopleTagManager(s.foldersManager.getTagPath())
 	for _, tag := range tags {
 		ptm.Tag(tag.Folder, tag.Tag, tag.Paths, tag.Deleted)
 	}
 	ptm.Flush()
+	s.foldersManager.InvalidateSearchIndex()
 	w.Write([]byte("ok"))
 }
 
@@ -260,17 +355,23 @@ func (s Server) launchFaceDetection(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Folder unknown", http.StatusNotFound)
 		return
 	}
-	nbTags, nbPeople, err := s.faceDetector.Launch(folderId, subPath)
+	nbTags, nbPeople, faces, err := s.faceDetector.Launch(folderId, subPath)
 	if err != nil {
 		logger.GetLogger().Error("Error when launching face detector", err)
 		http.Error(w, "error during launch", http.StatusBadRequest)
 		return
 	}
-	w.Write([]byte(fmt.Sprintf("{\"tags\":%d,\"faces\":%d}", nbTags, nbPeople)))
+	// Square thumbnails are cropped again around faces, progress is followed with id (empty if nothing to crop)
+	id := ""
+	if progresser := s.foldersManager.UpdateFaces(node, faces); progresser != nil {
+		id = progresser.GetId()
+	}
+	s.foldersManager.InvalidateSearchIndex()
+	w.Write([]byte(fmt.Sprintf("{\"tags\":%d,\"faces\":%d,\"id\":\"%s\"}", nbTags, nbPeople, id)))
 }
 
 func (s Server) getPeoples(w http.ResponseWriter, r *http.Request) {
-	if peoples, err := people_tag.GetPeoplesAsByte(getTagPath()); err == nil {
+	if peoples, err := people_tag.GetPeoplesAsByte(s.foldersManager.getTagPath()); err == nil {
 		w.Write(peoples)
 	} else {
 		w.Write([]byte("[]"))
@@ -279,7 +380,7 @@ func (s Server) getPeoples(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s Server) addPeopleTag(w http.ResponseWriter, r *http.Request) {
-	if id, err := people_tag.AddPeopleTag(getTagPath(), r.FormValue("name")); err == nil {
+	if id, err := people_tag.AddPeopleTag(s.foldersManager.getTagPath(), r.FormValue("name")); err == nil {
 		w.Write([]byte(fmt.Sprintf("%d", id)))
 	} else {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -292,7 +393,7 @@ func (s Server) filterFolder(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 	}
-	ptm := people_tag.NewPeopleTagManager(getTagPath())
+	ptm := people_tag.NewPeopleTagManager(s.foldersManager.getTagPath())
 	folders := ptm.SearchAllFolder(idTag)
 	data, _ := json.Marshal(folders)
 	w.Write(data)
@@ -304,7 +405,7 @@ func (s Server) searchTagsOfFolder(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	ptm := people_tag.NewPeopleTagManager(getTagPath())
+	ptm := people_tag.NewPeopleTagManager(s.foldersManager.getTagPath())
 	data, _ := json.Marshal(ptm.SearchFolder(idFolder))
 	w.Write(data)
 
@@ -318,12 +419,20 @@ func (s Server) searchTag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	logger.GetLogger2().Info("Search tag folder", idFolder, idTag)
-	ptm := people_tag.NewPeopleTagManager(getTagPath())
+	ptm := people_tag.NewPeopleTagManager(s.foldersManager.getTagPath())
 	results := ptm.Search(idFolder, idTag)
 	data, _ := json.Marshal(results)
 	w.Write(data)
 }
 
+// canReadItem check that user can read photo (folder of photo must be readable) or video
+func (s Server) canReadItem(path string, isVideo bool, r *http.Request) bool {
+	if isVideo {
+		return s.securityServer.CanAccessUser(r)
+	}
+	return s.securityServer.CanReadPath(strings.Trim(filepath.ToSlash(filepath.Dir(cleanRelativePath(path))), "/"), r)
+}
+
 func error403(w http.ResponseWriter, r *http.Request) {
 	logger.GetLogger2().Info("Try to action by", r.Referer(), r.URL)
 	http.Error(w, "You can't execute this action", 403)
@@ -341,6 +450,149 @@ func (s Server) checkPhotoResizer(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// duplicates list groups of same images (GET) or move selected copies to garbage (POST with list of paths)
+func (s Server) duplicates(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	switch r.Method {
+	case http.MethodGet:
+		data, _ := json.Marshal(s.foldersManager.GetDuplicates())
+		write(data, w)
+	case http.MethodPost:
+		data, _ := io.ReadAll(r.Body)
+		paths := make([]string, 0)
+		if err := json.Unmarshal(data, &paths); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if success, err := s.foldersManager.RemoveDuplicates(paths); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			write([]byte(fmt.Sprintf("{\"success\":%d,\"errors\":%d}", success, len(paths)-success)), w)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// similarImages return groups of images visually identical, in a folder or in all library
+func (s Server) similarImages(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	distance, _ := strconv.Atoi(r.FormValue("distance"))
+	burst, _ := strconv.Atoi(r.FormValue("burst"))
+	if groups, err := s.foldersManager.GetSimilarImages(r.FormValue("folder"), distance, time.Duration(burst)*time.Second); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else {
+		data, _ := json.Marshal(groups)
+		write(data, w)
+	}
+}
+
+// computeHashes compute in background hash of images indexed without
+func (s Server) computeHashes(w http.ResponseWriter, r *http.Request) {
+	go s.foldersManager.ComputeMissingHashes()
+	write([]byte("Hashes computing launched"), w)
+}
+
+// resizeProfiles count missing and stale reduced images by profile (GET) or regenerate them in background (POST)
+func (s Server) resizeProfiles(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	switch r.Method {
+	case http.MethodGet:
+		data, _ := json.Marshal(s.foldersManager.CheckProfiles())
+		write(data, w)
+	case http.MethodPost:
+		if progresser, err := s.foldersManager.RegenerateProfiles(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			write([]byte(fmt.Sprintf("{\"status\":\"running\",\"id\":\"%s\"}", progresser.GetId())), w)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// resizeQueueStatus return state of resize queue (GET) or add again images which resize failed (POST)
+func (s Server) resizeQueueStatus(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	switch r.Method {
+	case http.MethodGet:
+		data, _ := json.Marshal(s.foldersManager.reducer.ResizeQueueStatus())
+		write(data, w)
+	case http.MethodPost:
+		if progresser, err := s.foldersManager.RetryFailedResizes(); err != nil {
+			http.Error(w, err.Error(), 404)
+		} else {
+			write([]byte(fmt.Sprintf("{\"status\":\"running\",\"id\":\"%s\"}", progresser.GetId())), w)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkCache return report of last verification of cache (GET) or launch a verification, with repair if dryrun is not true (POST)
+func (s Server) checkCache(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	switch r.Method {
+	case http.MethodGet:
+		report := GetCacheReport()
+		if report == nil {
+			http.Error(w, "cache never verified", 404)
+			return
+		}
+		data, _ := json.Marshal(report)
+		write(data, w)
+	case http.MethodPost:
+		if progresser, err := s.foldersManager.LaunchCacheCheck(strings.EqualFold(r.FormValue("dryrun"), "true")); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			write([]byte(fmt.Sprintf("{\"status\":\"running\",\"id\":\"%s\"}", progresser.GetId())), w)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s Server) getWatcherStatus(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	data, _ := json.Marshal(s.folderWatcher.Status())
+	write(data, w)
+}
+
+// storageUsage return disk usage of each storage area (GET) or compute it again (POST)
+func (s Server) storageUsage(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	var usage storage.Usage
+	switch r.Method {
+	case http.MethodGet:
+		usage = s.storage.Usage()
+	case http.MethodPost:
+		usage = s.storage.Compute()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, _ := json.Marshal(usage)
+	write(data, w)
+}
+
+// snapshots list snapshots of state files (GET) or rollback a file to a snapshot (POST with file and snapshot)
+func (s Server) snapshots(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		header(w)
+		data, _ := json.Marshal(persistence.GetStateFiles())
+		write(data, w)
+	case http.MethodPost:
+		if err := persistence.RollbackStateFile(r.FormValue("file"), r.FormValue("snapshot")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			write([]byte("Rollback done"), w)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 func (s Server) getCustomConfig(w http.ResponseWriter, r *http.Request) {
 	data, _ := json.Marshal(s.custom)
 	w.Write(data)
@@ -597,6 +849,9 @@ func (s Server) deleteVideo(w http.ResponseWriter, r *http.Request) {
 	if err := s.videoManager.Delete(path, s.foldersManager.garbageManager.MoveOriginalFileFromPath); err != nil {
 		http.Error(w, err.Error(), 400)
 	} else {
+		s.foldersManager.albumManager.RemovePaths([]string{path})
+		s.foldersManager.ratingsManager.RemovePaths([]string{path})
+		s.foldersManager.tagManger.RemoveImages([]string{path})
 		write([]byte("{\"success\":true}"), w)
 	}
 }
@@ -677,12 +932,24 @@ func (s Server) getCover(w http.ResponseWriter, r *http.Request) {
 	error404(w, r)
 }
 
+// image return a reduced image of cache. With size (name of a profile), path is the path of photo
 func (s Server) image(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path[7:]
 	if !s.securityServer.CanReadPath(getCleanPath(path), r) {
 		error403(w, r)
 		return
 	}
+	if size := r.FormValue("size"); size != "" {
+		node, _, err := s.foldersManager.FindNode(path)
+		if err != nil || node.IsFolder {
+			http.Error(w, "Impossible to find image", 404)
+			return
+		}
+		if path = s.foldersManager.getProfileImageName(*node, size); path == "" {
+			http.Error(w, "Unknown size "+size, 400)
+			return
+		}
+	}
 	s.writeImage(w, filepath.Join(s.foldersManager.reducer.GetCache(), path))
 }
 
@@ -694,17 +961,25 @@ func getCleanPath(path string) string {
 }
 
 func (s Server) writeImage(w http.ResponseWriter, path string) {
-	w.Header().Set("Content-type", "image/jpeg")
 	if file, err := os.Open(path); err == nil {
 		defer file.Close()
-		if _, e := io.Copy(w, file); e != nil {
-			http.Error(w, "Error during image rendering", 404)
-		}
+		s.writeImageFile(w, file)
 	} else {
 		http.Error(w, "Image not found", 404)
 	}
 }
 
+// writeImageFile write content of an opened image, content type is defined by its name
+func (s Server) writeImageFile(w http.ResponseWriter, file *os.File) {
+	w.Header().Set("Content-type", "image/jpeg")
+	if strings.EqualFold(filepath.Ext(file.Name()), "."+formatPng) {
+		w.Header().Set("Content-type", "image/png")
+	}
+	if _, e := io.Copy(w, file); e != nil {
+		http.Error(w, "Error during image rendering", 404)
+	}
+}
+
 func (s Server) removeNode(w http.ResponseWriter, r *http.Request) {
 	header(w)
 	if s.foldersManager.garbageManager == nil {
@@ -735,6 +1010,62 @@ func (s Server) imageHD(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// imageRaw download RAW original of a photo (path of photo or of RAW file)
+func (s Server) imageRaw(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path[10:]
+	if !s.securityServer.CanReadPath(getCleanPath(path), r) {
+		error403(w, r)
+		return
+	}
+	node, _, err := s.foldersManager.FindNode(path)
+	if err != nil || node.GetRawPath() == "" {
+		http.Error(w, "Impossible to find raw image", 404)
+		return
+	}
+	rawPath := node.GetRawAbsolutePath(s.foldersManager.Sources)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(rawPath)))
+	http.ServeFile(w, r, rawPath)
+}
+
+// imageResize return photo resized on demand (/imageresize/<path>?width=&height=), sizes are rounded to allowed ones
+func (s Server) imageResize(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path[13:]
+	if !s.securityServer.CanReadPath(getCleanPath(path), r) {
+		error403(w, r)
+		return
+	}
+	node, _, err := s.foldersManager.FindNode(path)
+	if err != nil || node.IsFolder {
+		http.Error(w, "Impossible to find image", 404)
+		return
+	}
+	width, _ := strconv.ParseUint(r.FormValue("width"), 10, 32)
+	height, _ := strconv.ParseUint(r.FormValue("height"), 10, 32)
+	if width == 0 && height == 0 {
+		http.Error(w, "width or height is mandatory", 400)
+		return
+	}
+	conversion := resize.ImageToResize{Width: s.resizeCache.clamp(uint(width)), Height: s.resizeCache.clamp(uint(height))}
+	original := node.GetAbsolutePath(s.foldersManager.Sources)
+	// A new version of original (other content) change name of resized image
+	version := node.Hash
+	if info, err := os.Stat(original); err == nil {
+		version += info.ModTime().String()
+	}
+	key := variantKey(node.RelativePath, conversion.Width, conversion.Height, version)
+	resized, err := s.resizeCache.Get(key, func(to string) error {
+		conversion.To = to
+		return s.foldersManager.reducer.ResizeOnDemand(original, node.RelativePath, conversion)
+	})
+	if err != nil {
+		logger.GetLogger2().Error("Impossible to resize on demand", path, err)
+		http.Error(w, "Impossible to resize image", 500)
+		return
+	}
+	defer resized.Close()
+	s.writeImageFile(w, resized)
+}
+
 func (s Server) update(w http.ResponseWriter, r *http.Request) {
 	logger.GetLogger2().Info("Launch update")
 	if err := s.foldersManager.Update(); err != nil {
@@ -956,7 +1287,7 @@ func (s Server) browseRestfulVideo(w http.ResponseWriter, r *http.Request) {
 		for _, file := range node.Files {
 			nodes = append(nodes, file)
 		}
-		folder := folderRestFul{Name: node.Name, Children: s.convertVideoPaths(nodes, false)}
+		folder := folderRestFul{Name: node.Name, Children: s.setUserRatings(s.convertVideoPaths(s.newRatingsFilter(r).filterVideos(nodes), false), r)}
 		if s.securityServer.CanAccessAdmin(r) {
 			folder.RemoveFolderUrl = fmt.Sprintf("/video/folder?path=%s", path[1:])
 			folder.UpdateExifFolderUrl = fmt.Sprintf("/video/folder/exif?path=%s", path[1:])
@@ -977,13 +1308,18 @@ func (s Server) browseRestful(w http.ResponseWriter, r *http.Request) {
 	// Return all tree
 	header(w)
 	path := r.URL.Path[9:]
+	if strings.HasPrefix(path[1:], smartAlbumsFolder+"/") {
+		// Content is also filtered by rights of user
+		s.browseSmartAlbum(w, r, path[1:])
+		return
+	}
 	if !s.securityServer.CanReadPath(path[1:], r) {
 		error403(w, r)
 		return
 	}
 	logger.GetLogger2().Info("Browse restfull receive request", path)
 	if files, node, err := s.foldersManager.Browse(path); err == nil {
-		formatedFiles := s.convertPaths(files, false)
+		formatedFiles := s.setUserRatings(s.convertPaths(s.newRatingsFilter(r).filter(newMetadataFilter(r).filter(files)), false), r)
 		tags := s.foldersManager.tagManger.GetTagsByFolder(path[1:])
 		folderResponse := imagesResponse{Id: node.Id,
 			Files:         formatedFiles,
@@ -1062,12 +1398,21 @@ type imagesResponse struct {
 type imageRestFul struct {
 	Name          string
 	ThumbnailLink string
+	SquareLink    string
 	ImageLink     string
 	HdLink        string
 	Width         int
 	Height        int
 	Date          time.Time
 	Orientation   int
+	Metadata      *PhotoMetadata `json:",omitempty"`
+	Path          string
+	Tags          []*Tag `json:",omitempty"`
+	// Favorite and rating of connected user
+	Favorite bool `json:",omitempty"`
+	Rating   int  `json:",omitempty"`
+	// Download link of RAW original, if any
+	RawLink string `json:",omitempty"`
 }
 
 type folderRestFul struct {
@@ -1085,11 +1430,21 @@ type folderRestFul struct {
 }
 
 func (s Server) newImageRestful(node *Node) imageRestFul {
-	return imageRestFul{
-		Name: node.Name, Width: node.Width, Height: node.Height, Date: node.Date,
+	restful := imageRestFul{
+		Name: node.Name, Width: node.Width, Height: node.Height, Date: node.Date, Metadata: node.Metadata, Path: node.RelativePath,
+		Tags:          s.foldersManager.tagManger.GetTagsByImage(node.RelativePath),
 		HdLink:        filepath.ToSlash(filepath.Join("/imagehd", node.RelativePath)),
 		ThumbnailLink: filepath.ToSlash(filepath.Join("/image", s.foldersManager.GetSmallImageName(*node))),
+		SquareLink:    filepath.ToSlash(filepath.Join("/image", node.RelativePath)) + "?size=" + squareProfile,
 		ImageLink:     filepath.ToSlash(filepath.Join("/image", s.foldersManager.GetMiddleImageName(*node)))}
+	if node.GetRawPath() != "" {
+		restful.RawLink = filepath.ToSlash(filepath.Join("/imageraw", node.RelativePath))
+	}
+	if node.HasPreview() {
+		// Browsers can't display RAW and HEIC, show preview extracted in cache
+		restful.HdLink = filepath.ToSlash(filepath.Join("/image", s.foldersManager.GetPreviewImageName(*node)))
+	}
+	return restful
 }
 
 func (s Server) convertPathsFromInterface(nodes []common.INode, onlyFolders bool) []interface{} {
@@ -1153,6 +1508,26 @@ func (s Server) convertVideoPaths(nodes []*video.VideoNode, onlyFolders bool) []
 	return files
 }
 
+// convertItemPaths convert paths of photos or videos readable by user
+func (s Server) convertItemPaths(paths []string, r *http.Request) []interface{} {
+	files := make([]interface{}, 0, len(paths))
+	canReadVideos := s.securityServer.CanAccessUser(r)
+	for _, path := range paths {
+		if node, _, err := s.foldersManager.FindNode(path); err == nil && !node.IsFolder {
+			if s.canReadItem(path, false, r) {
+				files = append(files, s.convertPaths([]*Node{node}, false)...)
+			}
+			continue
+		}
+		if canReadVideos && s.videoManager != nil {
+			if node, _, err := s.videoManager.FindVideoNode(path); err == nil && !node.IsFolder {
+				files = append(files, s.convertVideoPaths([]*video.VideoNode{node}, false)...)
+			}
+		}
+	}
+	return files
+}
+
 func (s Server) getVideosChildren(n *video.VideoNode) []interface{} {
 	children := make([]*video.VideoNode, 0, len(n.Files))
 
@@ -1204,6 +1579,7 @@ func (s Server) Launch(conf *config.Config) {
 	server.HandleFunc("/share", s.buildHandler(s.securityServer.NeedAdmin, s.manageShare))
 	server.HandleFunc("/", s.buildHandler(s.securityServer.NeedNoAccess, s.defaultHandle))
 
+	s.foldersManager.ResumeResizes()
 	logger.GetLogger2().Info("Start server on port " + conf.Port)
 	err := http.ListenAndServe(":"+conf.Port, &server)
 	logger.GetLogger2().Error("Server stopped cause", err)
@@ -0,0 +1,375 @@
+package photos_server
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jotitan/photos_server/people_tag"
+	"github.com/jotitan/photos_server/query"
+	"github.com/jotitan/photos_server/video"
+)
+
+/* Search photos, folders and videos with a structured query (tag:noel person:12 after:2019-01-01 type:video...) */
+
+const defaultQueryPageSize = 50
+
+type queryResultDto struct {
+	// photo, video or folder
+	Type string
+	Item interface{}
+}
+
+type queryResponse struct {
+	Total   int
+	Page    int
+	Size    int
+	Results []queryResultDto
+}
+
+// queryItem is a photo, a folder or a video which can be returned by a query
+type queryItem struct {
+	kind  string
+	photo *Node
+	// Folder of photo (or folder itself)
+	folder *Node
+	video  *video.VideoNode
+}
+
+func (qi queryItem) relativePath() string {
+	if qi.video != nil {
+		return qi.video.RelativePath
+	}
+	return qi.photo.RelativePath
+}
+
+func (qi queryItem) date() time.Time {
+	if qi.video != nil {
+		return qi.video.Metadata.Date
+	}
+	return qi.photo.Date
+}
+
+// queryEvaluator check terms of query on items, computing once results of costly terms (text, person)
+type queryEvaluator struct {
+	fm *FoldersManager
+	// For each free text, matching photos and folders
+	texts map[string]map[*Node]struct{}
+	// For each person term, ids of peoples
+	peoples map[string][]int
+	// Name of people by id
+	peopleNames map[int]string
+	// For each people, photos names by folder id
+	peopleTags  map[int]map[int]map[string]struct{}
+	tagsManager *people_tag.PeopleTagManager
+	// Favorites and ratings of user
+	ratings UserRatings
+}
+
+func newQueryEvaluator(fm *FoldersManager, expr query.Expr, ratings UserRatings) *queryEvaluator {
+	qe := &queryEvaluator{fm: fm, ratings: ratings, texts: make(map[string]map[*Node]struct{}), peoples: make(map[string][]int),
+		peopleNames: make(map[int]string), peopleTags: make(map[int]map[int]map[string]struct{})}
+	for _, term := range query.Terms(expr) {
+		switch term.Field {
+		case query.FieldText:
+			qe.loadText(term.Value)
+		case query.FieldPerson:
+			qe.loadPerson(term.Value)
+		}
+	}
+	return qe
+}
+
+func (qe *queryEvaluator) loadText(text string) {
+	if _, exist := qe.texts[text]; exist {
+		return
+	}
+	nodes := make(map[*Node]struct{})
+	for _, node := range qe.fm.Search(text) {
+		nodes[node] = struct{}{}
+	}
+	qe.texts[text] = nodes
+}
+
+// loadPerson find peoples by id or by name and their tagged photos
+func (qe *queryEvaluator) loadPerson(value string) {
+	if qe.tagsManager == nil {
+		qe.tagsManager = people_tag.NewPeopleTagManager(qe.fm.getTagPath())
+		if peoples, err := people_tag.GetPeoples(qe.fm.getTagPath()); err == nil {
+			for _, people := range peoples {
+				qe.peopleNames[people.Id] = people.Name
+			}
+		}
+	}
+	ids := make([]int, 0, 1)
+	if id, err := strconv.Atoi(value); err == nil {
+		ids = append(ids, id)
+	} else {
+		for id, name := range qe.peopleNames {
+			if normalizeText(name) == normalizeText(value) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	qe.peoples[value] = ids
+	for _, id := range ids {
+		if _, exist := qe.peopleTags[id]; exist {
+			continue
+		}
+		folders := make(map[int]map[string]struct{})
+		for _, idFolder := range qe.tagsManager.SearchAllFolder(id) {
+			names := make(map[string]struct{})
+			for _, path := range qe.tagsManager.Search(idFolder, id) {
+				names[filepath.Base(path)] = struct{}{}
+			}
+			folders[idFolder] = names
+		}
+		qe.peopleTags[id] = folders
+	}
+}
+
+func (qe *queryEvaluator) match(item queryItem, term query.Term) bool {
+	switch term.Field {
+	case query.FieldType:
+		return item.kind == term.Value
+	case query.FieldIn:
+		folder := normalizeText(strings.Trim(term.Value, "/"))
+		path := normalizeText(strings.TrimPrefix(filepath.ToSlash(item.relativePath()), "/"))
+		return path == folder || strings.HasPrefix(path, folder+"/")
+	case query.FieldAfter:
+		return !item.date().IsZero() && !item.date().Before(term.Date)
+	case query.FieldBefore:
+		return !item.date().IsZero() && item.date().Before(term.Date)
+	case query.FieldFavorite:
+		if item.kind == query.TypeFolder {
+			return false
+		}
+		favorite, _ := qe.ratings.Get(item.relativePath())
+		return favorite == (term.Value == "true")
+	case query.FieldRating:
+		if item.kind == query.TypeFolder {
+			return false
+		}
+		_, rating := qe.ratings.Get(item.relativePath())
+		return rating >= term.Rating
+	}
+	if item.video != nil {
+		return qe.matchVideo(item.video, term)
+	}
+	return qe.matchPhoto(item, term)
+}
+
+func (qe *queryEvaluator) matchPhoto(item queryItem, term query.Term) bool {
+	switch term.Field {
+	case query.FieldText:
+		_, exist := qe.texts[term.Value][item.photo]
+		return exist
+	case query.FieldTag:
+		if item.kind == query.TypePhoto && qe.hasImageTag(item.photo.RelativePath, term.Value) {
+			return true
+		}
+		for _, tag := range qe.fm.tagManger.GetTagsByFolder(strings.TrimPrefix(item.folder.RelativePath, "/")) {
+			if matchTag(tag.Value, term.Value) {
+				return true
+			}
+		}
+	case query.FieldPerson:
+		for _, id := range qe.peoples[term.Value] {
+			if names, exist := qe.peopleTags[id][item.folder.Id]; exist {
+				if item.kind == query.TypeFolder {
+					return true
+				}
+				if _, exist := names[item.photo.Name]; exist {
+					return true
+				}
+			}
+		}
+	case query.FieldCamera:
+		if metadata := item.photo.Metadata; metadata != nil {
+			return containsText(metadata.Make+" "+metadata.Model, term.Value)
+		}
+	case query.FieldLens:
+		if metadata := item.photo.Metadata; metadata != nil {
+			return containsText(metadata.Lens, term.Value)
+		}
+	case query.FieldPlace:
+		if place := item.photo.Place; place != nil {
+			return matchOneOf(place.Keywords(), term.Value)
+		}
+	}
+	return false
+}
+
+func (qe *queryEvaluator) matchVideo(node *video.VideoNode, term query.Term) bool {
+	switch term.Field {
+	case query.FieldText:
+		return containsText(strings.Join(append([]string{node.Name, node.Metadata.Title}, node.Metadata.Keywords...), " "), term.Value)
+	case query.FieldTag:
+		return matchOneOf(node.Metadata.Keywords, term.Value) || qe.hasImageTag(node.RelativePath, term.Value)
+	case query.FieldPerson:
+		if matchOneOf(node.Metadata.Peoples, term.Value) {
+			return true
+		}
+		for _, id := range qe.peoples[term.Value] {
+			if name, exist := qe.peopleNames[id]; exist && matchOneOf(node.Metadata.Peoples, name) {
+				return true
+			}
+		}
+	case query.FieldPlace:
+		return matchOneOf(node.Metadata.Place, term.Value)
+	}
+	return false
+}
+
+func (qe *queryEvaluator) hasImageTag(path, value string) bool {
+	for _, tag := range qe.fm.tagManger.GetTagsByImage(path) {
+		if matchTag(tag.Value, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsText(text, search string) bool {
+	return strings.Contains(normalizeText(text), normalizeText(search))
+}
+
+func matchOneOf(values []string, search string) bool {
+	for _, value := range values {
+		if normalizeText(value) == normalizeText(search) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendPhotoItems add folders and photos (from search index) of readable folders
+func appendPhotoItems(items, indexed []queryItem, canRead func(folder string) bool) []queryItem {
+	readables := make(map[*Node]bool)
+	for _, item := range indexed {
+		readable, exist := readables[item.folder]
+		if !exist {
+			readable = canRead(strings.TrimPrefix(filepath.ToSlash(item.folder.RelativePath), "/"))
+			readables[item.folder] = readable
+		}
+		if readable {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// textCandidates return photos and folders matching a free text required by expression, false if no text is required
+func (fm *FoldersManager) textCandidates(expr query.Expr, evaluator *queryEvaluator) ([]queryItem, bool) {
+	text, required := requiredText(expr)
+	if !required {
+		return nil, false
+	}
+	candidates := make([]queryItem, 0, len(evaluator.texts[text]))
+	for _, item := range fm.getSearchIndex().items {
+		if _, exist := evaluator.texts[text][item.photo]; exist {
+			candidates = append(candidates, item)
+		}
+	}
+	return candidates, true
+}
+
+// requiredText return a free text that all results must match (term alone or in a AND)
+func requiredText(expr query.Expr) (string, bool) {
+	switch e := expr.(type) {
+	case query.Term:
+		return e.Value, e.Field == query.FieldText
+	case query.And:
+		for _, sub := range e.Exprs {
+			if text, required := requiredText(sub); required {
+				return text, true
+			}
+		}
+	}
+	return "", false
+}
+
+func appendVideoItems(items []queryItem, nodes video.VideoFiles) []queryItem {
+	for _, node := range nodes {
+		if node.IsFolder {
+			items = appendVideoItems(items, node.Files)
+		} else {
+			items = append(items, queryItem{kind: query.TypeVideo, video: node})
+		}
+	}
+	return items
+}
+
+// Query return items matching expression, folders first and then photos and videos, most recent first
+func (fm *FoldersManager) Query(expr query.Expr, canRead func(folder string) bool, videos video.VideoFiles, ratings UserRatings) []queryItem {
+	evaluator := newQueryEvaluator(fm, expr, ratings)
+	// Photos and folders come from search index, restricted to those matching text when query requires one
+	indexed, filtered := fm.textCandidates(expr, evaluator)
+	if !filtered {
+		indexed = fm.getSearchIndex().items
+	}
+	items := appendVideoItems(appendPhotoItems(make([]queryItem, 0), indexed, canRead), videos)
+	results := make([]queryItem, 0)
+	for _, item := range items {
+		if query.Eval(expr, func(term query.Term) bool { return evaluator.match(item, term) }) {
+			results = append(results, item)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if isFolderI, isFolderJ := results[i].kind == query.TypeFolder, results[j].kind == query.TypeFolder; isFolderI != isFolderJ {
+			return isFolderI
+		}
+		if !results[i].date().Equal(results[j].date()) {
+			return results[i].date().After(results[j].date())
+		}
+		return results[i].relativePath() < results[j].relativePath()
+	})
+	return results
+}
+
+// searchByQuery search with a structured query (q), results are paginated with page (from 0) and size
+func (s Server) searchByQuery(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	expr, err := query.Parse(r.FormValue("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	size, err := strconv.Atoi(r.FormValue("size"))
+	if err != nil || size <= 0 {
+		size = defaultQueryPageSize
+	}
+	if page < 0 {
+		page = 0
+	}
+	results := s.runQuery(expr, r)
+	response := queryResponse{Total: len(results), Page: page, Size: size, Results: make([]queryResultDto, 0, size)}
+	for i := page * size; i < len(results) && i < (page+1)*size; i++ {
+		response.Results = append(response.Results, s.convertQueryItem(results[i], r))
+	}
+	if data, err := json.Marshal(response); err == nil {
+		write(data, w)
+	}
+}
+
+// runQuery return items matching expression and readable by user
+func (s Server) runQuery(expr query.Expr, r *http.Request) []queryItem {
+	var videos video.VideoFiles
+	// Videos are only available for users
+	if s.videoManager != nil && s.securityServer.CanAccessUser(r) {
+		videos = s.videoManager.Folders
+	}
+	return s.foldersManager.Query(expr, s.canReadFolder(r), videos, s.foldersManager.ratingsManager.GetUserRatings(s.getUserId(r)))
+}
+
+func (s Server) convertQueryItem(item queryItem, r *http.Request) queryResultDto {
+	if item.video != nil {
+		return queryResultDto{Type: item.kind, Item: s.setUserRatings(s.convertVideoPaths([]*video.VideoNode{item.video}, false), r)[0]}
+	}
+	return queryResultDto{Type: item.kind, Item: s.setUserRatings(s.convertPaths([]*Node{item.photo}, false), r)[0]}
+}
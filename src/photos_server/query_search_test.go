@@ -0,0 +1,54 @@
+package photos_server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jotitan/photos_server/query"
+	"github.com/jotitan/photos_server/video"
+)
+
+func TestQuery(t *testing.T) {
+	fm, _, _ := createFakeStructure(t)
+	folder1 := fm.Sources["root"].Files["folder1"].Files
+	folder1["first.txt"].Metadata = &PhotoMetadata{Make: "Google", Model: "Pixel 6"}
+	folder1["first.txt"].Date = time.Date(2020, 12, 25, 10, 0, 0, 0, time.UTC)
+	folder1["second.txt"].Date = time.Date(2018, 12, 25, 10, 0, 0, 0, time.UTC)
+	fm.tagManger.addTagInMap(tagsOfFolders, "root/folder1", Tag{Value: "Noël", Color: "red"})
+	videos := video.VideoFiles{"clip.mp4": {Name: "clip.mp4", RelativePath: "films/clip.mp4", Metadata: video.Metadata{Keywords: []string{"noel"}}}}
+	all := func(string) bool { return true }
+	ratings := UserRatings{Favorites: map[string]bool{"root/folder2/fifth.txt": true}, Ratings: map[string]int{"root/folder2/fifth.txt": 4, "root/folder1/first.txt": 2}}
+
+	search := func(q string, canRead func(string) bool) []queryItem {
+		expr, err := query.Parse(q)
+		if err != nil {
+			t.Fatal("Query must be parsed", q, err)
+		}
+		return fm.Query(expr, canRead, videos, ratings)
+	}
+	if results := search(`camera:"pixel 6"`, all); len(results) != 1 || results[0].photo != folder1["first.txt"] {
+		t.Error("Must find photo by camera", results)
+	}
+	if results := search("tag:noel type:photo after:2020-06 before:2021", all); len(results) != 1 || results[0].photo != folder1["first.txt"] {
+		t.Error("Must find photo by tag of folder and date", results)
+	}
+	if results := search("tag:noel -type:photo", all); len(results) != 2 || results[0].kind != query.TypeFolder || results[1].video == nil {
+		t.Error("Must find folder then video", results)
+	}
+	if results := search("first after:2020", all); len(results) != 1 || results[0].photo != folder1["first.txt"] {
+		t.Error("Must find photo by text and date", results)
+	}
+	if results := search("in:root/folder2 type:photo", all); len(results) != 2 {
+		t.Error("Must find photos of folder2", results)
+	}
+	if results := search("rating:2 -favorite:true", all); len(results) != 1 || results[0].photo != folder1["first.txt"] {
+		t.Error("Must find photo rated but not favorite", results)
+	}
+	onlyFolder2 := func(folder string) bool { return folder == "root/folder2" }
+	for _, item := range search("type:photo OR type:folder", onlyFolder2) {
+		if filepath.Base(filepath.Dir(item.relativePath())) != "folder2" && filepath.Base(item.relativePath()) != "folder2" {
+			t.Error("Folder not shared must be hidden", item.relativePath())
+		}
+	}
+}
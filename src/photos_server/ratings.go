@@ -0,0 +1,120 @@
+package photos_server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/jotitan/photos_server/video"
+)
+
+/* Endpoints to manage favorites and ratings of connected user */
+
+// ratingsFilter keep only favorites or images rated enough by user. Folders are always kept
+type ratingsFilter struct {
+	ratings   UserRatings
+	favorite  bool
+	minRating int
+}
+
+func (s Server) getUserId(r *http.Request) string {
+	if s.securityAccess == nil {
+		return ""
+	}
+	return s.securityAccess.GetUserId(r)
+}
+
+func (s Server) newRatingsFilter(r *http.Request) *ratingsFilter {
+	filter := ratingsFilter{favorite: r.FormValue("favorite") == "true"}
+	filter.minRating, _ = strconv.Atoi(r.FormValue("rating_min"))
+	if !filter.favorite && filter.minRating <= 0 {
+		return nil
+	}
+	filter.ratings = s.foldersManager.ratingsManager.GetUserRatings(s.getUserId(r))
+	return &filter
+}
+
+func (rf *ratingsFilter) match(path string) bool {
+	favorite, rating := rf.ratings.Get(path)
+	return (!rf.favorite || favorite) && rating >= rf.minRating
+}
+
+func (rf *ratingsFilter) filter(nodes []*Node) []*Node {
+	if rf == nil {
+		return nodes
+	}
+	filtered := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		if node.IsFolder || rf.match(node.RelativePath) {
+			filtered = append(filtered, node)
+		}
+	}
+	return filtered
+}
+
+func (rf *ratingsFilter) filterVideos(nodes []*video.VideoNode) []*video.VideoNode {
+	if rf == nil {
+		return nodes
+	}
+	filtered := make([]*video.VideoNode, 0, len(nodes))
+	for _, node := range nodes {
+		if node.IsFolder || rf.match(node.RelativePath) {
+			filtered = append(filtered, node)
+		}
+	}
+	return filtered
+}
+
+// setUserRatings add favorite and rating of connected user on converted photos and videos
+func (s Server) setUserRatings(files []interface{}, r *http.Request) []interface{} {
+	ratings := s.foldersManager.ratingsManager.GetUserRatings(s.getUserId(r))
+	for i, file := range files {
+		switch restful := file.(type) {
+		case imageRestFul:
+			restful.Favorite, restful.Rating = ratings.Get(restful.Path)
+			files[i] = restful
+		case video.VideoNodeDto:
+			restful.Favorite, restful.Rating = ratings.Get(restful.Path)
+			files[i] = restful
+		}
+	}
+	return files
+}
+
+// rate define favorite (favorite=true|false) and / or rating (rating=0 to 5) of a photo or a video (video=true) for connected user
+func (s Server) rate(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only post is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := s.getUserId(r)
+	path := r.FormValue("path")
+	if user == "" || !s.canReadItem(path, r.FormValue("video") == "true", r) {
+		error403(w, r)
+		return
+	}
+	ratingsManager := s.foldersManager.ratingsManager
+	if favorite := r.FormValue("favorite"); favorite != "" {
+		if err := ratingsManager.SetFavorite(user, path, favorite == "true"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.FormValue("rating"); value != "" {
+		rating, err := strconv.Atoi(value)
+		if err == nil {
+			err = ratingsManager.SetRating(user, path, rating)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	write([]byte("success"), w)
+}
+
+// getFavorites return favorites photos and videos of connected user
+func (s Server) getFavorites(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	s.writeItemsOfPaths(w, r, s.foldersManager.ratingsManager.GetFavorites(s.getUserId(r)))
+}
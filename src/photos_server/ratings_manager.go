@@ -0,0 +1,195 @@
+package photos_server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/jotitan/photos_server/logger"
+	"github.com/jotitan/photos_server/persistence"
+)
+
+/* Favorites and star ratings (0 to 5) of photos and videos, for each user */
+
+const maxRating = 5
+
+// UserRatings store favorites and ratings of a user, key is the relative path of photo or video
+type UserRatings struct {
+	Favorites map[string]bool
+	Ratings   map[string]int
+}
+
+func newUserRatings() *UserRatings {
+	return &UserRatings{Favorites: make(map[string]bool), Ratings: make(map[string]int)}
+}
+
+// Get return favorite and rating of a photo or video
+func (ur UserRatings) Get(path string) (bool, int) {
+	path = cleanRelativePath(path)
+	return ur.Favorites[path], ur.Ratings[path]
+}
+
+type RatingsManager struct {
+	// By user id
+	Users  map[string]*UserRatings
+	path   string
+	locker sync.Mutex
+}
+
+func getRatingsPath(folder string) string {
+	return filepath.Join(folder, "ratings.json")
+}
+
+// NewRatingsManager load ratings saved in folder
+func NewRatingsManager(folder string) *RatingsManager {
+	rm := &RatingsManager{Users: make(map[string]*UserRatings), path: getRatingsPath(folder)}
+	rm.load()
+	persistence.Register("ratings", rm.path, func() error {
+		rm.locker.Lock()
+		defer rm.locker.Unlock()
+		rm.Users = make(map[string]*UserRatings)
+		rm.load()
+		return nil
+	})
+	return rm
+}
+
+func (rm *RatingsManager) load() {
+	if data, err := os.ReadFile(rm.path); err == nil {
+		temp := RatingsManager{}
+		if json.Unmarshal(data, &temp) == nil && temp.Users != nil {
+			rm.Users = temp.Users
+			logger.GetLogger2().Info("Load ratings of", len(rm.Users), "users")
+		}
+	}
+}
+
+// save write ratings, lock must be held
+func (rm *RatingsManager) save() error {
+	data, err := json.Marshal(rm)
+	if err != nil {
+		return err
+	}
+	return persistence.WriteFile(rm.path, data)
+}
+
+func (rm *RatingsManager) update(user string, updater func(ratings *UserRatings)) error {
+	if user == "" {
+		return errors.New("unknown user")
+	}
+	rm.locker.Lock()
+	defer rm.locker.Unlock()
+	ratings, exist := rm.Users[user]
+	if !exist {
+		ratings = newUserRatings()
+		rm.Users[user] = ratings
+	}
+	updater(ratings)
+	return rm.save()
+}
+
+func (rm *RatingsManager) SetFavorite(user, path string, favorite bool) error {
+	return rm.update(user, func(ratings *UserRatings) {
+		if favorite {
+			ratings.Favorites[cleanRelativePath(path)] = true
+		} else {
+			delete(ratings.Favorites, cleanRelativePath(path))
+		}
+	})
+}
+
+// SetRating define stars of a photo or video, 0 remove rating
+func (rm *RatingsManager) SetRating(user, path string, rating int) error {
+	if rating < 0 || rating > maxRating {
+		return errors.New("rating must be between 0 and 5")
+	}
+	return rm.update(user, func(ratings *UserRatings) {
+		if rating == 0 {
+			delete(ratings.Ratings, cleanRelativePath(path))
+		} else {
+			ratings.Ratings[cleanRelativePath(path)] = rating
+		}
+	})
+}
+
+// GetUserRatings return a copy of favorites and ratings of user
+func (rm *RatingsManager) GetUserRatings(user string) UserRatings {
+	rm.locker.Lock()
+	defer rm.locker.Unlock()
+	copyRatings := newUserRatings()
+	if ratings, exist := rm.Users[user]; exist {
+		for path, favorite := range ratings.Favorites {
+			copyRatings.Favorites[path] = favorite
+		}
+		for path, rating := range ratings.Ratings {
+			copyRatings.Ratings[path] = rating
+		}
+	}
+	return *copyRatings
+}
+
+// GetFavorites return sorted paths of favorites of user
+func (rm *RatingsManager) GetFavorites(user string) []string {
+	favorites := make([]string, 0)
+	for path := range rm.GetUserRatings(user).Favorites {
+		favorites = append(favorites, path)
+	}
+	sort.Strings(favorites)
+	return favorites
+}
+
+// UpdateExistingPath change paths of a moved folder
+func (rm *RatingsManager) UpdateExistingPath(pathFrom, pathTo string) {
+	from, to := cleanRelativePath(pathFrom), cleanRelativePath(pathTo)
+	rm.locker.Lock()
+	defer rm.locker.Unlock()
+	changed := false
+	for _, ratings := range rm.Users {
+		changed = moveKeys(ratings.Favorites, from, to) || changed
+		changed = moveKeys(ratings.Ratings, from, to) || changed
+	}
+	rm.saveIfChanged(changed)
+}
+
+// moveKeys change paths in moved folder, return true if one path is moved
+func moveKeys[V any](values map[string]V, from, to string) bool {
+	moved := make(map[string]V)
+	for path, value := range values {
+		if newPath, isMoved := movePath(path, from, to); isMoved {
+			moved[newPath] = value
+			delete(values, path)
+		}
+	}
+	for path, value := range moved {
+		values[path] = value
+	}
+	return len(moved) > 0
+}
+
+// RemovePaths remove favorites and ratings of deleted photos or videos
+func (rm *RatingsManager) RemovePaths(paths []string) {
+	rm.locker.Lock()
+	defer rm.locker.Unlock()
+	changed := false
+	for path := range toPathsSet(paths) {
+		for _, ratings := range rm.Users {
+			_, favorite := ratings.Favorites[path]
+			_, rated := ratings.Ratings[path]
+			delete(ratings.Favorites, path)
+			delete(ratings.Ratings, path)
+			changed = changed || favorite || rated
+		}
+	}
+	rm.saveIfChanged(changed)
+}
+
+func (rm *RatingsManager) saveIfChanged(changed bool) {
+	if changed {
+		if err := rm.save(); err != nil {
+			logger.GetLogger2().Error("Impossible to save ratings", err)
+		}
+	}
+}
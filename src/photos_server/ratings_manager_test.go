@@ -0,0 +1,36 @@
+package photos_server
+
+import (
+	"testing"
+)
+
+func TestRatingsManager(t *testing.T) {
+	folder := t.TempDir()
+	rm := NewRatingsManager(folder)
+	if rm.SetRating("", "root/folder1/first.txt", 3) == nil || rm.SetRating("john", "root/folder1/first.txt", 6) == nil {
+		t.Error("Rating without user or more than 5 stars must be rejected")
+	}
+	rm.SetRating("john", "/root/folder1/first.txt", 4)
+	rm.SetFavorite("john", "root/folder1/first.txt", true)
+	rm.SetFavorite("john", "root/folder2/fifth.txt", true)
+	rm.SetFavorite("jane", "root/folder2/fifth.txt", true)
+	if favorite, rating := rm.GetUserRatings("john").Get("root/folder1/first.txt"); !favorite || rating != 4 {
+		t.Error("Bad rating of john", favorite, rating)
+	}
+	if favorite, rating := rm.GetUserRatings("jane").Get("root/folder1/first.txt"); favorite || rating != 0 {
+		t.Error("Ratings must be by user", favorite, rating)
+	}
+
+	rm.UpdateExistingPath("root/folder1", "root/folder1/sub")
+	rm.RemovePaths([]string{"root/folder2/fifth.txt"})
+	reloaded := NewRatingsManager(folder)
+	if favorites := reloaded.GetFavorites("john"); len(favorites) != 1 || favorites[0] != "root/folder1/sub/first.txt" {
+		t.Error("Favorites must follow moved folder and deleted photos", favorites)
+	}
+	if _, rating := reloaded.GetUserRatings("john").Get("root/folder1/sub/first.txt"); rating != 4 {
+		t.Error("Rating must follow moved folder", rating)
+	}
+	if len(reloaded.GetFavorites("jane")) != 0 {
+		t.Error("Deleted photo must be removed from favorites")
+	}
+}
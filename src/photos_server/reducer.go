@@ -17,6 +17,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -27,34 +28,48 @@ import (
 type Reducer interface {
 	GetCache() string
 	CreateJpegFile(folder, basePath string, size uint) string
-	GetSizes() []uint
+	// GetProfiles return resize profiles of source of path
+	GetProfiles(relativePath string) []config.ResizeProfile
 	AddImage(path, relativePath string, node *Node, progresser *progress.UploadProgress, existings map[string]struct{}, forceRotate bool)
+	// ResizeOnDemand create synchronously a reduced image of a photo
+	ResizeOnDemand(path, relativePath string, conversion resize.ImageToResize) error
 	CheckResizer() bool
+	ResizeQueueStatus() ResizeQueueStatus
+	// ResizesToResume return images not resized at last stop, only once
+	ResizesToResume() []string
+	FailedResizes() []string
+	// SetFaces save locations of faces found in photos of a folder, used to crop smart profiles
+	SetFaces(folder string, faces map[string][]resize.FaceBox)
 }
 
 type ImageReducer struct {
 	// Where reduced images are created
 	cache string
-	// Differents sizes to produce
-	sizes []uint
-	// Receive an absolute path of image and a relative path to cache
-	imagesToResize chan ImageToResize
-	resize         resize.GoResizerManager
-	totalCount     int
+	// Reduced images to produce
+	profiles resizeProfiles
+	// Durable queue of images to resize
+	queue  *resizeQueue
+	resize resize.GoResizerManager
+	// Convert HEIC photos to JPEG before resize
+	heic resize.HeicDecoder
+	// Faces kept in smart crops
+	faces *faceLocations
 }
 
-func NewReducer(conf config.Config, sizes []uint) ImageReducer {
+func NewReducer(conf config.Config) ImageReducer {
 	r := ImageReducer{
-		cache:          conf.CacheFolder,
-		sizes:          sizes,
-		imagesToResize: make(chan ImageToResize, 100),
+		cache:    conf.CacheFolder,
+		profiles: newResizeProfiles(conf),
+		queue:    newResizeQueue(conf.CacheFolder),
+		heic:     resize.NewHeicDecoder(conf.PhotoConfig.HeicConverter),
+		faces:    newFaceLocations(conf.CacheFolder),
 	}
 	if strings.EqualFold(conf.PhotoConfig.Converter, "remote") {
 		r.resize = resize.NewHttpGoResizer(conf.PhotoConfig.Url)
 	} else {
-		r.resize = resize.NewAsyncGoResize()
+		r.resize = resize.NewAsyncGoResize(conf.PhotoConfig.Workers, int64(conf.PhotoConfig.MaxMemory)<<20)
 	}
-	go r.listenAndResize()
+	r.listenAndResize(conf.PhotoConfig.Workers)
 	return r
 }
 
@@ -65,6 +80,8 @@ type ImageToResize struct {
 	waiter       *progress.UploadProgress
 	forceRotate  bool
 	existings    map[string]struct{}
+	// Called once when resize is done or failed
+	end func(err error)
 }
 
 func setExif(path string, orientation int, date time.Time) bool {
@@ -101,54 +118,139 @@ func (itr ImageToResize) update(h, w uint, datePhoto time.Time, orientation int,
 			setExif(img.To, orientation, datePhoto)
 		}
 	}
+	itr.node.PHash = computePerceptualHash(conversions)
 	itr.node.ImagesResized = true
-	itr.waiter.Done()
+	itr.end(nil)
+}
+
+// referenceConversion return the smallest not cropped image (last one, conversions are sorted), used to get size of photo
+func referenceConversion(conversions []resize.ImageToResize) resize.ImageToResize {
+	for i := len(conversions) - 1; i >= 0; i-- {
+		if !conversions[i].Crop {
+			return conversions[i]
+		}
+	}
+	return conversions[len(conversions)-1]
+}
+
+// photoSize return size of reference reduction of photo. A HEIC can be reduced from a JPEG smaller than reductions,
+// size is computed from size of its primary image
+func photoSize(path string, reference resize.ImageToResize, width, height uint) (uint, uint) {
+	if !resize.IsHeic(path) {
+		return width, height
+	}
+	w, h, err := resize.ReadHeicSize(path)
+	if err != nil {
+		return width, height
+	}
+	// Size of primary image is before rotation, keep orientation of reduction
+	if (w > h) != (width > height) {
+		w, h = h, w
+	}
+	return resize.FitSize(uint(w), uint(h), reference.Width, reference.Height)
+}
+
+// computePerceptualHash use the smallest reduced image, faster to read
+func computePerceptualHash(conversions []resize.ImageToResize) string {
+	if len(conversions) == 0 {
+		return ""
+	}
+	smallest := referenceConversion(conversions)
+	hash, err := resize.DHash(smallest.To)
+	if err != nil {
+		logger.GetLogger2().Error("Impossible to compute perceptual hash of", smallest.To, err)
+	}
+	return hash
 }
 
 func (r ImageReducer) GetCache() string {
 	return r.cache
 }
 
-func (r ImageReducer) GetSizes() []uint {
-	return r.sizes
+func (r ImageReducer) GetProfiles(relativePath string) []config.ResizeProfile {
+	return r.profiles.get(relativePath)
 }
 
 func (r ImageReducer) AddImage(path, relativePath string, node *Node, progresser *progress.UploadProgress, existings map[string]struct{}, forceRotate bool) {
-	r.imagesToResize <- ImageToResize{path, relativePath, node, progresser, forceRotate, existings}
+	r.queue.push(ImageToResize{path: path, relativePath: relativePath, node: node, waiter: progresser, forceRotate: forceRotate, existings: existings})
+}
+
+func (r ImageReducer) ResizeOnDemand(path, relativePath string, conversion resize.ImageToResize) error {
+	from := path
+	_, orientation, _ := ReadExif(path)
+	if resize.IsRaw(path) || resize.IsHeic(path) {
+		folder := filepath.Join(r.cache, filepath.Dir(relativePath))
+		if err := r.createPathInCache(folder); err != nil {
+			return err
+		}
+		preview, err := r.createPreview(folder, path)
+		if err != nil {
+			return err
+		}
+		if resize.IsHeic(path) && r.heic.Rotated(path) {
+			orientation = 1
+		}
+		from = preview
+	}
+	// Resized by pipeline, like uploads, to share its workers and memory budget
+	done := make(chan error, 1)
+	r.resize.ResizeAsync(from, orientation, []resize.ImageToResize{conversion}, func(err error, _, _ uint, _ int) {
+		done <- err
+	})
+	return <-done
 }
 
 func (r ImageReducer) CheckResizer() bool {
 	return r.resize.CheckStatus()
 }
 
-// Return number of images wating to reduce and number of images reduced
-func (r *ImageReducer) Stat() (int, int) {
-	return len(r.imagesToResize), r.totalCount
+func (r ImageReducer) ResizeQueueStatus() ResizeQueueStatus {
+	return r.queue.Status()
+}
+
+func (r ImageReducer) ResizesToResume() []string {
+	return r.queue.resumable()
+}
+
+func (r ImageReducer) FailedResizes() []string {
+	return r.queue.failedPaths()
 }
 
-func (r *ImageReducer) listenAndResize() {
-	go func() {
-		for {
-			imageToResize := <-r.imagesToResize
-			r.totalCount++
-			targetFolder := filepath.Dir(imageToResize.relativePath)
-			folder := filepath.Join(r.cache, targetFolder)
-			if r.createPathInCache(folder) == nil {
-				r.resizeMultiformat(imageToResize, folder)
-			}
+func (r ImageReducer) SetFaces(folder string, faces map[string][]resize.FaceBox) {
+	if err := r.faces.setFolder(folder, faces); err != nil {
+		logger.GetLogger2().Error("Impossible to save faces of", folder, err)
+	}
+}
+
+// listenAndResize launch workers preparing images (exif, preview) before resize, number of cpus if 0
+func (r *ImageReducer) listenAndResize(workers int) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	for i := 0; i < workers; i++ {
+		go r.runWorker()
+	}
+}
+
+func (r *ImageReducer) runWorker() {
+	for {
+		job := r.queue.next()
+		imageToResize := job.image
+		imageToResize.end = func(err error) { r.queue.end(job, err) }
+		targetFolder := filepath.Dir(imageToResize.relativePath)
+		folder := filepath.Join(r.cache, targetFolder)
+		if err := r.createPathInCache(folder); err != nil {
+			imageToResize.end(err)
+		} else {
+			r.resizeMultiformat(imageToResize, folder)
 		}
-	}()
+	}
 }
 
 // Called when index photo or update
 func GetExif(path string) (time.Time, int) {
-	if f, err := os.Open(path); err == nil {
-		defer f.Close()
-		if infos, err := exif.Decode(f); err == nil || !exif.IsCriticalError(err) {
-			return getExifDate(infos, path), getExifOrientation(infos)
-		}
-	}
-	return getModificationDate(path), 0
+	date, orientation, _ := ReadExif(path)
+	return date, orientation
 }
 
 func getModificationDate(path string) time.Time {
@@ -197,7 +299,21 @@ func getExifValue(infos *exif.Exif, field exif.FieldName) string {
 func (r ImageReducer) resizeMultiformat(imageToResize ImageToResize, folder string) {
 	// Reuse computed image to accelerate
 	from := imageToResize.path
-	datePhoto, orientation := GetExif(from)
+	datePhoto, orientation, metadata := ReadExif(from)
+	imageToResize.node.Metadata = metadata
+	if resize.IsRaw(from) || resize.IsHeic(from) {
+		// RAW and HEIC are not decoded, reductions are made from a JPEG preview
+		preview, err := r.createPreview(folder, from)
+		if err != nil {
+			logger.GetLogger2().Error("Impossible to create preview of", from, err)
+			imageToResize.end(err)
+			return
+		}
+		if resize.IsHeic(from) && r.heic.Rotated(from) {
+			orientation = 1
+		}
+		from = preview
+	}
 	// Check if both exist, if true, return, otherwise, resize
 	conversions, alreadyExist := r.checkAlreadyExist(folder, imageToResize)
 	if alreadyExist {
@@ -206,33 +322,41 @@ func (r ImageReducer) resizeMultiformat(imageToResize ImageToResize, folder stri
 		return
 	}
 	callback := func(err error, width, height uint, correctOrientation int) {
-		if err != nil {
+		switch {
+		case err != nil:
 			logger.GetLogger2().Info("Got Error on resize", from, err)
-			imageToResize.waiter.Done()
-		} else {
-			if width != 0 && height != 0 {
-				imageToResize.update(height, width, datePhoto, correctOrientation, conversions, true)
-			}
+			imageToResize.end(err)
+		case width == 0 || height == 0:
+			imageToResize.end(errors.New("no size returned by resizer"))
+		default:
+			width, height = photoSize(imageToResize.path, referenceConversion(conversions), width, height)
+			imageToResize.update(height, width, datePhoto, correctOrientation, conversions, true)
 		}
 	}
 	r.resize.ResizeAsync(from, orientation, conversions, callback)
 }
 
 func (r ImageReducer) checkAlreadyExist(folder string, imageToResize ImageToResize) ([]resize.ImageToResize, bool) {
-	conversions := make([]resize.ImageToResize, len(r.sizes))
+	profiles := r.GetProfiles(imageToResize.relativePath)
+	conversions := make([]resize.ImageToResize, len(profiles))
 	nbExist := 0
-	for i, size := range r.sizes {
-		conversions[i] = resize.ImageToResize{To: r.CreateJpegFile(folder, imageToResize.path, size), Width: 0, Height: size}
+	for i, profile := range profiles {
+		conversions[i] = toConversion(r, folder, imageToResize.path, profile, profiles)
+		if conversions[i].Smart {
+			conversions[i].Focus = r.faces.get(imageToResize.relativePath)
+		}
 		if _, exist := imageToResize.existings[conversions[i].To]; exist {
 			nbExist++
 		}
 	}
-	return conversions, nbExist == len(r.sizes)
+	return conversions, nbExist == len(profiles)
 }
 
 func (r ImageReducer) treatAlreadyExist(conversions []resize.ImageToResize, datePhoto time.Time, orientation int, imageToResize ImageToResize) {
 	// All exist, get Size of little one and return
-	w, h := resize.GetSize(conversions[len(conversions)-1].To)
+	reference := referenceConversion(conversions)
+	width, height := resize.GetSize(reference.To)
+	w, h := photoSize(imageToResize.path, reference, width, height)
 	logger.GetLogger2().Info("Image already exist", imageToResize.path, "extract infos", w, h, orientation, datePhoto)
 	// If force rotate, rotate images and set exif orientation to 0
 	if imageToResize.forceRotate && orientation != 1 {
@@ -281,6 +405,24 @@ func (r ImageReducer) CreateJpegFile(folder, basePath string, size uint) string
 	return filepath.Join(folder, r.CreateJpegName(filepath.Base(basePath), size))
 }
 
+// createPreviewFile return path of JPEG extracted from a RAW or HEIC file
+func createPreviewFile(folder, basePath string) string {
+	name := filepath.Base(basePath)
+	return filepath.Join(folder, fmt.Sprintf("%s-preview.jpg", name[:len(name)-len(filepath.Ext(name))]))
+}
+
+// createPreview write JPEG preview of RAW or HEIC file in cache folder if not already done
+func (r ImageReducer) createPreview(folder, path string) (string, error) {
+	preview := createPreviewFile(folder, path)
+	if _, err := os.Stat(preview); err == nil {
+		return preview, nil
+	}
+	if resize.IsHeic(path) {
+		return preview, r.heic.Decode(path, preview)
+	}
+	return preview, resize.ExtractRawPreview(path, preview)
+}
+
 // Generate a jpeg name from size
 func (r ImageReducer) CreateJpegName(name string, size uint) string {
 	extension := filepath.Ext(name)
@@ -0,0 +1,30 @@
+package photos_server
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+/* Helpers on relative paths of photos (source/folder/name) used to reference them in albums, ratings and tags */
+
+// cleanRelativePath return path with slashes and without leading or trailing slash
+func cleanRelativePath(path string) string {
+	return strings.Trim(filepath.ToSlash(path), "/")
+}
+
+// movePath return new path if path is in moved folder
+func movePath(path, from, to string) (string, bool) {
+	if path == from || strings.HasPrefix(path, from+"/") {
+		return to + strings.TrimPrefix(path, from), true
+	}
+	return path, false
+}
+
+// toPathsSet return set of cleaned paths
+func toPathsSet(paths []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		set[cleanRelativePath(path)] = struct{}{}
+	}
+	return set
+}
@@ -0,0 +1,201 @@
+package photos_server
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jotitan/photos_server/config"
+	"github.com/jotitan/photos_server/logger"
+)
+
+/* Images resized on demand (any size asked by screen), kept in an area of cache limited in size.
+Least recently used images are removed first. Concurrent requests of same image resize it once.
+Images are returned opened, an image removed from cache can still be read by requests which got it */
+
+const (
+	onDemandFolder      = "_ondemand"
+	defaultOnDemandSize = 500
+)
+
+var defaultOnDemandSizes = []uint{160, 320, 640, 1280, 1920, 2560, 3840}
+
+type resizeCacheEntry struct {
+	key  string
+	size int64
+}
+
+// pendingResize is a resize in progress, other requests of same image wait for it
+type pendingResize struct {
+	done chan struct{}
+	err  error
+}
+
+type resizeCache struct {
+	folder  string
+	maxSize int64
+	sizes   []uint
+	locker  sync.Mutex
+	// Most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+	pending map[string]*pendingResize
+}
+
+func newResizeCache(cache string, conf config.OnDemandConfig) *resizeCache {
+	maxSize := conf.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultOnDemandSize
+	}
+	sizes := append([]uint{}, conf.Sizes...)
+	if len(sizes) == 0 {
+		sizes = append(sizes, defaultOnDemandSizes...)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	rc := &resizeCache{folder: filepath.Join(cache, onDemandFolder), maxSize: int64(maxSize) << 20, sizes: sizes,
+		lru: list.New(), entries: make(map[string]*list.Element), pending: make(map[string]*pendingResize)}
+	rc.load()
+	return rc
+}
+
+// load register existing images, oldest modified are the least recently used. Temporary and unreadable files are removed
+func (rc *resizeCache) load() {
+	type file struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	files := make([]file, 0)
+	filepath.Walk(rc.folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") || !isReadableImage(path) {
+			logger.GetLogger2().Info("Remove invalid image resized on demand", path)
+			os.Remove(path)
+			return nil
+		}
+		files = append(files, file{filepath.Base(path), info.Size(), info.ModTime()})
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+	for _, f := range files {
+		rc.entries[f.key] = rc.lru.PushBack(&resizeCacheEntry{key: f.key, size: f.size})
+		rc.size += f.size
+	}
+	rc.evict()
+	logger.GetLogger2().Info("Load", len(files), "images resized on demand")
+}
+
+func isReadableImage(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, _, err = image.DecodeConfig(f)
+	return err == nil
+}
+
+// clamp round size to the next allowed size, 0 is kept (free dimension)
+func (rc *resizeCache) clamp(size uint) uint {
+	if size == 0 {
+		return 0
+	}
+	for _, allowed := range rc.sizes {
+		if size <= allowed {
+			return allowed
+		}
+	}
+	return rc.sizes[len(rc.sizes)-1]
+}
+
+// variantKey return name of resized image of a photo, unique by path, size and version of original
+func variantKey(relativePath string, width, height uint, version string) string {
+	hash := sha1.Sum([]byte(fmt.Sprintf("%s|%d|%d|%s", relativePath, width, height, version)))
+	return hex.EncodeToString(hash[:]) + ".jpg"
+}
+
+func (rc *resizeCache) path(key string) string {
+	return filepath.Join(rc.folder, key[:2], key)
+}
+
+// Get return resized image opened, create it if necessary. Caller must close file
+func (rc *resizeCache) Get(key string, create func(path string) error) (*os.File, error) {
+	rc.locker.Lock()
+	if element, exist := rc.entries[key]; exist {
+		rc.lru.MoveToFront(element)
+		// Opened under lock, eviction can't remove it before
+		defer rc.locker.Unlock()
+		return os.Open(rc.path(key))
+	}
+	if pending, exist := rc.pending[key]; exist {
+		rc.locker.Unlock()
+		<-pending.done
+		if pending.err != nil {
+			return nil, pending.err
+		}
+		// Image may have been evicted since, get it again
+		return rc.Get(key, create)
+	}
+	pending := &pendingResize{done: make(chan struct{})}
+	rc.pending[key] = pending
+	rc.locker.Unlock()
+
+	file, err := rc.create(key, create)
+	pending.err = err
+
+	rc.locker.Lock()
+	delete(rc.pending, key)
+	rc.locker.Unlock()
+	close(pending.done)
+	return file, err
+}
+
+func (rc *resizeCache) create(key string, create func(path string) error) (*os.File, error) {
+	path := rc.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := create(path); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	rc.locker.Lock()
+	defer rc.locker.Unlock()
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New("resized image not created")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	rc.entries[key] = rc.lru.PushFront(&resizeCacheEntry{key: key, size: info.Size()})
+	rc.size += info.Size()
+	rc.evict()
+	return file, nil
+}
+
+// evict remove least recently used images until size is under limit, most recent image is always kept. Lock must be held
+func (rc *resizeCache) evict() {
+	for rc.size > rc.maxSize && rc.lru.Len() > 1 {
+		entry := rc.lru.Remove(rc.lru.Back()).(*resizeCacheEntry)
+		delete(rc.entries, entry.key)
+		rc.size -= entry.size
+		if err := os.Remove(rc.path(entry.key)); err != nil {
+			logger.GetLogger2().Error("Impossible to remove resized image", entry.key, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package photos_server
+
+import (
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jotitan/photos_server/config"
+)
+
+func TestResizeCacheClamp(t *testing.T) {
+	rc := newResizeCache(t.TempDir(), config.OnDemandConfig{Sizes: []uint{800, 200, 400}})
+	for size, expected := range map[uint]uint{0: 0, 1: 200, 200: 200, 201: 400, 500: 800, 5000: 800} {
+		if value := rc.clamp(size); value != expected {
+			t.Error("size", size, "must be clamped to", expected, "but found", value)
+		}
+	}
+}
+
+func TestResizeCacheCoalesce(t *testing.T) {
+	rc := newResizeCache(t.TempDir(), config.OnDemandConfig{})
+	key := variantKey("source/photo.jpg", 320, 0, "v1")
+	calls := int32(0)
+	create := func(path string) error {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		return os.WriteFile(path, []byte("image"), os.ModePerm)
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			file, err := rc.Get(key, create)
+			if err != nil || file.Name() != rc.path(key) {
+				t.Error("image must be resized", err)
+				return
+			}
+			file.Close()
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Error("image must be resized once but found", calls)
+	}
+	if key == variantKey("source/photo.jpg", 320, 0, "v2") {
+		t.Error("new version of original must change name")
+	}
+}
+
+func TestResizeCacheEvict(t *testing.T) {
+	rc := newResizeCache(t.TempDir(), config.OnDemandConfig{})
+	// Limit to 2 images of 1 Ko
+	rc.maxSize = 2048
+	data := make([]byte, 1024)
+	create := func(path string) error { return os.WriteFile(path, data, os.ModePerm) }
+	get := func(key string) *os.File {
+		file, err := rc.Get(key, create)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	keys := []string{variantKey("a.jpg", 320, 0, ""), variantKey("b.jpg", 320, 0, ""), variantKey("c.jpg", 320, 0, "")}
+	get(keys[0]).Close()
+	// b is kept opened by a request while it is evicted
+	opened := get(keys[1])
+	defer opened.Close()
+	// a is used again, b is now the least recently used
+	get(keys[0]).Close()
+	get(keys[2]).Close()
+	if _, err := os.Stat(rc.path(keys[1])); err == nil || rc.entries[keys[1]] != nil {
+		t.Error("least recently used image must be removed")
+	}
+	if content, err := io.ReadAll(opened); err != nil || len(content) != len(data) {
+		t.Error("evicted image must still be readable by request which got it", err)
+	}
+	for _, key := range []string{keys[0], keys[2]} {
+		if _, err := os.Stat(rc.path(key)); err != nil {
+			t.Error("recent image must be kept", err)
+		}
+	}
+	if rc.size != 2048 {
+		t.Error("size must be 2048 but found", rc.size)
+	}
+}
+
+func TestResizeCacheLoad(t *testing.T) {
+	cache := t.TempDir()
+	rc := newResizeCache(cache, config.OnDemandConfig{})
+	valid, invalid := variantKey("a.jpg", 320, 0, ""), variantKey("b.jpg", 320, 0, "")
+	os.MkdirAll(filepath.Dir(rc.path(valid)), os.ModePerm)
+	os.MkdirAll(filepath.Dir(rc.path(invalid)), os.ModePerm)
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	f, _ := os.Create(rc.path(valid))
+	jpeg.Encode(f, img, nil)
+	f.Close()
+	os.WriteFile(rc.path(invalid), []byte("partial"), os.ModePerm)
+	tmp := filepath.Join(filepath.Dir(rc.path(valid)), ".a-123.jpg")
+	os.WriteFile(tmp, []byte("partial"), os.ModePerm)
+
+	rc = newResizeCache(cache, config.OnDemandConfig{})
+	if len(rc.entries) != 1 || rc.entries[valid] == nil {
+		t.Error("only readable images must be loaded", len(rc.entries))
+	}
+	for _, path := range []string{rc.path(invalid), tmp} {
+		if _, err := os.Stat(path); err == nil {
+			t.Error("invalid file must be removed", path)
+		}
+	}
+}
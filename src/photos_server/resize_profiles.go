@@ -0,0 +1,370 @@
+package photos_server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jotitan/photos_server/config"
+	"github.com/jotitan/photos_server/logger"
+	"github.com/jotitan/photos_server/persistence"
+	"github.com/jotitan/photos_server/progress"
+	"github.com/jotitan/photos_server/resize"
+)
+
+/* Resize profiles : reduced images created for each photo. Profiles middle (displayed image), small (thumbnail) and square (thumbnail of grid) always exist,
+they can be overridden by name in config, globally or by source.
+Date of last change of each profile is saved in cache (profiles.json), reduced images older than it are stale and created again */
+
+const (
+	middleProfile     = "middle"
+	smallProfile      = "small"
+	squareProfile     = "square"
+	cropFill          = "fill"
+	cropSmart         = "smart"
+	formatPng         = "png"
+	formatJpg         = "jpg"
+	profilesStateFile = "profiles.json"
+)
+
+var defaultProfiles = []config.ResizeProfile{{Name: middleProfile, Height: 1080, Format: formatJpg}, {Name: smallProfile, Height: 250, Format: formatJpg},
+	{Name: squareProfile, Width: 250, Height: 250, Crop: cropSmart, Format: formatJpg}}
+
+// Only one regeneration at a time
+var profilesLocker = sync.Mutex{}
+
+type resizeProfiles struct {
+	global   []config.ResizeProfile
+	bySource map[string][]config.ResizeProfile
+}
+
+func newResizeProfiles(conf config.Config) resizeProfiles {
+	profiles := resizeProfiles{global: mergeProfiles(defaultProfiles, conf.PhotoConfig.Profiles), bySource: make(map[string][]config.ResizeProfile)}
+	for _, source := range conf.Sources {
+		if len(source.Profiles) > 0 {
+			profiles.bySource[source.Name] = mergeProfiles(profiles.global, source.Profiles)
+		}
+	}
+	return profiles
+}
+
+// get return profiles used by source of path
+func (rp resizeProfiles) get(relativePath string) []config.ResizeProfile {
+	if profiles, exist := rp.bySource[getSourceKey(relativePath)]; exist {
+		return profiles
+	}
+	return rp.global
+}
+
+// mergeProfiles replace profiles of base by overrides with same name, others are added.
+// Biggest profiles are first to compute smaller ones from them, cropped profiles are at the end
+func mergeProfiles(base, overrides []config.ResizeProfile) []config.ResizeProfile {
+	profiles := append([]config.ResizeProfile{}, base...)
+	for _, override := range overrides {
+		if override.Name = strings.TrimSpace(override.Name); override.Name == "" {
+			continue
+		}
+		override.Format = profileFormat(override)
+		if pos := indexOfProfile(profiles, override.Name); pos != -1 {
+			profiles[pos] = override
+		} else {
+			profiles = append(profiles, override)
+		}
+	}
+	sort.SliceStable(profiles, func(i, j int) bool {
+		if isCrop(profiles[i]) != isCrop(profiles[j]) {
+			return !isCrop(profiles[i])
+		}
+		return profileSize(profiles[i].Height) > profileSize(profiles[j].Height) ||
+			(profiles[i].Height == profiles[j].Height && profileSize(profiles[i].Width) > profileSize(profiles[j].Width))
+	})
+	return profiles
+}
+
+func indexOfProfile(profiles []config.ResizeProfile, name string) int {
+	for i, profile := range profiles {
+		if strings.EqualFold(profile.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// profileSize return dimension of bounding box, 0 is not limited
+func profileSize(size uint) uint {
+	if size == 0 {
+		return ^uint(0)
+	}
+	return size
+}
+
+func isCrop(profile config.ResizeProfile) bool {
+	return strings.EqualFold(profile.Crop, cropFill) || isSmartCrop(profile)
+}
+
+// isSmartCrop return true if crop window is placed on faces or details instead of center
+func isSmartCrop(profile config.ResizeProfile) bool {
+	return strings.EqualFold(profile.Crop, cropSmart)
+}
+
+func profileFormat(profile config.ResizeProfile) string {
+	if strings.EqualFold(profile.Format, formatPng) {
+		return formatPng
+	}
+	return formatJpg
+}
+
+// isNamedBySize return true if reduced image of profile keeps name based on size (photo-1080.jpg) : profile has only a height
+// and no previous profile of list has the same height (both would write the same file)
+func isNamedBySize(profile config.ResizeProfile, profiles []config.ResizeProfile) bool {
+	bySize := func(p config.ResizeProfile) bool {
+		return p.Width == 0 && !isCrop(p) && profileFormat(p) == formatJpg
+	}
+	if !bySize(profile) {
+		return false
+	}
+	for _, other := range profiles {
+		if strings.EqualFold(other.Name, profile.Name) {
+			return true
+		}
+		if bySize(other) && other.Height == profile.Height {
+			return false
+		}
+	}
+	return true
+}
+
+// createProfileFile return path of reduced image of a profile of list profiles. Name is based on size (photo-1080.jpg) or on name of profile (photo-square.jpg)
+func createProfileFile(r Reducer, folder, basePath string, profile config.ResizeProfile, profiles []config.ResizeProfile) string {
+	if isNamedBySize(profile, profiles) {
+		return r.CreateJpegFile(folder, basePath, profile.Height)
+	}
+	return createNamedProfileFile(folder, basePath, profile)
+}
+
+func createNamedProfileFile(folder, basePath string, profile config.ResizeProfile) string {
+	name := filepath.Base(basePath)
+	return filepath.Join(folder, fmt.Sprintf("%s-%s.%s", strings.TrimSuffix(name, filepath.Ext(name)), profile.Name, profileFormat(profile)))
+}
+
+func toConversion(r Reducer, folder, basePath string, profile config.ResizeProfile, profiles []config.ResizeProfile) resize.ImageToResize {
+	return resize.ImageToResize{To: createProfileFile(r, folder, basePath, profile, profiles), Width: profile.Width, Height: profile.Height,
+		Quality: profile.Quality, Crop: isCrop(profile), Smart: isSmartCrop(profile)}
+}
+
+// getProfileImageName return path in cache of reduced image of profile
+func (fm FoldersManager) getProfileImageName(node Node, name string) string {
+	profiles := fm.reducer.GetProfiles(node.RelativePath)
+	if pos := indexOfProfile(profiles, name); pos != -1 {
+		return createProfileFile(fm.reducer, filepath.Dir(node.RelativePath), node.RelativePath, profiles[pos], profiles)
+	}
+	return ""
+}
+
+// profileState is a profile with date of its last change
+type profileState struct {
+	Profile config.ResizeProfile
+	Changed time.Time
+}
+
+// ProfileReport count reduced images to create for a profile of a source
+type ProfileReport struct {
+	Source  string
+	Profile config.ResizeProfile
+	Missing int
+	Stale   int
+}
+
+func getProfilesStatePath(cache string) string {
+	return filepath.Join(cache, profilesStateFile)
+}
+
+func profileKey(source, name string) string {
+	return source + "/" + strings.ToLower(name)
+}
+
+func (fm FoldersManager) readProfilesState() map[string]profileState {
+	states := make(map[string]profileState)
+	if data, err := os.ReadFile(getProfilesStatePath(fm.reducer.GetCache())); err == nil {
+		if err := json.Unmarshal(data, &states); err != nil {
+			logger.GetLogger2().Error("Impossible to read profiles state", err)
+		}
+	}
+	return states
+}
+
+// updateProfilesState save profiles used by each source and return true if one has changed since last launch, with profiles removed by source.
+// At first launch (no state), existing reduced images of legacy profiles are kept, other profiles are created
+func (fm FoldersManager) updateProfilesState() (bool, map[string][]config.ResizeProfile) {
+	removed := make(map[string][]config.ResizeProfile)
+	if fm.reducer.GetCache() == "" {
+		return false, removed
+	}
+	previous := fm.readProfilesState()
+	firstLaunch := len(previous) == 0
+	states := make(map[string]profileState)
+	changed := false
+	for source := range fm.Sources {
+		for _, profile := range fm.reducer.GetProfiles(source) {
+			key := profileKey(source, profile.Name)
+			state, exist := previous[key]
+			switch {
+			case !exist && firstLaunch && isLegacyProfile(profile.Name):
+				state = profileState{Profile: profile}
+			case !exist || state.Profile != profile:
+				state = profileState{Profile: profile, Changed: time.Now()}
+				changed = true
+			}
+			states[key] = state
+		}
+		for key, state := range previous {
+			if _, exist := states[key]; !exist && strings.HasPrefix(key, source+"/") {
+				removed[source] = append(removed[source], state.Profile)
+			}
+		}
+	}
+	if data, err := json.Marshal(states); err == nil {
+		if err := persistence.WriteFile(getProfilesStatePath(fm.reducer.GetCache()), data); err != nil {
+			logger.GetLogger2().Error("Impossible to save profiles state", err)
+		}
+	}
+	return changed, removed
+}
+
+// isLegacyProfile return true for profiles which existed before resize profiles (middle and small)
+func isLegacyProfile(name string) bool {
+	return strings.EqualFold(name, middleProfile) || strings.EqualFold(name, smallProfile)
+}
+
+// removeProfilesFiles delete reduced images of profiles removed from config. A file still used by a profile is kept
+func (fm *FoldersManager) removeProfilesFiles(removed map[string][]config.ResizeProfile) {
+	count := 0
+	for source, profiles := range removed {
+		src, exist := fm.Sources[source]
+		if !exist {
+			continue
+		}
+		for _, folder := range src.Files {
+			folder.applyOnEach(fm.Sources, func(_, _ string, node *Node) {
+				used := make(map[string]struct{})
+				for _, path := range fm.reducedImagesOf(node) {
+					used[path] = struct{}{}
+				}
+				cacheFolder := filepath.Join(fm.reducer.GetCache(), filepath.Dir(node.RelativePath))
+				for _, profile := range profiles {
+					// Name of file depended on other profiles, both names are checked
+					for _, path := range []string{createProfileFile(fm.reducer, cacheFolder, node.RelativePath, profile, nil), createNamedProfileFile(cacheFolder, node.RelativePath, profile)} {
+						if _, isUsed := used[path]; !isUsed && os.Remove(path) == nil {
+							count++
+						}
+					}
+				}
+			})
+		}
+	}
+	if count > 0 {
+		logger.GetLogger2().Info("Remove", count, "reduced images of removed profiles")
+	}
+}
+
+// imageToRegenerate is an image with at least a reduced image missing or stale, existings are up to date images
+type imageToRegenerate struct {
+	node      *Node
+	existings map[string]struct{}
+}
+
+// checkProfiles search images with missing or stale reduced images
+func (fm *FoldersManager) checkProfiles() ([]ProfileReport, []imageToRegenerate) {
+	states := fm.readProfilesState()
+	reports := make(map[string]*ProfileReport)
+	images := make([]imageToRegenerate, 0)
+	for name, source := range fm.Sources {
+		for _, profile := range fm.reducer.GetProfiles(name) {
+			reports[profileKey(name, profile.Name)] = &ProfileReport{Source: name, Profile: profile}
+		}
+		for _, folder := range source.Files {
+			folder.applyOnEach(fm.Sources, func(_, _ string, node *Node) {
+				if image := fm.checkImageProfiles(name, node, states, reports); len(image.existings) < len(fm.reducer.GetProfiles(name)) {
+					images = append(images, image)
+				}
+			})
+		}
+	}
+	list := make([]ProfileReport, 0, len(reports))
+	for _, report := range reports {
+		list = append(list, *report)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Source < list[j].Source || (list[i].Source == list[j].Source && list[i].Profile.Name < list[j].Profile.Name)
+	})
+	return list, images
+}
+
+func (fm *FoldersManager) checkImageProfiles(source string, node *Node, states map[string]profileState, reports map[string]*ProfileReport) imageToRegenerate {
+	image := imageToRegenerate{node: node, existings: make(map[string]struct{})}
+	folder := filepath.Join(fm.reducer.GetCache(), filepath.Dir(node.RelativePath))
+	profiles := fm.reducer.GetProfiles(source)
+	for _, profile := range profiles {
+		key := profileKey(source, profile.Name)
+		path := createProfileFile(fm.reducer, folder, node.RelativePath, profile, profiles)
+		stat, err := os.Stat(path)
+		switch {
+		case err != nil:
+			reports[key].Missing++
+		case stat.ModTime().Before(states[key].Changed):
+			reports[key].Stale++
+		default:
+			image.existings[path] = struct{}{}
+		}
+	}
+	return image
+}
+
+// CheckProfiles count missing and stale reduced images of each profile
+func (fm *FoldersManager) CheckProfiles() []ProfileReport {
+	reports, _ := fm.checkProfiles()
+	return reports
+}
+
+// RegenerateProfiles create again missing and stale reduced images in background
+func (fm *FoldersManager) RegenerateProfiles() (*progress.UploadProgress, error) {
+	if fm.uploadProgressManager == nil {
+		return nil, errors.New("no progress manager to follow regeneration of reduced images")
+	}
+	if !profilesLocker.TryLock() {
+		return nil, errors.New("regeneration of reduced images is already running")
+	}
+	_, images := fm.checkProfiles()
+	logger.GetLogger2().Info("Regenerate reduced images of", len(images), "images")
+	progresser := fm.uploadProgressManager.AddTask(len(images))
+	progresser.EnableWaiter()
+	progresser.Add(len(images))
+	go func() {
+		defer profilesLocker.Unlock()
+		// Tree is read under lock, resize is not waited with it
+		updateLocker.Lock()
+		nodes := make([]*Node, 0, len(images))
+		absolutePaths := make([]string, 0, len(images))
+		for _, image := range images {
+			nodes = append(nodes, image.node)
+			absolutePaths = append(absolutePaths, image.node.GetAbsolutePath(fm.Sources))
+		}
+		updateLocker.Unlock()
+		for i, image := range images {
+			fm.reducer.AddImage(absolutePaths[i], image.node.RelativePath, image.node, progresser, image.existings, false)
+		}
+		progresser.Wait()
+		progresser.End()
+		updateLocker.Lock()
+		defer updateLocker.Unlock()
+		fm.saveNodes(nil, nodes, false)
+		logger.GetLogger2().Info("End of regeneration of reduced images")
+	}()
+	return progresser, nil
+}
@@ -0,0 +1,109 @@
+package photos_server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jotitan/photos_server/config"
+)
+
+func TestMergeProfiles(t *testing.T) {
+	profiles := mergeProfiles(defaultProfiles, []config.ResizeProfile{
+		{Name: "square", Width: 200, Height: 200, Crop: cropFill},
+		{Name: "SMALL", Height: 300, Quality: 90},
+		{Name: "big", Width: 2560, Height: 1440, Format: "PNG"}})
+	names := make([]string, 0, len(profiles))
+	for _, profile := range profiles {
+		names = append(names, profile.Name)
+	}
+	if len(profiles) != 4 || names[0] != "big" || names[1] != middleProfile || names[2] != "SMALL" || names[3] != "square" {
+		t.Error("profiles must be overridden and sorted, biggest first and cropped at the end", names)
+	}
+	if profiles[2].Quality != 90 || profiles[0].Format != formatPng {
+		t.Error("override must replace profile", profiles)
+	}
+	reducer := ImageReducer{}
+	if path := createProfileFile(reducer, "folder", "/src/a.jpg", profiles[2], profiles); path != filepath.Join("folder", "a-300.jpg") {
+		t.Error("profile with only height must keep name based on size", path)
+	}
+	if path := createProfileFile(reducer, "folder", "/src/a.jpg", profiles[0], profiles); path != filepath.Join("folder", "a-big.png") {
+		t.Error("profile must use its name and format", path)
+	}
+}
+
+func TestProfilesRegeneration(t *testing.T) {
+	cache := t.TempDir()
+	image := &Node{Name: "a.jpg", RelativePath: "/src/folder/a.jpg"}
+	sources := SourceNodes{"src": &SourceNode{Name: "src", Folder: "/photos/src", Files: Files{
+		"folder": &Node{Name: "folder", RelativePath: "/src/folder", IsFolder: true, Files: Files{"a.jpg": image}}}}}
+	createManager := func(profiles ...config.ResizeProfile) *FoldersManager {
+		conf := config.Config{CacheFolder: cache, PhotoConfig: config.PhotoConfig{Profiles: profiles}}
+		return &FoldersManager{Sources: sources, reducer: ImageReducer{cache: cache, profiles: newResizeProfiles(conf)}}
+	}
+	countImages := func(fm *FoldersManager) (int, int) {
+		missing, stale := 0, 0
+		for _, report := range fm.CheckProfiles() {
+			missing += report.Missing
+			stale += report.Stale
+		}
+		return missing, stale
+	}
+
+	fm := createManager()
+	if changed, _ := fm.updateProfilesState(); !changed {
+		t.Error("at first launch, profiles other than middle and small must be created")
+	}
+	if missing, stale := countImages(fm); missing != 3 || stale != 0 {
+		t.Error("reduced images must be missing", missing, stale)
+	}
+	// Legacy images are older than first launch, square image is created by regeneration
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	for name, date := range map[string]time.Time{fm.GetMiddleImageName(*image): past, fm.GetSmallImageName(*image): past, fm.getProfileImageName(*image, squareProfile): future} {
+		path := filepath.Join(cache, name)
+		os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		os.WriteFile(path, []byte{}, os.ModePerm)
+		os.Chtimes(path, date, date)
+	}
+	if missing, stale := countImages(fm); missing != 0 || stale != 0 {
+		t.Error("reduced images must be up to date", missing, stale)
+	}
+
+	fm = createManager(config.ResizeProfile{Name: middleProfile, Height: 1080, Quality: 90}, config.ResizeProfile{Name: smallProfile, Height: 300})
+	if changed, _ := fm.updateProfilesState(); !changed {
+		t.Error("change of profiles must be detected")
+	}
+	if missing, stale := countImages(fm); missing != 1 || stale != 1 {
+		t.Error("new size must be missing and new quality stale", missing, stale)
+	}
+	if changed, _ := fm.updateProfilesState(); changed {
+		t.Error("profiles didn't change since last launch")
+	}
+	if _, err := fm.RegenerateProfiles(); err == nil {
+		t.Error("regeneration needs a progress manager")
+	}
+
+	// Profile with same height as small doesn't overwrite its images, files of removed profile are deleted
+	thumb := config.ResizeProfile{Name: "thumb", Height: 300}
+	fm = createManager(config.ResizeProfile{Name: middleProfile, Height: 1080, Quality: 90}, config.ResizeProfile{Name: smallProfile, Height: 300}, thumb)
+	fm.updateProfilesState()
+	small, thumbFile := filepath.Join(cache, fm.GetSmallImageName(*image)), filepath.Join(cache, fm.getProfileImageName(*image, "thumb"))
+	if filepath.Base(small) != "a-300.jpg" || filepath.Base(thumbFile) != "a-thumb.jpg" {
+		t.Error("profiles with same height must use different files", small, thumbFile)
+	}
+	os.WriteFile(small, []byte{}, os.ModePerm)
+	os.WriteFile(thumbFile, []byte{}, os.ModePerm)
+	fm = createManager(config.ResizeProfile{Name: middleProfile, Height: 1080, Quality: 90}, config.ResizeProfile{Name: smallProfile, Height: 300})
+	changed, removed := fm.updateProfilesState()
+	if changed || len(removed["src"]) != 1 {
+		t.Fatal("removed profile must be detected", changed, removed)
+	}
+	fm.removeProfilesFiles(removed)
+	if _, err := os.Stat(thumbFile); err == nil {
+		t.Error("images of removed profile must be deleted")
+	}
+	if _, err := os.Stat(small); err != nil {
+		t.Error("images of other profiles must be kept", err)
+	}
+}
@@ -0,0 +1,363 @@
+package photos_server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jotitan/photos_server/logger"
+	"github.com/jotitan/photos_server/persistence"
+	"github.com/jotitan/photos_server/progress"
+)
+
+/* Durable queue of images to resize. Pending and failed jobs are saved in cache (resize_queue.json),
+each change is written in a journal (resize_queue.journal) merged in state every resizeJournalSize operations.
+A failed resize is tried again later (delay doubled each time), after maxResizeAttempts it is kept in failed list until asked again.
+At startup, pending jobs and images never resized are added again */
+
+const (
+	resizeQueueFile   = "resize_queue.json"
+	resizeJournalFile = "resize_queue.journal"
+	// Number of operations written in journal before saving queue
+	resizeJournalSize = 500
+	maxResizeAttempts = 5
+	resizeRetryDelay  = 30 * time.Second
+)
+
+// Operations written in journal
+const (
+	jobAdded  = "add"
+	jobDone   = "done"
+	jobRetry  = "retry"
+	jobFailed = "failed"
+)
+
+// ResizeJob is the persisted part of an image to resize
+type ResizeJob struct {
+	Path         string
+	RelativePath string
+	ForceRotate  bool
+	Attempts     int
+	// Date of next attempt after a failure
+	NextTry   time.Time
+	LastError string `json:",omitempty"`
+	image     ImageToResize
+}
+
+type resizeJournalEntry struct {
+	Action string
+	Job    ResizeJob
+}
+
+// ResizeQueueStatus is the state of queue, returned by admin endpoint
+type ResizeQueueStatus struct {
+	// Jobs waiting for a first resize
+	Waiting int
+	// Jobs waiting for a new attempt after a failure
+	Retrying int
+	// Jobs done since launch
+	Resized int
+	Failed  []ResizeJob
+}
+
+type resizeQueue struct {
+	folder  string
+	journal *persistence.Journal
+	// Number of operations in journal
+	counter    int
+	retryDelay time.Duration
+	jobs       chan *ResizeJob
+	// By relative path
+	pending map[string]*ResizeJob
+	failed  map[string]*ResizeJob
+	// Pending jobs of last launch, to add again
+	toResume []string
+	retrying int
+	resized  int
+	locker   sync.Mutex
+}
+
+// newResizeQueue create a queue saved in cache folder, only in memory if cache is empty
+func newResizeQueue(cache string) *resizeQueue {
+	rq := &resizeQueue{folder: cache, retryDelay: resizeRetryDelay, jobs: make(chan *ResizeJob, 100),
+		pending: make(map[string]*ResizeJob), failed: make(map[string]*ResizeJob)}
+	if cache != "" {
+		rq.journal = persistence.NewJournal(filepath.Join(cache, resizeJournalFile))
+		rq.load()
+	}
+	return rq
+}
+
+type resizeQueueState struct {
+	Pending map[string]*ResizeJob
+	Failed  map[string]*ResizeJob
+}
+
+// load read saved state, replay journal and save the merged state
+func (rq *resizeQueue) load() {
+	if data, err := os.ReadFile(filepath.Join(rq.folder, resizeQueueFile)); err == nil {
+		state := resizeQueueState{}
+		if err := json.Unmarshal(data, &state); err != nil {
+			logger.GetLogger2().Error("Impossible to read resize queue", err)
+		}
+		if state.Pending != nil {
+			rq.pending = state.Pending
+		}
+		if state.Failed != nil {
+			rq.failed = state.Failed
+		}
+	}
+	count, err := rq.journal.Replay(func(data []byte) error {
+		var entry resizeJournalEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		rq.apply(entry)
+		return nil
+	})
+	if err != nil {
+		logger.GetLogger2().Error("Impossible to replay resize journal", err)
+	}
+	for path := range rq.pending {
+		rq.toResume = append(rq.toResume, path)
+	}
+	sort.Strings(rq.toResume)
+	// Pending jobs are added again with their image
+	rq.pending = make(map[string]*ResizeJob)
+	if count > 0 || len(rq.toResume) > 0 {
+		rq.save()
+	}
+	logger.GetLogger2().Info("Resize queue loaded,", len(rq.toResume), "images to resume and", len(rq.failed), "failed")
+}
+
+func (rq *resizeQueue) apply(entry resizeJournalEntry) {
+	job := entry.Job
+	switch entry.Action {
+	case jobAdded, jobRetry:
+		delete(rq.failed, job.RelativePath)
+		rq.pending[job.RelativePath] = &job
+	case jobDone:
+		delete(rq.pending, job.RelativePath)
+	case jobFailed:
+		delete(rq.pending, job.RelativePath)
+		rq.failed[job.RelativePath] = &job
+	}
+}
+
+// write apply operation and write it in journal, lock must be held
+func (rq *resizeQueue) write(action string, job *ResizeJob) {
+	entry := resizeJournalEntry{Action: action, Job: *job}
+	rq.apply(entry)
+	// Keep same pointer, used by running job
+	if action == jobAdded || action == jobRetry {
+		rq.pending[job.RelativePath] = job
+	}
+	if rq.journal == nil {
+		return
+	}
+	if err := rq.journal.Append(entry); err != nil {
+		logger.GetLogger2().Error("Impossible to write resize journal, save queue", err)
+		rq.save()
+		return
+	}
+	if rq.counter++; rq.counter >= resizeJournalSize {
+		rq.save()
+	}
+}
+
+// save write state and empty journal, lock must be held
+func (rq *resizeQueue) save() {
+	data, err := json.Marshal(resizeQueueState{Pending: rq.pending, Failed: rq.failed})
+	if err != nil {
+		logger.GetLogger2().Error("Impossible to save resize queue", err)
+		return
+	}
+	if err := persistence.WriteFile(filepath.Join(rq.folder, resizeQueueFile), data); err != nil {
+		logger.GetLogger2().Error("Impossible to save resize queue", err)
+		return
+	}
+	if err := rq.journal.Truncate(); err != nil {
+		logger.GetLogger2().Error("Impossible to empty resize journal", err)
+		return
+	}
+	rq.counter = 0
+}
+
+// push add an image to resize, wait if queue is full
+func (rq *resizeQueue) push(image ImageToResize) {
+	job := &ResizeJob{Path: image.path, RelativePath: image.relativePath, ForceRotate: image.forceRotate, image: image}
+	rq.locker.Lock()
+	rq.write(jobAdded, job)
+	rq.locker.Unlock()
+	rq.jobs <- job
+}
+
+// next wait for a job to run
+func (rq *resizeQueue) next() *ResizeJob {
+	return <-rq.jobs
+}
+
+// end finish a job. When resize failed, job is launched again later or kept in failed list after too many attempts
+func (rq *resizeQueue) end(job *ResizeJob, err error) {
+	rq.locker.Lock()
+	defer rq.locker.Unlock()
+	if err == nil {
+		rq.resized++
+		rq.write(jobDone, job)
+		job.image.waiter.Done()
+		return
+	}
+	job.Attempts++
+	job.LastError = err.Error()
+	if job.Attempts >= maxResizeAttempts {
+		logger.GetLogger2().Error("Resize of", job.RelativePath, "failed", job.Attempts, "times, give up", err)
+		rq.write(jobFailed, job)
+		job.image.waiter.Done()
+		return
+	}
+	delay := rq.retryDelay << (job.Attempts - 1)
+	job.NextTry = time.Now().Add(delay)
+	logger.GetLogger2().Info("Resize of", job.RelativePath, "failed, try again in", delay, err)
+	rq.write(jobRetry, job)
+	rq.retrying++
+	time.AfterFunc(delay, func() {
+		rq.locker.Lock()
+		rq.retrying--
+		rq.locker.Unlock()
+		rq.jobs <- job
+	})
+}
+
+// Status return number of jobs in queue and failed jobs
+func (rq *resizeQueue) Status() ResizeQueueStatus {
+	rq.locker.Lock()
+	defer rq.locker.Unlock()
+	status := ResizeQueueStatus{Waiting: len(rq.pending) - rq.retrying, Retrying: rq.retrying, Resized: rq.resized, Failed: make([]ResizeJob, 0, len(rq.failed))}
+	for _, job := range rq.failed {
+		status.Failed = append(status.Failed, *job)
+	}
+	sort.Slice(status.Failed, func(i, j int) bool { return status.Failed[i].RelativePath < status.Failed[j].RelativePath })
+	return status
+}
+
+// resumable return once pending jobs of last launch
+func (rq *resizeQueue) resumable() []string {
+	rq.locker.Lock()
+	defer rq.locker.Unlock()
+	paths := rq.toResume
+	rq.toResume = nil
+	return paths
+}
+
+// failedPaths return relative paths of failed jobs
+func (rq *resizeQueue) failedPaths() []string {
+	rq.locker.Lock()
+	defer rq.locker.Unlock()
+	paths := make([]string, 0, len(rq.failed))
+	for path := range rq.failed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// existingReducedImages return reduced images of node already in cache
+func (fm *FoldersManager) existingReducedImages(node *Node) map[string]struct{} {
+	existings := make(map[string]struct{})
+	folder := filepath.Join(fm.reducer.GetCache(), filepath.Dir(node.RelativePath))
+	profiles := fm.reducer.GetProfiles(node.RelativePath)
+	for _, profile := range profiles {
+		path := createProfileFile(fm.reducer, folder, node.RelativePath, profile, profiles)
+		if _, err := os.Stat(path); err == nil {
+			existings[path] = struct{}{}
+		}
+	}
+	return existings
+}
+
+// resizeImages add images in resize queue in background, return nil if no image is found
+func (fm *FoldersManager) resizeImages(paths []string) *progress.UploadProgress {
+	nodes := make([]*Node, 0, len(paths))
+	for _, path := range paths {
+		if node, _, err := fm.FindNode(path); err == nil && !node.IsFolder {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	// Tree is only read before going in background
+	absolutePaths := make([]string, len(nodes))
+	for i, node := range nodes {
+		absolutePaths[i] = node.GetAbsolutePath(fm.Sources)
+	}
+	progresser := fm.uploadProgressManager.AddTask(len(nodes))
+	progresser.EnableWaiter()
+	progresser.Add(len(nodes))
+	go func() {
+		for i, node := range nodes {
+			fm.reducer.AddImage(absolutePaths[i], node.RelativePath, node, progresser, fm.existingReducedImages(node), false)
+		}
+		progresser.Wait()
+		progresser.End()
+		updateLocker.Lock()
+		defer updateLocker.Unlock()
+		for _, node := range nodes {
+			fm.resolvePlace(node)
+		}
+		fm.saveNodes(nil, nodes, false)
+		logger.GetLogger2().Info("End of resize of", len(nodes), "images")
+	}()
+	return progresser
+}
+
+// ResumeResizes add again images pending at last stop and images never resized, except failed ones.
+// Called at server launch, once tree is loaded
+func (fm *FoldersManager) ResumeResizes() {
+	if fm.reducer.GetCache() == "" || fm.uploadProgressManager == nil {
+		return
+	}
+	updateLocker.Lock()
+	defer updateLocker.Unlock()
+	paths := make(map[string]struct{})
+	for _, path := range fm.reducer.ResizesToResume() {
+		paths[path] = struct{}{}
+	}
+	failed := make(map[string]struct{})
+	for _, job := range fm.reducer.ResizeQueueStatus().Failed {
+		failed[job.RelativePath] = struct{}{}
+	}
+	for _, source := range fm.Sources {
+		for _, folder := range source.Files {
+			folder.applyOnEach(fm.Sources, func(_, relativePath string, node *Node) {
+				if _, isFailed := failed[relativePath]; !node.ImagesResized && !isFailed {
+					paths[relativePath] = struct{}{}
+				}
+			})
+		}
+	}
+	list := make([]string, 0, len(paths))
+	for path := range paths {
+		list = append(list, path)
+	}
+	sort.Strings(list)
+	if fm.resizeImages(list) != nil {
+		logger.GetLogger2().Info("Resume resize of", len(list), "images")
+	}
+}
+
+// RetryFailedResizes add again images which resize failed too many times
+func (fm *FoldersManager) RetryFailedResizes() (*progress.UploadProgress, error) {
+	paths := fm.reducer.FailedResizes()
+	if len(paths) == 0 {
+		return nil, errors.New("no failed resize")
+	}
+	if progresser := fm.resizeImages(paths); progresser != nil {
+		return progresser, nil
+	}
+	return nil, errors.New("failed images don't exist anymore")
+}
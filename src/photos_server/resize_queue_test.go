@@ -0,0 +1,69 @@
+package photos_server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jotitan/photos_server/progress"
+)
+
+func newTestWaiter(size int) *progress.UploadProgress {
+	waiter := progress.NewUploadProgressManager().AddUploader(size)
+	waiter.EnableWaiter()
+	waiter.Add(size)
+	return waiter
+}
+
+func TestResizeQueueRetry(t *testing.T) {
+	rq := newResizeQueue(t.TempDir())
+	rq.retryDelay = time.Millisecond
+	waiter := newTestWaiter(1)
+	rq.push(ImageToResize{path: "/photos/source/a.jpg", relativePath: "source/a.jpg", waiter: waiter})
+	attempts := 0
+	go func() {
+		for {
+			job := rq.next()
+			attempts++
+			rq.end(job, errors.New("remote resizer unavailable"))
+		}
+	}()
+	waiter.Wait()
+	status := rq.Status()
+	if attempts != maxResizeAttempts || len(status.Failed) != 1 || status.Waiting != 0 || status.Retrying != 0 {
+		t.Fatal("job must be tried", maxResizeAttempts, "times and failed but found", attempts, status)
+	}
+	if job := status.Failed[0]; job.RelativePath != "source/a.jpg" || job.Attempts != maxResizeAttempts || job.LastError != "remote resizer unavailable" {
+		t.Error("failed job must keep last error", job)
+	}
+}
+
+func TestResizeQueueReload(t *testing.T) {
+	folder := t.TempDir()
+	rq := newResizeQueue(folder)
+	waiter := newTestWaiter(3)
+	for _, path := range []string{"source/a.jpg", "source/b.jpg", "source/c.jpg"} {
+		rq.push(ImageToResize{path: "/photos/" + path, relativePath: path, waiter: waiter})
+	}
+	rq.end(rq.next(), nil)
+	failed := rq.next()
+	failed.Attempts = maxResizeAttempts - 1
+	rq.end(failed, errors.New("corrupted image"))
+
+	// Restart : journal is replayed, c is still pending
+	reloaded := newResizeQueue(folder)
+	if paths := reloaded.resumable(); len(paths) != 1 || paths[0] != "source/c.jpg" {
+		t.Error("pending image must be resumed but found", paths)
+	}
+	if len(reloaded.resumable()) != 0 {
+		t.Error("images are resumed once")
+	}
+	if paths := reloaded.failedPaths(); len(paths) != 1 || paths[0] != "source/b.jpg" {
+		t.Error("failed image must be kept but found", paths)
+	}
+	// Pushed again, failed image is removed from failed list
+	reloaded.push(ImageToResize{path: "/photos/source/b.jpg", relativePath: "source/b.jpg", waiter: newTestWaiter(1)})
+	if status := reloaded.Status(); len(status.Failed) != 0 || status.Waiting != 1 {
+		t.Error("image must be pending again", status)
+	}
+}
@@ -11,6 +11,7 @@ func (s Server) updateRoutes(server *http.ServeMux) {
 	server.HandleFunc("/photo/folder/exif", s.buildHandler(s.securityServer.NeedAdmin, s.updateExifFolder))
 	server.HandleFunc("/photo", s.buildHandler(s.securityServer.NeedAdmin, s.uploadFolder))
 	server.HandleFunc("/updateExifOfDate", s.buildHandler(s.securityServer.NeedAdmin, s.updateExifOfDate))
+	server.HandleFunc("/photo/watcher/status", s.buildHandler(s.securityServer.NeedAdmin, s.getWatcherStatus))
 	server.HandleFunc("/sources", s.buildHandler(s.securityServer.NeedUser, s.getSources))
 }
 
@@ -24,7 +25,26 @@ func (s Server) photoRoutes(server *http.ServeMux) {
 	server.HandleFunc("/getFoldersDetails", s.buildHandler(s.securityServer.NeedConnected, s.getFoldersDetails))
 	server.HandleFunc("/custom-config", s.buildHandler(s.securityServer.NeedConnected, s.getCustomConfig))
 	server.HandleFunc("/count", s.count)
+	server.HandleFunc("/photo/map", s.buildHandler(s.securityServer.NeedConnected, s.getPhotosOnMap))
+	server.HandleFunc("/search", s.buildHandler(s.securityServer.NeedConnected, s.searchByQuery))
+	server.HandleFunc("/photo/search", s.buildHandler(s.securityServer.NeedConnected, s.searchPhotos))
+	server.HandleFunc("/photo/places/search", s.buildHandler(s.securityServer.NeedConnected, s.searchByPlace))
+	server.HandleFunc("/photo/places/resolve", s.buildHandler(s.securityServer.NeedAdmin, s.resolvePlaces))
+	server.HandleFunc("/photo/geojson", s.buildHandler(s.securityServer.NeedConnected, s.exportGeoJson))
 	server.HandleFunc("/photo/check-resizer", s.buildHandler(s.securityServer.NeedAdmin, s.checkPhotoResizer))
+	server.HandleFunc("/photo/duplicates", s.buildHandler(s.securityServer.NeedAdmin, s.duplicates))
+	server.HandleFunc("/photo/similar", s.buildHandler(s.securityServer.NeedAdmin, s.similarImages))
+	server.HandleFunc("/photo/profiles", s.buildHandler(s.securityServer.NeedAdmin, s.resizeProfiles))
+	server.HandleFunc("/photo/resize/queue", s.buildHandler(s.securityServer.NeedAdmin, s.resizeQueueStatus))
+	server.HandleFunc("/photo/cache/check", s.buildHandler(s.securityServer.NeedAdmin, s.checkCache))
+	server.HandleFunc("/photo/duplicates/compute-hashes", s.buildHandler(s.securityServer.NeedAdmin, s.computeHashes))
+	server.HandleFunc("/photo/rate", s.buildHandler(s.securityServer.NeedConnected, s.rate))
+	server.HandleFunc("/photo/favorites", s.buildHandler(s.securityServer.NeedConnected, s.getFavorites))
+	server.HandleFunc("/album", s.buildHandler(s.securityServer.NeedUser, s.albums))
+	server.HandleFunc("/album/edit", s.buildHandler(s.securityServer.NeedAdmin, s.editAlbum))
+	server.HandleFunc("/album/items", s.buildHandler(s.securityServer.NeedAdmin, s.editAlbumItems))
+	server.HandleFunc("/admin/snapshots", s.buildHandler(s.securityServer.NeedAdmin, s.snapshots))
+	server.HandleFunc("/admin/storage", s.buildHandler(s.securityServer.NeedAdmin, s.storageUsage))
 	//server.HandleFunc("/indexFolder",s.indexFolder)
 }
 
@@ -44,6 +64,10 @@ func (s Server) tagRoutes(server *http.ServeMux) {
 	server.HandleFunc("/tag/search_folder", s.buildHandler(s.securityServer.NeedUser, s.searchTagsOfFolder))
 	server.HandleFunc("/tag/peoples", s.buildHandler(s.securityServer.NeedUser, s.getPeoples))
 	server.HandleFunc("/tag/add_people", s.buildHandler(s.securityServer.NeedAdmin, s.addPeopleTag))
+	server.HandleFunc("/tag/catalog", s.buildHandler(s.securityServer.NeedUser, s.tagsCatalog))
+	server.HandleFunc("/tag/catalog/complete", s.buildHandler(s.securityServer.NeedUser, s.completeTag))
+	server.HandleFunc("/tag/catalog/edit", s.buildHandler(s.securityServer.NeedAdmin, s.editCatalogTag))
+	server.HandleFunc("/tag/catalog/merge", s.buildHandler(s.securityServer.NeedAdmin, s.mergeCatalogTags))
 }
 
 func (s Server) remoteRoutes(server *http.ServeMux) {
@@ -64,6 +88,10 @@ func (s Server) dateRoutes(server *http.ServeMux) {
 	server.HandleFunc("/flushTags", s.buildHandler(s.securityServer.NeedAdmin, s.flushTags))
 	server.HandleFunc("/filterTagsFolder", s.buildHandler(s.securityServer.NeedUser, s.filterTagsFolder))
 	server.HandleFunc("/filterTagsDate", s.buildHandler(s.securityServer.NeedUser, s.filterTagsDate))
+	server.HandleFunc("/filterTagsImages", s.buildHandler(s.securityServer.NeedUser, s.filterTagsImages))
+	server.HandleFunc("/filterTagsDateImages", s.buildHandler(s.securityServer.NeedUser, s.filterTagsDateImages))
+	server.HandleFunc("/tagsByImages", s.buildHandler(s.securityServer.NeedAdmin, s.updateTagsByImages))
+	server.HandleFunc("/tagsOfImage", s.buildHandler(s.securityServer.NeedUser, s.getTagsOfImage))
 }
 
 func (s Server) securityRoutes(server *http.ServeMux) {
@@ -80,6 +108,8 @@ func (s *Server) loadPathRoutes() {
 		"/browserf":         s.buildHandler(s.securityServer.NeedConnected, s.browseRestful),
 		"/imagehd":          s.buildHandler(s.securityServer.NeedConnected, s.imageHD),
 		"/image":            s.buildHandler(s.securityServer.NeedConnected, s.image),
+		"/imageraw":         s.buildHandler(s.securityServer.NeedConnected, s.imageRaw),
+		"/imageresize":      s.buildHandler(s.securityServer.NeedConnected, s.imageResize),
 		"/removeNode":       s.buildHandler(s.securityServer.NeedAdmin, s.removeNode),
 		"/tagsByFolder":     s.buildHandler(s.securityServer.NeedAdmin, s.updateTagsByFolder),
 		"/tagsByDate":       s.buildHandler(s.securityServer.NeedAdmin, s.updateTagsByDate),
@@ -0,0 +1,181 @@
+package photos_server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jotitan/photos_server/resize"
+)
+
+/* Find images visually identical (bursts, images saved again...) with perceptual hashes */
+
+const defaultSimilarDistance = 6
+
+type SimilarGroup struct {
+	// Path of image with best resolution
+	Best   string
+	Images []DuplicateImage
+}
+
+// bkTree index hashes by hamming distance to find quickly close hashes
+type bkTree struct {
+	hash     uint64
+	nodes    []*Node
+	children map[int]*bkTree
+}
+
+func (bk *bkTree) add(hash uint64, node *Node) *bkTree {
+	if bk == nil {
+		return &bkTree{hash: hash, nodes: []*Node{node}, children: make(map[int]*bkTree)}
+	}
+	current := bk
+	for {
+		distance := resize.HammingDistance(hash, current.hash)
+		if distance == 0 {
+			current.nodes = append(current.nodes, node)
+			return bk
+		}
+		child, exist := current.children[distance]
+		if !exist {
+			current.children[distance] = &bkTree{hash: hash, nodes: []*Node{node}, children: make(map[int]*bkTree)}
+			return bk
+		}
+		current = child
+	}
+}
+
+// search return all nodes with a hash at most at maxDistance
+func (bk *bkTree) search(hash uint64, maxDistance int) []*Node {
+	results := make([]*Node, 0)
+	if bk == nil {
+		return results
+	}
+	toVisit := []*bkTree{bk}
+	for len(toVisit) > 0 {
+		current := toVisit[0]
+		toVisit = toVisit[1:]
+		distance := resize.HammingDistance(hash, current.hash)
+		if distance <= maxDistance {
+			results = append(results, current.nodes...)
+		}
+		for d, child := range current.children {
+			if d >= distance-maxDistance && d <= distance+maxDistance {
+				toVisit = append(toVisit, child)
+			}
+		}
+	}
+	return results
+}
+
+func (fm *FoldersManager) getSimilarIndex() *bkTree {
+	if fm.similarIndex == nil {
+		var tree *bkTree
+		for _, src := range fm.Sources {
+			for _, folder := range src.Files {
+				tree = addToSimilarIndex(folder, tree)
+			}
+		}
+		fm.similarIndex = tree
+	}
+	return fm.similarIndex
+}
+
+func addToSimilarIndex(node *Node, tree *bkTree) *bkTree {
+	if !node.IsFolder {
+		if hash, err := resize.ParseHash(node.PHash); err == nil && node.PHash != "" {
+			tree = tree.add(hash, node)
+		}
+		return tree
+	}
+	for _, file := range node.Files {
+		tree = addToSimilarIndex(file, tree)
+	}
+	return tree
+}
+
+// GetSimilarImages return groups of images visually identical. If folder is set, only images of the folder are grouped.
+// If burst is set, images must also be taken in this delay
+func (fm *FoldersManager) GetSimilarImages(folder string, maxDistance int, burst time.Duration) ([]SimilarGroup, error) {
+	if maxDistance <= 0 {
+		maxDistance = defaultSimilarDistance
+	}
+	tree := fm.getSimilarIndex()
+	if folder != "" {
+		node, _, err := fm.FindNode(folder)
+		if err != nil {
+			return nil, err
+		}
+		tree = addToSimilarIndex(node, nil)
+	}
+	// Union of close images
+	parents := make(map[*Node]*Node)
+	var find func(node *Node) *Node
+	find = func(node *Node) *Node {
+		if parent, exist := parents[node]; exist && parent != node {
+			root := find(parent)
+			parents[node] = root
+			return root
+		}
+		parents[node] = node
+		return node
+	}
+	tree.walk(func(hash uint64, nodes []*Node) {
+		for _, node := range nodes {
+			for _, neighbour := range tree.search(hash, maxDistance) {
+				if neighbour != node && (burst == 0 || absDuration(node.Date.Sub(neighbour.Date)) <= burst) {
+					parents[find(neighbour)] = find(node)
+				}
+			}
+		}
+	})
+	clusters := make(map[*Node][]*Node)
+	for node := range parents {
+		root := find(node)
+		clusters[root] = append(clusters[root], node)
+	}
+	return createSimilarGroups(clusters), nil
+}
+
+func (bk *bkTree) walk(fct func(hash uint64, nodes []*Node)) {
+	if bk == nil {
+		return
+	}
+	fct(bk.hash, bk.nodes)
+	for _, child := range bk.children {
+		child.walk(fct)
+	}
+}
+
+func createSimilarGroups(clusters map[*Node][]*Node) []SimilarGroup {
+	groups := make([]SimilarGroup, 0)
+	for _, nodes := range clusters {
+		if len(nodes) < 2 {
+			continue
+		}
+		sort.Slice(nodes, func(i, j int) bool {
+			if nodes[i].Date.Equal(nodes[j].Date) {
+				return nodes[i].RelativePath < nodes[j].RelativePath
+			}
+			return nodes[i].Date.Before(nodes[j].Date)
+		})
+		group := SimilarGroup{Images: make([]DuplicateImage, len(nodes))}
+		best := nodes[0]
+		for i, node := range nodes {
+			group.Images[i] = DuplicateImage{Path: node.RelativePath, Date: node.Date, Width: node.Width, Height: node.Height}
+			if node.Width*node.Height > best.Width*best.Height {
+				best = node
+			}
+		}
+		group.Best = best.RelativePath
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Images[0].Path < groups[j].Images[0].Path })
+	return groups
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
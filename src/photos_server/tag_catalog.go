@@ -0,0 +1,312 @@
+package photos_server
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+/* Catalog of tags used in folders, dates and photos. Each tag has a stable id, a color and a parent (Voyage/Italie is a child of Voyage) */
+
+const tagSeparator = "/"
+
+// CatalogTag is the reference of a tag, Name is the full name with parents (Voyage/Italie)
+type CatalogTag struct {
+	Id     int
+	Name   string
+	Color  string
+	Parent int `json:",omitempty"`
+}
+
+// CatalogEntry is a tag of catalog with usage counts
+type CatalogEntry struct {
+	CatalogTag
+	Folders int
+	Dates   int
+	Images  int
+}
+
+func (ce CatalogEntry) usage() int {
+	return ce.Folders + ce.Dates + ce.Images
+}
+
+// cleanTagName remove spaces and empty levels of a tag name
+func cleanTagName(name string) string {
+	levels := make([]string, 0)
+	for _, level := range strings.Split(name, tagSeparator) {
+		if level = strings.TrimSpace(level); level != "" {
+			levels = append(levels, level)
+		}
+	}
+	return strings.Join(levels, tagSeparator)
+}
+
+// matchTag return true if tag value is search or a child of search, case and accents are ignored
+func matchTag(value, search string) bool {
+	value, search = normalizeText(value), normalizeText(cleanTagName(search))
+	return value == search || strings.HasPrefix(value, search+tagSeparator)
+}
+
+// sameTagName compare names of tags like filters do, case and accents are ignored (Noël is Noel)
+func sameTagName(name, other string) bool {
+	return normalizeText(name) == normalizeText(other)
+}
+
+// findCatalogTag return tag with same name, the oldest one if an old catalog has many
+func (tm *TagManager) findCatalogTag(name string) *CatalogTag {
+	var found *CatalogTag
+	for _, tag := range tm.Catalog {
+		if sameTagName(tag.Name, name) && (found == nil || tag.Id < found.Id) {
+			found = tag
+		}
+	}
+	return found
+}
+
+// registerTag create tag (and its parents) in catalog if necessary and return tag with catalog name.
+// Color of catalog is only changed by editing catalog, tag keeps its own color if it has one
+func (tm *TagManager) registerTag(tag Tag) Tag {
+	tag.Value = cleanTagName(tag.Value)
+	if tag.Value == "" {
+		return tag
+	}
+	catalogTag := tm.findCatalogTag(tag.Value)
+	if catalogTag == nil {
+		catalogTag = tm.createCatalogTag(tag.Value, tag.Color)
+	} else if catalogTag.Color == "" && tag.Color != "" {
+		catalogTag.Color = tag.Color
+		tm.touchCatalog(catalogTag.Id)
+	}
+	if tag.Color == "" {
+		tag.Color = catalogTag.Color
+	}
+	return Tag{Value: catalogTag.Name, Color: tag.Color}
+}
+
+// setColor change color of tag everywhere it is used
+func (tm *TagManager) setColor(catalogTag *CatalogTag, color string) {
+	catalogTag.Color = color
+	tm.touchCatalog(catalogTag.Id)
+	for _, kind := range tagKinds {
+		for key, tags := range tm.tagsMap(kind) {
+			if tag := tm.searchTagByName(tags, catalogTag.Name); tag != nil {
+				tag.Color = color
+				tm.touch(kind, key)
+			}
+		}
+	}
+}
+
+// createCatalogTag create tag and its parents. Tag keeps name of existing parents and their color if it has none
+func (tm *TagManager) createCatalogTag(name, color string) *CatalogTag {
+	tag := &CatalogTag{Name: name, Color: color}
+	if parent := tm.getParent(name, color); parent != nil {
+		tag.Parent = parent.Id
+		tag.Name = parent.Name + name[len(parent.Name):]
+		if tag.Color == "" {
+			tag.Color = parent.Color
+		}
+	}
+	tm.NextTagId++
+	tag.Id = tm.NextTagId
+	tm.Catalog[tag.Id] = tag
+	tm.touchCatalog(tag.Id)
+	return tag
+}
+
+// getParent return parent of tag name, parent is created if necessary
+func (tm *TagManager) getParent(name, color string) *CatalogTag {
+	pos := strings.LastIndex(name, tagSeparator)
+	if pos == -1 {
+		return nil
+	}
+	if parent := tm.findCatalogTag(name[:pos]); parent != nil {
+		return parent
+	}
+	return tm.createCatalogTag(name[:pos], color)
+}
+
+// syncCatalog register in catalog all tags used, used when catalog didn't exist.
+// Keys are sorted so the color of a new catalog tag is always the one of the first usage
+func (tm *TagManager) syncCatalog() {
+	for _, kind := range tagKinds {
+		tagsMap := tm.tagsMap(kind)
+		keys := make([]string, 0, len(tagsMap))
+		for key := range tagsMap {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			for _, tag := range tagsMap[key] {
+				*tag = tm.registerTag(*tag)
+			}
+		}
+	}
+}
+
+// GetCatalog return all tags of catalog sorted by name, with usage counts
+func (tm *TagManager) GetCatalog() []CatalogEntry {
+	tm.locker.RLock()
+	defer tm.locker.RUnlock()
+	return tm.catalogEntries()
+}
+
+func (tm *TagManager) catalogEntries() []CatalogEntry {
+	entries := make(map[string]*CatalogEntry, len(tm.Catalog))
+	for _, tag := range tm.Catalog {
+		entries[normalizeText(tag.Name)] = &CatalogEntry{CatalogTag: *tag}
+	}
+	for _, kind := range tagKinds {
+		for _, tags := range tm.tagsMap(kind) {
+			for _, tag := range tags {
+				if entry, exist := entries[normalizeText(tag.Value)]; exist {
+					switch kind {
+					case tagsOfFolders:
+						entry.Folders++
+					case tagsOfDates:
+						entry.Dates++
+					default:
+						entry.Images++
+					}
+				}
+			}
+		}
+	}
+	list := make([]CatalogEntry, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name) })
+	return list
+}
+
+// CompleteTag return tags where name or a level of name begin with prefix, most used first
+func (tm *TagManager) CompleteTag(prefix string, limit int) []CatalogEntry {
+	tm.locker.RLock()
+	defer tm.locker.RUnlock()
+	prefix = normalizeText(strings.TrimSpace(prefix))
+	results := make([]CatalogEntry, 0)
+	for _, entry := range tm.catalogEntries() {
+		if tm.matchPrefix(entry.Name, prefix) {
+			results = append(results, entry)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].usage() > results[j].usage() })
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+func (tm *TagManager) matchPrefix(name, prefix string) bool {
+	name = normalizeText(name)
+	if strings.HasPrefix(name, prefix) {
+		return true
+	}
+	for _, level := range strings.Split(name, tagSeparator) {
+		if strings.HasPrefix(level, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateCatalogTag rename (with its children) and / or change color of a tag everywhere it is used
+func (tm *TagManager) UpdateCatalogTag(id int, name, color string) error {
+	return tm.update(func() error {
+		return tm.updateCatalogTag(id, name, color)
+	})
+}
+
+func (tm *TagManager) updateCatalogTag(id int, name, color string) error {
+	tag, exist := tm.Catalog[id]
+	if !exist {
+		return errors.New("unknown tag")
+	}
+	if name = cleanTagName(name); name != "" && name != tag.Name {
+		if existing := tm.findCatalogTag(name); existing != nil && existing.Id != id {
+			return errors.New("tag " + name + " already exists, merge tags instead")
+		}
+		if strings.HasPrefix(normalizeText(name), normalizeText(tag.Name)+tagSeparator) {
+			return errors.New("tag can't be moved in its children")
+		}
+		tm.moveTag(tag, name)
+	}
+	if color != "" && color != tag.Color {
+		tm.setColor(tag, color)
+	}
+	return nil
+}
+
+// MergeTags replace tag from by tag to everywhere, children of from become children of to
+func (tm *TagManager) MergeTags(from, to int) error {
+	return tm.update(func() error {
+		return tm.mergeTags(from, to)
+	})
+}
+
+func (tm *TagManager) mergeTags(from, to int) error {
+	fromTag, existFrom := tm.Catalog[from]
+	toTag, existTo := tm.Catalog[to]
+	if !existFrom || !existTo {
+		return errors.New("unknown tag")
+	}
+	if from == to || strings.HasPrefix(normalizeText(toTag.Name), normalizeText(fromTag.Name)+tagSeparator) {
+		return errors.New("tag can't be merged in itself or its children")
+	}
+	tm.mergeTag(fromTag, toTag)
+	return nil
+}
+
+// moveTag rename tag and its children, merge them if new name already exists
+func (tm *TagManager) moveTag(tag *CatalogTag, name string) {
+	if existing := tm.findCatalogTag(name); existing != nil && existing.Id != tag.Id {
+		tm.mergeTag(tag, existing)
+		return
+	}
+	oldName := tag.Name
+	tm.touchCatalog(tag.Id)
+	tag.Name, tag.Parent = name, 0
+	if parent := tm.getParent(name, tag.Color); parent != nil {
+		tag.Name, tag.Parent = parent.Name+name[len(parent.Name):], parent.Id
+	}
+	tm.replaceTag(oldName, *tag)
+	for _, child := range tm.children(tag.Id) {
+		tm.moveTag(child, name+child.Name[len(oldName):])
+	}
+}
+
+func (tm *TagManager) mergeTag(from, to *CatalogTag) {
+	for _, child := range tm.children(from.Id) {
+		tm.moveTag(child, to.Name+child.Name[len(from.Name):])
+	}
+	tm.replaceTag(from.Name, *to)
+	delete(tm.Catalog, from.Id)
+	tm.touchCatalog(from.Id)
+}
+
+func (tm *TagManager) children(id int) []*CatalogTag {
+	children := make([]*CatalogTag, 0)
+	for _, tag := range tm.Catalog {
+		if tag.Parent == id {
+			children = append(children, tag)
+		}
+	}
+	return children
+}
+
+// replaceTag replace tags named name by tag in folders, dates and photos. Tag is not duplicated if already present
+func (tm *TagManager) replaceTag(name string, tag CatalogTag) {
+	for _, kind := range tagKinds {
+		keys := make([]string, 0)
+		for key, tags := range tm.tagsMap(kind) {
+			if tm.searchTagByName(tags, name) != nil {
+				keys = append(keys, key)
+			}
+		}
+		for _, key := range keys {
+			tm.removeTagInMap(kind, key, Tag{Value: name})
+			tm.addTagInMap(kind, key, Tag{Value: tag.Name, Color: tag.Color})
+		}
+	}
+}
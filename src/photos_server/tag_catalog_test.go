@@ -0,0 +1,71 @@
+package photos_server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTagCatalog(t *testing.T) {
+	fm, _, _ := createFakeStructure(t)
+	tm := fm.tagManger
+	tm.AddTagByFolder("root/folder1", " Voyage / Italie ", "green")
+	tm.AddTagByFolder("root/folder2", "Noel", "red")
+	tm.AddTagByDate("20200503", "Noël", "blue")
+	tm.AddTagByFolder("root/folder2", "noel/2020", "")
+	tm.AddTagByDate("20200504", "Christmas", "blue")
+
+	voyage, italie := tm.findCatalogTag("Voyage"), tm.findCatalogTag("voyage/italie")
+	if voyage == nil || italie == nil || italie.Parent != voyage.Id || italie.Color != "green" {
+		t.Fatal("Tag and its parent must be in catalog", voyage, italie)
+	}
+	if folders := tm.FilterFolder("voyage"); !reflect.DeepEqual(folders, []string{"root/folder1"}) {
+		t.Error("Parent tag must find folders of children", folders)
+	}
+	if tag := tm.searchTagByName(tm.GetTagsByFolder("root/folder2"), "noel/2020"); tag == nil || tag.Value != "Noel/2020" || tag.Color != "red" {
+		t.Error("Tag must use catalog name and color of parent", tag)
+	}
+	if entries := tm.CompleteTag("ita", 10); len(entries) != 1 || entries[0].Name != "Voyage/Italie" || entries[0].Folders != 1 || entries[0].Dates != 1 {
+		t.Error("Bad completion", entries)
+	}
+
+	// Same tag without accent, it keeps color of catalog
+	noel, christmas := tm.findCatalogTag("Noel"), tm.findCatalogTag("Christmas")
+	if tm.findCatalogTag("Noël") != noel || noel.Color != "red" {
+		t.Error("Tag with accent must be the same and keep catalog color", noel)
+	}
+	if tags := tm.GetTagsByDate("20200503"); len(tags) != 1 || tags[0].Value != "Noel" || tags[0].Color != "blue" {
+		t.Error("Date must use catalog name with its own color", tags)
+	}
+	if tm.UpdateCatalogTag(noel.Id, "christmas", "") == nil {
+		t.Error("Rename on an existing tag must be rejected")
+	}
+	if err := tm.MergeTags(noel.Id, christmas.Id); err != nil {
+		t.Fatal("Tags must be merged", err)
+	}
+	if tm.findCatalogTag("Noel") != nil || tm.findCatalogTag("Christmas/2020") == nil {
+		t.Error("Merged tag must be removed and children moved")
+	}
+	if tags := tm.GetTagsByFolder("root/folder2"); len(tags) != 2 || tm.searchTagByName(tags, "Christmas").Color != "blue" {
+		t.Error("Folder must use merged tag", tags)
+	}
+	if err := tm.UpdateCatalogTag(voyage.Id, "Voyages", "yellow"); err != nil {
+		t.Fatal("Tag must be renamed", err)
+	}
+	if tags := tm.GetTagsByFolder("root/folder1"); len(tags) != 1 || tags[0].Value != "Voyages/Italie" {
+		t.Error("Children must be renamed", tags)
+	}
+	if len(tm.FilterDate("Voyage/Italie")) != 0 || len(tm.FilterDate("voyages/italie")) != 1 {
+		t.Error("Dates must use renamed tag")
+	}
+}
+
+func TestSyncCatalogColor(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		tm := &TagManager{Catalog: make(map[int]*CatalogTag), TagsByDate: make(map[string][]*Tag), TagsByImage: make(map[string][]*Tag),
+			TagsByFolder: map[string][]*Tag{"b": {{Value: "plage", Color: "blue"}}, "a": {{Value: "Plage", Color: "red"}}}, changes: newTagChanges()}
+		tm.syncCatalog()
+		if tag := tm.findCatalogTag("plage"); len(tm.Catalog) != 1 || tag.Color != "red" || tm.TagsByFolder["b"][0].Color != "blue" {
+			t.Fatal("Catalog must use color of first usage and keep color of others", tag)
+		}
+	}
+}
@@ -5,15 +5,28 @@ import (
 	"errors"
 	"fmt"
 	"github.com/jotitan/photos_server/logger"
-	"io/ioutil"
+	"github.com/jotitan/photos_server/persistence"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// Number of operations written in journal before saving tag database
 const bufferSize = 100
 
+// Kinds of tagged elements
+const (
+	tagsOfFolders = "folders"
+	tagsOfDates   = "dates"
+	tagsOfImages  = "images"
+)
+
+var tagKinds = []string{tagsOfFolders, tagsOfDates, tagsOfImages}
+
 type Tag struct {
 	Value string
 	Color string
@@ -27,35 +40,89 @@ func (t Tag) Equals(tag Tag) bool {
 	return strings.EqualFold(t.Value, tag.Value) && strings.EqualFold(t.Color, tag.Color)
 }
 
+// TagManager is safe for concurrent use. Each modification is written in a journal, journal is merged in tag database every bufferSize operations
 type TagManager struct {
-	TagsByDate     map[string][]*Tag
-	TagsByFolder   map[string][]*Tag
+	TagsByDate   map[string][]*Tag
+	TagsByFolder map[string][]*Tag
+	// Tags of a single photo or video, key is relative path
+	TagsByImage map[string][]*Tag
+	// Reference of all tags by id
+	Catalog        map[int]*CatalogTag
+	NextTagId      int
 	foldersManager *FoldersManager
-	counter        int32
-	// Used to synchronize write
-	locker sync.Mutex
+	// Path of tag database
+	path    string
+	journal *persistence.Journal
+	// Number of operations in journal
+	counter int
+	// Keys and catalog tags modified by current operation
+	changes tagChanges
+	// Incremented on each modification, used to refresh search index
+	version int64
+	locker  sync.RWMutex
+}
+
+type tagChanges struct {
+	keys    map[string]map[string]struct{}
+	catalog map[int]struct{}
+}
+
+func newTagChanges() tagChanges {
+	return tagChanges{keys: make(map[string]map[string]struct{}), catalog: make(map[int]struct{})}
+}
+
+// tagJournalEntry is the new state of keys and catalog tags modified by an operation. Missing tags of a key or nil catalog tag means removed
+type tagJournalEntry struct {
+	Tags      map[string]map[string][]*Tag `json:",omitempty"`
+	Catalog   map[int]*CatalogTag          `json:",omitempty"`
+	NextTagId int
 }
 
 func NewTagManager(foldersManager *FoldersManager) *TagManager {
-	tm := &TagManager{TagsByDate: make(map[string][]*Tag), TagsByFolder: make(map[string][]*Tag), foldersManager: foldersManager, counter: 0, locker: sync.Mutex{}}
-	tm.load()
+	tm := &TagManager{foldersManager: foldersManager, path: getTagDatabasePath(foldersManager.stateFolder),
+		journal: persistence.NewJournal(getTagJournalPath(foldersManager.stateFolder)), changes: newTagChanges()}
+	tm.load(true)
+	persistence.Register("tags", tm.path, func() error {
+		tm.locker.Lock()
+		defer tm.locker.Unlock()
+		// Operations of journal were done on previous version
+		if err := tm.journal.Truncate(); err != nil {
+			return err
+		}
+		tm.load(false)
+		return nil
+	})
 	return tm
 }
 
-func (tm TagManager) FilterDate(searchTag string) []string {
-	return tm.filterTags(searchTag, tm.TagsByDate)
+func (tm *TagManager) tagsMap(kind string) map[string][]*Tag {
+	switch kind {
+	case tagsOfFolders:
+		return tm.TagsByFolder
+	case tagsOfDates:
+		return tm.TagsByDate
+	default:
+		return tm.TagsByImage
+	}
+}
+
+func (tm *TagManager) FilterDate(searchTag string) []string {
+	tm.locker.RLock()
+	defer tm.locker.RUnlock()
+	return tm.filterTags(searchTag, tagsOfDates)
 }
 
-func (tm TagManager) FilterFolder(searchTag string) []string {
-	return tm.filterTags(searchTag, tm.TagsByFolder)
+func (tm *TagManager) FilterFolder(searchTag string) []string {
+	tm.locker.RLock()
+	defer tm.locker.RUnlock()
+	return tm.filterTags(searchTag, tagsOfFolders)
 }
 
-func (tm TagManager) filterTags(searchTag string, mapTags map[string][]*Tag) []string {
-	lower := strings.ToLower(searchTag)
+func (tm *TagManager) filterTags(searchTag, kind string) []string {
 	paths := make([]string, 0)
-	for path, tags := range mapTags {
+	for path, tags := range tm.tagsMap(kind) {
 		for _, tag := range tags {
-			if strings.EqualFold(strings.ToLower(tag.Value), lower) {
+			if matchTag(tag.Value, searchTag) {
 				paths = append(paths, path)
 				break
 			}
@@ -66,70 +133,212 @@ func (tm TagManager) filterTags(searchTag string, mapTags map[string][]*Tag) []s
 
 // Detect dates of nodes to improve by dates
 func (tm *TagManager) AddTagByFolder(path, value, color string) error {
-	if folder, _, err := tm.foldersManager.FindNode(path); err == nil && folder.IsFolder {
-		tm.addTagInMap(tm.TagsByFolder, path, Tag{value, color})
-		dates := tm.findDatesOfNodes(folder)
-		for date := range dates {
-			tm.AddTagByDate(date, value, color)
-		}
-	} else {
-		if err == nil {
-			return errors.New("not a folder")
-		}
+	folder, _, err := tm.foldersManager.FindNode(path)
+	if err != nil {
 		return err
 	}
-	tm.countOperation()
-	return nil
+	if !folder.IsFolder {
+		return errors.New("not a folder")
+	}
+	return tm.update(func() error {
+		tm.addTagInMap(tagsOfFolders, path, Tag{value, color})
+		for date := range tm.findDatesOfNodes(folder) {
+			tm.addTagInMap(tagsOfDates, date, Tag{value, color})
+		}
+		return nil
+	})
 }
 
 func (tm *TagManager) AddTagByDate(date, value, color string) error {
-	tm.addTagInMap(tm.TagsByDate, date, Tag{value, color})
-	tm.countOperation()
-	return nil
+	return tm.update(func() error {
+		tm.addTagInMap(tagsOfDates, date, Tag{value, color})
+		return nil
+	})
 }
 
-// Count number of operation on tag manager and flush data if necessary
-func (tm *TagManager) countOperation() {
-	atomic.AddInt32(&tm.counter, 1)
-	if tm.counter >= bufferSize {
+// update run a modification under lock and write modified tags in journal.
+// Journal is synced on disk after lock is released, so readers and other writers don't wait disk
+func (tm *TagManager) update(modify func() error) error {
+	tm.locker.Lock()
+	err := modify()
+	tm.commit()
+	tm.locker.Unlock()
+	if errSync := tm.journal.Sync(); errSync != nil {
+		logger.GetLogger2().Error("Impossible to sync tag journal, save database", errSync)
 		tm.flush()
 	}
+	return err
+}
+
+func (tm *TagManager) touch(kind, key string) {
+	if _, exist := tm.changes.keys[kind]; !exist {
+		tm.changes.keys[kind] = make(map[string]struct{})
+	}
+	tm.changes.keys[kind][key] = struct{}{}
+}
+
+func (tm *TagManager) touchCatalog(id int) {
+	tm.changes.catalog[id] = struct{}{}
+}
+
+// commit write changes of current operation in journal and save database if journal is too long
+func (tm *TagManager) commit() {
+	if len(tm.changes.keys) == 0 && len(tm.changes.catalog) == 0 {
+		return
+	}
+	entry := tagJournalEntry{Tags: make(map[string]map[string][]*Tag), Catalog: make(map[int]*CatalogTag), NextTagId: tm.NextTagId}
+	for kind, keys := range tm.changes.keys {
+		entry.Tags[kind] = make(map[string][]*Tag, len(keys))
+		for key := range keys {
+			entry.Tags[kind][key] = tm.tagsMap(kind)[key]
+		}
+	}
+	for id := range tm.changes.catalog {
+		entry.Catalog[id] = tm.Catalog[id]
+	}
+	tm.changes = newTagChanges()
+	atomic.AddInt64(&tm.version, 1)
+	if err := tm.journal.Write(entry); err != nil {
+		logger.GetLogger2().Error("Impossible to write tag journal, save database", err)
+		tm.save()
+		return
+	}
+	if tm.counter++; tm.counter >= bufferSize {
+		tm.save()
+	}
+}
+
+// apply set state of a journal entry
+func (tm *TagManager) apply(entry tagJournalEntry) {
+	for kind, keys := range entry.Tags {
+		for key, tags := range keys {
+			if len(tags) == 0 {
+				delete(tm.tagsMap(kind), key)
+			} else {
+				tm.tagsMap(kind)[key] = tags
+			}
+		}
+	}
+	for id, tag := range entry.Catalog {
+		if tag == nil {
+			delete(tm.Catalog, id)
+		} else {
+			tm.Catalog[id] = tag
+		}
+	}
+	tm.NextTagId = entry.NextTagId
 }
 
 func (tm *TagManager) UpdateExistingPath(pathFrom, pathTo string) {
-	if list, exist := tm.TagsByFolder[pathFrom]; exist {
-		tm.TagsByFolder[pathTo] = list
-		delete(tm.TagsByFolder, pathFrom)
+	tm.update(func() error {
+		if list, exist := tm.TagsByFolder[pathFrom]; exist && pathFrom != pathTo {
+			tm.setTags(tagsOfFolders, pathTo, list)
+			tm.setTags(tagsOfFolders, pathFrom, nil)
+		}
+		from, to := cleanRelativePath(pathFrom), cleanRelativePath(pathTo)
+		moves := make(map[string]string)
+		for key := range tm.TagsByImage {
+			if moved, isMoved := movePath(key, from, to); isMoved && moved != key {
+				moves[key] = moved
+			}
+		}
+		for key, moved := range moves {
+			tags := tm.TagsByImage[key]
+			tm.setTags(tagsOfImages, key, nil)
+			tm.setTags(tagsOfImages, moved, tags)
+		}
+		return nil
+	})
+}
+
+// setTags replace tags of key, no tags remove key
+func (tm *TagManager) setTags(kind, key string, tags []*Tag) {
+	if len(tags) == 0 {
+		delete(tm.tagsMap(kind), key)
+	} else {
+		tm.tagsMap(kind)[key] = tags
 	}
+	tm.touch(kind, key)
 }
 
-func (tm *TagManager) load() {
-	if data, err := ioutil.ReadFile("tag_database.json"); err == nil {
+// load read tag database and, if withJournal, replay operations done since database was saved
+func (tm *TagManager) load(withJournal bool) {
+	tm.TagsByDate = make(map[string][]*Tag)
+	tm.TagsByFolder = make(map[string][]*Tag)
+	tm.TagsByImage = make(map[string][]*Tag)
+	tm.Catalog = make(map[int]*CatalogTag)
+	tm.NextTagId, tm.counter = 0, 0
+	if data, err := os.ReadFile(tm.path); err == nil {
 		tempTM := TagManager{}
 		if json.Unmarshal(data, &tempTM) == nil {
-			tm.TagsByFolder = tempTM.TagsByFolder
-			tm.TagsByDate = tempTM.TagsByDate
-			logger.GetLogger2().Info("Tag database well imported", len(tm.TagsByFolder), len(tm.TagsByDate))
+			if tempTM.TagsByFolder != nil {
+				tm.TagsByFolder = tempTM.TagsByFolder
+			}
+			if tempTM.TagsByDate != nil {
+				tm.TagsByDate = tempTM.TagsByDate
+			}
+			if tempTM.TagsByImage != nil {
+				tm.TagsByImage = tempTM.TagsByImage
+			}
+			if tempTM.Catalog != nil {
+				tm.Catalog, tm.NextTagId = tempTM.Catalog, tempTM.NextTagId
+			}
+			logger.GetLogger2().Info("Tag database well imported", len(tm.TagsByFolder), len(tm.TagsByDate), len(tm.TagsByImage))
 		}
 	} else {
 		logger.GetLogger2().Info("Impossible to import tag database, does not exist")
 	}
+	if withJournal {
+		count, err := tm.journal.Replay(func(data []byte) error {
+			var entry tagJournalEntry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return err
+			}
+			tm.apply(entry)
+			return nil
+		})
+		if err != nil {
+			logger.GetLogger2().Error("Impossible to replay tag journal", err)
+		}
+		if count > 0 {
+			logger.GetLogger2().Info("Replay", count, "operations of tag journal")
+		}
+		tm.counter = count
+	}
+	tm.syncCatalog()
+	tm.changes = newTagChanges()
+	atomic.AddInt64(&tm.version, 1)
+}
+
+// Version change each time tags are modified
+func (tm *TagManager) Version() int64 {
+	return atomic.LoadInt64(&tm.version)
 }
 
+// flush save tag database and empty journal
 func (tm *TagManager) flush() {
 	tm.locker.Lock()
 	defer tm.locker.Unlock()
-	atomic.StoreInt32(&tm.counter, 0)
-	if file, err := os.OpenFile("tag_database.json", os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.ModePerm); err == nil {
-		defer file.Close()
-		if data, err := json.Marshal(tm); err == nil {
-			if _, err := file.Write(data); err == nil {
-				logger.GetLogger2().Info("Save in file tag_database well Done")
-			} else {
-				logger.GetLogger2().Error("Impossible to save tag database", err)
-			}
-		}
+	tm.save()
+}
+
+// save must be called with lock
+func (tm *TagManager) save() {
+	data, err := json.Marshal(tm)
+	if err != nil {
+		logger.GetLogger2().Error("Impossible to save tag database", err)
+		return
+	}
+	if err := persistence.WriteFile(tm.path, data); err != nil {
+		logger.GetLogger2().Error("Impossible to save tag database", err)
+		return
 	}
+	if err := tm.journal.Truncate(); err != nil {
+		logger.GetLogger2().Error("Impossible to empty tag journal", err)
+		return
+	}
+	tm.counter = 0
+	logger.GetLogger2().Info("Save in file tag_database well Done")
 }
 
 func (tm *TagManager) findDatesOfNodes(node *Node) map[string]struct{} {
@@ -144,7 +353,7 @@ func (tm *TagManager) findDatesOfNodes(node *Node) map[string]struct{} {
 
 func (tm *TagManager) searchTagByName(tags []*Tag, value string) *Tag {
 	for _, tag := range tags {
-		if strings.EqualFold(value, tag.Value) {
+		if sameTagName(value, tag.Value) {
 			return tag
 		}
 	}
@@ -152,57 +361,224 @@ func (tm *TagManager) searchTagByName(tags []*Tag, value string) *Tag {
 }
 
 func (tm *TagManager) RemoveByFolder(path string, value, color string) {
-	tm.removeTagInMap(tm.TagsByFolder, path, Tag{value, color})
-	if folder, _, err := tm.foldersManager.FindNode(path); err == nil && folder.IsFolder {
-		dates := tm.findDatesOfNodes(folder)
-		for date := range dates {
-			tm.RemoveByDate(date, value, color)
+	folder, _, err := tm.foldersManager.FindNode(path)
+	tm.update(func() error {
+		tm.removeTagInMap(tagsOfFolders, path, Tag{value, color})
+		if err == nil && folder.IsFolder {
+			for date := range tm.findDatesOfNodes(folder) {
+				tm.removeTagInMap(tagsOfDates, date, Tag{value, color})
+			}
 		}
-	}
-	tm.countOperation()
+		return nil
+	})
 }
 
 func (tm *TagManager) RemoveByDate(key string, value, color string) {
-	tm.removeTagInMap(tm.TagsByDate, key, Tag{value, color})
-	tm.countOperation()
+	tm.update(func() error {
+		tm.removeTagInMap(tagsOfDates, key, Tag{value, color})
+		return nil
+	})
 }
 
-func (tm *TagManager) removeTagInMap(mapTag map[string][]*Tag, key string, tagToRemove Tag) {
-	if tags, exist := mapTag[key]; exist {
-		for pos, tag := range tags {
-			if tag.Equals(tagToRemove) {
-				tags[pos] = tags[len(tags)-1]
-				mapTag[key] = tags[:len(tags)-1]
-				return
-			}
+// removeTagInMap remove tag with same name, color is managed by catalog. Tags are copied as readers may use previous list
+func (tm *TagManager) removeTagInMap(kind, key string, tagToRemove Tag) {
+	name := cleanTagName(tagToRemove.Value)
+	tags := tm.tagsMap(kind)[key]
+	for pos, tag := range tags {
+		if sameTagName(tag.Value, name) {
+			tm.setTags(kind, key, append(append([]*Tag{}, tags[:pos]...), tags[pos+1:]...))
+			return
 		}
 	}
 }
 
-func (tm *TagManager) addTagInMap(mapTag map[string][]*Tag, key string, tag Tag) {
-	if tags, exist := mapTag[key]; exist {
-		// Check if tag already exist, if true, update color
-		if foundTag := tm.searchTagByName(tags, tag.Value); foundTag != nil {
+func (tm *TagManager) addTagInMap(kind, key string, tag Tag) {
+	tag = tm.registerTag(tag)
+	tags := tm.tagsMap(kind)[key]
+	// Check if tag already exist, if true, update color
+	if foundTag := tm.searchTagByName(tags, tag.Value); foundTag != nil {
+		if foundTag.Color != tag.Color {
 			foundTag.Color = tag.Color
-		} else {
-			mapTag[key] = append(tags, &tag)
+			tm.touch(kind, key)
 		}
-	} else {
-		mapTag[key] = []*Tag{&tag}
+		return
 	}
+	tm.setTags(kind, key, append(append([]*Tag{}, tags...), &tag))
 }
 
 func (tm *TagManager) GetTagsByFolder(folder string) []*Tag {
-	return tm.getTags(tm.TagsByFolder, folder)
+	return tm.getTags(tagsOfFolders, folder)
 }
 
 func (tm *TagManager) GetTagsByDate(date string) []*Tag {
-	return tm.getTags(tm.TagsByDate, date)
+	return tm.getTags(tagsOfDates, date)
+}
+
+// getTags return a copy of tags, safe to use outside lock
+func (tm *TagManager) getTags(kind, key string) []*Tag {
+	tm.locker.RLock()
+	defer tm.locker.RUnlock()
+	tags := tm.tagsMap(kind)[key]
+	copies := make([]*Tag, len(tags))
+	for i, tag := range tags {
+		copyTag := *tag
+		copies[i] = &copyTag
+	}
+	return copies
+}
+
+func getTagDatabasePath(folder string) string {
+	return filepath.Join(folder, "tag_database.json")
+}
+
+func getTagJournalPath(folder string) string {
+	return filepath.Join(folder, "tag_database.journal")
+}
+
+func (tm *TagManager) GetTagsByImage(path string) []*Tag {
+	return tm.getTags(tagsOfImages, cleanRelativePath(path))
+}
+
+// AddTagByImages tag many photos or videos. Tag is added to the day of each photo and to folders when all their photos are tagged.
+// Photos of a folder already tagged (or one of its ancestors) are not tagged again
+func (tm *TagManager) AddTagByImages(paths []string, value, color string, exists func(path string) bool) error {
+	for _, path := range paths {
+		if !exists(path) {
+			return errors.New("unknown photo or video " + path)
+		}
+	}
+	return tm.update(func() error {
+		folders := make(map[string]*Node)
+		for _, path := range paths {
+			if !tm.isTaggedByFolders(cleanRelativePath(path), value) {
+				tm.addTagInMap(tagsOfImages, cleanRelativePath(path), Tag{value, color})
+			}
+			if node, _, err := tm.foldersManager.FindNode(path); err == nil && !node.IsFolder {
+				tm.addTagInMap(tagsOfDates, node.Date.Format("20060102"), Tag{value, color})
+				folderPath := cleanRelativePath(filepath.Dir(cleanRelativePath(path)))
+				if folder, _, err := tm.foldersManager.FindNode(folderPath); err == nil && !tm.isTaggedByFolders(cleanRelativePath(path), value) {
+					folders[folderPath] = folder
+				}
+			}
+		}
+		for folderPath, folder := range folders {
+			if tm.allImagesTagged(folder, value) {
+				tm.addTagInMap(tagsOfFolders, folderPath, Tag{value, color})
+			}
+		}
+		return nil
+	})
+}
+
+// isTaggedByFolders return true if a folder containing path (its parent or any ancestor) has the tag
+func (tm *TagManager) isTaggedByFolders(path, value string) bool {
+	for folder := cleanRelativePath(filepath.Dir(path)); folder != "" && folder != "."; folder = cleanRelativePath(filepath.Dir(folder)) {
+		if tm.searchTagByName(tm.TagsByFolder[folder], value) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// allImagesTagged return true if all photos of folder have the tag
+func (tm *TagManager) allImagesTagged(folder *Node, value string) bool {
+	hasImages := false
+	for _, file := range folder.Files {
+		if !file.IsFolder {
+			if tm.searchTagByName(tm.TagsByImage[cleanRelativePath(file.RelativePath)], value) == nil {
+				return false
+			}
+			hasImages = true
+		}
+	}
+	return hasImages
+}
+
+// RemoveByImages remove tag set on photos or videos, tags of their folders are kept.
+// Tag is removed of a day only if no other photo of the day (or its folders) has it
+func (tm *TagManager) RemoveByImages(paths []string, value, color string) {
+	tm.update(func() error {
+		dates := make(map[string]struct{})
+		for _, path := range paths {
+			tm.removeTagInMap(tagsOfImages, cleanRelativePath(path), Tag{value, color})
+			if node, _, err := tm.foldersManager.FindNode(path); err == nil && !node.IsFolder {
+				dates[node.Date.Format("20060102")] = struct{}{}
+			}
+		}
+		for date := range dates {
+			if !tm.isDateStillTagged(date, value) {
+				tm.removeTagInMap(tagsOfDates, date, Tag{value, color})
+			}
+		}
+		return nil
+	})
+}
+
+func (tm *TagManager) isDateStillTagged(date, value string) bool {
+	for _, node := range tm.foldersManager.GetPhotosByDate()[tm.parseDate(date)] {
+		image := node.(*Node)
+		if tm.searchTagByName(tm.TagsByImage[cleanRelativePath(image.RelativePath)], value) != nil ||
+			tm.isTaggedByFolders(cleanRelativePath(image.RelativePath), value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (tm *TagManager) parseDate(date string) time.Time {
+	parsed, _ := time.Parse("20060102", date)
+	return parsed
+}
+
+// RemoveImages remove tags of deleted photos or videos
+func (tm *TagManager) RemoveImages(paths []string) {
+	tm.update(func() error {
+		for path := range toPathsSet(paths) {
+			if _, exist := tm.TagsByImage[path]; exist {
+				tm.setTags(tagsOfImages, path, nil)
+			}
+		}
+		return nil
+	})
+}
+
+// FilterImages return paths of photos and videos with tag, tagged directly or in a tagged folder
+func (tm *TagManager) FilterImages(searchTag string) []string {
+	tm.locker.RLock()
+	defer tm.locker.RUnlock()
+	paths := make(map[string]struct{})
+	for _, path := range tm.filterTags(searchTag, tagsOfImages) {
+		paths[path] = struct{}{}
+	}
+	for _, folderPath := range tm.filterTags(searchTag, tagsOfFolders) {
+		if folder, _, err := tm.foldersManager.FindNode(folderPath); err == nil {
+			for _, file := range folder.Files {
+				if !file.IsFolder {
+					paths[cleanRelativePath(file.RelativePath)] = struct{}{}
+				}
+			}
+		}
+	}
+	return sortedPaths(paths)
+}
+
+// FilterDateImages return paths of photos of days with tag
+func (tm *TagManager) FilterDateImages(searchTag string) []string {
+	byDate := tm.foldersManager.GetPhotosByDate()
+	paths := make(map[string]struct{})
+	for _, date := range tm.FilterDate(searchTag) {
+		for _, node := range byDate[tm.parseDate(date)] {
+			paths[cleanRelativePath(node.(*Node).RelativePath)] = struct{}{}
+		}
+	}
+	return sortedPaths(paths)
 }
 
-func (tm *TagManager) getTags(mapTags map[string][]*Tag, key string) []*Tag {
-	if tags, exist := mapTags[key]; exist {
-		return tags
+func sortedPaths(paths map[string]struct{}) []string {
+	list := make([]string, 0, len(paths))
+	for path := range paths {
+		list = append(list, path)
 	}
-	return []*Tag{}
+	sort.Strings(list)
+	return list
 }
@@ -0,0 +1,80 @@
+package photos_server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestTagJournal(t *testing.T) {
+	fm, _, _ := createFakeStructure(t)
+	tm := fm.tagManger
+	tm.AddTagByFolder("root/folder1", "Voyage/Italie", "green")
+	tm.AddTagByDate("20200503", "Noel", "red")
+	tm.RemoveByDate("20200502", "Voyage/Italie", "")
+	tm.UpdateExistingPath("root/folder1", "root/folder3")
+	voyage := tm.findCatalogTag("Voyage")
+	tm.UpdateCatalogTag(voyage.Id, "", "blue")
+
+	// Not saved, state must be read from journal
+	reloaded := NewTagManager(fm)
+	if tags := reloaded.GetTagsByFolder("root/folder3"); len(tags) != 1 || tags[0].Value != "Voyage/Italie" || tags[0].Color != "green" {
+		t.Error("Folder tags must be replayed", tags)
+	}
+	if len(reloaded.GetTagsByFolder("root/folder1")) != 0 || len(reloaded.GetTagsByDate("20200502")) != 0 || len(reloaded.GetTagsByDate("20200503")) != 1 {
+		t.Error("Removed and moved tags must be replayed")
+	}
+	if tag := reloaded.Catalog[voyage.Id]; tag == nil || tag.Color != "blue" || reloaded.NextTagId != tm.NextTagId {
+		t.Error("Catalog must be replayed", tag)
+	}
+
+	reloaded.flush()
+	if _, err := os.Stat(getTagJournalPath(fm.stateFolder)); !os.IsNotExist(err) {
+		t.Error("Journal must be empty after save")
+	}
+	if tags := NewTagManager(fm).GetTagsByFolder("root/folder3"); len(tags) != 1 {
+		t.Error("Saved tags must be loaded", tags)
+	}
+}
+
+// Run with -race to detect unsafe access
+func TestTagManagerConcurrency(t *testing.T) {
+	// More operations than bufferSize, database is saved
+	fm, _, _ := createFakeStructure(t)
+	tm := fm.tagManger
+	exists := func(path string) bool { return true }
+	wait := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wait.Add(2)
+		go func(i int) {
+			defer wait.Done()
+			value := fmt.Sprintf("tag%d", i%3)
+			for j := 0; j < 20; j++ {
+				tm.AddTagByFolder("root/folder1", value, "red")
+				tm.AddTagByImages([]string{"root/folder2/fifth.txt"}, value, "blue", exists)
+				tm.RemoveByDate("20200502", value, "")
+				tm.RemoveByImages([]string{"root/folder2/fifth.txt"}, value, "")
+			}
+		}(i)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 20; j++ {
+				tm.FilterFolder("tag1")
+				tm.FilterImages("tag2")
+				for _, tag := range tm.GetTagsByFolder("root/folder1") {
+					_ = tag.Value + tag.Color
+				}
+				tm.GetCatalog()
+				tm.CompleteTag("ta", 5)
+			}
+		}()
+	}
+	wait.Wait()
+	if tags := tm.GetTagsByFolder("root/folder1"); len(tags) != 3 {
+		t.Error("All tags must be added on folder", tags)
+	}
+	if reloaded := NewTagManager(fm); len(reloaded.GetTagsByFolder("root/folder1")) != 3 || len(reloaded.GetCatalog()) != len(tm.GetCatalog()) {
+		t.Error("Journal must contain all operations")
+	}
+}
@@ -0,0 +1,79 @@
+package photos_server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+/* Endpoints to manage catalog of tags */
+
+type catalogTagDto struct {
+	Id    int
+	Name  string
+	Color string
+}
+
+type mergeTagsDto struct {
+	From int
+	To   int
+}
+
+// tagsCatalog return all tags with parent and usage counts
+func (s Server) tagsCatalog(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	data, _ := json.Marshal(s.foldersManager.tagManger.GetCatalog())
+	write(data, w)
+}
+
+// completeTag return tags beginning with prefix, most used first (10 by default)
+func (s Server) completeTag(w http.ResponseWriter, r *http.Request) {
+	header(w)
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = 10
+	}
+	data, _ := json.Marshal(s.foldersManager.tagManger.CompleteTag(r.FormValue("prefix"), limit))
+	write(data, w)
+}
+
+// editCatalogTag rename and / or change color of a tag (POST with json {Id, Name, Color})
+func (s Server) editCatalogTag(w http.ResponseWriter, r *http.Request) {
+	var tag catalogTagDto
+	if !s.readTagRequest(w, r, &tag) {
+		return
+	}
+	s.applyTagUpdate(w, s.foldersManager.tagManger.UpdateCatalogTag(tag.Id, tag.Name, tag.Color))
+}
+
+// mergeCatalogTags replace a tag by another everywhere (POST with json {From, To})
+func (s Server) mergeCatalogTags(w http.ResponseWriter, r *http.Request) {
+	var merge mergeTagsDto
+	if !s.readTagRequest(w, r, &merge) {
+		return
+	}
+	s.applyTagUpdate(w, s.foldersManager.tagManger.MergeTags(merge.From, merge.To))
+}
+
+func (s Server) readTagRequest(w http.ResponseWriter, r *http.Request, request interface{}) bool {
+	header(w)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only post is allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	data, _ := io.ReadAll(r.Body)
+	if err := json.Unmarshal(data, request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (s Server) applyTagUpdate(w http.ResponseWriter, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	write([]byte("success"), w)
+}
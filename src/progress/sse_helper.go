@@ -15,6 +15,8 @@ type sse struct {
 type stat struct {
 	done int
 	total int
+	// Result of task, sent once at the end
+	report []byte
 }
 
 func newSse(w http.ResponseWriter, r *http.Request)*sse{
@@ -59,11 +61,21 @@ func (s *sse) error(err error) {
 }
 
 func writeEvent(w http.ResponseWriter, st stat){
+	if st.report != nil {
+		writeReport(w,st.report)
+		return
+	}
 	w.Write([]byte("event: stat\n"))
 	w.Write([]byte(fmt.Sprintf("data: {\"done\":%d,\"total\":%d}\n\n",st.done,st.total)))
 	w.(http.Flusher).Flush()
 }
 
+func writeReport(w http.ResponseWriter, report []byte){
+	w.Write([]byte("event: report\n"))
+	w.Write([]byte(fmt.Sprintf("data: %s\n\n",report)))
+	w.(http.Flusher).Flush()
+}
+
 func writeEnd(w http.ResponseWriter){
 	w.Write([]byte("event: end\n"))
 	w.Write([]byte("data: {\"End\":true}\n\n"))
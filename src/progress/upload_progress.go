@@ -3,6 +3,7 @@ package progress
 import (
 	"crypto/md5"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/jotitan/photos_server/logger"
@@ -45,7 +46,7 @@ func (up *UploadProgress)run(){
 				up.totalDone++
 				// Send notif if sse exist
 				for _, s := range up.sses {
-					s.done(stat{up.totalDone, up.total})
+					s.done(stat{done: up.totalDone, total: up.total})
 				}
 			}else{
 				// close chanel, send End message to all
@@ -77,6 +78,18 @@ func (up *UploadProgress)Wait(){
 	}
 }
 
+// Report send result of task (serialized in json) to SSE, before End
+func (up *UploadProgress) Report(report interface{}) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		logger.GetLogger2().Error("Impossible to send report", err)
+		return
+	}
+	for _, s := range up.sses {
+		s.done(stat{report: data})
+	}
+}
+
 func (up *UploadProgress) Error(e error) {
 	// Send message to sse and remove from manager
 	for _, s := range up.sses {
@@ -96,7 +109,7 @@ func NewUploadProgressManager()*UploadProgressManager {
 
 func (upm *UploadProgressManager)getStatUpload(id string)(stat,error){
 	if up,ok := upm.uploads[id] ; ok {
-		return stat{up.totalDone,up.total},nil
+		return stat{done: up.totalDone, total: up.total},nil
 	}
 	return stat{},errors.New("unknown upload id")
 }
@@ -110,10 +123,15 @@ func (upm *UploadProgressManager) AddSSE(id string, w http.ResponseWriter,r * ht
 	return nil,errors.New("unknown upload id " + id + " for SSE (" + fmt.Sprintf("%d",len(upm.uploads)))
 }
 
-// return unique id representing upload
+// return unique id representing upload, each file is copied then resized (two steps)
 func (upm *UploadProgressManager) AddUploader(total int)*UploadProgress {
+	return upm.AddTask(total*2)
+}
+
+// AddTask return progresser of a task with total steps, Done must be called once by step
+func (upm *UploadProgressManager) AddTask(total int)*UploadProgress {
 	id := upm.generateNewID()
-	uploader := &UploadProgress{chanel: make(chan struct{},10),total:total*2,id:id,manager:upm}
+	uploader := &UploadProgress{chanel: make(chan struct{},10),total:total,id:id,manager:upm}
 	uploader.run()
 	logger.GetLogger2().Info("Create uploader",id)
 	upm.uploads[id] = uploader
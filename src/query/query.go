@@ -0,0 +1,353 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Parse search queries like : tag:noel person:12 after:2019-01-01 camera:"Pixel 6" in:famille/2020 type:video
+Terms separated by space must all match, OR between terms accept one of them, - (or NOT) exclude a term, parenthesis group terms.
+A term without field is a free text search */
+
+// Fields accepted in a query
+const (
+	FieldText   = ""
+	FieldTag    = "tag"
+	FieldPerson = "person"
+	FieldAfter  = "after"
+	FieldBefore = "before"
+	FieldCamera = "camera"
+	FieldLens   = "lens"
+	FieldIn     = "in"
+	FieldType   = "type"
+	FieldPlace  = "place"
+	// true or false, favorites of user
+	FieldFavorite = "favorite"
+	// Minimum stars given by user, from 0 to 5
+	FieldRating = "rating"
+)
+
+// Types accepted by type field
+const (
+	TypePhoto  = "photo"
+	TypeVideo  = "video"
+	TypeFolder = "folder"
+)
+
+var fields = map[string]struct{}{FieldTag: {}, FieldPerson: {}, FieldAfter: {}, FieldBefore: {}, FieldCamera: {},
+	FieldLens: {}, FieldIn: {}, FieldType: {}, FieldPlace: {}, FieldFavorite: {}, FieldRating: {}}
+
+var dateFormats = []string{"2006-01-02", "2006-01", "2006"}
+
+// Expr is a node of query tree
+type Expr interface {
+	String() string
+}
+
+// Term is a criteria on a field
+type Term struct {
+	Field string
+	Value string
+	// Only for after and before fields
+	Date time.Time
+	// Only for rating field
+	Rating int
+}
+
+type And struct {
+	Exprs []Expr
+}
+
+type Or struct {
+	Exprs []Expr
+}
+
+type Not struct {
+	Expr Expr
+}
+
+func (t Term) String() string {
+	if t.Field == FieldText {
+		return fmt.Sprintf("%q", t.Value)
+	}
+	return fmt.Sprintf("%s:%q", t.Field, t.Value)
+}
+
+func (a And) String() string {
+	return "(" + joinExprs(a.Exprs, " AND ") + ")"
+}
+
+func (o Or) String() string {
+	return "(" + joinExprs(o.Exprs, " OR ") + ")"
+}
+
+func (n Not) String() string {
+	return "NOT " + n.Expr.String()
+}
+
+func joinExprs(exprs []Expr, separator string) string {
+	values := make([]string, len(exprs))
+	for i, expr := range exprs {
+		values[i] = expr.String()
+	}
+	return strings.Join(values, separator)
+}
+
+// Eval return true if element match expression, matchTerm check a term on element
+func Eval(expr Expr, matchTerm func(term Term) bool) bool {
+	switch e := expr.(type) {
+	case Term:
+		return matchTerm(e)
+	case Not:
+		return !Eval(e.Expr, matchTerm)
+	case And:
+		for _, sub := range e.Exprs {
+			if !Eval(sub, matchTerm) {
+				return false
+			}
+		}
+		return true
+	case Or:
+		for _, sub := range e.Exprs {
+			if Eval(sub, matchTerm) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// Terms return all terms of expression
+func Terms(expr Expr) []Term {
+	switch e := expr.(type) {
+	case Term:
+		return []Term{e}
+	case Not:
+		return Terms(e.Expr)
+	case And:
+		return termsOf(e.Exprs)
+	case Or:
+		return termsOf(e.Exprs)
+	}
+	return nil
+}
+
+func termsOf(exprs []Expr) []Term {
+	terms := make([]Term, 0)
+	for _, expr := range exprs {
+		terms = append(terms, Terms(expr)...)
+	}
+	return terms
+}
+
+type tokenType int
+
+const (
+	tokenWord tokenType = iota
+	tokenOpen
+	tokenClose
+	tokenNot
+	tokenOr
+)
+
+type token struct {
+	kind  tokenType
+	value string
+}
+
+// tokenize split query in words, parenthesis and operators. Quoted values keep spaces
+func tokenize(query string) ([]token, error) {
+	tokens := make([]token, 0)
+	runes := []rune(query)
+	for pos := 0; pos < len(runes); {
+		switch r := runes[pos]; {
+		case r == ' ' || r == '\t':
+			pos++
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenOpen})
+			pos++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenClose})
+			pos++
+		case r == '-':
+			tokens = append(tokens, token{kind: tokenNot})
+			pos++
+		default:
+			word := strings.Builder{}
+			quoted := false
+			for ; pos < len(runes); pos++ {
+				if runes[pos] == '"' {
+					quoted = !quoted
+					continue
+				}
+				if !quoted && (runes[pos] == ' ' || runes[pos] == '\t' || runes[pos] == '(' || runes[pos] == ')') {
+					break
+				}
+				word.WriteRune(runes[pos])
+			}
+			if quoted {
+				return nil, errors.New("quote not closed")
+			}
+			switch word.String() {
+			case "OR":
+				tokens = append(tokens, token{kind: tokenOr})
+			case "NOT":
+				tokens = append(tokens, token{kind: tokenNot})
+			default:
+				tokens = append(tokens, token{kind: tokenWord, value: word.String()})
+			}
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse build the tree of a query
+func Parse(query string) (Expr, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty query")
+	}
+	p := &parser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errors.New("unexpected parenthesis")
+	}
+	return expr, nil
+}
+
+func (p *parser) next() *token {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	exprs := make([]Expr, 0, 1)
+	for {
+		expr, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if next := p.next(); next == nil || next.kind != tokenOr {
+			break
+		}
+		p.pos++
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return Or{Exprs: exprs}, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	exprs := make([]Expr, 0, 1)
+	for next := p.next(); next != nil && next.kind != tokenOr && next.kind != tokenClose; next = p.next() {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+	switch len(exprs) {
+	case 0:
+		return nil, errors.New("missing term")
+	case 1:
+		return exprs[0], nil
+	}
+	return And{Exprs: exprs}, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	current := p.next()
+	if current == nil {
+		return nil, errors.New("missing term")
+	}
+	p.pos++
+	switch current.kind {
+	case tokenNot:
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{Expr: expr}, nil
+	case tokenOpen:
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if next := p.next(); next == nil || next.kind != tokenClose {
+			return nil, errors.New("parenthesis not closed")
+		}
+		p.pos++
+		return expr, nil
+	case tokenWord:
+		return parseTerm(current.value)
+	}
+	return nil, errors.New("missing term")
+}
+
+func parseTerm(value string) (Expr, error) {
+	pos := strings.Index(value, ":")
+	if pos == -1 {
+		return Term{Field: FieldText, Value: value}, nil
+	}
+	field := strings.ToLower(value[:pos])
+	if _, exist := fields[field]; !exist {
+		return nil, errors.New("unknown field " + field)
+	}
+	term := Term{Field: field, Value: value[pos+1:]}
+	if term.Value == "" {
+		return nil, errors.New("missing value for field " + field)
+	}
+	switch field {
+	case FieldAfter, FieldBefore:
+		date, err := parseDate(term.Value)
+		if err != nil {
+			return nil, err
+		}
+		term.Date = date
+	case FieldType:
+		term.Value = strings.ToLower(term.Value)
+		if term.Value != TypePhoto && term.Value != TypeVideo && term.Value != TypeFolder {
+			return nil, errors.New("type must be photo, video or folder")
+		}
+	case FieldFavorite:
+		term.Value = strings.ToLower(term.Value)
+		if term.Value != "true" && term.Value != "false" {
+			return nil, errors.New("favorite must be true or false")
+		}
+	case FieldRating:
+		rating, err := strconv.Atoi(term.Value)
+		if err != nil || rating < 0 || rating > 5 {
+			return nil, errors.New("rating must be between 0 and 5")
+		}
+		term.Rating = rating
+	}
+	return term, nil
+}
+
+func parseDate(value string) (time.Time, error) {
+	for _, format := range dateFormats {
+		if date, err := time.Parse(format, value); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, errors.New("bad date " + value + ", must be yyyy-mm-dd, yyyy-mm or yyyy")
+}
@@ -0,0 +1,38 @@
+package query
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	expr, err := Parse(`tag:noel person:12 after:2019-01-01 camera:"Pixel 6" in:famille/2020 type:video`)
+	if err != nil {
+		t.Fatal("Query must be parsed", err)
+	}
+	if expr.String() != `(tag:"noel" AND person:"12" AND after:"2019-01-01" AND camera:"Pixel 6" AND in:"famille/2020" AND type:"video")` {
+		t.Error("Bad tree", expr)
+	}
+	expr, err = Parse(`(tag:noel OR tag:paques) -type:video "la plage"`)
+	if err != nil {
+		t.Fatal("Query must be parsed", err)
+	}
+	if expr.String() != `((tag:"noel" OR tag:"paques") AND NOT type:"video" AND "la plage")` {
+		t.Error("Bad tree", expr)
+	}
+	for _, query := range []string{"", "(tag:noel", "tag:noel)", "color:red", "after:yesterday", "type:music", "rating:6", "favorite:maybe", `camera:"Pixel`, "noel OR"} {
+		if _, err := Parse(query); err == nil {
+			t.Error("Query must be rejected", query)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	expr, _ := Parse("a (b OR c) -d")
+	values := map[string]bool{"a": true, "c": true}
+	match := func(term Term) bool { return values[term.Value] }
+	if !Eval(expr, match) {
+		t.Error("Must match")
+	}
+	values["d"] = true
+	if Eval(expr, match) {
+		t.Error("Must not match with d")
+	}
+}
@@ -0,0 +1,511 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/jotitan/photos_server/logger"
+)
+
+/* HEIC / HEIF photos (iPhone) are ISOBMFF files : a meta box describes items (HEVC tiles, thumbnails, exif...) stored in mdat.
+HEVC is not decoded in go, photos are converted by an external command or, if none, embedded JPEG is used */
+
+var heicExtensions = []string{".heic", ".heif"}
+
+// Converter used when no command is defined and photo has no JPEG item, if installed
+const defaultHeicConverter = "heif-convert"
+
+// HeicDecoder convert a HEIC photo to a JPEG file
+type HeicDecoder interface {
+	Decode(from, to string) error
+	// Rotated return true if image decoded from path is already rotated (exif orientation must be ignored)
+	Rotated(path string) bool
+}
+
+// NewHeicDecoder use command if defined (heif-convert, convert...), embedded JPEG otherwise
+func NewHeicDecoder(command string) HeicDecoder {
+	if strings.TrimSpace(command) != "" {
+		logger.GetLogger2().Info("Use command to convert heic", command)
+		return CommandHeicDecoder{command: command}
+	}
+	decoder := ThumbnailHeicDecoder{}
+	if path, err := exec.LookPath(defaultHeicConverter); err == nil {
+		decoder.converter = CommandHeicDecoder{command: path}
+	}
+	return decoder
+}
+
+// CommandHeicDecoder run an external converter with <from> <to> as arguments
+type CommandHeicDecoder struct {
+	command string
+}
+
+// Decode convert in a temporary file with the same extension (converters choose format with it), file to only exists when complete
+func (chd CommandHeicDecoder) Decode(from, to string) error {
+	return writeSafely(to, func(tmp string) error {
+		if output, err := exec.Command(chd.command, from, tmp).CombinedOutput(); err != nil {
+			return errors.New("impossible to convert heic : " + err.Error() + " " + string(output))
+		}
+		return nil
+	})
+}
+
+// Rotated is true, converters apply the rotation defined in container
+func (chd CommandHeicDecoder) Rotated(_ string) bool {
+	return true
+}
+
+// ThumbnailHeicDecoder extract the biggest JPEG item embedded in HEIC.
+// Without JPEG item, photo is converted by converter if any, small exif thumbnail is used otherwise
+type ThumbnailHeicDecoder struct {
+	converter HeicDecoder
+}
+
+func (thd ThumbnailHeicDecoder) Decode(from, to string) error {
+	if !hasHeicJpeg(from) {
+		if thd.converter != nil {
+			logger.GetLogger2().Info("No jpeg item in heic, convert with", defaultHeicConverter, from)
+			return thd.converter.Decode(from, to)
+		}
+		logger.GetLogger2().Info("No jpeg item in heic and no converter, use exif thumbnail", from)
+	}
+	data, err := ReadHeicThumbnail(from)
+	if err != nil {
+		return err
+	}
+	return writeFileSafely(to, data)
+}
+
+// Rotated is true only when photo is converted, embedded JPEG are not rotated
+func (thd ThumbnailHeicDecoder) Rotated(path string) bool {
+	return thd.converter != nil && !hasHeicJpeg(path)
+}
+
+// hasHeicJpeg return true if HEIC has a JPEG item (not only an exif thumbnail)
+func hasHeicJpeg(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	meta, err := readHeicMeta(f)
+	return err == nil && len(meta.itemsOfType("jpeg")) > 0
+}
+
+// IsHeic return true if file is a HEIC / HEIF photo, based on its extension
+func IsHeic(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, heicExt := range heicExtensions {
+		if ext == heicExt {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadHeicThumbnail return the biggest JPEG embedded in HEIC file
+func ReadHeicThumbnail(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readHeicThumbnail(f)
+}
+
+// ReadHeicSize return size of primary image of HEIC (ispe property), before rotation. Embedded JPEG are smaller
+func ReadHeicSize(path string) (int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	meta, err := readHeicMeta(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return meta.primarySize()
+}
+
+// ReadHeicExif return exif of HEIC file, as a TIFF structure
+func ReadHeicExif(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readHeicExif(f)
+}
+
+func decodeHeicThumbnail(r io.ReaderAt) (image.Image, error) {
+	data, err := readHeicThumbnail(r)
+	if err != nil {
+		return nil, err
+	}
+	return jpeg.Decode(bytes.NewReader(data))
+}
+
+func readHeicThumbnail(r io.ReaderAt) ([]byte, error) {
+	meta, err := readHeicMeta(r)
+	if err != nil {
+		return nil, err
+	}
+	var best []byte
+	bestSize := 0
+	keepBiggest := func(data []byte) {
+		if config, err := jpeg.DecodeConfig(bytes.NewReader(data)); err == nil && config.Width*config.Height > bestSize {
+			best, bestSize = data, config.Width*config.Height
+		}
+	}
+	for _, item := range meta.itemsOfType("jpeg") {
+		if data, err := meta.read(r, item); err == nil {
+			keepBiggest(data)
+		}
+	}
+	if tiff, err := meta.readExif(r); err == nil {
+		if data, err := readTiffPreview(bytes.NewReader(tiff)); err == nil {
+			keepBiggest(data)
+		}
+	}
+	if best == nil {
+		return nil, errors.New("no jpeg thumbnail in heic")
+	}
+	return best, nil
+}
+
+func readHeicExif(r io.ReaderAt) ([]byte, error) {
+	meta, err := readHeicMeta(r)
+	if err != nil {
+		return nil, err
+	}
+	return meta.readExif(r)
+}
+
+const (
+	maxBoxesByLevel = 1024
+	// meta box only describes items, a bigger one is corrupted
+	maxMetaSize = 16 << 20
+	maxItemSize = 64 << 20
+)
+
+type heicExtent struct {
+	offset uint64
+	length uint64
+}
+
+type heicItem struct {
+	id      uint32
+	kind    string
+	idat    bool
+	extents []heicExtent
+}
+
+type heicMeta struct {
+	items map[uint32]*heicItem
+	// Data of idat box, used by items with construction method 1
+	idat []byte
+	// Id of main image (pitm), its size is defined by an ispe property
+	primary uint32
+	// Size (ispe) by index of property in ipco, indexes begin at 1
+	sizes map[int][2]uint32
+	// Indexes of properties by item (ipma)
+	properties map[uint32][]int
+}
+
+// readBoxHeader return type, position and size of content of box at offset
+func readBoxHeader(r io.ReaderAt, offset, end int64) (string, int64, int64, error) {
+	header := make([]byte, 16)
+	if _, err := r.ReadAt(header[:8], offset); err != nil {
+		return "", 0, 0, err
+	}
+	size, kind, headerSize := int64(binary.BigEndian.Uint32(header)), string(header[4:8]), int64(8)
+	switch size {
+	case 0:
+		size = end - offset
+	case 1:
+		if _, err := r.ReadAt(header[8:], offset+8); err != nil {
+			return "", 0, 0, err
+		}
+		size, headerSize = int64(binary.BigEndian.Uint64(header[8:])), 16
+	}
+	// Sizes come from file, they are compared by subtraction to avoid overflows
+	if size < headerSize || size > math.MaxInt64-offset || (end > 0 && size > end-offset) {
+		return "", 0, 0, errors.New("invalid box " + kind)
+	}
+	return kind, offset + headerSize, size - headerSize, nil
+}
+
+func readHeicMeta(r io.ReaderAt) (*heicMeta, error) {
+	kind, start, size, err := readBoxHeader(r, 0, -1)
+	if err != nil || kind != "ftyp" {
+		return nil, errors.New("not a heic file")
+	}
+	offset := start + size
+	for i := 0; i < maxBoxesByLevel; i++ {
+		if kind, start, size, err = readBoxHeader(r, offset, -1); err != nil {
+			return nil, errors.New("no meta box in heic")
+		}
+		if kind == "meta" {
+			if size > maxMetaSize {
+				return nil, errors.New("invalid meta box")
+			}
+			data := make([]byte, size)
+			if _, err := r.ReadAt(data, start); err != nil {
+				return nil, err
+			}
+			return parseHeicMeta(data)
+		}
+		offset = start + size
+	}
+	return nil, errors.New("no meta box in heic")
+}
+
+// readBoxes call read with type and content of each box of data
+func readBoxes(data []byte, read func(kind string, content []byte) error) error {
+	r := bytes.NewReader(data)
+	offset := int64(0)
+	for i := 0; i < maxBoxesByLevel && offset < int64(len(data)); i++ {
+		kind, start, size, err := readBoxHeader(r, offset, int64(len(data)))
+		if err != nil {
+			return err
+		}
+		if err = read(kind, data[start:start+size]); err != nil {
+			return err
+		}
+		offset = start + size
+	}
+	return nil
+}
+
+// parseHeicMeta read items informations (iinf), locations (iloc), idat, primary item (pitm) and properties (iprp) from content of meta box
+func parseHeicMeta(data []byte) (*heicMeta, error) {
+	meta := &heicMeta{items: make(map[uint32]*heicItem), sizes: make(map[int][2]uint32), properties: make(map[uint32][]int)}
+	if len(data) < 4 {
+		return nil, errors.New("invalid meta box")
+	}
+	// meta is a full box, skip version and flags
+	err := readBoxes(data[4:], func(kind string, content []byte) error {
+		switch kind {
+		case "iinf":
+			return meta.parseItemInfos(content)
+		case "iloc":
+			return meta.parseItemLocations(content)
+		case "idat":
+			meta.idat = content
+		case "pitm":
+			br := &boxReader{data: content}
+			version := br.uint(1)
+			br.uint(3)
+			meta.primary = uint32(br.uint(sizeByVersion(version > 0)))
+			return br.err
+		case "iprp":
+			return readBoxes(content, meta.parseProperties)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// parseProperties read sizes of property container (ipco) and properties of items (ipma)
+func (hm *heicMeta) parseProperties(kind string, content []byte) error {
+	switch kind {
+	case "ipco":
+		index := 0
+		return readBoxes(content, func(kind string, property []byte) error {
+			index++
+			if kind == "ispe" {
+				// Full box, skip version and flags
+				br := &boxReader{data: property}
+				br.uint(4)
+				if width, height := br.uint(4), br.uint(4); br.err == nil {
+					hm.sizes[index] = [2]uint32{uint32(width), uint32(height)}
+				}
+			}
+			return nil
+		})
+	case "ipma":
+		br := &boxReader{data: content}
+		version := br.uint(1)
+		flags := br.uint(3)
+		count := br.uint(4)
+		for i := uint64(0); i < count && br.err == nil; i++ {
+			id := uint32(br.uint(sizeByVersion(version > 0)))
+			associations := br.uint(1)
+			for j := uint64(0); j < associations && br.err == nil; j++ {
+				// First bit is essential flag, index is on 7 or 15 bits
+				if flags&1 == 1 {
+					hm.properties[id] = append(hm.properties[id], int(br.uint(2)&0x7FFF))
+				} else {
+					hm.properties[id] = append(hm.properties[id], int(br.uint(1)&0x7F))
+				}
+			}
+		}
+		return br.err
+	}
+	return nil
+}
+
+// primarySize return size (ispe) of primary item
+func (hm *heicMeta) primarySize() (int, int, error) {
+	for _, index := range hm.properties[hm.primary] {
+		if size, exist := hm.sizes[index]; exist {
+			return int(size[0]), int(size[1]), nil
+		}
+	}
+	return 0, 0, errors.New("no size of primary item in heic")
+}
+
+func (hm *heicMeta) item(id uint32) *heicItem {
+	if _, exist := hm.items[id]; !exist {
+		hm.items[id] = &heicItem{id: id}
+	}
+	return hm.items[id]
+}
+
+func (hm *heicMeta) parseItemInfos(data []byte) error {
+	br := &boxReader{data: data}
+	version := br.uint(1)
+	br.uint(3)
+	count := br.uint(sizeByVersion(version > 0))
+	for i := uint64(0); i < count && br.err == nil; i++ {
+		_, start, size, err := readBoxHeader(bytes.NewReader(data), int64(br.pos), int64(len(data)))
+		if err != nil {
+			return err
+		}
+		infe := &boxReader{data: data[start : start+size]}
+		infeVersion := infe.uint(1)
+		infe.uint(3)
+		// Item type only exist since version 2
+		if infeVersion >= 2 {
+			id := infe.uint(sizeByVersion(infeVersion == 3))
+			infe.uint(2)
+			if kind := infe.bytes(4); infe.err == nil {
+				hm.item(uint32(id)).kind = string(kind)
+			}
+		}
+		br.pos = int(start + size)
+	}
+	return br.err
+}
+
+func (hm *heicMeta) parseItemLocations(data []byte) error {
+	br := &boxReader{data: data}
+	version := br.uint(1)
+	br.uint(3)
+	sizes := br.uint(2)
+	offsetSize, lengthSize, baseOffsetSize, indexSize := int(sizes>>12), int(sizes>>8&0xF), int(sizes>>4&0xF), 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0xF)
+	}
+	count := br.uint(sizeByVersion(version == 2))
+	for i := uint64(0); i < count && br.err == nil; i++ {
+		item := hm.item(uint32(br.uint(sizeByVersion(version == 2))))
+		if version == 1 || version == 2 {
+			item.idat = br.uint(2)&0xF == 1
+		}
+		br.uint(2)
+		baseOffset := br.uint(baseOffsetSize)
+		extents := br.uint(2)
+		item.extents = make([]heicExtent, 0, extents)
+		for j := uint64(0); j < extents && br.err == nil; j++ {
+			br.uint(indexSize)
+			offset := br.uint(offsetSize)
+			if baseOffset > math.MaxInt64 || offset > math.MaxInt64-baseOffset {
+				return errors.New("invalid extent of item")
+			}
+			item.extents = append(item.extents, heicExtent{offset: baseOffset + offset, length: br.uint(lengthSize)})
+		}
+	}
+	return br.err
+}
+
+func (hm *heicMeta) itemsOfType(kind string) []*heicItem {
+	items := make([]*heicItem, 0)
+	for _, item := range hm.items {
+		if item.kind == kind {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// read return content of item, concatenation of its extents
+func (hm *heicMeta) read(r io.ReaderAt, item *heicItem) ([]byte, error) {
+	data := make([]byte, 0)
+	for _, extent := range item.extents {
+		if extent.length == 0 || extent.length > maxItemSize-uint64(len(data)) {
+			return nil, errors.New("invalid extent of item")
+		}
+		if item.idat {
+			if extent.offset > uint64(len(hm.idat)) || extent.length > uint64(len(hm.idat))-extent.offset {
+				return nil, errors.New("invalid extent of item")
+			}
+			data = append(data, hm.idat[extent.offset:extent.offset+extent.length]...)
+			continue
+		}
+		buffer := make([]byte, extent.length)
+		if _, err := r.ReadAt(buffer, int64(extent.offset)); err != nil {
+			return nil, err
+		}
+		data = append(data, buffer...)
+	}
+	return data, nil
+}
+
+// readExif return TIFF structure of Exif item. Item begins with offset of TIFF header (after "Exif\0\0")
+func (hm *heicMeta) readExif(r io.ReaderAt) ([]byte, error) {
+	for _, item := range hm.itemsOfType("Exif") {
+		data, err := hm.read(r, item)
+		if err != nil || len(data) < 4 {
+			continue
+		}
+		if offset := uint64(binary.BigEndian.Uint32(data)) + 4; offset < uint64(len(data)) {
+			return data[offset:], nil
+		}
+	}
+	return nil, errors.New("no exif in heic")
+}
+
+// sizeByVersion return size of counts and ids, 16 bits in first versions of boxes and 32 bits after
+func sizeByVersion(large bool) int {
+	if large {
+		return 4
+	}
+	return 2
+}
+
+// boxReader read big endian integers of any size, err is set if data is too short
+type boxReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (br *boxReader) bytes(size int) []byte {
+	if br.err != nil || br.pos+size > len(br.data) {
+		br.err = errors.New("box too short")
+		return nil
+	}
+	br.pos += size
+	return br.data[br.pos-size : br.pos]
+}
+
+func (br *boxReader) uint(size int) uint64 {
+	value := uint64(0)
+	for _, b := range br.bytes(size) {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
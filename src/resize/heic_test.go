@@ -0,0 +1,162 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+func createBox(kind string, contents ...[]byte) []byte {
+	content := bytes.Join(contents, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(content)))
+	return append(append(box, kind...), content...)
+}
+
+func createItemInfo(id uint16, kind string) []byte {
+	infe := []byte{2, 0, 0, 0}
+	infe = binary.BigEndian.AppendUint16(infe, id)
+	infe = append(infe, 0, 0)
+	return createBox("infe", append(append(infe, kind...), 0))
+}
+
+// createHeic build a heic with a thumbnail item (jpeg or hvc1), an exif item stored in mdat and a primary item of 4032x3024
+func createHeic(thumbnailKind string, thumbnail, tiff []byte) []byte {
+	exifItem := append(append([]byte{0, 0, 0, 6}, "Exif\x00\x00"...), tiff...)
+	ftyp := createBox("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	meta := func(mdatOffset uint32) []byte {
+		// iloc version 0, offset and length on 4 bytes, no base offset
+		iloc := []byte{0, 0, 0, 0, 0x44, 0x00, 0, 2}
+		for i, item := range [][]byte{thumbnail, exifItem} {
+			offset := mdatOffset
+			if i == 1 {
+				offset += uint32(len(thumbnail))
+			}
+			iloc = binary.BigEndian.AppendUint16(iloc, uint16(i+1))
+			iloc = append(iloc, 0, 0, 0, 1)
+			iloc = binary.BigEndian.AppendUint32(iloc, offset)
+			iloc = binary.BigEndian.AppendUint32(iloc, uint32(len(item)))
+		}
+		iinf := createBox("iinf", []byte{0, 0, 0, 0, 0, 3}, createItemInfo(1, thumbnailKind), createItemInfo(2, "Exif"), createItemInfo(3, "grid"))
+		// Property 1 is size of thumbnail, property 2 is size of primary item
+		ipco := createBox("ipco", createBox("ispe", []byte{0, 0, 0, 0, 0, 0, 0, 64, 0, 0, 0, 48}), createBox("ispe", []byte{0, 0, 0, 0, 0, 0, 0x0F, 0xC0, 0, 0, 0x0B, 0xD0}))
+		ipma := createBox("ipma", []byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 1, 1, 0x81, 0, 3, 1, 0x82})
+		return createBox("meta", []byte{0, 0, 0, 0}, createBox("hdlr", make([]byte, 24)), createBox("pitm", []byte{0, 0, 0, 0, 0, 3}),
+			iinf, createBox("iloc", iloc), createBox("iprp", ipco, ipma))
+	}
+	mdatOffset := uint32(len(ftyp) + len(meta(0)) + 8)
+	return bytes.Join([][]byte{ftyp, meta(mdatOffset), createBox("mdat", thumbnail, exifItem)}, nil)
+}
+
+// createExifTiff build a tiff with only an orientation
+func createExifTiff(orientation uint16) []byte {
+	tiff := append([]byte("II*\x00"), 8, 0, 0, 0, 1, 0)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0x112)
+	tiff = binary.LittleEndian.AppendUint16(tiff, tiffTypeShort)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientation)
+	return append(tiff, 0, 0, 0, 0, 0, 0)
+}
+
+func TestReadHeic(t *testing.T) {
+	thumbnail := createJpeg(t, 64, 48)
+	path := filepath.Join(t.TempDir(), "IMG_01.HEIC")
+	if err := os.WriteFile(path, createHeic("jpeg", thumbnail, createExifTiff(6)), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if !IsHeic(path) || IsHeic("IMG_01.jpg") {
+		t.Error("heic must be detected by extension")
+	}
+	if data, err := ReadHeicThumbnail(path); err != nil || !bytes.Equal(data, thumbnail) {
+		t.Error("jpeg item must be extracted", err)
+	}
+	tiff, err := ReadHeicExif(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := exif.Decode(bytes.NewReader(tiff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag, err := infos.Get(exif.Orientation); err != nil {
+		t.Error("orientation must be read", err)
+	} else if value, _ := tag.Int(0); value != 6 {
+		t.Error("orientation must be 6 but found", value)
+	}
+	if w, h := GetSize(path); w != 64 || h != 48 {
+		t.Error("heic must be opened with its thumbnail", w, h)
+	}
+	if w, h, err := ReadHeicSize(path); err != nil || w != 4032 || h != 3024 {
+		t.Error("size must be the one of primary item", w, h, err)
+	}
+	to := filepath.Join(t.TempDir(), "IMG_01-preview.jpg")
+	decoder := ThumbnailHeicDecoder{converter: &fakeConverter{}}
+	if err := decoder.Decode(path, to); err != nil || decoder.Rotated(path) || decoder.converter.(*fakeConverter).used {
+		t.Error("jpeg item must be used", err)
+	}
+	if _, err := ReadHeicThumbnail(to); err == nil {
+		t.Error("jpeg is not a heic file")
+	}
+	if files, _ := os.ReadDir(filepath.Dir(to)); len(files) != 1 {
+		t.Error("temporary file must be renamed", len(files))
+	}
+}
+
+type fakeConverter struct {
+	used bool
+}
+
+func (fc *fakeConverter) Decode(_, to string) error {
+	fc.used = true
+	return os.WriteFile(to, []byte("converted"), os.ModePerm)
+}
+
+func (fc *fakeConverter) Rotated(_ string) bool {
+	return true
+}
+
+func TestHeicWithoutJpeg(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "IMG_02.HEIC")
+	if err := os.WriteFile(path, createHeic("hvc1", []byte("hevc data"), createExifTiff(1)), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	to := filepath.Join(t.TempDir(), "IMG_02-preview.jpg")
+	if err := (ThumbnailHeicDecoder{}).Decode(path, to); err == nil {
+		t.Error("heic without jpeg and without converter can't be decoded")
+	}
+	converter := &fakeConverter{}
+	decoder := ThumbnailHeicDecoder{converter: converter}
+	if err := decoder.Decode(path, to); err != nil || !converter.used || !decoder.Rotated(path) {
+		t.Error("converter must be used without jpeg item", err)
+	}
+}
+
+func TestMalformedHeic(t *testing.T) {
+	// Box with a 64 bits size bigger than its parent
+	box := append([]byte{0, 0, 0, 0, 0, 0, 0, 1}, "iinf"...)
+	box = binary.BigEndian.AppendUint64(box, math.MaxInt64)
+	if _, err := parseHeicMeta(box); err == nil {
+		t.Error("box bigger than meta must be refused")
+	}
+	if _, _, _, err := readBoxHeader(bytes.NewReader(append(make([]byte, 8), box[4:]...)), 8, -1); err == nil {
+		t.Error("box with end after max offset must be refused")
+	}
+	// Extent in idat which overflows
+	meta := &heicMeta{idat: make([]byte, 4), items: make(map[uint32]*heicItem)}
+	if _, err := meta.read(nil, &heicItem{idat: true, extents: []heicExtent{{offset: math.MaxUint64, length: 2}}}); err == nil {
+		t.Error("extent out of idat must be refused")
+	}
+	// Base offset and offset of extent (on 8 bytes) which overflow
+	iloc := []byte{0, 0, 0, 0, 0x84, 0x80, 0, 1, 0, 1, 0, 0}
+	iloc = binary.BigEndian.AppendUint64(iloc, math.MaxUint64)
+	iloc = append(iloc, 0, 1)
+	iloc = binary.BigEndian.AppendUint64(iloc, 2)
+	iloc = binary.BigEndian.AppendUint32(iloc, 4)
+	if err := meta.parseItemLocations(iloc); err == nil {
+		t.Error("extent with overflowing offset must be refused")
+	}
+}
@@ -0,0 +1,46 @@
+package resize
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+/* Perceptual hash (dHash) : two images visually identical have a small hamming distance between their hashes */
+
+// DHash compute a difference hash of an image, better on a reduced image to go faster
+func DHash(path string) (string, error) {
+	img, err := openImage(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x", dHashImage(img)), nil
+}
+
+// Reduce image to 9x8 in gray and compare each pixel with its right neighbour
+func dHashImage(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Box))
+	hash := uint64(0)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.Pix[small.PixOffset(x, y)] < small.Pix[small.PixOffset(x+1, y)] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// ParseHash read a hash computed by DHash
+func ParseHash(hash string) (uint64, error) {
+	return strconv.ParseUint(hash, 16, 64)
+}
+
+// HammingDistance return the number of different bits between two hashes
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -0,0 +1,62 @@
+package resize
+
+import (
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// Image with a diagonal gradient and a dark disc, details are different between x and y
+func createHashImage(width, height int, brightness int) image.Image {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			value := (x*200/width+y*55/height)/2 + brightness
+			dx, dy := x-width/3, y-height/2
+			if dx*dx+dy*dy < (height/4)*(height/4) {
+				value = 20 + brightness
+			}
+			img.SetGray(x, y, color.Gray{Y: uint8(clamp(value, 0, 255))})
+		}
+	}
+	return img
+}
+
+func hashFile(t *testing.T, img image.Image, name string) uint64 {
+	path := filepath.Join(t.TempDir(), name)
+	if err := imaging.Save(img, path, imaging.JPEGQuality(70)); err != nil {
+		t.Fatal(err)
+	}
+	value, err := DHash(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := ParseHash(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestDHash(t *testing.T) {
+	original := hashFile(t, createHashImage(400, 300, 0), "original.jpg")
+	// Same photo reduced, lighter and compressed again
+	resized := hashFile(t, createHashImage(200, 150, 15), "resized.jpg")
+	if distance := HammingDistance(original, resized); distance > 5 {
+		t.Error("near duplicates must have close hashes", distance)
+	}
+	// Same photo flipped, a different image
+	flipped := hashFile(t, imaging.FlipH(createHashImage(400, 300, 0)), "flipped.jpg")
+	if distance := HammingDistance(original, flipped); distance < 20 {
+		t.Error("distinct images must have far hashes", distance)
+	}
+	if HammingDistance(0xf0, 0x0f) != 8 || HammingDistance(original, original) != 0 {
+		t.Error("bad hamming distance")
+	}
+	if _, err := DHash(filepath.Join(t.TempDir(), "missing.jpg")); err == nil {
+		t.Error("hash of missing image must fail")
+	}
+}
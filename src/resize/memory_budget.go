@@ -0,0 +1,67 @@
+package resize
+
+import (
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"sync"
+)
+
+/* Limit memory used by decoded images : an image is opened only when its estimated size fits in budget.
+An image bigger than whole budget waits for all others to be released */
+
+const (
+	defaultMaxMemory = int64(1 << 30)
+	// Bytes by pixel of a decoded image (RGBA)
+	bytesByPixel = 4
+	// Ratio between decoded and compressed size when header can't be read
+	compressionRatio = 10
+)
+
+type memoryBudget struct {
+	max  int64
+	used int64
+	cond *sync.Cond
+}
+
+func newMemoryBudget(max int64) *memoryBudget {
+	return &memoryBudget{max: max, cond: sync.NewCond(&sync.Mutex{})}
+}
+
+// acquire wait until size is available and return memory reserved, to release later
+func (mb *memoryBudget) acquire(size int64) int64 {
+	if size > mb.max {
+		size = mb.max
+	}
+	mb.cond.L.Lock()
+	defer mb.cond.L.Unlock()
+	for mb.used+size > mb.max {
+		mb.cond.Wait()
+	}
+	mb.used += size
+	return size
+}
+
+func (mb *memoryBudget) release(size int64) {
+	mb.cond.L.Lock()
+	defer mb.cond.L.Unlock()
+	mb.used -= size
+	mb.cond.Broadcast()
+}
+
+// estimateMemory return size of decoded image from its header, or from file size if format is not readable (RAW, HEIC)
+func estimateMemory(path string) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	if config, _, err := image.DecodeConfig(f); err == nil {
+		return int64(config.Width) * int64(config.Height) * bytesByPixel
+	}
+	if stat, err := f.Stat(); err == nil {
+		return stat.Size() * compressionRatio
+	}
+	return 0
+}
@@ -0,0 +1,221 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/* RAW files (CR2, NEF, ARW, DNG) are TIFF files which embed one or more JPEG previews.
+The biggest preview is used to display and reduce the photo, RAW data is never decoded */
+
+var rawExtensions = []string{".cr2", ".nef", ".arw", ".dng"}
+
+const (
+	tagCompression     = 0x103
+	tagStripOffsets    = 0x111
+	tagStripByteCounts = 0x117
+	tagSubIFDs         = 0x14A
+	tagJpegOffset      = 0x201
+	tagJpegLength      = 0x202
+	compressionOldJpeg = 6
+	compressionJpeg    = 7
+	maxIFDs            = 64
+	maxEntriesByIFD    = 1024
+	tiffEntrySize      = 12
+	tiffTypeShort      = 3
+	// A preview bigger than 64Mo is a corrupted entry
+	maxPreviewSize = 64 << 20
+)
+
+// IsRaw return true if file is a RAW photo, based on its extension
+func IsRaw(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, rawExt := range rawExtensions {
+		if ext == rawExt {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtractRawPreview write the biggest JPEG preview of RAW file from in file to, file to only exists when complete
+func ExtractRawPreview(from, to string) error {
+	data, err := ReadRawPreview(from)
+	if err != nil {
+		return err
+	}
+	return writeFileSafely(to, data)
+}
+
+// ReadRawPreview return the biggest JPEG preview embedded in RAW file
+func ReadRawPreview(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readTiffPreview(f)
+}
+
+func decodeRawPreview(r io.ReaderAt) (image.Image, error) {
+	data, err := readTiffPreview(r)
+	if err != nil {
+		return nil, err
+	}
+	return jpeg.Decode(bytes.NewReader(data))
+}
+
+type tiffReader struct {
+	r        io.ReaderAt
+	order    binary.ByteOrder
+	visited  map[uint32]struct{}
+	best     []byte
+	bestSize int
+}
+
+func readTiffPreview(r io.ReaderAt) ([]byte, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, errors.New("not a tiff file")
+	}
+	tr := &tiffReader{r: r, visited: make(map[uint32]struct{})}
+	switch string(header[:4]) {
+	case "II*\x00":
+		tr.order = binary.LittleEndian
+	case "MM\x00*":
+		tr.order = binary.BigEndian
+	default:
+		return nil, errors.New("not a tiff file")
+	}
+	tr.readIFDs(tr.order.Uint32(header[4:]))
+	if tr.best == nil {
+		return nil, errors.New("no jpeg preview found")
+	}
+	return tr.best, nil
+}
+
+type tiffEntry struct {
+	kind   uint16
+	count  uint32
+	values []byte
+}
+
+// readIFDs read chain of IFDs starting at offset, with their sub IFDs
+func (tr *tiffReader) readIFDs(offset uint32) {
+	for offset != 0 && len(tr.visited) < maxIFDs {
+		if _, exist := tr.visited[offset]; exist {
+			return
+		}
+		tr.visited[offset] = struct{}{}
+		entries, next, err := tr.readIFD(offset)
+		if err != nil {
+			return
+		}
+		tr.checkPreviews(entries)
+		for _, subIFD := range tr.uints(entries[tagSubIFDs]) {
+			tr.readIFDs(subIFD)
+		}
+		offset = next
+	}
+}
+
+func (tr *tiffReader) readIFD(offset uint32) (map[uint16]tiffEntry, uint32, error) {
+	count := make([]byte, 2)
+	if _, err := tr.r.ReadAt(count, int64(offset)); err != nil {
+		return nil, 0, err
+	}
+	nb := int(tr.order.Uint16(count))
+	if nb > maxEntriesByIFD {
+		return nil, 0, errors.New("invalid ifd")
+	}
+	data := make([]byte, nb*tiffEntrySize+4)
+	if _, err := tr.r.ReadAt(data, int64(offset)+2); err != nil {
+		return nil, 0, err
+	}
+	entries := make(map[uint16]tiffEntry, nb)
+	for i := 0; i < nb; i++ {
+		raw := data[i*tiffEntrySize : (i+1)*tiffEntrySize]
+		entry := tiffEntry{kind: tr.order.Uint16(raw[2:]), count: tr.order.Uint32(raw[4:]), values: raw[8:12]}
+		// Values which don't fit in 4 bytes are stored at an offset. Count comes from file, too many values is a corrupted entry
+		if size := entry.size(); size > 4 {
+			if size >= 1<<16 {
+				continue
+			}
+			entry.values = make([]byte, size)
+			if _, err := tr.r.ReadAt(entry.values, int64(tr.order.Uint32(raw[8:]))); err != nil {
+				continue
+			}
+		}
+		entries[tr.order.Uint16(raw)] = entry
+	}
+	return entries, tr.order.Uint32(data[nb*tiffEntrySize:]), nil
+}
+
+// width return size in bytes of a value of entry
+func (e tiffEntry) width() int {
+	if e.kind == tiffTypeShort {
+		return 2
+	}
+	return 4
+}
+
+func (e tiffEntry) size() uint64 {
+	return uint64(e.count) * uint64(e.width())
+}
+
+// uints return values of a SHORT or LONG entry, only values really read are returned (never more than count)
+func (tr *tiffReader) uints(entry tiffEntry) []uint32 {
+	nb := len(entry.values) / entry.width()
+	if uint64(nb) > uint64(entry.count) {
+		nb = int(entry.count)
+	}
+	values := make([]uint32, 0, nb)
+	for i := 0; i < nb; i++ {
+		if entry.kind == tiffTypeShort {
+			values = append(values, uint32(tr.order.Uint16(entry.values[i*2:])))
+		} else {
+			values = append(values, tr.order.Uint32(entry.values[i*4:]))
+		}
+	}
+	return values
+}
+
+func (tr *tiffReader) value(entries map[uint16]tiffEntry, tag uint16) uint32 {
+	if values := tr.uints(entries[tag]); len(values) == 1 {
+		return values[0]
+	}
+	return 0
+}
+
+// checkPreviews keep JPEG of IFD if bigger than current one. JPEG is referenced by JPEGInterchangeFormat or by a single strip
+func (tr *tiffReader) checkPreviews(entries map[uint16]tiffEntry) {
+	tr.checkPreview(tr.value(entries, tagJpegOffset), tr.value(entries, tagJpegLength))
+	if compression := tr.value(entries, tagCompression); compression == compressionOldJpeg || compression == compressionJpeg {
+		tr.checkPreview(tr.value(entries, tagStripOffsets), tr.value(entries, tagStripByteCounts))
+	}
+}
+
+func (tr *tiffReader) checkPreview(offset, length uint32) {
+	if offset == 0 || length < 4 || length > maxPreviewSize {
+		return
+	}
+	data := make([]byte, length)
+	if _, err := tr.r.ReadAt(data, int64(offset)); err != nil || data[0] != 0xFF || data[1] != 0xD8 {
+		return
+	}
+	// Lossless JPEG of raw data can't be decoded and is ignored
+	config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	if size := config.Width * config.Height; size > tr.bestSize {
+		tr.best, tr.bestSize = data, size
+	}
+}
@@ -0,0 +1,111 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func createJpeg(t testing.TB, width, height int) []byte {
+	buffer := bytes.Buffer{}
+	if err := jpeg.Encode(&buffer, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// createRaw build a tiff with a big preview in IFD0 (strip, as CR2) and a thumbnail in IFD1 (JPEGInterchangeFormat)
+func createRaw(order binary.ByteOrder, preview, thumbnail []byte) []byte {
+	ifdSize := uint32(2 + 3*12 + 4)
+	ifd0, ifd1 := uint32(8), 8+ifdSize
+	previewOffset := ifd1 + ifdSize
+	thumbnailOffset := previewOffset + uint32(len(preview))
+
+	buffer := &bytes.Buffer{}
+	if order == binary.LittleEndian {
+		buffer.WriteString("II*\x00")
+	} else {
+		buffer.WriteString("MM\x00*")
+	}
+	binary.Write(buffer, order, ifd0)
+	writeIFD := func(entries [][3]uint32, next uint32) {
+		binary.Write(buffer, order, uint16(len(entries)))
+		for _, entry := range entries {
+			binary.Write(buffer, order, uint16(entry[0]))
+			binary.Write(buffer, order, uint16(entry[1]))
+			binary.Write(buffer, order, uint32(1))
+			if entry[1] == tiffTypeShort {
+				binary.Write(buffer, order, uint16(entry[2]))
+				binary.Write(buffer, order, uint16(0))
+			} else {
+				binary.Write(buffer, order, entry[2])
+			}
+		}
+		binary.Write(buffer, order, next)
+	}
+	writeIFD([][3]uint32{{tagCompression, tiffTypeShort, compressionOldJpeg}, {tagStripOffsets, 4, previewOffset}, {tagStripByteCounts, 4, uint32(len(preview))}}, ifd1)
+	writeIFD([][3]uint32{{tagCompression, tiffTypeShort, compressionOldJpeg}, {tagJpegOffset, 4, thumbnailOffset}, {tagJpegLength, 4, uint32(len(thumbnail))}}, 0)
+	buffer.Write(preview)
+	buffer.Write(thumbnail)
+	return buffer.Bytes()
+}
+
+func TestReadRawPreview(t *testing.T) {
+	preview, thumbnail := createJpeg(t, 120, 80), createJpeg(t, 12, 8)
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		data, err := readTiffPreview(bytes.NewReader(createRaw(order, preview, thumbnail)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, preview) {
+			t.Error("biggest preview must be extracted", order)
+		}
+	}
+	if _, err := readTiffPreview(bytes.NewReader(preview)); err == nil {
+		t.Error("jpeg is not a raw file")
+	}
+	if _, err := readTiffPreview(bytes.NewReader(createRaw(binary.LittleEndian, []byte("noop"), []byte("noop")))); err == nil {
+		t.Error("raw without valid jpeg must fail")
+	}
+	// Entry with a huge count of sub IFDs (with and without offset of next IFD) must not allocate its count
+	for _, size := range []int{22, 26} {
+		corrupted := make([]byte, size)
+		copy(corrupted, "II*\x00")
+		binary.LittleEndian.PutUint32(corrupted[4:], 8)
+		binary.LittleEndian.PutUint16(corrupted[8:], 1)
+		binary.LittleEndian.PutUint16(corrupted[10:], tagSubIFDs)
+		binary.LittleEndian.PutUint16(corrupted[12:], 4)
+		binary.LittleEndian.PutUint32(corrupted[14:], 0xFFFFFFFF)
+		binary.LittleEndian.PutUint32(corrupted[18:], 8)
+		if _, err := readTiffPreview(bytes.NewReader(corrupted)); err == nil {
+			t.Error("corrupted raw must fail", size)
+		}
+	}
+}
+
+func TestOpenRawImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "IMG_01.CR2")
+	if err := os.WriteFile(path, createRaw(binary.LittleEndian, createJpeg(t, 120, 80), createJpeg(t, 12, 8)), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if !IsRaw(path) || IsRaw("IMG_01.jpg") {
+		t.Error("raw must be detected by extension")
+	}
+	if w, h := GetSize(path); w != 120 || h != 80 {
+		t.Error("raw must be opened with its preview", w, h)
+	}
+	to := filepath.Join(t.TempDir(), "IMG_01-preview.jpg")
+	if err := ExtractRawPreview(path, to); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := GetSize(to); w != 120 || h != 80 {
+		t.Error("preview must be extracted", w, h)
+	}
+	if files, _ := os.ReadDir(filepath.Dir(to)); len(files) != 1 {
+		t.Error("temporary file must be renamed", len(files))
+	}
+}
@@ -13,9 +13,13 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 )
 
+const defaultQuality = 75
+
 type Request struct {
 	from string
 	to   string
@@ -54,7 +58,7 @@ func (gor GoResizer) Resize(from, to string, width, height uint) (error, uint, u
 
 	if img, err := openImage(from); err == nil {
 		imgResize, w, h := resizeImage(img, width, height)
-		return saveImage(imgResize, to), w, h
+		return saveImage(imgResize, to, 0), w, h
 	} else {
 		logger.GetLogger2().Info("Impossible to resize", err)
 		return err, 0, 0
@@ -66,21 +70,59 @@ type imageWrapper struct {
 	conversions []ImageToResize
 	// Rotation of original image
 	orientation int
-	finalWidth  uint
-	finalHeight uint
 	to          string
+	quality     int
 	img         image.Image
-	// Used when error or end
-	callback       func(error, uint, uint, int)
-	launchCallback bool
+	// Memory reserved for decoded original, released when all conversions are computed
+	memory int64
+	job    *imageJob
+}
+
+// imageJob follow saves of reduced images of an original, callback is called once, when the last one is saved or at first error
+type imageJob struct {
+	locker    sync.Mutex
+	remaining int
+	ended     bool
+	// Size of the last not cropped image and orientation after rotation
+	width       uint
+	height      uint
+	orientation int
+	callback    func(error, uint, uint, int)
+}
+
+func (ij *imageJob) saved(err error) {
+	ij.locker.Lock()
+	defer ij.locker.Unlock()
+	if ij.ended {
+		return
+	}
+	if ij.remaining--; err != nil || ij.remaining <= 0 {
+		ij.ended = true
+		ij.callback(err, ij.width, ij.height, ij.orientation)
+	}
 }
 
 type ImageToResize struct {
 	To     string
 	Width  uint
 	Height uint
+	// Jpeg quality, default if 0
+	Quality int `json:",omitempty"`
+	// If true, image is cropped to fill width and height, otherwise image fits in
+	Crop bool `json:",omitempty"`
+	// With crop, window is placed on focus areas (faces) or on most detailed area instead of center
+	Smart bool      `json:",omitempty"`
+	Focus []FaceBox `json:",omitempty"`
+}
+
+// contains return true if conversion can be computed from result of other (smaller bounding box)
+func (itr ImageToResize) contains(other ImageToResize) bool {
+	return !itr.Crop && (itr.Width == 0 || (other.Width != 0 && other.Width <= itr.Width)) &&
+		(itr.Height == 0 || (other.Height != 0 && other.Height <= itr.Height))
 }
 
+// AsyncGoResizer is a pipeline opening, resizing and saving images, each step run by many workers.
+// Decoded images are limited by a memory budget, opening waits when it is reached
 type AsyncGoResizer struct {
 	goResizer GoResizer
 	// Chanel to open image
@@ -89,19 +131,30 @@ type AsyncGoResizer struct {
 	chanResizeImage chan imageWrapper
 	// Chanel to save resize image
 	chanSaveImage chan imageWrapper
+	memory        *memoryBudget
 }
 
-func NewAsyncGoResize() GoResizerManager {
+// NewAsyncGoResize create a pipeline with workers for each step (number of cpus if 0) and a memory budget in bytes for decoded images (1 Go if 0)
+func NewAsyncGoResize(workers int, maxMemory int64) GoResizerManager {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if maxMemory <= 0 {
+		maxMemory = defaultMaxMemory
+	}
 	agor := AsyncGoResizer{
 		goResizer:       GoResizer{},
 		chanOpenImage:   make(chan imageWrapper, 18),
-		chanResizeImage: make(chan imageWrapper, 7),
-		chanSaveImage:   make(chan imageWrapper, 7),
+		chanResizeImage: make(chan imageWrapper, workers),
+		chanSaveImage:   make(chan imageWrapper, 7*workers),
+		memory:          newMemoryBudget(maxMemory),
 	}
-	go agor.runOpener()
-	go agor.runResizer()
-	go agor.runSaver()
-	logger.GetLogger2().Info("Use default async resizer")
+	for i := 0; i < workers; i++ {
+		go agor.runOpener()
+		go agor.runResizer()
+		go agor.runSaver()
+	}
+	logger.GetLogger2().Info("Use default async resizer with", workers, "workers")
 	return agor
 }
 
@@ -109,11 +162,13 @@ func (agor AsyncGoResizer) runOpener() {
 	for {
 		pathWrapper := <-agor.chanOpenImage
 		logger.GetLogger2().Info("Run resize", pathWrapper.from)
+		pathWrapper.memory = agor.memory.acquire(estimateMemory(pathWrapper.from))
 		if img, err := openImage(pathWrapper.from); err == nil {
 			pathWrapper.img = img
 			agor.chanResizeImage <- pathWrapper
 		} else {
-			pathWrapper.callback(err, 0, 0, 1)
+			agor.memory.release(pathWrapper.memory)
+			pathWrapper.job.callback(err, 0, 0, 1)
 		}
 	}
 }
@@ -128,23 +183,41 @@ func (agor AsyncGoResizer) runResizer() {
 		// Launch many resize if necessary
 		img := imgWrapper.img
 		correctedOrientation := imgWrapper.orientation
+		if imgWrapper.orientation != 1 {
+			// Rotate once, all conversions are computed on rotated image
+			img, correctedOrientation = rotateImage(img, imgWrapper.orientation)
+		}
+		// Conversions are computed on previous result when possible, faster than original
+		original, previous := img, ImageToResize{}
+		// Callback receive size of the last not cropped image
+		var fitWidth, fitHeight = uint(0), uint(0)
+		resized := make([]imageWrapper, len(imgWrapper.conversions))
 		for i, conversion := range imgWrapper.conversions {
+			if i == 0 || !previous.contains(conversion) {
+				img = original
+			}
 			var imgResize image.Image
 			var w, h = uint(0), uint(0)
-			if imgWrapper.orientation != 1 && i == 0 {
-				// Run resize and rotate, only on the first (cause resize on following are computed on first image
-				imgResize, w, h, correctedOrientation = resizeAndRotateImage(img, conversion.Width, conversion.Height, imgWrapper.orientation)
+			if conversion.Crop {
+				imgResize, w, h = cropImage(img, conversion)
 			} else {
 				imgResize, w, h = resizeImage(img, conversion.Width, conversion.Height)
+				fitWidth, fitHeight = w, h
+				img, previous = imgResize, conversion
 			}
-			// Only update the smallest
-			launchCallback := i == len(imgWrapper.conversions)-1
-			/*if i < len(imgWrapper.conversions) -1 {
-				h = 0
-				w = 0
-			}*/
-			agor.chanSaveImage <- imageWrapper{img: imgResize, to: conversion.To, finalWidth: w, finalHeight: h, orientation: correctedOrientation, callback: imgWrapper.callback, launchCallback: launchCallback}
-			img = imgResize
+			resized[i] = imageWrapper{img: imgResize, to: conversion.To, quality: conversion.Quality, job: imgWrapper.job}
+		}
+		// Original is not used anymore
+		agor.memory.release(imgWrapper.memory)
+		job := imgWrapper.job
+		job.locker.Lock()
+		job.width, job.height, job.orientation, job.remaining = fitWidth, fitHeight, correctedOrientation, len(resized)
+		job.locker.Unlock()
+		if len(resized) == 0 {
+			job.callback(nil, fitWidth, fitHeight, correctedOrientation)
+		}
+		for _, wrapper := range resized {
+			agor.chanSaveImage <- wrapper
 		}
 	}
 }
@@ -152,25 +225,32 @@ func (agor AsyncGoResizer) runResizer() {
 func (agor AsyncGoResizer) runSaver() {
 	for {
 		imgWrapper := <-agor.chanSaveImage
-		err := saveImage(imgWrapper.img, imgWrapper.to)
-		if err != nil || imgWrapper.launchCallback {
-			imgWrapper.callback(err, imgWrapper.finalWidth, imgWrapper.finalHeight, imgWrapper.orientation)
-		}
+		imgWrapper.job.saved(saveImage(imgWrapper.img, imgWrapper.to, imgWrapper.quality))
 	}
 }
 
 // Launch resize async
 func (agor AsyncGoResizer) ResizeAsync(from string, orientation int, conversions []ImageToResize, callback func(err error, w uint, h uint, o int)) {
-	agor.chanOpenImage <- imageWrapper{from: from, orientation: orientation, conversions: conversions, callback: callback}
+	agor.chanOpenImage <- imageWrapper{from: from, orientation: orientation, conversions: conversions, job: &imageJob{callback: callback}}
 }
 
-func saveImage(img image.Image, path string) error {
-	if f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm); err == nil {
+// saveImage save image as png or jpeg depending on extension, quality is only used by jpeg (75 by default).
+// Image is written in a temporary file, a reader never gets a partial image
+func saveImage(img image.Image, path string, quality int) error {
+	return writeSafely(path, func(tmp string) error {
+		f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm)
+		if err != nil {
+			return err
+		}
 		defer f.Close()
-		return jpeg.Encode(f, img, &(jpeg.Options{Quality: 75}))
-	} else {
-		return err
-	}
+		if strings.EqualFold(filepath.Ext(path), ".png") {
+			return png.Encode(f, img)
+		}
+		if quality <= 0 || quality > 100 {
+			quality = defaultQuality
+		}
+		return jpeg.Encode(f, img, &(jpeg.Options{Quality: quality}))
+	})
 }
 
 func openImage(path string) (image.Image, error) {
@@ -186,6 +266,12 @@ func openImage(path string) (image.Image, error) {
 		case strings.EqualFold(ext, ".png"):
 			img, err2 = png.Decode(f)
 			break
+		case IsRaw(path):
+			img, err2 = decodeRawPreview(f)
+			break
+		case IsHeic(path):
+			img, err2 = decodeHeicThumbnail(f)
+			break
 		default:
 			err2 = errors.New("unknown format")
 		}
@@ -199,33 +285,62 @@ func openImage(path string) (image.Image, error) {
 	}
 }
 
+// resizeImage reduce image to fit in width and height, keeping ratio. Image is never enlarged
 func resizeImage(img image.Image, width, height uint) (image.Image, uint, uint) {
-	x, y := float32(img.Bounds().Size().X), float32(img.Bounds().Size().Y)
-	if float32(height) > y || float32(width) > x {
-		return img, uint(x), uint(y)
+	x, y := uint(img.Bounds().Size().X), uint(img.Bounds().Size().Y)
+	if width, height = FitSize(x, y, width, height); width == x && height == y {
+		return img, x, y
 	}
+	return resizer.Resize(width, height, img, resizer.Bicubic), width, height
+}
+
+// FitSize return size of an image of size x, y reduced to fit in width and height (0 is not limited), image is never enlarged
+func FitSize(x, y, width, height uint) (uint, uint) {
+	fx, fy := float32(x), float32(y)
 	switch {
 	case width == 0 && height == 0:
-		return img, uint(x), uint(y)
+		return x, y
 	case width == 0:
-		width = uint((float32(height) / y) * x)
+		width = uint((float32(height) / fy) * fx)
 	case height == 0:
-		height = uint((float32(width) / x) * y)
+		height = uint((float32(width) / fx) * fy)
+	case float32(width)/fx < float32(height)/fy:
+		height = uint((float32(width) / fx) * fy)
+	default:
+		width = uint((float32(height) / fy) * fx)
 	}
-	return resizer.Resize(width, height, img, resizer.Bicubic), width, height
+	if height > y || width > x {
+		return x, y
+	}
+	return width, height
+}
+
+// fillImage reduce and crop image (centered) to cover exactly width and height
+func fillImage(img image.Image, width, height uint) (image.Image, uint, uint) {
+	if width == 0 || height == 0 {
+		return resizeImage(img, width, height)
+	}
+	return imaging.Fill(img, int(width), int(height), imaging.Center, imaging.Lanczos), width, height
+}
+
+// cropImage crop image to cover size of conversion, centered or smart
+func cropImage(img image.Image, conversion ImageToResize) (image.Image, uint, uint) {
+	if conversion.Smart {
+		return smartCropImage(img, conversion.Width, conversion.Height, conversion.Focus)
+	}
+	return fillImage(img, conversion.Width, conversion.Height)
 }
 
 // Rotate image before resizing
 // Image is rotating, always return 1 as exif orientation
-func resizeAndRotateImage(img image.Image, width, height uint, orientation int) (image.Image, uint, uint, int) {
+func rotateImage(img image.Image, orientation int) (image.Image, int) {
 	angle := CorrectRotation(orientation)
 
 	// If angle different than normal, rotate
 	if angle != 0 {
 		img = imaging.Rotate(img, float64(angle), color.Transparent)
 	}
-	imgResized, w, h := resizeImage(img, width, height)
-	return imgResized, w, h, 1
+	return img, 1
 }
 
 // CorrectRotation return angle in degree based on exif rotation
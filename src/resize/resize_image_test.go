@@ -0,0 +1,32 @@
+package resize
+
+import (
+	"image"
+	"testing"
+)
+
+func TestResizeInBoundingBox(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 400, 200))
+	if _, w, h := resizeImage(img, 100, 100); w != 100 || h != 50 {
+		t.Error("image must fit in bounding box", w, h)
+	}
+	if _, w, h := resizeImage(img, 0, 100); w != 200 || h != 100 {
+		t.Error("image must be reduced with height", w, h)
+	}
+	if _, w, h := resizeImage(img, 1000, 0); w != 400 || h != 200 {
+		t.Error("image must not be enlarged", w, h)
+	}
+	if result, w, h := fillImage(img, 100, 100); w != 100 || h != 100 || result.Bounds().Dx() != 100 || result.Bounds().Dy() != 100 {
+		t.Error("image must be cropped to fill bounding box", w, h)
+	}
+}
+
+func TestContainsConversion(t *testing.T) {
+	big, small := ImageToResize{Height: 1080}, ImageToResize{Height: 250}
+	if !big.contains(small) || small.contains(big) {
+		t.Error("small conversion must be computed from big one only")
+	}
+	if big.contains(ImageToResize{Width: 500}) || (ImageToResize{Height: 500, Crop: true}).contains(small) {
+		t.Error("conversion must not be computed from a different or cropped box")
+	}
+}
@@ -47,16 +47,25 @@ func (hgr HttpGoResizer) ResizeAsync(from string, orientation int, conversions [
 	request := ConversionRequest{Input: from, Orientation: orientation, Conversions: conversions}
 	if data, err := json.Marshal(request); err != nil {
 		logger.GetLogger2().Error("Impossible to launch remote conversion", err)
+		callback(err, 0, 0, 0)
 	} else {
 		req, err := http.Post(fmt.Sprintf("%s/convert", hgr.url), "application/json", bytes.NewBuffer(data))
-		if err != nil || req.StatusCode != 200 {
-			logger.GetLogger2().Error("Impossible to execute remote", err, req.StatusCode)
+		if err != nil {
+			logger.GetLogger2().Error("Impossible to execute remote", err)
 			callback(err, 0, 0, 0)
 			return
 		}
+		defer req.Body.Close()
+		if req.StatusCode != http.StatusOK {
+			logger.GetLogger2().Error("Impossible to execute remote", req.StatusCode)
+			callback(fmt.Errorf("remote conversion failed with status %d", req.StatusCode), 0, 0, 0)
+			return
+		}
 		data, _ := io.ReadAll(req.Body)
 		response := conversionResponse{}
-		if err := json.Unmarshal(data, &response); err == nil {
+		if err := json.Unmarshal(data, &response); err != nil {
+			callback(err, 0, 0, 0)
+		} else {
 			callback(nil, response.Width, response.Height, response.Orientation)
 		}
 	}
@@ -0,0 +1,124 @@
+package resize
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// createPhoto write a jpeg with a gradient, closer to a photo than a plain image
+func createPhoto(tb testing.TB, path string, width, height int) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: uint8(x + y), A: 255})
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	if err := jpeg.Encode(f, img, nil); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestAsyncResizeCallbackOnce(t *testing.T) {
+	folder := t.TempDir()
+	path := filepath.Join(folder, "photo.jpg")
+	createPhoto(t, path, 800, 600)
+	resizer := NewAsyncGoResize(4, 0)
+	conversions := []ImageToResize{
+		{To: filepath.Join(folder, "photo-400.jpg"), Height: 400},
+		{To: filepath.Join(folder, "photo-100.jpg"), Height: 100},
+		{To: filepath.Join(folder, "photo-square.jpg"), Width: 50, Height: 50, Crop: true},
+	}
+	calls := make(chan [2]uint, 2)
+	resizer.ResizeAsync(path, 1, conversions, func(err error, w, h uint, _ int) {
+		if err != nil {
+			t.Error(err)
+		}
+		// All images must be saved when callback is called
+		for _, conversion := range conversions {
+			if _, err := os.Stat(conversion.To); err != nil {
+				t.Error("image must be saved before callback", conversion.To)
+			}
+		}
+		calls <- [2]uint{w, h}
+	})
+	if size := <-calls; size != [2]uint{133, 100} {
+		t.Error("callback must receive size of smallest fit image but found", size)
+	}
+	select {
+	case <-calls:
+		t.Error("callback must be called once")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	resizer.ResizeAsync(filepath.Join(folder, "missing.jpg"), 1, conversions, func(err error, _, _ uint, _ int) {
+		if err == nil {
+			t.Error("missing image must return an error")
+		}
+		calls <- [2]uint{}
+	})
+	<-calls
+}
+
+func TestMemoryBudget(t *testing.T) {
+	budget := newMemoryBudget(100)
+	if size := budget.acquire(500); size != 100 {
+		t.Error("image bigger than budget must reserve whole budget but found", size)
+	}
+	acquired := make(chan int64)
+	go func() { acquired <- budget.acquire(30) }()
+	select {
+	case <-acquired:
+		t.Fatal("budget is full, acquire must wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	budget.release(100)
+	if size := <-acquired; size != 30 {
+		t.Error("30 must be reserved but found", size)
+	}
+}
+
+// BenchmarkAsyncResize resize a batch of photos with an increasing number of workers, throughput is reported in images/s
+func BenchmarkAsyncResize(b *testing.B) {
+	folder := b.TempDir()
+	paths := make([]string, 8)
+	for i := range paths {
+		paths[i] = filepath.Join(folder, fmt.Sprintf("photo-%d.jpg", i))
+		createPhoto(b, paths[i], 1600, 1200)
+	}
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			resizer := NewAsyncGoResize(workers, 0)
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				wg := sync.WaitGroup{}
+				wg.Add(len(paths))
+				for i, path := range paths {
+					conversions := []ImageToResize{
+						{To: filepath.Join(folder, fmt.Sprintf("photo-%d-%d-1080.jpg", workers, i)), Height: 1080},
+						{To: filepath.Join(folder, fmt.Sprintf("photo-%d-%d-250.jpg", workers, i)), Height: 250},
+					}
+					resizer.ResizeAsync(path, 1, conversions, func(err error, _, _ uint, _ int) {
+						if err != nil {
+							b.Error(err)
+						}
+						wg.Done()
+					})
+				}
+				wg.Wait()
+			}
+			b.ReportMetric(float64(len(paths)*b.N)/b.Elapsed().Seconds(), "images/s")
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package resize
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/* Previews and converted photos are written in a temporary file renamed at the end.
+A file which exists is always complete, even if the server stops during the write */
+
+// writeSafely call write with a temporary path in the folder of path, which keeps the extension, and rename it to path if write succeeds
+func writeSafely(path string, write func(tmp string) error) error {
+	ext := filepath.Ext(path)
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+strings.TrimSuffix(filepath.Base(path), ext)+"-*"+ext)
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	if err = write(tmp.Name()); err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// writeFileSafely write data in path through a temporary file
+func writeFileSafely(path string, data []byte) error {
+	return writeSafely(path, func(tmp string) error {
+		return os.WriteFile(tmp, data, os.ModePerm)
+	})
+}
@@ -0,0 +1,177 @@
+package resize
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+/* Smart crop : crop window has ratio of target and is as big as possible, so it only moves along one axis.
+It is centered on faces when they are known, otherwise placed on the area with most details (edges and entropy of luminance),
+computed on a small copy of image */
+
+const (
+	// Size of longest side of copy of image analysed to find details
+	saliencySize = 64
+	// Number of levels of luminance used to compute entropy
+	entropyLevels = 32
+)
+
+// FaceBox is location of a face, found by face detector and kept in a smart crop. Coordinates are ratios of image size (0 to 1)
+type FaceBox struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// smartCropImage reduce and crop image to cover exactly width and height, keeping focus areas or the most detailed area
+func smartCropImage(img image.Image, width, height uint, focus []FaceBox) (image.Image, uint, uint) {
+	if width == 0 || height == 0 {
+		return resizeImage(img, width, height)
+	}
+	bounds := img.Bounds()
+	cropWidth, cropHeight := cropWindowSize(bounds.Dx(), bounds.Dy(), width, height)
+	var x, y int
+	if len(focus) > 0 {
+		x, y = focusPosition(bounds.Dx(), bounds.Dy(), cropWidth, cropHeight, focus)
+	} else {
+		x, y = saliencyPosition(img, cropWidth, cropHeight)
+	}
+	cropped := imaging.Crop(img, image.Rect(x, y, x+cropWidth, y+cropHeight).Add(bounds.Min))
+	return imaging.Resize(cropped, int(width), int(height), imaging.Lanczos), width, height
+}
+
+// cropWindowSize return biggest window in image with ratio of width and height
+func cropWindowSize(imageWidth, imageHeight int, width, height uint) (int, int) {
+	cropWidth, cropHeight := imageWidth, int(math.Round(float64(imageWidth)*float64(height)/float64(width)))
+	if cropHeight > imageHeight {
+		cropWidth, cropHeight = int(math.Round(float64(imageHeight)*float64(width)/float64(height))), imageHeight
+	}
+	return max(1, min(cropWidth, imageWidth)), max(1, min(cropHeight, imageHeight))
+}
+
+// focusPosition return top left corner of window centered on all focus areas
+func focusPosition(imageWidth, imageHeight, cropWidth, cropHeight int, focus []FaceBox) (int, int) {
+	minX, minY, maxX, maxY := 1.0, 1.0, 0.0, 0.0
+	for _, area := range focus {
+		minX, minY = math.Min(minX, area.X), math.Min(minY, area.Y)
+		maxX, maxY = math.Max(maxX, area.X+area.Width), math.Max(maxY, area.Y+area.Height)
+	}
+	x := int(math.Round((minX+maxX)/2*float64(imageWidth))) - cropWidth/2
+	y := int(math.Round((minY+maxY)/2*float64(imageHeight))) - cropHeight/2
+	return clamp(x, 0, imageWidth-cropWidth), clamp(y, 0, imageHeight-cropHeight)
+}
+
+// saliencyPosition return top left corner of window with most details. When equal, the closest to center is kept
+func saliencyPosition(img image.Image, cropWidth, cropHeight int) (int, int) {
+	imageWidth, imageHeight := img.Bounds().Dx(), img.Bounds().Dy()
+	horizontal := cropWidth < imageWidth
+	if !horizontal && cropHeight >= imageHeight {
+		return 0, 0
+	}
+	scale := math.Min(1, float64(saliencySize)/float64(max(imageWidth, imageHeight)))
+	small := imaging.Grayscale(imaging.Resize(img, max(1, int(float64(imageWidth)*scale)), max(1, int(float64(imageHeight)*scale)), imaging.Box))
+	width, height := small.Bounds().Dx(), small.Bounds().Dy()
+	luminance := make([]uint8, width*height)
+	for i := range luminance {
+		luminance[i] = small.Pix[i*4]
+	}
+	edges := edgeMap(luminance, width, height)
+
+	// Window in small image, moving along one axis
+	window := image.Rect(0, 0, min(width, max(1, int(math.Round(float64(cropWidth)*scale)))), min(height, max(1, int(math.Round(float64(cropHeight)*scale)))))
+	positions := height - window.Dy()
+	if horizontal {
+		positions = width - window.Dx()
+	}
+	edgeScores, entropyScores := make([]float64, positions+1), make([]float64, positions+1)
+	maxEdge, maxEntropy := 0.0, 0.0
+	for p := 0; p <= positions; p++ {
+		area := window.Add(image.Pt(0, p))
+		if horizontal {
+			area = window.Add(image.Pt(p, 0))
+		}
+		edgeScores[p], entropyScores[p] = windowDetails(luminance, edges, width, area)
+		maxEdge, maxEntropy = math.Max(maxEdge, edgeScores[p]), math.Max(maxEntropy, entropyScores[p])
+	}
+	best, bestScore, center := 0, -1.0, positions/2
+	for p := 0; p <= positions; p++ {
+		score := ratio(edgeScores[p], maxEdge) + ratio(entropyScores[p], maxEntropy)
+		if score > bestScore || (score == bestScore && abs(p-center) < abs(best-center)) {
+			best, bestScore = p, score
+		}
+	}
+	free := imageHeight - cropHeight
+	if horizontal {
+		free = imageWidth - cropWidth
+	}
+	// Image without details is cropped on center
+	offset := free / 2
+	if bestScore > 0 && positions > 0 {
+		offset = clamp(int(math.Round(float64(best*free)/float64(positions))), 0, free)
+	}
+	if horizontal {
+		return offset, 0
+	}
+	return 0, offset
+}
+
+// edgeMap return gradient of luminance of each pixel, between 0 and 1
+func edgeMap(luminance []uint8, width, height int) []float64 {
+	edges := make([]float64, len(luminance))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			current := int(luminance[y*width+x])
+			gradient := 0
+			if x+1 < width {
+				gradient += abs(int(luminance[y*width+x+1]) - current)
+			}
+			if y+1 < height {
+				gradient += abs(int(luminance[(y+1)*width+x]) - current)
+			}
+			edges[y*width+x] = float64(gradient) / 510
+		}
+	}
+	return edges
+}
+
+// windowDetails return mean of edges and entropy of luminance of an area
+func windowDetails(luminance []uint8, edges []float64, width int, area image.Rectangle) (float64, float64) {
+	histogram := make([]int, entropyLevels)
+	sum := 0.0
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			sum += edges[y*width+x]
+			histogram[int(luminance[y*width+x])*entropyLevels/256]++
+		}
+	}
+	total := float64(area.Dx() * area.Dy())
+	entropy := 0.0
+	for _, count := range histogram {
+		if count > 0 {
+			p := float64(count) / total
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return sum / total, entropy
+}
+
+func ratio(value, maximum float64) float64 {
+	if maximum == 0 {
+		return 0
+	}
+	return value / maximum
+}
+
+func clamp(value, minimum, maximum int) int {
+	return max(minimum, min(value, maximum))
+}
+
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
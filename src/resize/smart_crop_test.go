@@ -0,0 +1,45 @@
+package resize
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestSmartCropOnDetails(t *testing.T) {
+	// Uniform landscape image with a checkerboard on the right
+	img := image.NewGray(image.Rect(0, 0, 300, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 300; x++ {
+			value := uint8(128)
+			if x >= 220 && (x/10+y/10)%2 == 0 {
+				value = 255
+			} else if x >= 220 {
+				value = 0
+			}
+			img.SetGray(x, y, color.Gray{Y: value})
+		}
+	}
+	if x, y := saliencyPosition(img, 100, 100); x < 180 || y != 0 {
+		t.Error("window must be on detailed area", x, y)
+	}
+	if x, y := saliencyPosition(image.NewGray(image.Rect(0, 0, 300, 100)), 100, 100); x != 100 || y != 0 {
+		t.Error("window of uniform image must be centered", x, y)
+	}
+	if result, w, h := smartCropImage(img, 50, 50, nil); w != 50 || h != 50 || result.Bounds().Dx() != 50 || result.Bounds().Dy() != 50 {
+		t.Error("image must be cropped to square", w, h)
+	}
+}
+
+func TestSmartCropOnFaces(t *testing.T) {
+	if w, h := cropWindowSize(300, 600, 250, 250); w != 300 || h != 300 {
+		t.Error("window must be the biggest square", w, h)
+	}
+	faces := []FaceBox{{X: 0.4, Y: 0.1, Width: 0.2, Height: 0.1}, {X: 0.1, Y: 0.2, Width: 0.2, Height: 0.1}}
+	if x, y := focusPosition(300, 600, 300, 300, faces); x != 0 || y != 0 {
+		t.Error("window must contain faces at top", x, y)
+	}
+	if x, y := focusPosition(300, 600, 300, 300, []FaceBox{{X: 0.4, Y: 0.6, Width: 0.2, Height: 0.1}}); x != 0 || y != 240 {
+		t.Error("window must be centered on face", x, y)
+	}
+}
@@ -124,14 +124,15 @@ type SecurityAccess struct {
 	ShareFolders *ShareFolders
 }
 
-func NewSecurityAccess(conf config.SecurityConfig, maskForAdmin string, hs256SecretKey []byte) *SecurityAccess {
+// NewSecurityAccess create security, shares are saved in state folder
+func NewSecurityAccess(conf config.SecurityConfig, maskForAdmin string, hs256SecretKey []byte, stateFolder string) *SecurityAccess {
 	sa := SecurityAccess{maskForAdmin: maskForAdmin, userAccessEnable: false}
 	if jwtManager, err := NewJWTManager(conf); err == nil {
 		sa.jwtManager = jwtManager
 	} else {
 		logger.GetLogger2().Info("Use simple security mode")
 	}
-	sa.ShareFolders = NewShareFolders(&sa)
+	sa.ShareFolders = NewShareFolders(&sa, stateFolder)
 	return &sa
 }
 
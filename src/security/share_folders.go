@@ -4,8 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/jotitan/photos_server/logger"
+	"github.com/jotitan/photos_server/persistence"
 	"io/ioutil"
-	"os"
 	"path/filepath"
 	"strings"
 )
@@ -34,19 +34,29 @@ type ShareFolders struct {
 	pathsByUser map[string]*ShareUser
 	usersByPath map[string]map[string]struct{}
 	security * SecurityAccess
+	// Folder of shares.json
+	folder string
 }
 
-func NewShareFolders(security * SecurityAccess)*ShareFolders{
-	shares := ShareFolders{
+func NewShareFolders(security * SecurityAccess, folder string)*ShareFolders{
+	shares := &ShareFolders{
 		pathsByUser:make(map[string]*ShareUser),
 		usersByPath:make(map[string]map[string]struct{}),
-		security:security}
+		security:security,
+		folder:folder}
 	if err := shares.load(); err != nil {
 		logger.GetLogger2().Error("Impossible to load shares",err.Error())
 		return nil
 	}
 	logger.GetLogger2().Info("Load shares with",len(shares.pathsByUser),"user(s)")
-	return &shares
+	persistence.Register("shares",shares.getFilename(),shares.reload)
+	return shares
+}
+
+// reload read again shares from file, after a rollback
+func (shares * ShareFolders)reload()error{
+	shares.pathsByUser = make(map[string]*ShareUser)
+	return shares.load()
 }
 
 func (shares ShareFolders)checkUser(email string)bool{
@@ -89,8 +99,7 @@ func ( shares * ShareFolders)Remove(user,path string,checkPathExist func(path st
 }
 
 func (shares ShareFolders)getFilename()string{
-	wd,_ := os.Getwd()
-	return filepath.Join(wd,"shares.json")
+	return filepath.Join(shares.folder,"shares.json")
 }
 
 func (shares * ShareFolders)load()error {
@@ -120,14 +129,8 @@ func (shares * ShareFolders)buildUsersByPath(){
 
 // Save shares in file
 func ( shares * ShareFolders)save()error{
-	if f, err := os.OpenFile(shares.getFilename(),os.O_CREATE|os.O_RDWR|os.O_TRUNC,os.ModePerm);err == nil {
-		defer f.Close()
-		if data,err := json.Marshal(shares.pathsByUser) ; err == nil {
-			f.Write(data)
-		return nil
-		}else{
-			return err
-		}
+	if data,err := json.Marshal(shares.pathsByUser) ; err == nil {
+		return persistence.WriteFile(shares.getFilename(),data)
 	}else{
 		return err
 	}
@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jotitan/photos_server/config"
+	"github.com/jotitan/photos_server/logger"
+)
+
+/* Accounting of disk usage of each storage area (sources, cache, garbage, videos and hls segments), by top level folder.
+Usage is computed periodically. Each accepted upload reserves its size until its files are measured by a computation.
+An upload exceeding quota of an area (size and reservations) is refused, a warning is logged when usage of an area crosses threshold */
+
+// Kinds of storage area
+const (
+	KindSource  = "source"
+	KindCache   = "cache"
+	KindGarbage = "garbage"
+	KindVideos  = "videos"
+	KindHLS     = "hls"
+)
+
+const (
+	defaultRefresh = 60
+	defaultWarning = 90
+	mo             = int64(1 << 20)
+)
+
+// Area is the usage of a folder
+type Area struct {
+	Kind   string
+	Name   string
+	Folder string
+	Size   int64
+	Files  int
+	// Maximum size in bytes, 0 is unlimited
+	Quota int64
+	// Size by top level folder, files at root are in "."
+	Folders map[string]int64
+	// Size reserved by uploads and not measured yet
+	Reserved int64
+	// True when usage is over warning threshold
+	Warning bool
+}
+
+// used return measured and reserved size
+func (a Area) used() int64 {
+	return a.Size + a.Reserved
+}
+
+// Key identify an area : kind or kind:name for sources
+func (a Area) Key() string {
+	return areaKey(a.Kind, a.Name)
+}
+
+func areaKey(kind, name string) string {
+	if kind == KindSource {
+		return kind + ":" + name
+	}
+	return kind
+}
+
+type Usage struct {
+	Date  time.Time
+	Areas []Area
+}
+
+type StorageManager struct {
+	// Percent of quota from which a warning is logged
+	warning int
+	areas   map[string]*Area
+	// Reservations of uploads, removed when released or measured
+	reservations map[*Reservation]struct{}
+	date         time.Time
+	locker       sync.Mutex
+	// Only one computation at a time
+	computeLocker sync.Mutex
+}
+
+// NewStorageManager create areas of configured folders and compute their usage periodically
+func NewStorageManager(conf config.Config) *StorageManager {
+	sm := newStorageManager(conf)
+	refresh := conf.Storage.Refresh
+	if refresh <= 0 {
+		refresh = defaultRefresh
+	}
+	go func() {
+		for {
+			sm.Compute()
+			time.Sleep(time.Duration(refresh) * time.Minute)
+		}
+	}()
+	return sm
+}
+
+func newStorageManager(conf config.Config) *StorageManager {
+	sm := &StorageManager{warning: conf.Storage.Warning, areas: make(map[string]*Area), reservations: make(map[*Reservation]struct{})}
+	if sm.warning <= 0 || sm.warning > 100 {
+		sm.warning = defaultWarning
+	}
+	quotas := conf.Storage.Quotas
+	for _, source := range conf.Sources {
+		sm.addArea(KindSource, source.Name, source.Folder, quotas.Sources[source.Name])
+	}
+	sm.addArea(KindCache, "", conf.CacheFolder, quotas.Cache)
+	sm.addArea(KindGarbage, "", conf.Garbage, quotas.Garbage)
+	sm.addArea(KindVideos, "", conf.VideoConfig.OriginalUploadedFolder, quotas.Videos)
+	sm.addArea(KindHLS, "", conf.VideoConfig.HLSUploadedFolder, quotas.HLS)
+	return sm
+}
+
+func (sm *StorageManager) addArea(kind, name, folder string, quota int) {
+	if folder == "" {
+		return
+	}
+	area := &Area{Kind: kind, Name: name, Folder: folder, Quota: int64(quota) * mo, Folders: make(map[string]int64)}
+	sm.areas[area.Key()] = area
+}
+
+// Compute walk all areas to get their usage
+func (sm *StorageManager) Compute() Usage {
+	sm.computeLocker.Lock()
+	defer sm.computeLocker.Unlock()
+	begin := time.Now()
+	type measure struct {
+		size    int64
+		files   int
+		folders map[string]int64
+	}
+	areas := sm.list()
+	measures := make([]measure, len(areas))
+	for i, area := range areas {
+		measures[i].size, measures[i].files, measures[i].folders = computeFolder(area.Folder)
+	}
+	sm.locker.Lock()
+	// Files of reservations written before computation are now in measured size
+	for reservation := range sm.reservations {
+		if !reservation.written.IsZero() && reservation.written.Before(begin) {
+			sm.release(reservation)
+		}
+	}
+	for i, area := range areas {
+		area.Size, area.Files, area.Folders = measures[i].size, measures[i].files, measures[i].folders
+		sm.checkWarning(area)
+	}
+	sm.date = time.Now()
+	sm.locker.Unlock()
+	logger.GetLogger2().Info("Storage usage computed in", time.Since(begin))
+	return sm.Usage()
+}
+
+func (sm *StorageManager) list() []*Area {
+	sm.locker.Lock()
+	defer sm.locker.Unlock()
+	areas := make([]*Area, 0, len(sm.areas))
+	for _, area := range sm.areas {
+		areas = append(areas, area)
+	}
+	return areas
+}
+
+// computeFolder return size and number of files of folder and size of each top level folder
+func computeFolder(folder string) (int64, int, map[string]int64) {
+	size, files, folders := int64(0), 0, make(map[string]int64)
+	filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		top := "."
+		if relative, err := filepath.Rel(folder, path); err == nil {
+			if parts := strings.SplitN(filepath.ToSlash(relative), "/", 2); len(parts) == 2 {
+				top = parts[0]
+			}
+		}
+		size += info.Size()
+		files++
+		folders[top] += info.Size()
+		return nil
+	})
+	return size, files, folders
+}
+
+// checkWarning log when usage of area crosses warning threshold, lock must be held
+func (sm *StorageManager) checkWarning(area *Area) {
+	warning := area.Quota > 0 && area.used()*100 >= area.Quota*int64(sm.warning)
+	if warning && !area.Warning {
+		logger.GetLogger2().Error(fmt.Sprintf("Storage %s uses %d%% of its quota (%d / %d Mo)", area.Key(), area.used()*100/area.Quota, area.used()/mo, area.Quota/mo))
+	}
+	area.Warning = warning
+}
+
+// Usage return last computed usage of all areas
+func (sm *StorageManager) Usage() Usage {
+	sm.locker.Lock()
+	defer sm.locker.Unlock()
+	usage := Usage{Date: sm.date, Areas: make([]Area, 0, len(sm.areas))}
+	for _, area := range sm.areas {
+		copied := *area
+		copied.Folders = make(map[string]int64, len(area.Folders))
+		for name, size := range area.Folders {
+			copied.Folders[name] = size
+		}
+		usage.Areas = append(usage.Areas, copied)
+	}
+	sort.Slice(usage.Areas, func(i, j int) bool { return usage.Areas[i].Key() < usage.Areas[j].Key() })
+	return usage
+}
+
+// Reservation is the size reserved by an upload in some areas.
+// It must be released if upload fails, otherwise marked as written to be dropped once its files are measured
+type Reservation struct {
+	manager *StorageManager
+	size    int64
+	keys    []string
+	// Date of end of writing, zero while files are written
+	written time.Time
+}
+
+// Reserve check that size can be written in each area and reserve it, an error is returned if a quota is exceeded.
+// A nil manager accept everything (and return a nil reservation)
+func (sm *StorageManager) Reserve(size int64, keys ...string) (*Reservation, error) {
+	if sm == nil {
+		return nil, nil
+	}
+	sm.locker.Lock()
+	defer sm.locker.Unlock()
+	for _, key := range keys {
+		if area, exist := sm.areas[key]; exist && area.Quota > 0 && area.used()+size > area.Quota {
+			return nil, fmt.Errorf("quota of %s exceeded (%d / %d Mo used)", key, area.used()/mo, area.Quota/mo)
+		}
+	}
+	reservation := &Reservation{manager: sm, size: size, keys: keys}
+	sm.reservations[reservation] = struct{}{}
+	for _, key := range keys {
+		if area, exist := sm.areas[key]; exist {
+			area.Reserved += size
+			sm.checkWarning(area)
+		}
+	}
+	return reservation, nil
+}
+
+// release remove reservation from its areas, lock must be held
+func (sm *StorageManager) release(reservation *Reservation) {
+	if _, exist := sm.reservations[reservation]; !exist {
+		return
+	}
+	delete(sm.reservations, reservation)
+	for _, key := range reservation.keys {
+		if area, exist := sm.areas[key]; exist {
+			area.Reserved -= reservation.size
+			sm.checkWarning(area)
+		}
+	}
+}
+
+// Release give back reserved size, when upload failed
+func (r *Reservation) Release() {
+	if r == nil {
+		return
+	}
+	r.manager.locker.Lock()
+	defer r.manager.locker.Unlock()
+	r.manager.release(r)
+}
+
+// Written keep reservation until next computation, which measures the written files
+func (r *Reservation) Written() {
+	if r == nil {
+		return
+	}
+	r.manager.locker.Lock()
+	defer r.manager.locker.Unlock()
+	r.written = time.Now()
+}
+
+// SourceKey return key of area of a source
+func SourceKey(name string) string {
+	return areaKey(KindSource, name)
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jotitan/photos_server/config"
+)
+
+func writeFile(t *testing.T, path string, size int) {
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err := os.WriteFile(path, make([]byte, size), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageUsage(t *testing.T) {
+	source, cache := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(source, "2023", "a.jpg"), 300*1024)
+	writeFile(t, filepath.Join(source, "2023", "holidays", "b.jpg"), 300*1024)
+	writeFile(t, filepath.Join(source, "2024", "c.jpg"), 200*1024)
+	writeFile(t, filepath.Join(source, "d.jpg"), 100*1024)
+	writeFile(t, filepath.Join(cache, "photos", "2023", "a-250.jpg"), 1024)
+	conf := config.Config{CacheFolder: cache, Sources: []config.Source{{Name: "photos", Folder: source}},
+		Storage: config.StorageConfig{Warning: 80, Quotas: config.StorageQuotas{Sources: map[string]int{"photos": 1}}}}
+	sm := newStorageManager(conf)
+	usage := sm.Compute()
+	if len(usage.Areas) != 2 || usage.Areas[0].Key() != KindCache || usage.Areas[1].Key() != SourceKey("photos") {
+		t.Fatal("only configured areas must be computed", usage.Areas)
+	}
+	photos := usage.Areas[1]
+	if photos.Size != 900*1024 || photos.Files != 4 || photos.Folders["2023"] != 600*1024 || photos.Folders["2024"] != 200*1024 || photos.Folders["."] != 100*1024 {
+		t.Error("bad usage of source", photos.Size, photos.Files, photos.Folders)
+	}
+	if !photos.Warning || usage.Areas[0].Warning {
+		t.Error("only source over 80% of its quota must be in warning")
+	}
+
+	if _, err := sm.Reserve(200*1024, SourceKey("photos"), KindCache); err == nil {
+		t.Error("upload over quota must be refused")
+	}
+	reservation, err := sm.Reserve(124*1024, SourceKey("photos"), KindCache)
+	if err != nil {
+		t.Fatal("upload under quota must be accepted", err)
+	}
+	if usage := sm.Usage(); usage.Areas[1].Reserved != 124*1024 || usage.Areas[0].Reserved != 124*1024 || usage.Areas[1].Size != 900*1024 {
+		t.Error("accepted upload must be reserved", usage.Areas)
+	}
+	if _, err := sm.Reserve(1, SourceKey("photos")); err == nil {
+		t.Error("quota is reached")
+	}
+	// Reservation of a running upload is kept by computation
+	if usage := sm.Compute(); usage.Areas[1].Reserved != 124*1024 || usage.Areas[1].Size != 900*1024 {
+		t.Error("computation must keep reservation of running upload", usage.Areas)
+	}
+	reservation.Release()
+	reservation.Release()
+	if usage := sm.Usage(); usage.Areas[1].Reserved != 0 || usage.Areas[0].Reserved != 0 {
+		t.Error("failed upload must release its reservation once", usage.Areas)
+	}
+	// Written files are measured by next computation, reservation is dropped
+	reservation, _ = sm.Reserve(100*1024, SourceKey("photos"))
+	writeFile(t, filepath.Join(source, "2024", "e.jpg"), 100*1024)
+	reservation.Written()
+	if usage := sm.Compute(); usage.Areas[1].Reserved != 0 || usage.Areas[1].Size != 1000*1024 {
+		t.Error("written upload must be measured once", usage.Areas)
+	}
+	var none *StorageManager
+	if reservation, err := none.Reserve(1 << 40); err != nil {
+		t.Error("without manager, uploads are accepted")
+	} else {
+		reservation.Release()
+	}
+}
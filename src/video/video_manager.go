@@ -19,7 +19,9 @@ import (
 	"github.com/jotitan/photos_server/common"
 	"github.com/jotitan/photos_server/config"
 	"github.com/jotitan/photos_server/logger"
+	"github.com/jotitan/photos_server/persistence"
 	"github.com/jotitan/photos_server/progress"
+	"github.com/jotitan/photos_server/storage"
 )
 
 type VideoFiles map[string]*VideoNode
@@ -83,11 +85,16 @@ type VideoNodeDto struct {
 	CoverPath  string
 	DeletePath string
 	Metadata   Metadata
+	Path       string
+	// Favorite and rating of connected user
+	Favorite bool `json:",omitempty"`
+	Rating   int  `json:",omitempty"`
 }
 
 func NewVideoNodeDto(node VideoNode) VideoNodeDto {
 	return VideoNodeDto{
 		Metadata:   node.Metadata,
+		Path:       node.RelativePath,
 		CoverPath:  "/cover/" + node.RelativePath,
 		DeletePath: "/video?path=" + node.RelativePath,
 		VideosPath: fmt.Sprintf("/video_stream/%s/stream/", node.HLSFolder)}
@@ -190,24 +197,30 @@ type VideoManager struct {
 	VideosByDate    map[time.Time][]common.INode
 	hlsManager      HLSManager
 	index           *VideoMetadataIndex
+	// Refuse uploads when quota is exceeded, nil if not defined
+	storage *storage.StorageManager
+	// Folder of save-videos.json
+	stateFolder string
 }
 
 func NewVideoManager(conf config.Config) *VideoManager {
 	if conf.VideoConfig.ExifTool == "" {
 		return nil
 	}
-	return &VideoManager{
+	vm := &VideoManager{
 		exiftool:             conf.VideoConfig.ExifTool,
 		hlsUploadFolder:      conf.VideoConfig.HLSUploadedFolder,
 		originalUploadFolder: conf.VideoConfig.OriginalUploadedFolder,
 		Folders:              make(map[string]*VideoNode),
 		VideosByDate:         make(map[time.Time][]common.INode),
-		hlsManager:           GetHLSManager(conf)}
+		hlsManager:           GetHLSManager(conf),
+		stateFolder:          conf.Persistence.GetFolder()}
+	persistence.Register("videos", vm.getSavePath(), vm.Load)
+	return vm
 }
 
-func getSaveVideoPath() string {
-	wd, _ := os.Getwd()
-	return filepath.Join(wd, "save-videos.json")
+func (vm *VideoManager) getSavePath() string {
+	return filepath.Join(vm.stateFolder, "save-videos.json")
 }
 
 type sortFolders []*VideoNode
@@ -227,7 +240,7 @@ func (vm VideoManager) GetSortedFolders() []*VideoNode {
 }
 
 func (vm *VideoManager) Load() error {
-	path := getSaveVideoPath()
+	path := vm.getSavePath()
 	vm.Folders = make(map[string]*VideoNode)
 	defer func() {
 		vm.index = NewVideoMetadataIndex(vm.Folders)
@@ -305,13 +318,10 @@ func (vm VideoManager) Search(query string) []*VideoNode {
 }
 
 func (vm *VideoManager) Save() error {
-	path := getSaveVideoPath()
+	path := vm.getSavePath()
 	if data, err := json.Marshal(vm.Folders); err == nil {
-		if f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm); err == nil {
-			defer f.Close()
-			if _, err := f.Write(data); err != nil {
-				return err
-			}
+		if err := persistence.WriteFile(path, data); err != nil {
+			return err
 		}
 	} else {
 		return err
@@ -381,9 +391,40 @@ func (vm *VideoManager) GetCover(path string) (*os.File, error) {
 	}
 }
 
+// SetStorage define storage manager checking quotas of uploads
+func (vm *VideoManager) SetStorage(manager *storage.StorageManager) {
+	if vm != nil {
+		vm.storage = manager
+	}
+}
+
+// fileSize return size of an uploaded file, 0 if nil
+func fileSize(file multipart.File) int64 {
+	if file == nil {
+		return 0
+	}
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0
+	}
+	file.Seek(0, io.SeekStart)
+	return size
+}
+
 func (vm *VideoManager) UploadVideoGlobal(folder string, video multipart.File, videoName string, cover multipart.File, coverName string, progressManager *progress.UploadProgressManager) (*progress.UploadProgress, error) {
+	// HLS segments have roughly the size of original video
+	reservation, err := vm.storage.Reserve(fileSize(video)+fileSize(cover), storage.KindVideos, storage.KindHLS)
+	if err != nil {
+		return nil, err
+	}
 	progresser := progressManager.AddUploader(1)
-	go vm.UploadVideo(folder, video, videoName, cover, coverName, progresser)
+	go func() {
+		if vm.UploadVideo(folder, video, videoName, cover, coverName, progresser) {
+			reservation.Written()
+		} else {
+			reservation.Release()
+		}
+	}()
 	return progresser, nil
 }
 